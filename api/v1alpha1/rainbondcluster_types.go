@@ -18,6 +18,9 @@ package v1alpha1
 
 import (
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
@@ -57,8 +60,18 @@ const (
 	RainbondClusterConditionTypeContainerNetwork  = "ContainerNetwork"
 	RainbondClusterConditionTypeRunning           = "Running"
 	RainbondClusterConditionTypeMemory            = "Memory"
+	RainbondClusterConditionTypeEtcd              = "Etcd"
+	// RainbondClusterConditionTypeDegraded means some prechecks fail after the rainbond cluster is running.
+	RainbondClusterConditionTypeDegraded = "Degraded"
 )
 
+// DefaultPrecheckInterval is the default interval to re-evaluate the prechecks.
+const DefaultPrecheckInterval = 5 * time.Minute
+
+// DefaultProbePrecheckInterval is the default interval to re-evaluate the prechecks which create probe workloads,
+// such as storage and container network.
+const DefaultProbePrecheckInterval = 24 * time.Hour
+
 // RainbondClusterCondition contains condition information for rainbondcluster.
 type RainbondClusterCondition struct {
 	// Type of rainbondclsuter condition.
@@ -85,6 +98,147 @@ type ImageHub struct {
 	Namespace string `json:"namespace,omitempty"`
 	Username  string `json:"username,omitempty"`
 	Password  string `json:"password,omitempty"`
+	// Users are the additional users of the bundled rbd-hub, besides Username who has full access.
+	// +optional
+	Users []ImageHubUser `json:"users,omitempty"`
+	// TokenAuth authorizes the users of the bundled rbd-hub with the access of each user, through the
+	// token server rbd-hub-auth. Otherwise every user can pull and push all the repositories.
+	// +optional
+	TokenAuth bool `json:"tokenAuth,omitempty"`
+	// ImagePullUser is the user in Users whose credential is distributed in the image pull secret
+	// rbd-hub-credentials of the components. Defaults to Username.
+	// +optional
+	ImagePullUser string `json:"imagePullUser,omitempty"`
+}
+
+// ImageHubUser defines a user of the bundled rbd-hub.
+type ImageHubUser struct {
+	// Name of the user.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+	// SecretName is the secret holding the password of the user in password.
+	// Defaults to rbd-hub-user-<name>, which is generated if it does not exist.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+	// Access of the user, only for TokenAuth. Defaults to pull and push all the repositories.
+	// +optional
+	Access []ImageHubAccess `json:"access,omitempty"`
+}
+
+// PasswordSecret returns the secret holding the password of the user.
+func (in *ImageHubUser) PasswordSecret() string {
+	if in.SecretName != "" {
+		return in.SecretName
+	}
+	return "rbd-hub-user-" + in.Name
+}
+
+// ImageHubAccess defines the actions allowed to a user on the repositories of a namespace.
+type ImageHubAccess struct {
+	// Namespace of the repositories, such as team1 for team1/app. * matches all the repositories.
+	Namespace string `json:"namespace"`
+	// Actions allowed on the repositories.
+	// +kubebuilder:validation:MinItems=1
+	Actions []ImageHubAction `json:"actions"`
+}
+
+// ImageHubAction is an action on the repositories of rbd-hub.
+// +kubebuilder:validation:Enum=pull;push
+type ImageHubAction string
+
+const (
+	// ImageHubActionPull allows to pull the images.
+	ImageHubActionPull ImageHubAction = "pull"
+	// ImageHubActionPush allows to push the images.
+	ImageHubActionPush ImageHubAction = "push"
+)
+
+// HubStorageType is the storage driver of rbd-hub.
+type HubStorageType string
+
+const (
+	// HubStorageFilesystem keeps the images in the pvc rbd-hub, which is the default.
+	HubStorageFilesystem HubStorageType = "filesystem"
+	// HubStorageS3 keeps the images in a s3 compatible object storage.
+	HubStorageS3 HubStorageType = "s3"
+)
+
+// HubStorage defines where rbd-hub keeps the images.
+type HubStorage struct {
+	// Type of the storage, filesystem or s3. Defaults to filesystem, rbd-hub can not run more than
+	// one replica with it.
+	// +kubebuilder:validation:Enum=filesystem;s3
+	// +optional
+	Type HubStorageType `json:"type,omitempty"`
+	// S3 is the object storage for the type s3. The bucket rbd-hub of the bundled minio is used if it is not specified.
+	// +optional
+	S3 *HubS3Storage `json:"s3,omitempty"`
+}
+
+// HubS3Storage defines a s3 compatible object storage.
+type HubS3Storage struct {
+	// Endpoint of the object storage, such as http://minio.example.com:9000. Leave it empty for AWS S3.
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region of the bucket. Defaults to us-east-1.
+	// +optional
+	Region string `json:"region,omitempty"`
+	// Bucket where the images are kept, which must exist.
+	Bucket string `json:"bucket"`
+	// RootDirectory is the prefix of the images in the bucket.
+	// +optional
+	RootDirectory string `json:"rootDirectory,omitempty"`
+	// SecretName is the secret holding the access key and the secret key in accessKey and secretKey.
+	SecretName string `json:"secretName"`
+}
+
+// HubMirror defines the pull-through caches of the upstream registries, which are served through goodrain.me.
+// The registry proxies only one upstream and does not accept pushes, so each upstream is cached by a separate
+// instance named rbd-hub-mirror-<name> alongside rbd-hub.
+type HubMirror struct {
+	// Upstreams are the registries to cache. Defaults to Docker Hub and the Rainbond image repository.
+	// +optional
+	Upstreams []HubMirrorUpstream `json:"upstreams,omitempty"`
+	// ConfigureNodes configures containerd on every node to pull the images of the upstreams through goodrain.me,
+	// and docker to pull the images of Docker Hub through its mirror. containerd 1.x reads the registry hosts from
+	// /etc/containerd/certs.d only if config_path of the cri registry is set to it, which is reported in the logs
+	// of rbd-hub-mirror-config otherwise.
+	// +optional
+	ConfigureNodes bool `json:"configureNodes,omitempty"`
+}
+
+// HubMirrorUpstream defines an upstream registry cached by rbd-hub.
+type HubMirrorUpstream struct {
+	// Name of the mirror, the images are served at goodrain.me/mirrors/<name>.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+	// URL of the upstream registry, such as https://registry-1.docker.io.
+	URL string `json:"url"`
+	// Host is the registry mirrored on the nodes, such as docker.io. Defaults to the host of the url.
+	// +optional
+	Host string `json:"host,omitempty"`
+	// SecretName is the secret holding the username and the password of the upstream in username and password.
+	// The mirror of the upstream requires the credentials of rbd-hub, and is not configured on the nodes.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// HubGarbageCollection defines the scheduled garbage collection of rbd-hub. rbd-hub is read-only
+// while the expired images are deleted and the unreferenced blobs are removed.
+type HubGarbageCollection struct {
+	// Schedule of the garbage collection in cron format. Defaults to "0 3 * * 0".
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+	// KeepTags is the number of the latest pushed tags kept in each repository. Defaults to 10.
+	// The tags are only deleted with the filesystem storage.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	KeepTags int32 `json:"keepTags,omitempty"`
+	// UntaggedRetentionDays is the days to keep the untagged manifests. Defaults to 7.
+	// The manifests are only deleted with the filesystem storage.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	UntaggedRetentionDays int32 `json:"untaggedRetentionDays,omitempty"`
 }
 
 // Database defines the connection information of database.
@@ -94,16 +248,94 @@ type Database struct {
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
 	Name     string `json:"name,omitempty"`
+	// TLS is how to secure the connections, TLS is not used if it is nil.
+	// +optional
+	TLS *DatabaseTLS `json:"tls,omitempty"`
+	// Charset of the connections, such as utf8mb4.
+	// +optional
+	Charset string `json:"charset,omitempty"`
+	// Timezone is the location of the time values, such as UTC or Asia/Shanghai.
+	// +optional
+	Timezone string `json:"timezone,omitempty"`
+	// Params are the additional parameters of the data source name, which override the others.
+	// +optional
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// DatabaseTLSMode is the mode of the TLS connections to the database.
+type DatabaseTLSMode string
+
+const (
+	// DatabaseTLSDisabled does not use TLS.
+	DatabaseTLSDisabled DatabaseTLSMode = "disabled"
+	// DatabaseTLSPreferred uses TLS if the server supports it, the certificate of the server is not verified.
+	DatabaseTLSPreferred DatabaseTLSMode = "preferred"
+	// DatabaseTLSRequired requires TLS, the certificate of the server is not verified.
+	DatabaseTLSRequired DatabaseTLSMode = "required"
+	// DatabaseTLSVerifyCA requires TLS, and verifies the certificate of the server with the system ca certificates.
+	DatabaseTLSVerifyCA DatabaseTLSMode = "verify-ca"
+	// DatabaseTLSVerifyFull is the same as DatabaseTLSVerifyCA, and verifies the host name.
+	DatabaseTLSVerifyFull DatabaseTLSMode = "verify-full"
+)
+
+// DatabaseTLS defines the TLS connections to the database.
+type DatabaseTLS struct {
+	// +kubebuilder:validation:Enum=disabled;preferred;required;verify-ca;verify-full
+	Mode DatabaseTLSMode `json:"mode,omitempty"`
 }
 
 // EtcdConfig defines the configuration of etcd client.
 type EtcdConfig struct {
 	// Endpoints is a list of URLs.
 	Endpoints []string `json:"endpoints,omitempty"`
-	// Whether to use tls to connect to etcd
+	// Whether to use tls to connect to etcd. The secret holds the ca certificate,
+	// client certificate and key in ca-file, cert-file and key-file.
 	SecretName string `json:"secretName,omitempty"`
 }
 
+// DatabaseBackupStorage is where the backups of rbd-db are shipped to.
+type DatabaseBackupStorage string
+
+const (
+	// DatabaseBackupStoragePVC keeps the backups in the pvc rbd-db-backup.
+	DatabaseBackupStoragePVC DatabaseBackupStorage = "PVC"
+	// DatabaseBackupStorageMinIO also keeps the backups in the pvc rbd-db-backup, and uploads them
+	// to the bucket rbd-db-backup of the bundled minio.
+	DatabaseBackupStorageMinIO DatabaseBackupStorage = "MinIO"
+)
+
+// DatabaseBackup defines the scheduled backups of the bundled rbd-db.
+type DatabaseBackup struct {
+	// Schedule of the backups in cron format. Defaults to "0 2 * * *".
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+	// Storage is where the backups are shipped to, one of PVC and MinIO. Defaults to PVC.
+	// +optional
+	Storage DatabaseBackupStorage `json:"storage,omitempty"`
+	// Retention is the number of backups to keep. Defaults to 7.
+	// +optional
+	Retention int32 `json:"retention,omitempty"`
+	// BinlogArchive archives the binlogs along with the backups, for point-in-time recovery.
+	// +optional
+	BinlogArchive bool `json:"binlogArchive,omitempty"`
+}
+
+// DatabaseMigration defines the migration from the bundled rbd-db to the external databases.
+// The bundled rbd-db is read-only during the migration, and it is scaled down but retained after the migration.
+type DatabaseMigration struct {
+	// RegionDatabase is the external mysql to migrate the region database to, which must be empty.
+	// It is ignored if regionDatabase is specified.
+	// +optional
+	RegionDatabase *Database `json:"regionDatabase,omitempty"`
+	// UIDatabase is the external mysql to migrate the console database to, which must be empty.
+	// It is ignored if uiDatabase is specified.
+	// +optional
+	UIDatabase *Database `json:"uiDatabase,omitempty"`
+	// DeleteBundledDatabase confirms to delete the statefulset and the volumes of rbd-db after the migration.
+	// +optional
+	DeleteBundledDatabase bool `json:"deleteBundledDatabase,omitempty"`
+}
+
 // RainbondClusterSpec defines the desired state of RainbondCluster
 type RainbondClusterSpec struct {
 	// EnableHA is a highly available switch.
@@ -111,25 +343,50 @@ type RainbondClusterSpec struct {
 	// Repository of each Rainbond component image, eg. docker.io/rainbond.
 	// +optional
 	RainbondImageRepository string `json:"rainbondImageRepository,omitempty"`
+	// ImageRepositoryMirrors are the candidates of RainbondImageRepository, such as the mirrors in other regions.
+	// The registries are pinged periodically, and the component images are taken from the selected repository,
+	// see status.imageRepository.
+	// +optional
+	ImageRepositoryMirrors []ImageRepositoryMirror `json:"imageRepositoryMirrors,omitempty"`
 	// Suffix of component default domain name
 	SuffixHTTPHost string `json:"suffixHTTPHost"`
 	// Ingress IP addresses of rbd-gateway. If not specified,
 	// the IP of the node where the rbd-gateway is located will be used.
+	// They are required in NodePort mode and in DaemonSet mode with a node selector.
 	GatewayIngressIPs []string `json:"gatewayIngressIPs,omitempty"`
 	// Specify the nodes where the rbd-gateway will running.
 	NodesForGateway []*K8sNode `json:"nodesForGateway,omitempty"`
 	// Specify the nodes where the rbd-gateway will running.
 	NodesForChaos []*K8sNode `json:"nodesForChaos,omitempty"`
+	// APIGateway is the configuration of APISIX in rbd-gateway, which is merged into its config.yaml continuously.
+	// +optional
+	APIGateway *APIGatewayConfig `json:"apiGateway,omitempty"`
 	// InstallMode is the mode of Rainbond cluster installation.
 	InstallMode InstallMode `json:"installMode,omitempty"`
 	// User-specified private image repository, replacing goodrain.me.
 	ImageHub *ImageHub `json:"imageHub,omitempty"`
+	// HubStorage is where the bundled rbd-hub keeps the images.
+	// +optional
+	HubStorage *HubStorage `json:"hubStorage,omitempty"`
+	// HubGarbageCollection enables the scheduled garbage collection of the bundled rbd-hub.
+	// +optional
+	HubGarbageCollection *HubGarbageCollection `json:"hubGarbageCollection,omitempty"`
+	// HubMirror enables the pull-through caches of the bundled rbd-hub.
+	// +optional
+	HubMirror *HubMirror `json:"hubMirror,omitempty"`
 	// the region database information that rainbond component will be used.
 	// rainbond-operator will create one if DBInfo is empty
 	RegionDatabase *Database `json:"regionDatabase,omitempty"`
 	// the ui database information that rainbond component will be used.
 	// rainbond-operator will create one if DBInfo is empty
 	UIDatabase *Database `json:"uiDatabase,omitempty"`
+	// DatabaseBackup enables the scheduled backups of the bundled rbd-db.
+	// +optional
+	DatabaseBackup *DatabaseBackup `json:"databaseBackup,omitempty"`
+	// DatabaseMigration migrates the data of the bundled rbd-db to the external databases, then switches
+	// regionDatabase and uiDatabase to them.
+	// +optional
+	DatabaseMigration *DatabaseMigration `json:"databaseMigration,omitempty"`
 	// the etcd connection information that rainbond component will be used.
 	// rainbond-operator will create one if EtcdConfig is empty
 	EtcdConfig *EtcdConfig `json:"etcdConfig,omitempty"`
@@ -145,12 +402,141 @@ type RainbondClusterSpec struct {
 	SentinelImage string `json:"sentinelImage,omitempty"`
 
 	CacheMode string `json:"cacheMode,omitempty"`
+
+	// PrecheckInterval is the interval to re-evaluate the prechecks, such as database and kubernetes version,
+	// so that failures after installation are reflected in the conditions. Defaults to 5m.
+	// +optional
+	PrecheckInterval *metav1.Duration `json:"precheckInterval,omitempty"`
+
+	// ProbePrecheckInterval is the interval to re-evaluate the prechecks which create probe pvcs and pods,
+	// such as storage and container network. Defaults to 24h.
+	// +optional
+	ProbePrecheckInterval *metav1.Duration `json:"probePrecheckInterval,omitempty"`
+
+	// InternalDNS resolves the internal domains of Rainbond for the pods through CoreDNS,
+	// instead of the host aliases of each pod.
+	// +optional
+	InternalDNS *InternalDNS `json:"internalDNS,omitempty"`
+
+	// InstallPackageConfig is the offline package whose images are pushed into the bundled rbd-hub.
+	// The ImageRepository condition is not true until the images of all the components are present.
+	// +optional
+	InstallPackageConfig *InstallPackageConfig `json:"installPackageConfig,omitempty"`
+}
+
+// GatewayMode is how rbd-gateway is deployed and exposed.
+type GatewayMode string
+
+const (
+	// GatewayModeHostNetwork runs rbd-gateway on nodesForGateway with the host network, which is the default.
+	GatewayModeHostNetwork GatewayMode = "HostNetwork"
+	// GatewayModeDaemonSet runs rbd-gateway on every node of the node pool with the host network.
+	GatewayModeDaemonSet GatewayMode = "DaemonSet"
+	// GatewayModeLoadBalancer exposes rbd-gateway by a LoadBalancer service, without the host network.
+	// The gateway ingress ips are populated from the status of the service.
+	GatewayModeLoadBalancer GatewayMode = "LoadBalancer"
+	// GatewayModeNodePort exposes rbd-gateway by a NodePort service, without the host network,
+	// such as behind an external load balancer.
+	GatewayModeNodePort GatewayMode = "NodePort"
+)
+
+// APIGatewayConfig is the configuration of APISIX in rbd-gateway. The settings not covered here are kept
+// as they are in config.yaml.
+type APIGatewayConfig struct {
+	// Mode is how rbd-gateway is deployed and exposed. Defaults to HostNetwork.
+	// +kubebuilder:validation:Enum=HostNetwork;DaemonSet;LoadBalancer;NodePort
+	// +optional
+	Mode GatewayMode `json:"mode,omitempty"`
+	// NodeSelector selects the node pool of rbd-gateway instead of nodesForGateway, except in HostNetwork mode.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Replicas of rbd-gateway in LoadBalancer and NodePort mode, and in HostNetwork mode if it is scheduled
+	// by the affinity of rbd-gateway instead of nodesForGateway. Defaults to 2.
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// ServiceAnnotations are the annotations of the service in LoadBalancer and NodePort mode,
+	// such as the settings of the cloud load balancer.
+	// +optional
+	ServiceAnnotations map[string]string `json:"serviceAnnotations,omitempty"`
+	// ExternalTrafficPolicy of the service in LoadBalancer and NodePort mode. Local keeps the client ip.
+	// +kubebuilder:validation:Enum=Cluster;Local
+	// +optional
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicyType `json:"externalTrafficPolicy,omitempty"`
+	// HTTPPorts are the ports to listen on for http. Defaults to 80.
+	// +optional
+	HTTPPorts []int32 `json:"httpPorts,omitempty"`
+	// HTTPSPorts are the ports to listen on for https. Defaults to 443.
+	// +optional
+	HTTPSPorts []int32 `json:"httpsPorts,omitempty"`
+	// StreamTCPPorts are the ports of the tcp stream proxy. Defaults to 8443, 8889, 6060 and 7070.
+	// +optional
+	StreamTCPPorts []int32 `json:"streamTCPPorts,omitempty"`
+	// StreamUDPPorts are the ports of the udp stream proxy.
+	// +optional
+	StreamUDPPorts []int32 `json:"streamUDPPorts,omitempty"`
+	// Plugins are the enabled plugins. Defaults to the plugins bundled with rbd-gateway.
+	// +optional
+	Plugins []string `json:"plugins,omitempty"`
+	// DisabledPlugins are removed from Plugins.
+	// +optional
+	DisabledPlugins []string `json:"disabledPlugins,omitempty"`
+	// EnableIPv6 listens on ipv6 as well.
+	// +optional
+	EnableIPv6 bool `json:"enableIPv6,omitempty"`
+	// RealIPTrustedCIDRs are the addresses trusted to send the real client ip in RealIPHeader,
+	// such as the load balancers in front of rbd-gateway.
+	// +optional
+	RealIPTrustedCIDRs []string `json:"realIPTrustedCIDRs,omitempty"`
+	// RealIPHeader is the header holding the real client ip. Defaults to X-Real-IP.
+	// +optional
+	RealIPHeader string `json:"realIPHeader,omitempty"`
+	// AccessLogFormat is the nginx log format of the access log.
+	// +optional
+	AccessLogFormat string `json:"accessLogFormat,omitempty"`
+	// WorkerProcesses is the number of nginx worker processes, or auto.
+	// +optional
+	WorkerProcesses string `json:"workerProcesses,omitempty"`
+	// AdminAllowCIDRs are the addresses allowed to access the admin api of APISIX besides the loopback.
+	// The admin api only listens on the loopback unless it is set.
+	// +optional
+	AdminAllowCIDRs []string `json:"adminAllowCIDRs,omitempty"`
 }
 
-// InstallPackageConfig define install package download config
+// ImageRepositoryMirror is a candidate repository of the rainbond component images.
+type ImageRepositoryMirror struct {
+	// Repository of the images, eg. registry.cn-hangzhou.aliyuncs.com/goodrain.
+	Repository string `json:"repository"`
+	// SecretName is the secret holding the credential of the registry in username and password,
+	// which must be accepted by the registry for the repository to be selected.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// InternalDNS defines a server block in the Corefile of CoreDNS, which resolves goodrain.me, lang.goodrain.me
+// and maven.goodrain.me to the gateway ingress ips. The block is removed when InternalDNS is unset or the
+// RainbondCluster is deleted. CoreDNS must have the reload plugin enabled to pick up the changes.
+type InternalDNS struct {
+	// Namespace of the configmap of CoreDNS. Defaults to kube-system.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// ConfigMap of CoreDNS which holds the Corefile. Defaults to coredns.
+	// +optional
+	ConfigMap string `json:"configMap,omitempty"`
+}
+
+// InstallPackageConfig define install package download config.
+// The package is a tarball of an OCI image layout, whose images are named by the annotation
+// org.opencontainers.image.ref.name, such as rbd-api:v6.0.0. It is downloaded from URL, or read from Path
+// of the PersistentVolumeClaim.
 type InstallPackageConfig struct {
 	URL string `json:"url,omitempty"`
 	MD5 string `json:"md5,omitempty"`
+	// PersistentVolumeClaim in the namespace of the RainbondCluster which holds the package.
+	// +optional
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+	// Path of the package in the PersistentVolumeClaim.
+	// +optional
+	Path string `json:"path,omitempty"`
 }
 
 // StorageClass storage class
@@ -195,10 +581,36 @@ type RainbondClusterStatus struct {
 	ImagePullPassword string `json:"imagePullPassword,omitempty"`
 	// ImagePullSecret is an optional references to secret in the same namespace to use for pulling any of the images used by PodSpec.
 	ImagePullSecret *corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// ImageRepository is the selection of the image repository among RainbondImageRepository and the mirrors.
+	// +optional
+	ImageRepository *ImageRepositoryStatus `json:"imageRepository,omitempty"`
 
 	Conditions []RainbondClusterCondition `json:"conditions,omitempty"`
 }
 
+// ImageRepositoryStatus is the selection of the image repository.
+type ImageRepositoryStatus struct {
+	// Selected is the repository the component images are taken from.
+	Selected string `json:"selected,omitempty"`
+	// LastProbeTime is the last time the registries were pinged.
+	LastProbeTime metav1.Time `json:"lastProbeTime,omitempty"`
+	// Repositories are the measurements of the candidates, RainbondImageRepository comes first.
+	Repositories []ImageRepositoryProbe `json:"repositories,omitempty"`
+}
+
+// ImageRepositoryProbe is the measurement of a candidate image repository.
+type ImageRepositoryProbe struct {
+	Repository string `json:"repository"`
+	// Reachable is true if the registry v2 api responds, and accepts the credential if there is one.
+	Reachable bool `json:"reachable"`
+	// LatencyMilliseconds of the ping to the registry v2 api.
+	// +optional
+	LatencyMilliseconds int64 `json:"latencyMilliseconds,omitempty"`
+	// Message is the reason why the repository is not reachable.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 
@@ -224,9 +636,31 @@ func init() {
 	SchemeBuilder.Register(&RainbondCluster{}, &RainbondClusterList{})
 }
 
-// InnerGatewayIngressIP -
+// GatewayMode returns how rbd-gateway is deployed, HostNetwork by default.
+func (in *RainbondCluster) GatewayMode() GatewayMode {
+	if in.Spec.APIGateway == nil || in.Spec.APIGateway.Mode == "" {
+		return GatewayModeHostNetwork
+	}
+	return in.Spec.APIGateway.Mode
+}
+
+// GatewayOnNodesForGateway returns true if rbd-gateway listens on nodesForGateway with the host network.
+// Otherwise, rbd-gateway is only reached through the gateway ingress ips.
+func (in *RainbondCluster) GatewayOnNodesForGateway() bool {
+	switch in.GatewayMode() {
+	case GatewayModeHostNetwork:
+		return true
+	case GatewayModeDaemonSet:
+		return len(in.Spec.APIGateway.NodeSelector) == 0
+	default:
+		return false
+	}
+}
+
+// InnerGatewayIngressIP returns the ip to reach rbd-gateway in the cluster, such as for goodrain.me.
+// It is empty if the gateway ingress ips are required but not specified.
 func (in *RainbondCluster) InnerGatewayIngressIP() string {
-	if len(in.Spec.NodesForGateway) > 0 {
+	if in.GatewayOnNodesForGateway() && len(in.Spec.NodesForGateway) > 0 {
 		return in.Spec.NodesForGateway[0].InternalIP
 	}
 	if len(in.Spec.GatewayIngressIPs) > 0 && in.Spec.GatewayIngressIPs[0] != "" {
@@ -263,9 +697,101 @@ func (in *RainbondCluster) GatewayIngressIPs() (ips []string) {
 	return nil
 }
 
+// ImageRepositories returns RainbondImageRepository and the repositories of the mirrors.
+func (in *RainbondCluster) ImageRepositories() []string {
+	var repositories []string
+	if in.Spec.RainbondImageRepository != "" {
+		repositories = append(repositories, in.Spec.RainbondImageRepository)
+	}
+	for _, mirror := range in.Spec.ImageRepositoryMirrors {
+		repositories = append(repositories, mirror.Repository)
+	}
+	return repositories
+}
+
+// ImageRepository returns the repository of the rainbond component images, which is the selected one if there are mirrors.
+func (in *RainbondCluster) ImageRepository() string {
+	if len(in.Spec.ImageRepositoryMirrors) > 0 && in.Status.ImageRepository != nil && in.Status.ImageRepository.Selected != "" {
+		return in.Status.ImageRepository.Selected
+	}
+	return in.Spec.RainbondImageRepository
+}
+
+// ComponentImage replaces the repository of the image with the selected one, if it's from any of the candidates.
+func (in *RainbondCluster) ComponentImage(image string) string {
+	selected := in.ImageRepository()
+	var matched string
+	for _, repository := range in.ImageRepositories() {
+		if repository != "" && strings.HasPrefix(image, repository+"/") && len(repository) > len(matched) {
+			matched = repository
+		}
+	}
+	if matched == "" || selected == "" {
+		return image
+	}
+	return selected + strings.TrimPrefix(image, matched)
+}
+
+// PrecheckInterval returns the interval to re-evaluate the prechecks.
+func (in *RainbondCluster) PrecheckInterval() time.Duration {
+	if in.Spec.PrecheckInterval == nil || in.Spec.PrecheckInterval.Duration <= 0 {
+		return DefaultPrecheckInterval
+	}
+	return in.Spec.PrecheckInterval.Duration
+}
+
+// ProbePrecheckInterval returns the interval to re-evaluate the prechecks which create probe workloads.
+func (in *RainbondCluster) ProbePrecheckInterval() time.Duration {
+	if in.Spec.ProbePrecheckInterval == nil || in.Spec.ProbePrecheckInterval.Duration <= 0 {
+		return DefaultProbePrecheckInterval
+	}
+	return in.Spec.ProbePrecheckInterval.Duration
+}
+
 // RegionDataSource returns the data source for database region.
 func (in *Database) RegionDataSource() string {
-	return fmt.Sprintf("--mysql=%s:%s@tcp(%s:%d)/%s", in.Username, in.Password, in.Host, in.Port, in.Name)
+	return "--mysql=" + in.DataSourceName()
+}
+
+// DataSourceName returns the data source name of the driver.
+func (in *Database) DataSourceName() string {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", in.Username, in.Password, in.Host, in.Port, in.Name)
+	params := url.Values{}
+	if in.Charset != "" {
+		params.Set("charset", in.Charset)
+	}
+	if in.Timezone != "" {
+		params.Set("loc", in.Timezone)
+	}
+	if in.TLS != nil {
+		if tls := in.TLS.driverParam(); tls != "" {
+			params.Set("tls", tls)
+		}
+	}
+	for key, value := range in.Params {
+		params.Set(key, value)
+	}
+	if len(params) == 0 {
+		return dsn
+	}
+	// the params are sorted by key, so that the data source name is stable.
+	return dsn + "?" + params.Encode()
+}
+
+// driverParam returns the tls parameter of the mysql driver.
+func (in *DatabaseTLS) driverParam() string {
+	switch in.Mode {
+	case DatabaseTLSDisabled:
+		return "false"
+	case DatabaseTLSPreferred:
+		return "preferred"
+	case DatabaseTLSRequired:
+		return "skip-verify"
+	case DatabaseTLSVerifyCA, DatabaseTLSVerifyFull:
+		// verified by the system ca certificates.
+		return "true"
+	}
+	return ""
 }
 
 // NewRainbondClusterCondition creates a new rianbondcluster condition.
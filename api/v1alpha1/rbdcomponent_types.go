@@ -19,6 +19,7 @@ package v1alpha1
 import (
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -72,6 +73,39 @@ type RbdComponentSpec struct {
 	// If specified, the pod's scheduling constraints
 	// +optional
 	Affinity *corev1.Affinity `json:"affinity,omitempty" protobuf:"bytes,18,opt,name=affinity"`
+	// MySQLConfig tunes the bundled mysql of rbd-db, which is merged over its defaults.
+	// It is ignored by the other components.
+	// +optional
+	MySQLConfig *MySQLConfig `json:"mysqlConfig,omitempty"`
+}
+
+// MySQLConfig defines the configuration of the bundled mysql. The mysql servers are restarted one by one
+// when the configuration is changed.
+type MySQLConfig struct {
+	// InnodbBufferPoolSize is the size of the innodb buffer pool, which must be less than the memory limit.
+	// Defaults to half of the memory limit of rbd-db if it is specified.
+	// +optional
+	InnodbBufferPoolSize *resource.Quantity `json:"innodbBufferPoolSize,omitempty"`
+	// MaxConnections is the maximum number of the client connections.
+	// Defaults to one for every 16Mi of the memory limit of rbd-db, between 151 and 1000.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100000
+	// +optional
+	MaxConnections *int32 `json:"maxConnections,omitempty"`
+	// SlowQueryLog enables the slow query log if it is specified.
+	// +optional
+	SlowQueryLog *SlowQueryLog `json:"slowQueryLog,omitempty"`
+	// Options are the other options of mysqld, such as wait_timeout. The options managed by the operator,
+	// such as the replication and the data directories, can not be overridden.
+	// +optional
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// SlowQueryLog defines the slow query log of the bundled mysql.
+type SlowQueryLog struct {
+	// LongQueryTime is the threshold of the slow queries. Defaults to 10s.
+	// +optional
+	LongQueryTime *metav1.Duration `json:"longQueryTime,omitempty"`
 }
 
 // RbdComponentConditionType is a valid value for RbdComponentCondition.Type
@@ -83,6 +117,8 @@ const (
 	ClusterConfigCompeleted RbdComponentConditionType = "ClusterConfigCompeleted"
 	// RbdComponentReady means all pods related to the rbdcomponent are ready.
 	RbdComponentReady RbdComponentConditionType = "Ready"
+	// RbdComponentMigrationFailed means the job migrating the database schemas failed, the message contains its logs.
+	RbdComponentMigrationFailed RbdComponentConditionType = "MigrationFailed"
 )
 
 // RbdComponentCondition contains details for the current condition of this rbdcomponent.
@@ -119,6 +155,181 @@ type RbdComponentStatus struct {
 
 	// A list of pods
 	Pods []corev1.LocalObjectReference `json:"pods,omitempty"`
+
+	// Replication is the status of the replication, only for the components running in HA mode, such as rbd-db.
+	// +optional
+	Replication *ReplicationStatus `json:"replication,omitempty"`
+
+	// Backup is the status of the scheduled backups, only for rbd-db.
+	// +optional
+	Backup *BackupStatus `json:"backup,omitempty"`
+
+	// PasswordRotation is the progress of the password rotation of the database users of rbd-db,
+	// or the rotation of the admin key of rbd-gateway.
+	// +optional
+	PasswordRotation *PasswordRotationStatus `json:"passwordRotation,omitempty"`
+
+	// SchemaVersion is the version of the database schemas which have been migrated by the migration job,
+	// only for the components which migrate the schemas, such as rbd-api and rbd-app-ui.
+	// +optional
+	SchemaVersion string `json:"schemaVersion,omitempty"`
+
+	// DatabaseMigration is the progress of the migration to the external databases, only for rbd-db.
+	// +optional
+	DatabaseMigration *DatabaseMigrationStatus `json:"databaseMigration,omitempty"`
+
+	// GarbageCollection is the status of the scheduled garbage collection, only for rbd-hub.
+	// +optional
+	GarbageCollection *GarbageCollectionStatus `json:"garbageCollection,omitempty"`
+
+	// HostsSync is the resolution of goodrain.me on the nodes, only for rbd-hub.
+	// +optional
+	HostsSync *HostsSyncStatus `json:"hostsSync,omitempty"`
+}
+
+// HostsSyncStatus is the resolution of goodrain.me maintained in /etc/hosts of the nodes.
+type HostsSyncStatus struct {
+	// IP is the gateway ip that goodrain.me resolves to, goodrain.me is removed from /etc/hosts if it is empty.
+	// +optional
+	IP string `json:"ip,omitempty"`
+	// SyncedNodes is the number of the nodes whose /etc/hosts is up to date.
+	SyncedNodes int32 `json:"syncedNodes"`
+	// Nodes is the sync status of each node.
+	// +optional
+	Nodes []NodeHostsSyncStatus `json:"nodes,omitempty"`
+}
+
+// NodeHostsSyncStatus is the sync status of /etc/hosts on a node.
+type NodeHostsSyncStatus struct {
+	// Node is the name of the node.
+	Node string `json:"node"`
+	// Synced is true if /etc/hosts of the node is up to date.
+	Synced bool `json:"synced"`
+	// Message is why /etc/hosts of the node is not up to date.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// GarbageCollectionStatus is the status of the scheduled garbage collection.
+type GarbageCollectionStatus struct {
+	// Job is the garbage collection in progress, rbd-hub is read-only until it is finished.
+	// +optional
+	Job string `json:"job,omitempty"`
+	// LastJob is the name of the last finished garbage collection.
+	// +optional
+	LastJob string `json:"lastJob,omitempty"`
+	// LastCompletionTime is the time when the last garbage collection was finished.
+	// +optional
+	LastCompletionTime *metav1.Time `json:"lastCompletionTime,omitempty"`
+	// Message is why the last garbage collection failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// DeletedTags is the number of the tags deleted by the last garbage collection.
+	// +optional
+	DeletedTags int64 `json:"deletedTags,omitempty"`
+	// DeletedManifests is the number of the untagged manifests deleted by the last garbage collection.
+	// +optional
+	DeletedManifests int64 `json:"deletedManifests,omitempty"`
+	// DeletedBlobs is the number of the blobs removed by the last garbage collection.
+	// +optional
+	DeletedBlobs int64 `json:"deletedBlobs,omitempty"`
+	// ReclaimedBytes is the space reclaimed by the last garbage collection, only for the filesystem storage.
+	// +optional
+	ReclaimedBytes int64 `json:"reclaimedBytes,omitempty"`
+}
+
+// DatabaseMigrationPhase is the phase of a database migration.
+type DatabaseMigrationPhase string
+
+const (
+	// DatabaseMigrationMigrating means the data is being dumped, restored and verified.
+	DatabaseMigrationMigrating DatabaseMigrationPhase = "Migrating"
+	// DatabaseMigrationFailed means the migration job failed, delete the job to migrate again.
+	DatabaseMigrationFailed DatabaseMigrationPhase = "Failed"
+	// DatabaseMigrationCompleted means the components have been switched to the external databases.
+	DatabaseMigrationCompleted DatabaseMigrationPhase = "Completed"
+)
+
+// DatabaseMigrationStatus is the progress of a database migration.
+type DatabaseMigrationStatus struct {
+	// Phase of the migration.
+	Phase DatabaseMigrationPhase `json:"phase,omitempty"`
+	// Job is the name of the job which migrates the data.
+	// +optional
+	Job string `json:"job,omitempty"`
+	// Message is the result of the verification, or why the migration failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// MigratedDatabases are the databases migrated and verified by a failed job, which are verified
+	// again instead of being migrated by the next job.
+	// +optional
+	MigratedDatabases []string `json:"migratedDatabases,omitempty"`
+	// CompletionTime is the time when the components were switched to the external databases.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// PasswordRotationPhase is the phase of a password rotation.
+type PasswordRotationPhase string
+
+const (
+	// PasswordRotationRotating means the passwords are being rotated.
+	PasswordRotationRotating PasswordRotationPhase = "Rotating"
+	// PasswordRotationCompleted means the passwords of all users have been rotated.
+	PasswordRotationCompleted PasswordRotationPhase = "Completed"
+)
+
+// PasswordRotationStatus is the progress of a password rotation.
+type PasswordRotationStatus struct {
+	// Token is the value of the rotation annotation which triggered the rotation.
+	Token string `json:"token,omitempty"`
+	// Phase of the rotation.
+	Phase PasswordRotationPhase `json:"phase,omitempty"`
+	// User is the user whose password is being rotated.
+	// +optional
+	User string `json:"user,omitempty"`
+	// Message is why the rotation is not progressing.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// CompletionTime is the time when the passwords of all users have been rotated.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// BackupStatus is the status of the scheduled backups.
+type BackupStatus struct {
+	// LastSuccessfulTime is the completion time of the last successful backup.
+	// +optional
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// LastFailedJob is the name of the last backup job which failed after the last successful backup.
+	// +optional
+	LastFailedJob string `json:"lastFailedJob,omitempty"`
+}
+
+// ReplicationStatus is the status of a primary/replica topology.
+type ReplicationStatus struct {
+	// Primary is the name of the pod which is writable.
+	Primary string `json:"primary,omitempty"`
+	// LastFailoverTime is the last time a replica was promoted to be the primary.
+	// +optional
+	LastFailoverTime *metav1.Time `json:"lastFailoverTime,omitempty"`
+	// Replicas is the status of the replicas.
+	// +optional
+	Replicas []ReplicaStatus `json:"replicas,omitempty"`
+}
+
+// ReplicaStatus is the replication status of a replica.
+type ReplicaStatus struct {
+	// Name of the pod.
+	Name string `json:"name"`
+	// Running is true if the replica is replicating from the primary.
+	Running bool `json:"running"`
+	// LagSeconds is the replication lag in seconds, nil if unknown.
+	// +optional
+	LagSeconds *int64 `json:"lagSeconds,omitempty"`
+	// Message is the last replication error or why the replica is not replicating.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -25,9 +25,84 @@ package v1alpha1
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *APIGatewayConfig) DeepCopyInto(out *APIGatewayConfig) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.ServiceAnnotations != nil {
+		in, out := &in.ServiceAnnotations, &out.ServiceAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.HTTPPorts != nil {
+		in, out := &in.HTTPPorts, &out.HTTPPorts
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	if in.HTTPSPorts != nil {
+		in, out := &in.HTTPSPorts, &out.HTTPSPorts
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	if in.StreamTCPPorts != nil {
+		in, out := &in.StreamTCPPorts, &out.StreamTCPPorts
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	if in.StreamUDPPorts != nil {
+		in, out := &in.StreamUDPPorts, &out.StreamUDPPorts
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	if in.Plugins != nil {
+		in, out := &in.Plugins, &out.Plugins
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DisabledPlugins != nil {
+		in, out := &in.DisabledPlugins, &out.DisabledPlugins
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RealIPTrustedCIDRs != nil {
+		in, out := &in.RealIPTrustedCIDRs, &out.RealIPTrustedCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AdminAllowCIDRs != nil {
+		in, out := &in.AdminAllowCIDRs, &out.AdminAllowCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new APIGatewayConfig.
+func (in *APIGatewayConfig) DeepCopy() *APIGatewayConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(APIGatewayConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AvailableNodes) DeepCopyInto(out *AvailableNodes) {
 	*out = *in
@@ -85,9 +160,40 @@ func (in *CSIPluginSource) DeepCopy() *CSIPluginSource {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupStatus) DeepCopyInto(out *BackupStatus) {
+	*out = *in
+	if in.LastSuccessfulTime != nil {
+		in, out := &in.LastSuccessfulTime, &out.LastSuccessfulTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupStatus.
+func (in *BackupStatus) DeepCopy() *BackupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Database) DeepCopyInto(out *Database) {
 	*out = *in
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(DatabaseTLS)
+		**out = **in
+	}
+	if in.Params != nil {
+		in, out := &in.Params, &out.Params
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Database.
@@ -100,6 +206,85 @@ func (in *Database) DeepCopy() *Database {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseBackup) DeepCopyInto(out *DatabaseBackup) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseBackup.
+func (in *DatabaseBackup) DeepCopy() *DatabaseBackup {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseBackup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseMigration) DeepCopyInto(out *DatabaseMigration) {
+	*out = *in
+	if in.RegionDatabase != nil {
+		in, out := &in.RegionDatabase, &out.RegionDatabase
+		*out = new(Database)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.UIDatabase != nil {
+		in, out := &in.UIDatabase, &out.UIDatabase
+		*out = new(Database)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseMigration.
+func (in *DatabaseMigration) DeepCopy() *DatabaseMigration {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseMigration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseMigrationStatus) DeepCopyInto(out *DatabaseMigrationStatus) {
+	*out = *in
+	if in.MigratedDatabases != nil {
+		in, out := &in.MigratedDatabases, &out.MigratedDatabases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseMigrationStatus.
+func (in *DatabaseMigrationStatus) DeepCopy() *DatabaseMigrationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseMigrationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseTLS) DeepCopyInto(out *DatabaseTLS) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseTLS.
+func (in *DatabaseTLS) DeepCopy() *DatabaseTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *EtcdConfig) DeepCopyInto(out *EtcdConfig) {
 	*out = *in
@@ -120,9 +305,140 @@ func (in *EtcdConfig) DeepCopy() *EtcdConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GarbageCollectionStatus) DeepCopyInto(out *GarbageCollectionStatus) {
+	*out = *in
+	if in.LastCompletionTime != nil {
+		in, out := &in.LastCompletionTime, &out.LastCompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GarbageCollectionStatus.
+func (in *GarbageCollectionStatus) DeepCopy() *GarbageCollectionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(GarbageCollectionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HostsSyncStatus) DeepCopyInto(out *HostsSyncStatus) {
+	*out = *in
+	if in.Nodes != nil {
+		in, out := &in.Nodes, &out.Nodes
+		*out = make([]NodeHostsSyncStatus, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HostsSyncStatus.
+func (in *HostsSyncStatus) DeepCopy() *HostsSyncStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(HostsSyncStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HubGarbageCollection) DeepCopyInto(out *HubGarbageCollection) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HubGarbageCollection.
+func (in *HubGarbageCollection) DeepCopy() *HubGarbageCollection {
+	if in == nil {
+		return nil
+	}
+	out := new(HubGarbageCollection)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HubMirror) DeepCopyInto(out *HubMirror) {
+	*out = *in
+	if in.Upstreams != nil {
+		in, out := &in.Upstreams, &out.Upstreams
+		*out = make([]HubMirrorUpstream, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HubMirror.
+func (in *HubMirror) DeepCopy() *HubMirror {
+	if in == nil {
+		return nil
+	}
+	out := new(HubMirror)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HubMirrorUpstream) DeepCopyInto(out *HubMirrorUpstream) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HubMirrorUpstream.
+func (in *HubMirrorUpstream) DeepCopy() *HubMirrorUpstream {
+	if in == nil {
+		return nil
+	}
+	out := new(HubMirrorUpstream)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HubS3Storage) DeepCopyInto(out *HubS3Storage) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HubS3Storage.
+func (in *HubS3Storage) DeepCopy() *HubS3Storage {
+	if in == nil {
+		return nil
+	}
+	out := new(HubS3Storage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HubStorage) DeepCopyInto(out *HubStorage) {
+	*out = *in
+	if in.S3 != nil {
+		in, out := &in.S3, &out.S3
+		*out = new(HubS3Storage)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HubStorage.
+func (in *HubStorage) DeepCopy() *HubStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(HubStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ImageHub) DeepCopyInto(out *ImageHub) {
 	*out = *in
+	if in.Users != nil {
+		in, out := &in.Users, &out.Users
+		*out = make([]ImageHubUser, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageHub.
@@ -135,6 +451,99 @@ func (in *ImageHub) DeepCopy() *ImageHub {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageHubAccess) DeepCopyInto(out *ImageHubAccess) {
+	*out = *in
+	if in.Actions != nil {
+		in, out := &in.Actions, &out.Actions
+		*out = make([]ImageHubAction, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageHubAccess.
+func (in *ImageHubAccess) DeepCopy() *ImageHubAccess {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageHubAccess)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageHubUser) DeepCopyInto(out *ImageHubUser) {
+	*out = *in
+	if in.Access != nil {
+		in, out := &in.Access, &out.Access
+		*out = make([]ImageHubAccess, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageHubUser.
+func (in *ImageHubUser) DeepCopy() *ImageHubUser {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageHubUser)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageRepositoryMirror) DeepCopyInto(out *ImageRepositoryMirror) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageRepositoryMirror.
+func (in *ImageRepositoryMirror) DeepCopy() *ImageRepositoryMirror {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageRepositoryMirror)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageRepositoryProbe) DeepCopyInto(out *ImageRepositoryProbe) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageRepositoryProbe.
+func (in *ImageRepositoryProbe) DeepCopy() *ImageRepositoryProbe {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageRepositoryProbe)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageRepositoryStatus) DeepCopyInto(out *ImageRepositoryStatus) {
+	*out = *in
+	in.LastProbeTime.DeepCopyInto(&out.LastProbeTime)
+	if in.Repositories != nil {
+		in, out := &in.Repositories, &out.Repositories
+		*out = make([]ImageRepositoryProbe, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageRepositoryStatus.
+func (in *ImageRepositoryStatus) DeepCopy() *ImageRepositoryStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageRepositoryStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InstallPackageConfig) DeepCopyInto(out *InstallPackageConfig) {
 	*out = *in
@@ -150,6 +559,21 @@ func (in *InstallPackageConfig) DeepCopy() *InstallPackageConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InternalDNS) DeepCopyInto(out *InternalDNS) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InternalDNS.
+func (in *InternalDNS) DeepCopy() *InternalDNS {
+	if in == nil {
+		return nil
+	}
+	out := new(InternalDNS)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *K8sNode) DeepCopyInto(out *K8sNode) {
 	*out = *in
@@ -180,6 +604,77 @@ func (in *LocalPathCSIPluginSource) DeepCopy() *LocalPathCSIPluginSource {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MySQLConfig) DeepCopyInto(out *MySQLConfig) {
+	*out = *in
+	if in.InnodbBufferPoolSize != nil {
+		in, out := &in.InnodbBufferPoolSize, &out.InnodbBufferPoolSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.MaxConnections != nil {
+		in, out := &in.MaxConnections, &out.MaxConnections
+		*out = new(int32)
+		**out = **in
+	}
+	if in.SlowQueryLog != nil {
+		in, out := &in.SlowQueryLog, &out.SlowQueryLog
+		*out = new(SlowQueryLog)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Options != nil {
+		in, out := &in.Options, &out.Options
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MySQLConfig.
+func (in *MySQLConfig) DeepCopy() *MySQLConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(MySQLConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeHostsSyncStatus) DeepCopyInto(out *NodeHostsSyncStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeHostsSyncStatus.
+func (in *NodeHostsSyncStatus) DeepCopy() *NodeHostsSyncStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeHostsSyncStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PasswordRotationStatus) DeepCopyInto(out *PasswordRotationStatus) {
+	*out = *in
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PasswordRotationStatus.
+func (in *PasswordRotationStatus) DeepCopy() *PasswordRotationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PasswordRotationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RainbondCluster) DeepCopyInto(out *RainbondCluster) {
 	*out = *in
@@ -259,6 +754,11 @@ func (in *RainbondClusterList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RainbondClusterSpec) DeepCopyInto(out *RainbondClusterSpec) {
 	*out = *in
+	if in.ImageRepositoryMirrors != nil {
+		in, out := &in.ImageRepositoryMirrors, &out.ImageRepositoryMirrors
+		*out = make([]ImageRepositoryMirror, len(*in))
+		copy(*out, *in)
+	}
 	if in.GatewayIngressIPs != nil {
 		in, out := &in.GatewayIngressIPs, &out.GatewayIngressIPs
 		*out = make([]string, len(*in))
@@ -286,21 +786,51 @@ func (in *RainbondClusterSpec) DeepCopyInto(out *RainbondClusterSpec) {
 			}
 		}
 	}
+	if in.APIGateway != nil {
+		in, out := &in.APIGateway, &out.APIGateway
+		*out = new(APIGatewayConfig)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.ImageHub != nil {
 		in, out := &in.ImageHub, &out.ImageHub
 		*out = new(ImageHub)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HubStorage != nil {
+		in, out := &in.HubStorage, &out.HubStorage
+		*out = new(HubStorage)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HubGarbageCollection != nil {
+		in, out := &in.HubGarbageCollection, &out.HubGarbageCollection
+		*out = new(HubGarbageCollection)
 		**out = **in
 	}
+	if in.HubMirror != nil {
+		in, out := &in.HubMirror, &out.HubMirror
+		*out = new(HubMirror)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.RegionDatabase != nil {
 		in, out := &in.RegionDatabase, &out.RegionDatabase
 		*out = new(Database)
-		**out = **in
+		(*in).DeepCopyInto(*out)
 	}
 	if in.UIDatabase != nil {
 		in, out := &in.UIDatabase, &out.UIDatabase
 		*out = new(Database)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DatabaseBackup != nil {
+		in, out := &in.DatabaseBackup, &out.DatabaseBackup
+		*out = new(DatabaseBackup)
 		**out = **in
 	}
+	if in.DatabaseMigration != nil {
+		in, out := &in.DatabaseMigration, &out.DatabaseMigration
+		*out = new(DatabaseMigration)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.EtcdConfig != nil {
 		in, out := &in.EtcdConfig, &out.EtcdConfig
 		*out = new(EtcdConfig)
@@ -316,6 +846,26 @@ func (in *RainbondClusterSpec) DeepCopyInto(out *RainbondClusterSpec) {
 		*out = new(RainbondVolumeSpec)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.PrecheckInterval != nil {
+		in, out := &in.PrecheckInterval, &out.PrecheckInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.ProbePrecheckInterval != nil {
+		in, out := &in.ProbePrecheckInterval, &out.ProbePrecheckInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.InternalDNS != nil {
+		in, out := &in.InternalDNS, &out.InternalDNS
+		*out = new(InternalDNS)
+		**out = **in
+	}
+	if in.InstallPackageConfig != nil {
+		in, out := &in.InstallPackageConfig, &out.InstallPackageConfig
+		*out = new(InstallPackageConfig)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RainbondClusterSpec.
@@ -357,6 +907,11 @@ func (in *RainbondClusterStatus) DeepCopyInto(out *RainbondClusterStatus) {
 		*out = new(v1.LocalObjectReference)
 		**out = **in
 	}
+	if in.ImageRepository != nil {
+		in, out := &in.ImageRepository, &out.ImageRepository
+		*out = new(ImageRepositoryStatus)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
 		*out = make([]RainbondClusterCondition, len(*in))
@@ -613,6 +1168,11 @@ func (in *RbdComponentSpec) DeepCopyInto(out *RbdComponentSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.MySQLConfig != nil {
+		in, out := &in.MySQLConfig, &out.MySQLConfig
+		*out = new(MySQLConfig)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RbdComponentSpec.
@@ -640,6 +1200,36 @@ func (in *RbdComponentStatus) DeepCopyInto(out *RbdComponentStatus) {
 		*out = make([]v1.LocalObjectReference, len(*in))
 		copy(*out, *in)
 	}
+	if in.Replication != nil {
+		in, out := &in.Replication, &out.Replication
+		*out = new(ReplicationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = new(BackupStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PasswordRotation != nil {
+		in, out := &in.PasswordRotation, &out.PasswordRotation
+		*out = new(PasswordRotationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DatabaseMigration != nil {
+		in, out := &in.DatabaseMigration, &out.DatabaseMigration
+		*out = new(DatabaseMigrationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GarbageCollection != nil {
+		in, out := &in.GarbageCollection, &out.GarbageCollection
+		*out = new(GarbageCollectionStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HostsSync != nil {
+		in, out := &in.HostsSync, &out.HostsSync
+		*out = new(HostsSyncStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RbdComponentStatus.
@@ -652,6 +1242,72 @@ func (in *RbdComponentStatus) DeepCopy() *RbdComponentStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReplicaStatus) DeepCopyInto(out *ReplicaStatus) {
+	*out = *in
+	if in.LagSeconds != nil {
+		in, out := &in.LagSeconds, &out.LagSeconds
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReplicaStatus.
+func (in *ReplicaStatus) DeepCopy() *ReplicaStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ReplicaStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReplicationStatus) DeepCopyInto(out *ReplicationStatus) {
+	*out = *in
+	if in.LastFailoverTime != nil {
+		in, out := &in.LastFailoverTime, &out.LastFailoverTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = make([]ReplicaStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReplicationStatus.
+func (in *ReplicationStatus) DeepCopy() *ReplicationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ReplicationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SlowQueryLog) DeepCopyInto(out *SlowQueryLog) {
+	*out = *in
+	if in.LongQueryTime != nil {
+		in, out := &in.LongQueryTime, &out.LongQueryTime
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SlowQueryLog.
+func (in *SlowQueryLog) DeepCopy() *SlowQueryLog {
+	if in == nil {
+		return nil
+	}
+	out := new(SlowQueryLog)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *StorageClass) DeepCopyInto(out *StorageClass) {
 	*out = *in
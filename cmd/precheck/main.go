@@ -0,0 +1,215 @@
+// Command precheck checks whether a kubernetes cluster qualifies for rainbond before installing,
+// without the operator. It runs every precheck against a draft rainbondcluster, prints the report,
+// and cleans up the sentinel daemonset and storage probes it created.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/controllers/cluster-mgr/precheck"
+	"github.com/goodrain/rainbond-operator/util/constants"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(rainbondv1alpha1.AddToScheme(scheme))
+}
+
+func main() {
+	var kubeconfig, clusterFile, output string
+	var timeout, interval time.Duration
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to the kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config.")
+	flag.StringVar(&clusterFile, "cluster", "", "Path to the draft RainbondCluster YAML.")
+	flag.StringVar(&output, "output", "text", "Output format of the report, one of text or json.")
+	flag.DurationVar(&timeout, "timeout", 5*time.Minute, "How long to wait for the prechecks which run in the cluster, such as storage.")
+	flag.DurationVar(&interval, "interval", 5*time.Second, "Interval to re-run the prechecks which are still in progress.")
+	flag.Parse()
+
+	if clusterFile == "" {
+		fmt.Fprintln(os.Stderr, "--cluster is required")
+		os.Exit(2)
+	}
+	if output != "text" && output != "json" {
+		fmt.Fprintf(os.Stderr, "unsupported output %q\n", output)
+		os.Exit(2)
+	}
+
+	cluster, err := readCluster(clusterFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read rainbondcluster: %v\n", err)
+		os.Exit(2)
+	}
+	cfg, err := restConfig(kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load kubeconfig: %v\n", err)
+		os.Exit(2)
+	}
+	cli, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create kubernetes client: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	report, err := run(ctx, cli, cluster, timeout, interval)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "precheck: %v\n", err)
+		os.Exit(2)
+	}
+
+	if output == "json" {
+		bytes, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(bytes))
+	} else {
+		_ = report.Print(os.Stdout)
+	}
+	if !report.Passed {
+		os.Exit(1)
+	}
+}
+
+func readCluster(file string) (*rainbondv1alpha1.RainbondCluster, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{}
+	if err := yaml.Unmarshal(bytes, cluster); err != nil {
+		return nil, err
+	}
+	// the draft is not created yet, make sure it does not own anything.
+	cluster.UID = ""
+	if cluster.Namespace == "" {
+		cluster.Namespace = constants.Namespace
+	}
+	return cluster, nil
+}
+
+func restConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return ctrl.GetConfig()
+}
+
+func run(ctx context.Context, cli client.Client, cluster *rainbondv1alpha1.RainbondCluster, timeout, interval time.Duration) (*precheck.Report, error) {
+	createdNamespace, err := ensureNamespace(ctx, cli, cluster.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// use a new context, the resources have to be cleaned up even if the precheck is interrupted.
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := precheck.Cleanup(cleanupCtx, cli, cluster.Namespace); err != nil {
+			fmt.Fprintf(os.Stderr, "clean up: %v\n", err)
+		}
+		if createdNamespace {
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: cluster.Namespace}}
+			if err := cli.Delete(cleanupCtx, ns); err != nil && !k8sErrors.IsNotFound(err) {
+				fmt.Fprintf(os.Stderr, "delete namespace %s: %v\n", cluster.Namespace, err)
+			}
+		}
+	}()
+
+	prechekers := newPrecheckers(ctx, cli, cluster)
+	conditions := make([]rainbondv1alpha1.RainbondClusterCondition, len(prechekers))
+	finished := make([]bool, len(prechekers))
+	deadline := time.Now().Add(timeout)
+	for {
+		// the finished prechecks are not run again, or the probes cleaned up by them would be created again.
+		inProgress := false
+		for i, prechecker := range prechekers {
+			if finished[i] {
+				continue
+			}
+			conditions[i] = prechecker.Check()
+			if precheck.IsInProgress(conditions[i]) {
+				inProgress = true
+			} else {
+				finished[i] = true
+			}
+		}
+		if !inProgress || time.Now().After(deadline) {
+			return precheck.NewReport(conditions), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return precheck.NewReport(conditions), nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func newPrecheckers(ctx context.Context, cli client.Client, cluster *rainbondv1alpha1.RainbondCluster) []precheck.PreChecker {
+	log := ctrl.Log.WithName("precheck")
+	spec := cluster.Spec
+	var prechekers []precheck.PreChecker
+	if spec.RegionDatabase != nil {
+		prechekers = append(prechekers, precheck.NewDatabasePrechecker(rainbondv1alpha1.RainbondClusterConditionTypeDatabaseRegion, spec.RegionDatabase))
+	}
+	if spec.UIDatabase != nil {
+		prechekers = append(prechekers, precheck.NewDatabasePrechecker(rainbondv1alpha1.RainbondClusterConditionTypeDatabaseConsole, spec.UIDatabase))
+	}
+	if spec.EtcdConfig != nil && len(spec.EtcdConfig.Endpoints) > 0 {
+		prechekers = append(prechekers, precheck.NewEtcdPrechecker(ctx, cli, log, cluster))
+	}
+	prechekers = append(prechekers,
+		precheck.NewK8sVersionPrechecker(ctx, log, cli),
+		precheck.NewMemory(ctx, log, cli),
+	)
+	if spec.RainbondVolumeSpecRWX == nil {
+		// the operator fills it in before the storage precheck, so does the draft.
+		cluster.Spec.RainbondVolumeSpecRWX = &rainbondv1alpha1.RainbondVolumeSpec{}
+	}
+	prechekers = append(prechekers, precheck.NewStorage(ctx, cli, scheme, log, cluster))
+	if spec.InstallMode != rainbondv1alpha1.InstallationModeOffline {
+		prechekers = append(prechekers, precheck.NewDNSPrechecker(cluster, log))
+	}
+	// the container network precheck is left to the operator, it dials the pod ips, which are not reachable
+	// from the machine running the command.
+	return prechekers
+}
+
+func ensureNamespace(ctx context.Context, cli client.Client, name string) (bool, error) {
+	ns := &corev1.Namespace{}
+	err := cli.Get(ctx, client.ObjectKey{Name: name}, ns)
+	if err == nil {
+		return false, nil
+	}
+	if !k8sErrors.IsNotFound(err) {
+		return false, fmt.Errorf("get namespace %s: %v", name, err)
+	}
+	ns = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if err := cli.Create(ctx, ns); err != nil {
+		return false, fmt.Errorf("create namespace %s: %v", name, err)
+	}
+	return true, nil
+}
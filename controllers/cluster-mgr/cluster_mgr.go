@@ -126,6 +126,7 @@ func (r *RainbondClusteMgr) GenerateRainbondClusterStatus() (*rainbondv1alpha1.R
 	s := &rainbondv1alpha1.RainbondClusterStatus{
 		MasterRoleLabel: masterRoleLabel,
 		StorageClasses:  r.listStorageClasses(),
+		ImageRepository: r.imageRepositoryStatus(),
 	}
 
 	if r.checkIfImagePullSecretExists() {
@@ -238,13 +239,22 @@ func (r *RainbondClusteMgr) listMasterNodes(masterRoleLabelKey string) []*rainbo
 
 // CreateImagePullSecret create image pull secret.
 func (r *RainbondClusteMgr) CreateImagePullSecret() (bool, error) {
+	// the credential is published once it is accepted by the image repository.
+	if _, condition := r.cluster.Status.GetCondition(rainbondv1alpha1.RainbondClusterConditionTypeImageRepository); !precheck.ImageRepositoryLoggedIn(condition) {
+		r.log.V(5).Info("waiting for the credential of the image hub to be verified")
+		return false, nil
+	}
 	var secret corev1.Secret
 	if err := r.client.Get(r.ctx, types.NamespacedName{Namespace: r.cluster.Namespace, Name: RdbHubCredentialsName}, &secret); err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return false, err
 		}
 	}
-	if config, exist := secret.Data[".dockerconfigjson"]; exist && string(config) == string(r.generateDockerConfig()) {
+	dockerConfig, err := r.generateDockerConfig()
+	if err != nil {
+		return false, err
+	}
+	if config, exist := secret.Data[".dockerconfigjson"]; exist && string(config) == string(dockerConfig) {
 		r.log.V(5).Info("dockerconfig not change")
 		return false, nil
 	}
@@ -254,7 +264,7 @@ func (r *RainbondClusteMgr) CreateImagePullSecret() (bool, error) {
 			Namespace: r.cluster.Namespace,
 		},
 		Data: map[string][]byte{
-			".dockerconfigjson": r.generateDockerConfig(),
+			".dockerconfigjson": dockerConfig,
 		},
 		Type: corev1.SecretTypeDockerConfigJson,
 	}
@@ -263,7 +273,7 @@ func (r *RainbondClusteMgr) CreateImagePullSecret() (bool, error) {
 		return false, fmt.Errorf("set controller reference for secret %s: %v", RdbHubCredentialsName, err)
 	}
 
-	err := r.client.Create(r.ctx, &secret)
+	err = r.client.Create(r.ctx, &secret)
 	if err != nil {
 		if k8sErrors.IsAlreadyExists(err) {
 			r.log.V(7).Info("update image pull secret", "name", RdbHubCredentialsName)
@@ -290,12 +300,15 @@ func (r *RainbondClusteMgr) checkIfImagePullSecretExists() bool {
 	return true
 }
 
-func (r *RainbondClusteMgr) generateDockerConfig() []byte {
+func (r *RainbondClusteMgr) generateDockerConfig() ([]byte, error) {
 	type dockerConfig struct {
 		Auths map[string]map[string]string `json:"auths"`
 	}
 
-	username, password := r.cluster.Spec.ImageHub.Username, r.cluster.Spec.ImageHub.Password
+	username, password, err := r.imagePullCredential()
+	if err != nil {
+		return nil, err
+	}
 	auth := map[string]string{
 		"username": username,
 		"password": password,
@@ -309,7 +322,32 @@ func (r *RainbondClusteMgr) generateDockerConfig() []byte {
 	}
 
 	bytes, _ := ffjson.Marshal(dockercfg)
-	return bytes
+	return bytes, nil
+}
+
+// imagePullCredential returns the credential of ImagePullUser, whose password is kept in the secret of the user.
+func (r *RainbondClusteMgr) imagePullCredential() (string, string, error) {
+	imageHub := r.cluster.Spec.ImageHub
+	if imageHub.ImagePullUser == "" || imageHub.ImagePullUser == imageHub.Username {
+		return imageHub.Username, imageHub.Password, nil
+	}
+	for i := range imageHub.Users {
+		user := &imageHub.Users[i]
+		if user.Name != imageHub.ImagePullUser {
+			continue
+		}
+		var secret corev1.Secret
+		if err := r.client.Get(r.ctx, types.NamespacedName{Namespace: r.cluster.Namespace, Name: user.PasswordSecret()}, &secret); err != nil {
+			if k8sErrors.IsNotFound(err) {
+				// the secret is generated by rbd-hub, use Username until then.
+				r.log.Info("password of image pull user not found", "user", user.Name)
+				return imageHub.Username, imageHub.Password, nil
+			}
+			return "", "", fmt.Errorf("get the password of image pull user %s: %v", user.Name, err)
+		}
+		return user.Name, string(secret.Data["password"]), nil
+	}
+	return "", "", fmt.Errorf("image pull user %s not found in the users of the image hub", imageHub.ImagePullUser)
 }
 
 func (r *RainbondClusteMgr) checkIfRbdNodeReady() error {
@@ -328,34 +366,51 @@ func (r *RainbondClusteMgr) checkIfRbdNodeReady() error {
 func (r *RainbondClusteMgr) generateConditions() []rainbondv1alpha1.RainbondClusterCondition {
 	// region database
 	spec := r.cluster.Spec
-	if spec.RegionDatabase != nil && !r.isConditionTrue(rainbondv1alpha1.RainbondClusterConditionTypeDatabaseRegion) {
+	if spec.RegionDatabase != nil && r.shouldCheck(rainbondv1alpha1.RainbondClusterConditionTypeDatabaseRegion) {
 		preChecker := precheck.NewDatabasePrechecker(rainbondv1alpha1.RainbondClusterConditionTypeDatabaseRegion, spec.RegionDatabase)
 		condition := preChecker.Check()
-		r.cluster.Status.UpdateCondition(&condition)
+		r.updatePrecheckCondition(&condition)
 	}
 
 	// console database
-	if spec.UIDatabase != nil && !r.isConditionTrue(rainbondv1alpha1.RainbondClusterConditionTypeDatabaseConsole) {
+	if spec.UIDatabase != nil && r.shouldCheck(rainbondv1alpha1.RainbondClusterConditionTypeDatabaseConsole) {
 		preChecker := precheck.NewDatabasePrechecker(rainbondv1alpha1.RainbondClusterConditionTypeDatabaseConsole, spec.UIDatabase)
 		condition := preChecker.Check()
-		r.cluster.Status.UpdateCondition(&condition)
+		r.updatePrecheckCondition(&condition)
 	}
 
 	// kubernetes version
-	if !r.isConditionTrue(rainbondv1alpha1.RainbondClusterConditionTypeKubernetesVersion) {
+	if r.shouldCheck(rainbondv1alpha1.RainbondClusterConditionTypeKubernetesVersion) {
 		k8sVersion := precheck.NewK8sVersionPrechecker(r.ctx, r.log, r.client)
 		condition := k8sVersion.Check()
-		r.cluster.Status.UpdateCondition(&condition)
+		r.updatePrecheckCondition(&condition)
 	}
 
-	storagePreChecker := precheck.NewStorage(r.ctx, r.client, r.cluster.GetNamespace(), r.cluster.Spec.RainbondVolumeSpecRWX)
-	storageCondition := storagePreChecker.Check()
-	r.cluster.Status.UpdateCondition(&storageCondition)
+	// external etcd
+	if spec.EtcdConfig != nil && len(spec.EtcdConfig.Endpoints) > 0 && r.shouldCheck(rainbondv1alpha1.RainbondClusterConditionTypeEtcd) {
+		etcdPrechecker := precheck.NewEtcdPrechecker(r.ctx, r.client, r.log, r.cluster)
+		condition := etcdPrechecker.Check()
+		r.updatePrecheckCondition(&condition)
+	}
+
+	// storage, the probes are expensive, so they only run again after the probe interval.
+	if r.shouldProbe(rainbondv1alpha1.RainbondClusterConditionTypeStorage) {
+		storagePreChecker := precheck.NewStorage(r.ctx, r.client, r.scheme, r.log, r.cluster)
+		storageCondition := storagePreChecker.Check()
+		r.updatePrecheckCondition(&storageCondition)
+	}
+
+	// image repository, the credential is verified before it is published, then the images of the offline package are pushed.
+	if spec.ImageHub != nil && r.shouldCheck(rainbondv1alpha1.RainbondClusterConditionTypeImageRepository) {
+		imageRepositoryPrechecker := precheck.NewImageRepositoryPrechecker(r.ctx, r.client, r.scheme, r.log, r.cluster)
+		imageCondition := imageRepositoryPrechecker.Check()
+		r.updatePrecheckCondition(&imageCondition)
+	}
 
 	if r.cluster.Spec.InstallMode != rainbondv1alpha1.InstallationModeOffline {
 		dnsPrechecker := precheck.NewDNSPrechecker(r.cluster, r.log)
 		dnsCondition := dnsPrechecker.Check()
-		r.cluster.Status.UpdateCondition(&dnsCondition)
+		r.updatePrecheckCondition(&dnsCondition)
 	}
 	// disable kube-system namespace pod check
 	// k8sStatusPrechecker := precheck.NewK8sStatusPrechecker(r.ctx, r.cluster, r.client, r.log)
@@ -364,18 +419,30 @@ func (r *RainbondClusteMgr) generateConditions() []rainbondv1alpha1.RainbondClus
 
 	memory := precheck.NewMemory(r.ctx, r.log, r.client)
 	memoryCondition := memory.Check()
-	r.cluster.Status.UpdateCondition(&memoryCondition)
+	r.updatePrecheckCondition(&memoryCondition)
 
-	// container network
-	if r.cluster.Spec.SentinelImage != "" {
+	// container network, the probe pods are created on every node, so they only run again after the probe interval.
+	if r.cluster.Spec.SentinelImage != "" && r.shouldProbe(rainbondv1alpha1.RainbondClusterConditionTypeContainerNetwork) {
 		containerNetworkPrechecker := precheck.NewContainerNetworkPrechecker(r.ctx, r.client, r.scheme, r.log, r.cluster)
 		containerNetworkCondition := containerNetworkPrechecker.Check()
-		r.cluster.Status.UpdateCondition(&containerNetworkCondition)
-	}
-
-	if condition := r.precheckNotReadyRunningCondition(); condition != nil {
+		r.updatePrecheckCondition(&containerNetworkCondition)
+	}
+
+	blockers := r.precheckBlockers()
+	if r.isConditionTrue(rainbondv1alpha1.RainbondClusterConditionTypeRunning) {
+		// the cluster has been installed, precheck failures from now on mean it is degraded.
+		degraded := r.degradedCondition(blockers)
+		r.cluster.Status.UpdateCondition(&degraded)
+	} else if len(blockers) > 0 {
+		condition := &rainbondv1alpha1.RainbondClusterCondition{
+			Type:              rainbondv1alpha1.RainbondClusterConditionTypeRunning,
+			Status:            corev1.ConditionFalse,
+			LastHeartbeatTime: metav1.NewTime(time.Now()),
+			Reason:            "PrecheckNotReady",
+			Message:           fmt.Sprintf("precheck not ready: %s", strings.Join(blockers, "; ")),
+		}
 		r.cluster.Status.UpdateCondition(condition)
-	} else if idx, condition := r.cluster.Status.GetCondition(rainbondv1alpha1.RainbondClusterConditionTypeRunning); idx == -1 || condition.Status != corev1.ConditionTrue {
+	} else {
 		running := r.runningCondition()
 		r.cluster.Status.UpdateCondition(&running)
 	}
@@ -383,7 +450,35 @@ func (r *RainbondClusteMgr) generateConditions() []rainbondv1alpha1.RainbondClus
 	return r.cluster.Status.Conditions
 }
 
-func (r *RainbondClusteMgr) precheckNotReadyRunningCondition() *rainbondv1alpha1.RainbondClusterCondition {
+// shouldCheck returns true if the precheck has not passed yet, or it has not been re-evaluated for the precheck interval.
+func (r *RainbondClusteMgr) shouldCheck(typ3 rainbondv1alpha1.RainbondClusterConditionType) bool {
+	return r.precheckDue(typ3, r.cluster.PrecheckInterval())
+}
+
+// shouldProbe is shouldCheck for the prechecks which create probe workloads, they are re-evaluated for the probe precheck interval.
+func (r *RainbondClusteMgr) shouldProbe(typ3 rainbondv1alpha1.RainbondClusterConditionType) bool {
+	return r.precheckDue(typ3, r.cluster.ProbePrecheckInterval())
+}
+
+// precheckDue returns true if the precheck has not passed yet, or it has not been re-evaluated for the interval.
+func (r *RainbondClusteMgr) precheckDue(typ3 rainbondv1alpha1.RainbondClusterConditionType, interval time.Duration) bool {
+	_, condition := r.cluster.Status.GetCondition(typ3)
+	if condition == nil || condition.Status != corev1.ConditionTrue {
+		return true
+	}
+	return time.Since(condition.LastHeartbeatTime.Time) >= interval
+}
+
+// updatePrecheckCondition updates the condition of a precheck. A passed precheck keeps its last result
+// while it is being re-evaluated, so that a long-running re-check does not look like a failure.
+func (r *RainbondClusteMgr) updatePrecheckCondition(condition *rainbondv1alpha1.RainbondClusterCondition) {
+	if condition.Status != corev1.ConditionTrue && condition.Reason == "InProgress" && r.isConditionTrue(condition.Type) {
+		return
+	}
+	r.cluster.Status.UpdateCondition(condition)
+}
+
+func (r *RainbondClusteMgr) precheckBlockers() []string {
 	var blockers []string
 	for _, conditionType := range r.requiredPrecheckConditionTypes() {
 		_, condition := r.cluster.Status.GetCondition(conditionType)
@@ -400,17 +495,21 @@ func (r *RainbondClusteMgr) precheckNotReadyRunningCondition() *rainbondv1alpha1
 		}
 		blockers = append(blockers, blocker)
 	}
-	if len(blockers) == 0 {
-		return nil
-	}
+	return blockers
+}
 
-	return &rainbondv1alpha1.RainbondClusterCondition{
-		Type:              rainbondv1alpha1.RainbondClusterConditionTypeRunning,
+func (r *RainbondClusteMgr) degradedCondition(blockers []string) rainbondv1alpha1.RainbondClusterCondition {
+	condition := rainbondv1alpha1.RainbondClusterCondition{
+		Type:              rainbondv1alpha1.RainbondClusterConditionTypeDegraded,
 		Status:            corev1.ConditionFalse,
 		LastHeartbeatTime: metav1.NewTime(time.Now()),
-		Reason:            "PrecheckNotReady",
-		Message:           fmt.Sprintf("precheck not ready: %s", strings.Join(blockers, "; ")),
 	}
+	if len(blockers) > 0 {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "PrecheckFailed"
+		condition.Message = fmt.Sprintf("precheck failed: %s", strings.Join(blockers, "; "))
+	}
+	return condition
 }
 
 func (r *RainbondClusteMgr) requiredPrecheckConditionTypes() []rainbondv1alpha1.RainbondClusterConditionType {
@@ -427,12 +526,18 @@ func (r *RainbondClusteMgr) requiredPrecheckConditionTypes() []rainbondv1alpha1.
 	if spec.UIDatabase != nil {
 		conditionTypes = append(conditionTypes, rainbondv1alpha1.RainbondClusterConditionTypeDatabaseConsole)
 	}
+	if spec.EtcdConfig != nil && len(spec.EtcdConfig.Endpoints) > 0 {
+		conditionTypes = append(conditionTypes, rainbondv1alpha1.RainbondClusterConditionTypeEtcd)
+	}
 	if spec.InstallMode != rainbondv1alpha1.InstallationModeOffline {
 		conditionTypes = append(conditionTypes, rainbondv1alpha1.RainbondClusterConditionTypeDNS)
 	}
 	if spec.SentinelImage != "" {
 		conditionTypes = append(conditionTypes, rainbondv1alpha1.RainbondClusterConditionTypeContainerNetwork)
 	}
+	if spec.InstallPackageConfig != nil {
+		conditionTypes = append(conditionTypes, rainbondv1alpha1.RainbondClusterConditionTypeImageRepository)
+	}
 
 	return conditionTypes
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"strings"
 	"testing"
+	"time"
 
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
@@ -16,6 +17,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestGenerateConditionsDefersRunningCheckWhenPrecheckNotReady(t *testing.T) {
@@ -219,6 +221,133 @@ func TestGenerateConditionsDoesNotBlockOnImageRepository(t *testing.T) {
 	}
 }
 
+func TestGenerateConditionsReportsDegradedWhenPrecheckFailsAfterInstall(t *testing.T) {
+	t.Parallel()
+
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("add corev1 to scheme: %v", err)
+	}
+	if err := rainbondv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatalf("add rainbondv1alpha1 to scheme: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		lastHeartbeat time.Time
+		wantVersion   corev1.ConditionStatus
+		wantDegraded  corev1.ConditionStatus
+	}{
+		{
+			name:          "re-evaluated after the interval",
+			lastHeartbeat: time.Now().Add(-10 * time.Minute),
+			wantVersion:   corev1.ConditionFalse,
+			wantDegraded:  corev1.ConditionTrue,
+		},
+		{
+			name:          "not re-evaluated within the interval",
+			lastHeartbeat: time.Now(),
+			wantVersion:   corev1.ConditionTrue,
+			wantDegraded:  corev1.ConditionFalse,
+		},
+	}
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := &rainbondv1alpha1.RainbondCluster{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "rainbondcluster",
+					Namespace: "rbd-system",
+				},
+				Spec: rainbondv1alpha1.RainbondClusterSpec{
+					InstallMode:           rainbondv1alpha1.InstallationModeOffline,
+					RainbondVolumeSpecRWX: &rainbondv1alpha1.RainbondVolumeSpec{},
+				},
+				Status: rainbondv1alpha1.RainbondClusterStatus{
+					Conditions: []rainbondv1alpha1.RainbondClusterCondition{
+						{
+							Type:              rainbondv1alpha1.RainbondClusterConditionTypeKubernetesVersion,
+							Status:            corev1.ConditionTrue,
+							LastHeartbeatTime: metav1.NewTime(tc.lastHeartbeat),
+						},
+						{
+							Type:   rainbondv1alpha1.RainbondClusterConditionTypeRunning,
+							Status: corev1.ConditionTrue,
+						},
+					},
+				},
+			}
+
+			k8sClient := &clusterStatusTestClient{
+				scheme: scheme,
+				nodes: []corev1.Node{
+					{
+						ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+						Status: corev1.NodeStatus{
+							Allocatable: corev1.ResourceList{
+								corev1.ResourceMemory: resource.MustParse("4Gi"),
+							},
+							NodeInfo: corev1.NodeSystemInfo{
+								KubeletVersion: "v1.12.0",
+							},
+						},
+					},
+				},
+				components: readyRbdComponents("rbd-system"),
+			}
+			mgr := NewClusterMgr(context.Background(), k8sClient, ctrl.Log.WithName("test"), cluster, scheme)
+
+			status, err := mgr.GenerateRainbondClusterStatus()
+			if err != nil {
+				t.Fatalf("generate status: %v", err)
+			}
+
+			_, version := status.GetCondition(rainbondv1alpha1.RainbondClusterConditionTypeKubernetesVersion)
+			if version.Status != tc.wantVersion {
+				t.Fatalf("expected KubernetesVersion=%s, got %s", tc.wantVersion, version.Status)
+			}
+			_, degraded := status.GetCondition(rainbondv1alpha1.RainbondClusterConditionTypeDegraded)
+			if degraded == nil || degraded.Status != tc.wantDegraded {
+				t.Fatalf("expected Degraded=%s, got %+v", tc.wantDegraded, degraded)
+			}
+			_, running := status.GetCondition(rainbondv1alpha1.RainbondClusterConditionTypeRunning)
+			if running.Status != corev1.ConditionTrue {
+				t.Fatalf("expected Running to stay True after installation, got %s(%s)", running.Status, running.Reason)
+			}
+		})
+	}
+}
+
+func TestShouldProbeAfterProbePrecheckInterval(t *testing.T) {
+	passed := func(typ3 rainbondv1alpha1.RainbondClusterConditionType, ago time.Duration) rainbondv1alpha1.RainbondClusterCondition {
+		return rainbondv1alpha1.RainbondClusterCondition{Type: typ3, Status: corev1.ConditionTrue, LastHeartbeatTime: metav1.NewTime(time.Now().Add(-ago))}
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Status: rainbondv1alpha1.RainbondClusterStatus{
+			Conditions: []rainbondv1alpha1.RainbondClusterCondition{
+				passed(rainbondv1alpha1.RainbondClusterConditionTypeKubernetesVersion, 10*time.Minute),
+				passed(rainbondv1alpha1.RainbondClusterConditionTypeStorage, 10*time.Minute),
+				passed(rainbondv1alpha1.RainbondClusterConditionTypeContainerNetwork, 25*time.Hour),
+			},
+		},
+	}
+	mgr := &RainbondClusteMgr{cluster: cluster}
+	if !mgr.shouldCheck(rainbondv1alpha1.RainbondClusterConditionTypeKubernetesVersion) {
+		t.Fatal("expected the kubernetes version to be re-evaluated after the precheck interval")
+	}
+	if mgr.shouldProbe(rainbondv1alpha1.RainbondClusterConditionTypeStorage) {
+		t.Fatal("expected the storage probes not to run again within the probe precheck interval")
+	}
+	if !mgr.shouldProbe(rainbondv1alpha1.RainbondClusterConditionTypeContainerNetwork) {
+		t.Fatal("expected the container network probes to run again after the probe precheck interval")
+	}
+
+	cluster.Spec.ProbePrecheckInterval = &metav1.Duration{Duration: 5 * time.Minute}
+	if !mgr.shouldProbe(rainbondv1alpha1.RainbondClusterConditionTypeStorage) {
+		t.Fatal("expected the probe precheck interval to be configurable")
+	}
+}
+
 func TestCreateImagePullSecretReportsWhetherSecretChanged(t *testing.T) {
 	t.Parallel()
 
@@ -246,6 +375,16 @@ func TestCreateImagePullSecretReportsWhetherSecretChanged(t *testing.T) {
 				Password: "admin1234",
 			},
 		},
+		Status: rainbondv1alpha1.RainbondClusterStatus{
+			Conditions: []rainbondv1alpha1.RainbondClusterCondition{
+				{
+					// the credential has been verified by the image repository precheck.
+					Type:              rainbondv1alpha1.RainbondClusterConditionTypeImageRepository,
+					Status:            corev1.ConditionTrue,
+					LastHeartbeatTime: metav1.Now(),
+				},
+			},
+		},
 	}
 	k8sClient := &clusterStatusTestClient{
 		scheme:  scheme,
@@ -415,3 +554,35 @@ func (c *clusterStatusTestClient) Scheme() *runtime.Scheme {
 func (c *clusterStatusTestClient) RESTMapper() meta.RESTMapper {
 	return nil
 }
+
+func TestImagePullCredential(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			ImageHub: &rainbondv1alpha1.ImageHub{
+				Domain:        "goodrain.me",
+				Username:      "admin",
+				Password:      "admin-password",
+				Users:         []rainbondv1alpha1.ImageHubUser{{Name: "puller"}},
+				ImagePullUser: "puller",
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	mgr := NewClusterMgr(context.Background(), cli, ctrl.Log.WithName("test"), cluster, scheme)
+	if username, _, err := mgr.imagePullCredential(); err != nil || username != "admin" {
+		t.Fatalf("expected Username until the password of puller is generated, got %s %v", username, err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "rbd-hub-user-puller", Namespace: "rbd-system"},
+		Data:       map[string][]byte{"password": []byte("puller-password")},
+	}
+	if err := cli.Create(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if username, password, err := mgr.imagePullCredential(); err != nil || username != "puller" || password != "puller-password" {
+		t.Fatalf("expected the credential of puller, got %s %s %v", username, password, err)
+	}
+}
@@ -0,0 +1,83 @@
+package clustermgr
+
+import (
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// gatewayIngressIPsSourceAnnotation marks the gateway ingress ips populated from the load balancer,
+	// which follow the status of the service. The ips specified by users are never changed.
+	gatewayIngressIPsSourceAnnotation = "rainbond.io/gateway-ingress-ips-source"
+	gatewayIngressIPsFromLoadBalancer = "LoadBalancer"
+	// apiGatewayServiceName is the service of rbd-gateway in LoadBalancer and NodePort mode.
+	apiGatewayServiceName = "rbd-gateway"
+)
+
+// SyncGatewayIngressIPs populates the gateway ingress ips from the status of the LoadBalancer service of rbd-gateway.
+// It returns true if the ips are changed.
+func (r *RainbondClusteMgr) SyncGatewayIngressIPs() (bool, error) {
+	if r.cluster.GatewayMode() != rainbondv1alpha1.GatewayModeLoadBalancer {
+		return false, nil
+	}
+	populated := r.cluster.Annotations[gatewayIngressIPsSourceAnnotation] == gatewayIngressIPsFromLoadBalancer
+	if len(r.cluster.Spec.GatewayIngressIPs) > 0 && !populated {
+		return false, nil
+	}
+
+	svc := &corev1.Service{}
+	if err := r.client.Get(r.ctx, types.NamespacedName{Namespace: r.cluster.Namespace, Name: apiGatewayServiceName}, svc); err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	var ips []string
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			ips = append(ips, ingress.IP)
+		} else if ingress.Hostname != "" {
+			r.log.V(4).Info("the hostname of the load balancer is not supported as gateway ingress ip", "hostname", ingress.Hostname)
+		}
+	}
+	if len(ips) == 0 || (populated && sameStrings(ips, r.cluster.Spec.GatewayIngressIPs)) {
+		return false, nil
+	}
+
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		rc := &rainbondv1alpha1.RainbondCluster{}
+		if err := r.client.Get(r.ctx, types.NamespacedName{Namespace: r.cluster.Namespace, Name: r.cluster.Name}, rc); err != nil {
+			return err
+		}
+		if rc.Annotations == nil {
+			rc.Annotations = make(map[string]string)
+		}
+		rc.Annotations[gatewayIngressIPsSourceAnnotation] = gatewayIngressIPsFromLoadBalancer
+		rc.Spec.GatewayIngressIPs = ips
+		if err := r.client.Update(r.ctx, rc); err != nil {
+			return err
+		}
+		r.cluster.Annotations = rc.Annotations
+		r.cluster.Spec.GatewayIngressIPs = ips
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	r.log.Info("gateway ingress ips populated from the load balancer", "ips", ips)
+	return true, nil
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
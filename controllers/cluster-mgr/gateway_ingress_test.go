@@ -0,0 +1,132 @@
+package clustermgr
+
+import (
+	"context"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSyncGatewayIngressIPs(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			APIGateway: &rainbondv1alpha1.APIGatewayConfig{Mode: rainbondv1alpha1.GatewayModeLoadBalancer},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: apiGatewayServiceName, Namespace: "rbd-system"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster.DeepCopy(), svc).Build()
+	mgr := NewClusterMgr(context.Background(), cli, ctrl.Log.WithName("test"), cluster, scheme)
+	ctx := context.Background()
+	setIngress := func(ips ...string) {
+		svc := &corev1.Service{}
+		if err := cli.Get(ctx, types.NamespacedName{Namespace: "rbd-system", Name: apiGatewayServiceName}, svc); err != nil {
+			t.Fatal(err)
+		}
+		svc.Status.LoadBalancer.Ingress = nil
+		for _, ip := range ips {
+			svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+		}
+		if err := cli.Status().Update(ctx, svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func() bool {
+		changed, err := mgr.SyncGatewayIngressIPs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changed
+	}
+	stored := func() *rainbondv1alpha1.RainbondCluster {
+		rc := &rainbondv1alpha1.RainbondCluster{}
+		if err := cli.Get(ctx, types.NamespacedName{Namespace: "rbd-system", Name: "rainbondcluster"}, rc); err != nil {
+			t.Fatal(err)
+		}
+		return rc
+	}
+
+	if sync() {
+		t.Fatal("expected nothing to be populated before the load balancer is provisioned")
+	}
+	setIngress("47.0.0.1")
+	if !sync() {
+		t.Fatal("expected the gateway ingress ips to be populated")
+	}
+	rc := stored()
+	if len(rc.Spec.GatewayIngressIPs) != 1 || rc.Spec.GatewayIngressIPs[0] != "47.0.0.1" ||
+		rc.Annotations[gatewayIngressIPsSourceAnnotation] != gatewayIngressIPsFromLoadBalancer {
+		t.Fatalf("unexpected gateway ingress ips %v %v", rc.Spec.GatewayIngressIPs, rc.Annotations)
+	}
+	if cluster.InnerGatewayIngressIP() != "47.0.0.1" {
+		t.Fatalf("expected the load balancer to be the inner gateway, got %s", cluster.InnerGatewayIngressIP())
+	}
+	if sync() {
+		t.Fatal("expected the unchanged ips to be kept")
+	}
+	setIngress("47.0.0.2", "47.0.0.3")
+	if !sync() || len(stored().Spec.GatewayIngressIPs) != 2 {
+		t.Fatalf("expected the ips to follow the load balancer, got %v", stored().Spec.GatewayIngressIPs)
+	}
+
+	// the ips specified by users are never changed.
+	rc = stored()
+	delete(rc.Annotations, gatewayIngressIPsSourceAnnotation)
+	rc.Spec.GatewayIngressIPs = []string{"1.2.3.4"}
+	if err := cli.Update(ctx, rc); err != nil {
+		t.Fatal(err)
+	}
+	mgr = NewClusterMgr(ctx, cli, ctrl.Log.WithName("test"), rc, scheme)
+	if sync() || stored().Spec.GatewayIngressIPs[0] != "1.2.3.4" {
+		t.Fatalf("expected the specified ips to be kept, got %v", stored().Spec.GatewayIngressIPs)
+	}
+}
+
+func TestInnerGatewayIngressIP(t *testing.T) {
+	cluster := func(config *rainbondv1alpha1.APIGatewayConfig, ingressIPs ...string) *rainbondv1alpha1.RainbondCluster {
+		return &rainbondv1alpha1.RainbondCluster{
+			Spec: rainbondv1alpha1.RainbondClusterSpec{
+				APIGateway:        config,
+				GatewayIngressIPs: ingressIPs,
+				NodesForGateway:   []*rainbondv1alpha1.K8sNode{{Name: "gateway-1", InternalIP: "10.0.0.10"}},
+			},
+		}
+	}
+	nodePort := &rainbondv1alpha1.APIGatewayConfig{Mode: rainbondv1alpha1.GatewayModeNodePort}
+	daemonSet := &rainbondv1alpha1.APIGatewayConfig{Mode: rainbondv1alpha1.GatewayModeDaemonSet}
+	nodePool := &rainbondv1alpha1.APIGatewayConfig{
+		Mode:         rainbondv1alpha1.GatewayModeDaemonSet,
+		NodeSelector: map[string]string{"node-role/gateway": ""},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cluster *rainbondv1alpha1.RainbondCluster
+		want    string
+	}{
+		{"host network", cluster(nil, "47.0.0.1"), "10.0.0.10"},
+		{"daemonset on nodesForGateway", cluster(daemonSet, "47.0.0.1"), "10.0.0.10"},
+		// rbd-gateway does not listen on 443 of the nodes.
+		{"nodeport", cluster(nodePort, "47.0.0.1"), "47.0.0.1"},
+		{"nodeport without ingress ips", cluster(nodePort), ""},
+		// rbd-gateway may not run on nodesForGateway.
+		{"daemonset with node selector", cluster(nodePool, "10.0.1.10"), "10.0.1.10"},
+		{"daemonset with node selector without ingress ips", cluster(nodePool), ""},
+	} {
+		if got := tc.cluster.InnerGatewayIngressIP(); got != tc.want {
+			t.Errorf("%s: expected the inner gateway %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package clustermgr
+
+import (
+	"strings"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const registryPingTimeout = 5 * time.Second
+
+// compareRegistryLatency is replaced in tests.
+var compareRegistryLatency = commonutil.CompareRegistryLatency
+
+// imageRepositoryStatus selects the image repository among RainbondImageRepository and the mirrors.
+// The registries are pinged again after the precheck interval, or once the candidates change.
+// The selected repository is kept while it is reachable, unless another one is more than twice as fast,
+// so that the components are not restarted for small fluctuations of the latency.
+func (r *RainbondClusteMgr) imageRepositoryStatus() *rainbondv1alpha1.ImageRepositoryStatus {
+	if len(r.cluster.Spec.ImageRepositoryMirrors) == 0 {
+		return nil
+	}
+	candidates := r.cluster.ImageRepositories()
+	previous := r.cluster.Status.ImageRepository
+	if previous != nil && sameRepositories(previous.Repositories, candidates) &&
+		time.Since(previous.LastProbeTime.Time) < r.cluster.PrecheckInterval() {
+		return previous
+	}
+
+	var registries []commonutil.Registry
+	if repository := r.cluster.Spec.RainbondImageRepository; repository != "" {
+		registry := commonutil.Registry{URL: registryHost(repository)}
+		registry.Username, registry.Password = r.rainbondImageRepositoryCredential()
+		registries = append(registries, registry)
+	}
+	for _, mirror := range r.cluster.Spec.ImageRepositoryMirrors {
+		registry := commonutil.Registry{URL: registryHost(mirror.Repository)}
+		registry.Username, registry.Password = r.mirrorCredential(mirror)
+		registries = append(registries, registry)
+	}
+	results := compareRegistryLatency(registryPingTimeout, registries...)
+
+	status := &rainbondv1alpha1.ImageRepositoryStatus{LastProbeTime: metav1.Now()}
+	probes := make(map[string]*rainbondv1alpha1.ImageRepositoryProbe, len(candidates))
+	var best *rainbondv1alpha1.ImageRepositoryProbe
+	for _, repository := range candidates {
+		probe := rainbondv1alpha1.ImageRepositoryProbe{Repository: repository, Message: "not pinged"}
+		for _, result := range results {
+			if result.URL != registryHost(repository) {
+				continue
+			}
+			probe.Reachable, probe.Message = result.Success, result.Message
+			probe.LatencyMilliseconds = result.Latency.Milliseconds()
+			break
+		}
+		status.Repositories = append(status.Repositories, probe)
+		probes[repository] = &status.Repositories[len(status.Repositories)-1]
+	}
+	for i := range status.Repositories {
+		probe := &status.Repositories[i]
+		if probe.Reachable && (best == nil || probe.LatencyMilliseconds < best.LatencyMilliseconds) {
+			best = probe
+		}
+	}
+
+	switch {
+	case best == nil:
+		// none of them is reachable, keep the previous one rather than switching blindly.
+		status.Selected = r.cluster.ImageRepository()
+		r.log.Info("none of the image repositories is reachable", "selected", status.Selected)
+	case previous != nil && probes[previous.Selected] != nil && probes[previous.Selected].Reachable &&
+		best.LatencyMilliseconds*2 >= probes[previous.Selected].LatencyMilliseconds:
+		status.Selected = previous.Selected
+	default:
+		status.Selected = best.Repository
+	}
+	if probe := probes[status.Selected]; probe != nil && (previous == nil || previous.Selected != status.Selected) {
+		r.log.Info("image repository selected", "repository", status.Selected, "latencyMilliseconds", probe.LatencyMilliseconds)
+	}
+	return status
+}
+
+func (r *RainbondClusteMgr) mirrorCredential(mirror rainbondv1alpha1.ImageRepositoryMirror) (string, string) {
+	if mirror.SecretName == "" {
+		return "", ""
+	}
+	secret := &corev1.Secret{}
+	if err := r.client.Get(r.ctx, types.NamespacedName{Namespace: r.cluster.Namespace, Name: mirror.SecretName}, secret); err != nil {
+		r.log.V(4).Info("get credential of image repository mirror", "repository", mirror.Repository, "error", err.Error())
+		return "", ""
+	}
+	return string(secret.Data["username"]), string(secret.Data["password"])
+}
+
+// rainbondImageRepositoryCredential returns the credential of RainbondImageRepository if it is the image hub.
+func (r *RainbondClusteMgr) rainbondImageRepositoryCredential() (string, string) {
+	imageHub := r.cluster.Spec.ImageHub
+	if imageHub == nil || registryHost(r.cluster.Spec.RainbondImageRepository) != imageHub.Domain {
+		return "", ""
+	}
+	return imageHub.Username, imageHub.Password
+}
+
+// registryHost returns the registry host of the repository, docker.io if there is no host.
+func registryHost(repository string) string {
+	host := strings.SplitN(repository, "/", 2)[0]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "docker.io"
+	}
+	return host
+}
+
+func sameRepositories(probes []rainbondv1alpha1.ImageRepositoryProbe, repositories []string) bool {
+	if len(probes) != len(repositories) {
+		return false
+	}
+	for i := range probes {
+		if probes[i].Repository != repositories[i] {
+			return false
+		}
+	}
+	return true
+}
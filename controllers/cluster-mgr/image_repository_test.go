@@ -0,0 +1,101 @@
+package clustermgr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestImageRepositorySelection(t *testing.T) {
+	latencies := map[string]time.Duration{}
+	var credentials map[string]string
+	compareRegistryLatency = func(timeout time.Duration, registries ...commonutil.Registry) []commonutil.Result {
+		credentials = make(map[string]string)
+		var results []commonutil.Result
+		for _, registry := range registries {
+			credentials[registry.URL] = registry.Username + ":" + registry.Password
+			latency, ok := latencies[registry.URL]
+			result := commonutil.Result{URL: registry.URL, Success: ok, Latency: latency}
+			if !ok {
+				result.Message = "connection refused"
+			}
+			results = append(results, result)
+		}
+		return results
+	}
+	defer func() { compareRegistryLatency = commonutil.CompareRegistryLatency }()
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			RainbondImageRepository: "registry.cn-hangzhou.aliyuncs.com/goodrain",
+			ImageRepositoryMirrors: []rainbondv1alpha1.ImageRepositoryMirror{
+				{Repository: "rainbond"},
+				{Repository: "mirror.example.com/goodrain", SecretName: "mirror"},
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "mirror", Namespace: "rbd-system"},
+		Data:       map[string][]byte{"username": []byte("user"), "password": []byte("pass")},
+	}).Build()
+	mgr := NewClusterMgr(context.Background(), cli, ctrl.Log, cluster, scheme)
+
+	latencies["registry.cn-hangzhou.aliyuncs.com"] = 80 * time.Millisecond
+	latencies["docker.io"] = 200 * time.Millisecond
+	latencies["mirror.example.com"] = 30 * time.Millisecond
+	status := mgr.imageRepositoryStatus()
+	if status.Selected != "mirror.example.com/goodrain" {
+		t.Fatalf("expected the fastest mirror to be selected, got %s", status.Selected)
+	}
+	if len(status.Repositories) != 3 || status.Repositories[1].Repository != "rainbond" || status.Repositories[1].LatencyMilliseconds != 200 {
+		t.Fatalf("unexpected measurements: %+v", status.Repositories)
+	}
+	if credentials["mirror.example.com"] != "user:pass" {
+		t.Fatalf("expected the credential of the mirror, got %q", credentials["mirror.example.com"])
+	}
+	cluster.Status.ImageRepository = status
+	if image := cluster.ComponentImage("registry.cn-hangzhou.aliyuncs.com/goodrain/rbd-api:v6.0.0"); image != "mirror.example.com/goodrain/rbd-api:v6.0.0" {
+		t.Fatalf("expected the image from the selected mirror, got %s", image)
+	}
+	if image := cluster.ComponentImage("docker.io/library/nginx:1"); image != "docker.io/library/nginx:1" {
+		t.Fatalf("expected the image out of the candidates to be kept, got %s", image)
+	}
+
+	// the measurements are kept until the interval passes.
+	latencies["registry.cn-hangzhou.aliyuncs.com"] = 10 * time.Millisecond
+	if mgr.imageRepositoryStatus() != status {
+		t.Fatal("expected the registries not to be pinged again within the interval")
+	}
+
+	// a slightly faster repository does not take over.
+	latencies["registry.cn-hangzhou.aliyuncs.com"] = 20 * time.Millisecond
+	status.LastProbeTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	status = mgr.imageRepositoryStatus()
+	if status.Selected != "mirror.example.com/goodrain" {
+		t.Fatalf("expected the selected mirror to be kept, got %s", status.Selected)
+	}
+
+	// fail over once the selected one is not reachable.
+	cluster.Status.ImageRepository = status
+	delete(latencies, "mirror.example.com")
+	status.LastProbeTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	status = mgr.imageRepositoryStatus()
+	if status.Selected != "registry.cn-hangzhou.aliyuncs.com/goodrain" {
+		t.Fatalf("expected to fail over to the reachable repository, got %s", status.Selected)
+	}
+	if status.Repositories[2].Reachable || status.Repositories[2].Message == "" {
+		t.Fatalf("expected the mirror to be unreachable, got %+v", status.Repositories[2])
+	}
+}
@@ -0,0 +1,176 @@
+package clustermgr
+
+import (
+	"fmt"
+	"strings"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/constants"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// internalDNSFinalizer removes the server block from the Corefile before the RainbondCluster is deleted.
+	internalDNSFinalizer = "rainbond.io/internal-dns"
+	// internalDNSConfigMapAnnotation is the configmap of CoreDNS holding the server block, <namespace>/<name>.
+	internalDNSConfigMapAnnotation = "rainbond.io/internal-dns-configmap"
+	internalDNSBegin               = "# BEGIN rainbond internal domains, managed by rainbond-operator"
+	internalDNSEnd                 = "# END rainbond internal domains, managed by rainbond-operator"
+	corefileKey                    = "Corefile"
+)
+
+// internalDomains are the domains served by the gateway for the pods.
+var internalDomains = []string{constants.DefImageRepository, "lang." + constants.DefImageRepository, "maven." + constants.DefImageRepository}
+
+func internalDNSConfigMap(dns *rainbondv1alpha1.InternalDNS) string {
+	if dns == nil {
+		return ""
+	}
+	namespace, name := dns.Namespace, dns.ConfigMap
+	if namespace == "" {
+		namespace = "kube-system"
+	}
+	if name == "" {
+		name = "coredns"
+	}
+	return namespace + "/" + name
+}
+
+// SyncInternalDNS keeps the server block of the internal domains in the Corefile in sync with the gateway ingress ips.
+// The configmap is recorded with a finalizer before it is changed, so that the block can be removed later.
+func (r *RainbondClusteMgr) SyncInternalDNS() error {
+	desired := internalDNSConfigMap(r.cluster.Spec.InternalDNS)
+	previous := r.cluster.Annotations[internalDNSConfigMapAnnotation]
+	if previous != "" && previous != desired {
+		if err := r.updateCorefile(previous, nil); err != nil {
+			return err
+		}
+	}
+	if err := r.recordInternalDNS(desired); err != nil {
+		return err
+	}
+	if desired == "" {
+		return nil
+	}
+	return r.updateCorefile(desired, r.cluster.GatewayIngressIPs())
+}
+
+// RemoveInternalDNS removes the server block of the internal domains from the Corefile, then the finalizer.
+func (r *RainbondClusteMgr) RemoveInternalDNS() error {
+	if !controllerutil.ContainsFinalizer(r.cluster, internalDNSFinalizer) {
+		return nil
+	}
+	if configMap := r.cluster.Annotations[internalDNSConfigMapAnnotation]; configMap != "" {
+		if err := r.updateCorefile(configMap, nil); err != nil {
+			return err
+		}
+	}
+	return r.recordInternalDNS("")
+}
+
+func (r *RainbondClusteMgr) recordInternalDNS(configMap string) error {
+	if r.cluster.Annotations[internalDNSConfigMapAnnotation] == configMap &&
+		controllerutil.ContainsFinalizer(r.cluster, internalDNSFinalizer) == (configMap != "") {
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		rc := &rainbondv1alpha1.RainbondCluster{}
+		if err := r.client.Get(r.ctx, types.NamespacedName{Namespace: r.cluster.Namespace, Name: r.cluster.Name}, rc); err != nil {
+			return err
+		}
+		if configMap == "" {
+			delete(rc.Annotations, internalDNSConfigMapAnnotation)
+			controllerutil.RemoveFinalizer(rc, internalDNSFinalizer)
+		} else {
+			if rc.Annotations == nil {
+				rc.Annotations = make(map[string]string)
+			}
+			rc.Annotations[internalDNSConfigMapAnnotation] = configMap
+			controllerutil.AddFinalizer(rc, internalDNSFinalizer)
+		}
+		if err := r.client.Update(r.ctx, rc); err != nil {
+			return err
+		}
+		r.cluster.Annotations = rc.Annotations
+		r.cluster.Finalizers = rc.Finalizers
+		return nil
+	})
+}
+
+// updateCorefile writes the server block resolving the internal domains to the ips, or removes it if there is no ip.
+func (r *RainbondClusteMgr) updateCorefile(configMap string, ips []string) error {
+	namespace, name := configMap, ""
+	if i := strings.Index(configMap, "/"); i >= 0 {
+		namespace, name = configMap[:i], configMap[i+1:]
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.client.Get(r.ctx, types.NamespacedName{Namespace: namespace, Name: name}, cm); err != nil {
+		if k8sErrors.IsNotFound(err) && len(ips) == 0 {
+			return nil
+		}
+		return fmt.Errorf("get configmap %s of coredns: %v", configMap, err)
+	}
+	corefile, ok := cm.Data[corefileKey]
+	if !ok {
+		return fmt.Errorf("configmap %s of coredns has no %s", configMap, corefileKey)
+	}
+	updated := renderCorefile(corefile, ips)
+	if updated == corefile {
+		return nil
+	}
+	cm.Data[corefileKey] = updated
+	if err := r.client.Update(r.ctx, cm); err != nil {
+		return fmt.Errorf("update configmap %s of coredns: %v", configMap, err)
+	}
+	r.log.Info("corefile updated", "configmap", configMap, "ips", ips)
+	return nil
+}
+
+// renderCorefile replaces the managed server block of the corefile.
+func renderCorefile(corefile string, ips []string) string {
+	var lines []string
+	managed, found := false, false
+	for _, line := range strings.Split(strings.TrimRight(corefile, "\n"), "\n") {
+		switch {
+		case line == internalDNSBegin:
+			managed, found = true, true
+		case line == internalDNSEnd:
+			managed = false
+		case !managed:
+			lines = append(lines, line)
+		}
+	}
+	var hosts []string
+	for _, ip := range ips {
+		if ip != "" {
+			hosts = append(hosts, "        "+ip+" "+strings.Join(internalDomains, " "))
+		}
+	}
+	if !found && len(hosts) == 0 {
+		return corefile
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(hosts) > 0 {
+		lines = append(lines,
+			"",
+			internalDNSBegin,
+			constants.DefImageRepository+":53 {",
+			"    errors",
+			"    hosts {",
+		)
+		lines = append(lines, hosts...)
+		lines = append(lines,
+			"    }",
+			"    cache 30",
+			"}",
+			internalDNSEnd,
+		)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,84 @@
+package clustermgr
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const testCorefile = `.:53 {
+    errors
+    kubernetes cluster.local in-addr.arpa ip6.arpa
+    forward . /etc/resolv.conf
+    reload
+}
+`
+
+func TestInternalDNS(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			GatewayIngressIPs: []string{"10.0.0.10", "10.0.0.11"},
+			InternalDNS:       &rainbondv1alpha1.InternalDNS{},
+		},
+	}
+	coredns := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "coredns", Namespace: "kube-system"},
+		Data:       map[string]string{corefileKey: testCorefile},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster.DeepCopy(), coredns).Build()
+	mgr := NewClusterMgr(context.Background(), cli, ctrl.Log.WithName("test"), cluster, scheme)
+	corefile := func() string {
+		cm := &corev1.ConfigMap{}
+		if err := cli.Get(context.Background(), types.NamespacedName{Namespace: "kube-system", Name: "coredns"}, cm); err != nil {
+			t.Fatal(err)
+		}
+		return cm.Data[corefileKey]
+	}
+
+	if err := mgr.SyncInternalDNS(); err != nil {
+		t.Fatal(err)
+	}
+	got := corefile()
+	if !strings.HasPrefix(got, testCorefile) || !strings.Contains(got, "10.0.0.10 goodrain.me lang.goodrain.me maven.goodrain.me") ||
+		!strings.Contains(got, "10.0.0.11 goodrain.me") {
+		t.Fatalf("expected the internal domains to resolve to the gateway, got\n%s", got)
+	}
+	if !controllerutil.ContainsFinalizer(cluster, internalDNSFinalizer) || cluster.Annotations[internalDNSConfigMapAnnotation] != "kube-system/coredns" {
+		t.Fatalf("expected the configmap to be recorded, got %v %v", cluster.Finalizers, cluster.Annotations)
+	}
+	if renderCorefile(got, cluster.GatewayIngressIPs()) != got {
+		t.Fatal("expected the corefile to be unchanged if the ips are unchanged")
+	}
+
+	cluster.Spec.GatewayIngressIPs = []string{"10.0.0.12"}
+	if err := mgr.SyncInternalDNS(); err != nil {
+		t.Fatal(err)
+	}
+	if got := corefile(); strings.Contains(got, "10.0.0.10") || strings.Count(got, internalDNSBegin) != 1 || !strings.Contains(got, "10.0.0.12 goodrain.me") {
+		t.Fatalf("expected the server block to follow the gateway ingress ips, got\n%s", got)
+	}
+
+	cluster.Spec.InternalDNS = nil
+	if err := mgr.SyncInternalDNS(); err != nil {
+		t.Fatal(err)
+	}
+	if got := corefile(); got != testCorefile {
+		t.Fatalf("expected the server block to be removed, got\n%s", got)
+	}
+	if controllerutil.ContainsFinalizer(cluster, internalDNSFinalizer) || cluster.Annotations[internalDNSConfigMapAnnotation] != "" {
+		t.Fatalf("expected the finalizer to be removed, got %v", cluster.Finalizers)
+	}
+}
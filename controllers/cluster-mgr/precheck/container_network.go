@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +21,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
@@ -26,9 +29,42 @@ import (
 // SentinelName -
 const SentinelName = "rainbond-operator-sentinel"
 
+// NetworkProbeName is the name prefix of the pods created by the container network precheck.
+const NetworkProbeName = "rainbond-network-probe"
+
+const (
+	sentinelPort        = 8080
+	networkProbeTimeout = 5 * time.Minute
+	// networkProbeScript runs on every node, and checks the sentinel pods on the other nodes, the sentinel service
+	// by cluster ip and by domain name. Packets as large as the mtu of the pod are sent to detect mtu misconfigurations.
+	// Each failure is reported as a line of the termination message, and the last line is the mtu of the pod.
+	networkProbeScript = `mtu=$(cat /sys/class/net/eth0/mtu 2>/dev/null || echo 1500)
+size=$((mtu-28))
+: > /tmp/result
+for target in $TARGETS; do
+  node=${target%%=*}
+  ip=${target#*=}
+  [ "$node" = "$NODE_NAME" ] && continue
+  if ! nc -z -w 3 "$ip" "$PORT"; then
+    echo "pod $node $ip" >> /tmp/result
+    continue
+  fi
+  if ! ping -c 3 -W 3 -s "$size" "$ip" >/dev/null 2>&1 && ping -c 1 -W 3 "$ip" >/dev/null 2>&1; then
+    echo "mtu $node $ip $size" >> /tmp/result
+  fi
+done
+nc -z -w 3 "$SERVICE_IP" "$PORT" || echo "service $SERVICE_IP" >> /tmp/result
+nslookup "$SERVICE_DOMAIN" >/dev/null 2>&1 || echo "dns $SERVICE_DOMAIN" >> /tmp/result
+echo "mtu $mtu" >> /tmp/result
+cp /tmp/result /dev/termination-log`
+)
+
 // ErrSentinelNotReady -
 var ErrSentinelNotReady = errors.New("rainbond-operator-sentinel not ready")
 
+// ErrNetworkProbeInProgress means the network probe has not finished yet.
+var ErrNetworkProbeInProgress = errors.New("network probe in progress")
+
 type containerNetwork struct {
 	ctx     context.Context
 	log     logr.Logger
@@ -71,6 +107,19 @@ func (c *containerNetwork) Check() rainbondv1alpha1.RainbondClusterCondition {
 		return c.failCondition(condition, err.Error())
 	}
 
+	// Check the network between nodes, services and dns from inside the pods
+	msg, err := c.probe()
+	if err != nil {
+		if err == ErrNetworkProbeInProgress {
+			condition.Status = corev1.ConditionFalse
+			condition.Reason = "InProgress"
+			condition.Message = msg
+			return condition
+		}
+		return c.failCondition(condition, err.Error())
+	}
+	condition.Message = msg
+
 	return condition
 }
 
@@ -109,7 +158,7 @@ func (c *containerNetwork) communicate() error {
 
 	var badPods []string
 	for _, pod := range podList.Items {
-		if err := dial(pod.Status.PodIP, 8080); err != nil {
+		if err := dial(pod.Status.PodIP, sentinelPort); err != nil {
 			badPods = append(badPods, fmt.Sprintf("%s(%s)", pod.GetName(), pod.Status.PodIP))
 		}
 	}
@@ -121,6 +170,262 @@ func (c *containerNetwork) communicate() error {
 	return nil
 }
 
+// probe runs a probe pod on the node of every sentinel pod, and returns the result once all probe pods have finished.
+func (c *containerNetwork) probe() (string, error) {
+	svc, err := c.sentinelService()
+	if err != nil {
+		return "", err
+	}
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == corev1.ClusterIPNone {
+		return fmt.Sprintf("waiting for the cluster ip of service %s", SentinelName), ErrNetworkProbeInProgress
+	}
+
+	pods, err := c.listPods(NetworkProbeName)
+	if err != nil {
+		return "", err
+	}
+	if len(pods) == 0 {
+		if err := c.createProbes(svc); err != nil {
+			return "", err
+		}
+		return "network probes created", ErrNetworkProbeInProgress
+	}
+
+	var failures []string
+	var mtus []string
+	var pending int
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil {
+			return "waiting for the previous network probes to be cleaned up", ErrNetworkProbeInProgress
+		}
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded, corev1.PodFailed:
+			res, mtu, err := parseNetworkProbeResult(pod.Spec.NodeName, terminationMessage(pod))
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", pod.Spec.NodeName, err))
+				continue
+			}
+			failures = append(failures, res...)
+			mtus = append(mtus, mtu)
+		default:
+			if time.Since(pod.CreationTimestamp.Time) > networkProbeTimeout {
+				failures = append(failures, fmt.Sprintf("%s: probe pod %s is %s after %s: %s", pod.Spec.NodeName,
+					pod.Name, pod.Status.Phase, networkProbeTimeout, podPendingMessage(pod)))
+				continue
+			}
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Sprintf("%d of %d network probes finished", len(pods)-pending, len(pods)), ErrNetworkProbeInProgress
+	}
+
+	// every probe has finished, the probe pods are no longer needed.
+	for i := range pods {
+		if err := c.client.Delete(c.ctx, &pods[i]); err != nil && !k8sErrors.IsNotFound(err) {
+			c.log.V(4).Info("clean up network probe", "pod", pods[i].Name, "error", err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return "", errors.New(strings.Join(failures, "; "))
+	}
+	return fmt.Sprintf("pod-to-pod across %d nodes, pod-to-service and dns ok, mtu %s", len(pods), strings.Join(uniq(mtus), ",")), nil
+}
+
+func (c *containerNetwork) sentinelService() (*corev1.Service, error) {
+	svc := &corev1.Service{}
+	err := c.client.Get(c.ctx, types.NamespacedName{Namespace: c.cluster.GetNamespace(), Name: SentinelName}, svc)
+	if err == nil {
+		return svc, nil
+	}
+	if !k8sErrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	svc = c.serviceForSentinel()
+	if c.cluster.GetUID() != "" {
+		if err := controllerutil.SetControllerReference(c.cluster, svc, c.scheme); err != nil {
+			return nil, err
+		}
+	}
+	if err := k8sutil.CreateIfNotExists(c.ctx, c.client, svc); err != nil {
+		return nil, fmt.Errorf("create service %s: %v", SentinelName, err)
+	}
+	return svc, nil
+}
+
+func (c *containerNetwork) serviceForSentinel() *corev1.Service {
+	labels := rbdutil.LabelsForRainbond(map[string]string{
+		"name": SentinelName,
+	})
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      SentinelName,
+			Namespace: c.cluster.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "tcp",
+					Protocol:   corev1.ProtocolTCP,
+					Port:       sentinelPort,
+					TargetPort: intstr.FromInt(sentinelPort),
+				},
+			},
+		},
+	}
+}
+
+func (c *containerNetwork) listPods(name string) ([]corev1.Pod, error) {
+	podList := corev1.PodList{}
+	labels := rbdutil.LabelsForRainbond(map[string]string{
+		"name": name,
+	})
+	if err := c.client.List(c.ctx, &podList, client.InNamespace(c.cluster.Namespace), client.MatchingLabels(labels)); err != nil {
+		return nil, err
+	}
+	pods := podList.Items
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Spec.NodeName < pods[j].Spec.NodeName
+	})
+	return pods, nil
+}
+
+// createProbes creates a probe pod on the node of every sentinel pod.
+func (c *containerNetwork) createProbes(svc *corev1.Service) error {
+	sentinels, err := c.listPods(SentinelName)
+	if err != nil {
+		return err
+	}
+	var targets []string
+	for _, pod := range sentinels {
+		if pod.Spec.NodeName == "" || pod.Status.PodIP == "" {
+			continue
+		}
+		targets = append(targets, pod.Spec.NodeName+"="+pod.Status.PodIP)
+	}
+
+	for idx, target := range targets {
+		nodeName := strings.SplitN(target, "=", 2)[0]
+		pod := c.podForProbe(idx, nodeName, strings.Join(targets, " "), svc)
+		if c.cluster.GetUID() != "" {
+			if err := controllerutil.SetControllerReference(c.cluster, pod, c.scheme); err != nil {
+				return err
+			}
+		}
+		if err := k8sutil.CreateIfNotExists(c.ctx, c.client, pod); err != nil {
+			return fmt.Errorf("create %s: %v", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *containerNetwork) podForProbe(idx int, nodeName, targets string, svc *corev1.Service) *corev1.Pod {
+	labels := rbdutil.LabelsForRainbond(map[string]string{
+		"name": NetworkProbeName,
+	})
+	serviceDomain := fmt.Sprintf("%s.%s.svc.%s", svc.Name, svc.Namespace, rbdutil.GetenvDefault("CLUSTER_DOMAIN", "cluster.local"))
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", NetworkProbeName, idx),
+			Namespace: c.cluster.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: corev1.PodSpec{
+			NodeName:                      nodeName,
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: commonutil.Int64(0),
+			Tolerations: []corev1.Toleration{
+				{
+					Operator: corev1.TolerationOpExists, // tolerate everything.
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:            NetworkProbeName,
+					Image:           rbdutil.GetenvDefault("RAINBOND_IMAGE_REPOSITORY", c.cluster.ImageRepository()) + "/alpine:3",
+					ImagePullPolicy: corev1.PullIfNotPresent,
+					Command:         []string{"/bin/sh", "-c", networkProbeScript},
+					Env: []corev1.EnvVar{
+						{
+							Name: "NODE_NAME",
+							ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+							},
+						},
+						{
+							Name:  "TARGETS",
+							Value: targets,
+						},
+						{
+							Name:  "PORT",
+							Value: strconv.Itoa(sentinelPort),
+						},
+						{
+							Name:  "SERVICE_IP",
+							Value: svc.Spec.ClusterIP,
+						},
+						{
+							Name:  "SERVICE_DOMAIN",
+							Value: serviceDomain,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// parseNetworkProbeResult parses the termination message of a probe pod running on the given node,
+// and returns the failures and the mtu of the pod.
+func parseNetworkProbeResult(node, msg string) ([]string, string, error) {
+	var failures []string
+	var mtu string
+	for _, line := range strings.Split(msg, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "pod" && len(fields) == 3:
+			failures = append(failures, fmt.Sprintf("%s -> %s: can not reach pod %s", node, fields[1], fields[2]))
+		case fields[0] == "mtu" && len(fields) == 4:
+			failures = append(failures, fmt.Sprintf("%s -> %s: packets of %s bytes to pod %s are dropped, check the mtu of the cni",
+				node, fields[1], fields[3], fields[2]))
+		case fields[0] == "service" && len(fields) == 2:
+			failures = append(failures, fmt.Sprintf("%s: can not reach service %s by cluster ip %s", node, SentinelName, fields[1]))
+		case fields[0] == "dns" && len(fields) == 2:
+			failures = append(failures, fmt.Sprintf("%s: can not resolve %s", node, fields[1]))
+		case fields[0] == "mtu" && len(fields) == 2:
+			mtu = fields[1]
+		default:
+			return nil, "", fmt.Errorf("unexpected output of network probe: %q", line)
+		}
+	}
+	if mtu == "" {
+		return nil, "", fmt.Errorf("network probe did not finish: %q", msg)
+	}
+	return failures, mtu, nil
+}
+
+func uniq(items []string) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, item := range items {
+		if seen[item] {
+			continue
+		}
+		seen[item] = true
+		res = append(res, item)
+	}
+	return res
+}
+
 func dial(ip string, port int) error {
 	var d net.Dialer
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
@@ -138,9 +443,11 @@ func dial(ip string, port int) error {
 func (c *containerNetwork) createSentinel() error {
 	ds := c.daemonsetForSentinel()
 
-	// Set rainboncluster as the owner and controller
-	if err := controllerutil.SetControllerReference(c.cluster, ds, c.scheme); err != nil {
-		return err
+	// Set rainboncluster as the owner and controller, unless it is a draft which is not created yet.
+	if c.cluster.GetUID() != "" {
+		if err := controllerutil.SetControllerReference(c.cluster, ds, c.scheme); err != nil {
+			return err
+		}
 	}
 
 	return k8sutil.CreateIfNotExists(c.ctx, c.client, ds)
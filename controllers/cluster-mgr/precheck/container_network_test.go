@@ -0,0 +1,110 @@
+package precheck
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestContainerNetworkProbeReportsNodePairs(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+
+	labels := rbdutil.LabelsForRainbond(map[string]string{"name": SentinelName})
+	sentinel := func(name, node, ip string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "rbd-system", Labels: labels},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{PodIP: ip},
+		}
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		sentinel("sentinel-a", "node-a", "10.0.0.1"),
+		sentinel("sentinel-b", "node-b", "10.0.1.1"),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: SentinelName, Namespace: "rbd-system"},
+			Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.10"},
+		},
+	).Build()
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+	}
+	ctx := context.Background()
+	c := NewContainerNetworkPrechecker(ctx, cli, scheme, ctrl.Log, cluster).(*containerNetwork)
+
+	if _, err := c.probe(); err != ErrNetworkProbeInProgress {
+		t.Fatalf("expected network probe in progress, got %v", err)
+	}
+	probes, err := c.listPods(NetworkProbeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probes) != 2 {
+		t.Fatalf("expected 2 network probes, got %d", len(probes))
+	}
+
+	results := map[string]string{
+		"node-a": "mtu node-b 10.0.1.1 1472\nmtu 1500",
+		"node-b": "pod node-a 10.0.0.1\ndns rainbond-operator-sentinel.rbd-system.svc.cluster.local\nmtu 1450",
+	}
+	for i := range probes {
+		pod := probes[i]
+		for _, env := range pod.Spec.Containers[0].Env {
+			if env.Name == "TARGETS" && env.Value != "node-a=10.0.0.1 node-b=10.0.1.1" {
+				t.Fatalf("unexpected targets %q", env.Value)
+			}
+		}
+		pod.Status.Phase = corev1.PodSucceeded
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+			{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: results[pod.Spec.NodeName]}}},
+		}
+		if err := cli.Update(ctx, &pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = c.probe()
+	if err == nil {
+		t.Fatal("expected network probe to fail")
+	}
+	for _, want := range []string{
+		"node-a -> node-b: packets of 1472 bytes to pod 10.0.1.1 are dropped",
+		"node-b -> node-a: can not reach pod 10.0.0.1",
+		"node-b: can not resolve rainbond-operator-sentinel.rbd-system.svc.cluster.local",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %q", want, err.Error())
+		}
+	}
+
+	pods := &corev1.PodList{}
+	if err := cli.List(ctx, pods, client.InNamespace("rbd-system"), client.MatchingLabels{"name": NetworkProbeName}); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 {
+		t.Fatalf("expected network probes to be cleaned up, got %d", len(pods.Items))
+	}
+}
+
+func TestParseNetworkProbeResult(t *testing.T) {
+	failures, mtu, err := parseNetworkProbeResult("node-a", "service 10.96.0.10\nmtu 1450\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu != "1450" || len(failures) != 1 || !strings.Contains(failures[0], "by cluster ip 10.96.0.10") {
+		t.Fatalf("unexpected result %v, mtu %s", failures, mtu)
+	}
+
+	if _, _, err := parseNetworkProbeResult("node-a", "pod node-b 10.0.1.1"); err == nil {
+		t.Fatal("expected an error for an unfinished probe")
+	}
+}
@@ -2,11 +2,11 @@ package precheck
 
 import (
 	"database/sql"
-	"fmt"
+	"time"
+
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"time"
 )
 
 type database struct {
@@ -37,8 +37,9 @@ func (d *database) Check() rainbondv1alpha1.RainbondClusterCondition {
 	return condition
 }
 
+// check connects to the database with the same data source name as the components.
 func (d *database) check(db *rainbondv1alpha1.Database) error {
-	db2, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", db.Username, db.Password, db.Host, db.Port, db.Name))
+	db2, err := sql.Open("mysql", db.DataSourceName())
 	if err != nil {
 		return err
 	}
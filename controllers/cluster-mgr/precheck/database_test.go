@@ -28,3 +28,27 @@ func TestDatabasePreChecker(t *testing.T) {
 	assert.Equal(t, corev1.ConditionFalse, condition.Status)
 	assert.Equal(t, "DatabaseFailed", condition.Reason)
 }
+
+func TestDatabaseDataSourceName(t *testing.T) {
+	db := &rainbondv1alpha1.Database{
+		Host:     "127.0.0.1",
+		Port:     3306,
+		Username: "foo",
+		Password: "bar",
+		Name:     "foobar",
+	}
+	assert.Equal(t, "foo:bar@tcp(127.0.0.1:3306)/foobar", db.DataSourceName())
+
+	db.Charset = "utf8mb4"
+	db.Timezone = "Asia/Shanghai"
+	db.Params = map[string]string{"readTimeout": "10s", "charset": "utf8"}
+	db.TLS = &rainbondv1alpha1.DatabaseTLS{Mode: rainbondv1alpha1.DatabaseTLSRequired}
+	assert.Equal(t, "foo:bar@tcp(127.0.0.1:3306)/foobar?charset=utf8&loc=Asia%2FShanghai&readTimeout=10s&tls=skip-verify",
+		db.DataSourceName())
+
+	db.Params = nil
+	db.TLS.Mode = rainbondv1alpha1.DatabaseTLSVerifyCA
+	assert.Equal(t, "--mysql=foo:bar@tcp(127.0.0.1:3306)/foobar?charset=utf8mb4&loc=Asia%2FShanghai&tls=true", db.RegionDataSource())
+	db.TLS.Mode = rainbondv1alpha1.DatabaseTLSPreferred
+	assert.Equal(t, "--mysql=foo:bar@tcp(127.0.0.1:3306)/foobar?charset=utf8mb4&loc=Asia%2FShanghai&tls=preferred", db.RegionDataSource())
+}
@@ -0,0 +1,226 @@
+package precheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// certificates expire within certExpiryWarning will be reported in the condition message.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+type etcd struct {
+	ctx     context.Context
+	log     logr.Logger
+	client  client.Client
+	cluster *rainbondv1alpha1.RainbondCluster
+}
+
+// NewEtcdPrechecker creates a new prechecker for the external etcd.
+func NewEtcdPrechecker(ctx context.Context, client client.Client, log logr.Logger, cluster *rainbondv1alpha1.RainbondCluster) PreChecker {
+	return &etcd{
+		ctx:     ctx,
+		log:     log.WithName("EtcdPreChecker"),
+		client:  client,
+		cluster: cluster,
+	}
+}
+
+type etcdMemberList struct {
+	Members []struct {
+		Name       string   `json:"name"`
+		ClientURLs []string `json:"clientURLs"`
+	} `json:"members"`
+}
+
+func (e *etcd) Check() rainbondv1alpha1.RainbondClusterCondition {
+	condition := rainbondv1alpha1.RainbondClusterCondition{
+		Type:              rainbondv1alpha1.RainbondClusterConditionTypeEtcd,
+		Status:            corev1.ConditionTrue,
+		LastHeartbeatTime: metav1.NewTime(time.Now()),
+	}
+
+	etcdConfig := e.cluster.Spec.EtcdConfig
+	if etcdConfig == nil || len(etcdConfig.Endpoints) == 0 {
+		return e.failCondition(condition, "no endpoints specified for etcd")
+	}
+
+	var msgs []string
+	var tlsConfig *tls.Config
+	if etcdConfig.SecretName != "" {
+		secret := &corev1.Secret{}
+		if err := e.client.Get(e.ctx, types.NamespacedName{Namespace: e.cluster.Namespace, Name: etcdConfig.SecretName}, secret); err != nil {
+			return e.failCondition(condition, fmt.Sprintf("get etcd secret %s: %v", etcdConfig.SecretName, err))
+		}
+		cfg, notAfter, err := etcdTLSConfig(secret)
+		if err != nil {
+			return e.failCondition(condition, fmt.Sprintf("etcd secret %s: %v", etcdConfig.SecretName, err))
+		}
+		tlsConfig = cfg
+		if time.Until(notAfter) < certExpiryWarning {
+			msgs = append(msgs, fmt.Sprintf("client certificate expires at %s", notAfter.Format(time.RFC3339)))
+		}
+	}
+
+	httpClient := &http.Client{
+		Timeout: 3 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	var badEndpoints []string
+	var members *etcdMemberList
+	for _, endpoint := range etcdConfig.Endpoints {
+		endpoint = etcdEndpointURL(endpoint, tlsConfig != nil)
+		if err := etcdHealth(e.ctx, httpClient, endpoint); err != nil {
+			badEndpoints = append(badEndpoints, fmt.Sprintf("%s: %v", endpoint, err))
+			continue
+		}
+		if members != nil {
+			continue
+		}
+		memberList, err := etcdMembers(e.ctx, httpClient, endpoint)
+		if err != nil {
+			badEndpoints = append(badEndpoints, fmt.Sprintf("%s: list members: %v", endpoint, err))
+			continue
+		}
+		members = memberList
+	}
+	if len(badEndpoints) > 0 {
+		return e.failCondition(condition, strings.Join(badEndpoints, "; "))
+	}
+
+	var names []string
+	for _, member := range members.Members {
+		names = append(names, member.Name)
+	}
+	msgs = append([]string{fmt.Sprintf("%d members: %s", len(names), strings.Join(names, ","))}, msgs...)
+	condition.Message = strings.Join(msgs, "; ")
+
+	return condition
+}
+
+func (e *etcd) failCondition(condition rainbondv1alpha1.RainbondClusterCondition, msg string) rainbondv1alpha1.RainbondClusterCondition {
+	return failConditoin(condition, "EtcdFailed", msg)
+}
+
+// etcdTLSConfig verifies the certificates in the given secret, and returns the tls config
+// and the expiration time of the client certificate.
+func etcdTLSConfig(secret *corev1.Secret) (*tls.Config, time.Time, error) {
+	for _, key := range []string{constants.EtcdCAFileKey, constants.EtcdCertFileKey, constants.EtcdKeyFileKey} {
+		if len(secret.Data[key]) == 0 {
+			return nil, time.Time{}, fmt.Errorf("%s not found", key)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(secret.Data[constants.EtcdCAFileKey]) {
+		return nil, time.Time{}, fmt.Errorf("invalid %s", constants.EtcdCAFileKey)
+	}
+	keyPair, err := tls.X509KeyPair(secret.Data[constants.EtcdCertFileKey], secret.Data[constants.EtcdKeyFileKey])
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid client certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("parse client certificate: %v", err)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, time.Time{}, fmt.Errorf("client certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, time.Time{}, fmt.Errorf("verify client certificate: %v", err)
+	}
+
+	return &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{keyPair},
+	}, cert.NotAfter, nil
+}
+
+func etcdEndpointURL(endpoint string, secure bool) string {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	if secure {
+		return "https://" + endpoint
+	}
+	return "http://" + endpoint
+}
+
+func etcdHealth(ctx context.Context, httpClient *http.Client, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/health", nil)
+	if err != nil {
+		return err
+	}
+	body, err := doEtcdRequest(httpClient, req)
+	if err != nil {
+		return err
+	}
+	var health struct {
+		Health string `json:"health"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &health); err != nil {
+		return fmt.Errorf("unexpected health response: %s", string(body))
+	}
+	if health.Health != "true" {
+		return fmt.Errorf("unhealthy: %s", health.Reason)
+	}
+	return nil
+}
+
+func etcdMembers(ctx context.Context, httpClient *http.Client, endpoint string) (*etcdMemberList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/v3/cluster/member/list", bytes.NewBufferString("{}"))
+	if err != nil {
+		return nil, err
+	}
+	body, err := doEtcdRequest(httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	var members etcdMemberList
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, fmt.Errorf("unexpected member list response: %s", string(body))
+	}
+	if len(members.Members) == 0 {
+		return nil, fmt.Errorf("no members found")
+	}
+	return &members, nil
+}
+
+func doEtcdRequest(httpClient *http.Client, req *http.Request) ([]byte, error) {
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d: %s", res.StatusCode, string(body))
+	}
+	return body, nil
+}
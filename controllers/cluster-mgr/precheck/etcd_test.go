@@ -0,0 +1,89 @@
+package precheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestEtcdPreCheckerWithTLS(t *testing.T) {
+	caPem, certPem, keyPem, err := commonutil.DomainSign([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPem)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprint(w, `{"health":"true"}`)
+		case "/v3/cluster/member/list":
+			fmt.Fprint(w, `{"members":[{"name":"etcd-0"},{"name":"etcd-1"},{"name":"etcd-2"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "rbd-etcd-secret", Namespace: "rbd-system"},
+		Data: map[string][]byte{
+			constants.EtcdCAFileKey:   caPem,
+			constants.EtcdCertFileKey: certPem,
+			constants.EtcdKeyFileKey:  keyPem,
+		},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			EtcdConfig: &rainbondv1alpha1.EtcdConfig{
+				Endpoints:  []string{strings.TrimPrefix(srv.URL, "https://")},
+				SecretName: "rbd-etcd-secret",
+			},
+		},
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+	condition := NewEtcdPrechecker(context.Background(), cli, ctrl.Log, cluster).Check()
+	if condition.Status != corev1.ConditionTrue {
+		t.Fatalf("expected etcd precheck to pass, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+	if condition.Message != "3 members: etcd-0,etcd-1,etcd-2" {
+		t.Fatalf("unexpected message %q", condition.Message)
+	}
+
+	// an invalid ca certificate in the secret fails the precheck.
+	secret.Data[constants.EtcdCAFileKey] = []byte("invalid")
+	cli = fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+	condition = NewEtcdPrechecker(context.Background(), cli, ctrl.Log, cluster).Check()
+	if condition.Status != corev1.ConditionFalse || condition.Reason != "EtcdFailed" {
+		t.Fatalf("expected etcd precheck to fail, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+}
@@ -0,0 +1,109 @@
+package precheck
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/constants"
+	"github.com/goodrain/rainbond-operator/util/repositoryutil"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	imageRepositoryLoginTimeout = 5 * time.Second
+	// reasonWaitingForRegistry means the bundled rbd-hub is not available yet.
+	reasonWaitingForRegistry = "WaitingForRegistry"
+	reasonLoginFailed        = "LoginFailed"
+)
+
+type imageRepository struct {
+	ctx     context.Context
+	log     logr.Logger
+	client  client.Client
+	scheme  *runtime.Scheme
+	cluster *rainbondv1alpha1.RainbondCluster
+}
+
+// NewImageRepositoryPrechecker creates a new image repository prechecker, which verifies the credential of the image hub
+// through the registry v2 api, then pushes the images of the offline package into it if there is one.
+func NewImageRepositoryPrechecker(ctx context.Context, client client.Client, scheme *runtime.Scheme, log logr.Logger, cluster *rainbondv1alpha1.RainbondCluster) PreChecker {
+	return &imageRepository{
+		ctx:     ctx,
+		log:     log.WithName("ImageRepositoryPreChecker"),
+		client:  client,
+		scheme:  scheme,
+		cluster: cluster,
+	}
+}
+
+func (i *imageRepository) Check() rainbondv1alpha1.RainbondClusterCondition {
+	condition := rainbondv1alpha1.RainbondClusterCondition{
+		Type:              rainbondv1alpha1.RainbondClusterConditionTypeImageRepository,
+		Status:            corev1.ConditionTrue,
+		LastHeartbeatTime: metav1.NewTime(time.Now()),
+	}
+
+	imageHub := i.cluster.Spec.ImageHub
+	if imageHub == nil {
+		return failConditoin(condition, reasonWaitingForRegistry, "waiting for the image hub to be configured")
+	}
+
+	opts, bundled := imageHubLoginOptions(i.cluster)
+	_, err := repositoryutil.Login(i.ctx, imageHub.Domain, opts)
+	if err != nil && !bundled && !errors.Is(err, repositoryutil.ErrUnauthorized) {
+		i.log.V(4).Info("login image repository", "domain", imageHub.Domain, "error", err.Error())
+		opts.Insecure = true
+		_, err = repositoryutil.Login(i.ctx, imageHub.Domain, opts)
+	}
+	if err != nil {
+		if bundled && !errors.Is(err, repositoryutil.ErrUnauthorized) {
+			return failConditoin(condition, reasonWaitingForRegistry, fmt.Sprintf("waiting for %s: %v", imageHub.Domain, err))
+		}
+		return failConditoin(condition, reasonLoginFailed, err.Error())
+	}
+
+	if i.cluster.Spec.InstallPackageConfig != nil {
+		return NewImageSeeder(i.ctx, i.client, i.scheme, i.log, i.cluster).Check()
+	}
+	condition.Message = fmt.Sprintf("logged in to %s as %q", imageHub.Domain, imageHub.Username)
+	return condition
+}
+
+// imageHubLoginOptions returns the options to access the image hub, and whether it is the bundled rbd-hub.
+func imageHubLoginOptions(cluster *rainbondv1alpha1.RainbondCluster) (repositoryutil.LoginOptions, bool) {
+	imageHub := cluster.Spec.ImageHub
+	opts := repositoryutil.LoginOptions{
+		Username: imageHub.Username,
+		Password: imageHub.Password,
+		Timeout:  imageRepositoryLoginTimeout,
+	}
+	// the bundled rbd-hub is served by the gateway with a self-signed certificate.
+	bundled := strings.Split(imageHub.Domain, ":")[0] == constants.DefImageRepository
+	if bundled {
+		opts.Insecure = true
+		if cluster.Spec.InternalDNS == nil {
+			opts.DialAddress = cluster.InnerGatewayIngressIP()
+		}
+	}
+	return opts, bundled
+}
+
+// ImageRepositoryLoggedIn returns true if the credential of the image hub has been accepted by the image repository,
+// even if the images of the offline package are not ready yet.
+func ImageRepositoryLoggedIn(condition *rainbondv1alpha1.RainbondClusterCondition) bool {
+	if condition == nil {
+		return false
+	}
+	if condition.Status == corev1.ConditionTrue {
+		return true
+	}
+	return condition.Reason != reasonWaitingForRegistry && condition.Reason != reasonLoginFailed
+}
@@ -0,0 +1,70 @@
+package precheck
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestImageRepositoryPrechecker(t *testing.T) {
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); ok && username == "admin" && password == "admin1234" {
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "https://")
+	port := host[strings.LastIndex(host, ":")+1:]
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	tests := []struct {
+		name     string
+		domain   string
+		password string
+		reason   string
+		loggedIn bool
+	}{
+		{name: "external registry", domain: host, password: "admin1234", loggedIn: true},
+		{name: "wrong password", domain: host, password: "wrong", reason: "LoginFailed"},
+		{name: "bundled rbd-hub served by the gateway", domain: "goodrain.me:" + port, password: "admin1234", loggedIn: true},
+		{name: "bundled rbd-hub not ready", domain: "goodrain.me:1", password: "admin1234", reason: "WaitingForRegistry"},
+	}
+	for _, tc := range tests {
+		cluster := &rainbondv1alpha1.RainbondCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+			Spec: rainbondv1alpha1.RainbondClusterSpec{
+				GatewayIngressIPs: []string{"127.0.0.1"},
+				ImageHub: &rainbondv1alpha1.ImageHub{
+					Domain:   tc.domain,
+					Username: "admin",
+					Password: tc.password,
+				},
+			},
+		}
+		condition := NewImageRepositoryPrechecker(context.Background(), cli, scheme, ctrl.Log, cluster).Check()
+		if condition.Type != rainbondv1alpha1.RainbondClusterConditionTypeImageRepository || condition.Reason != tc.reason {
+			t.Fatalf("%s: unexpected condition %s(%s): %s", tc.name, condition.Status, condition.Reason, condition.Message)
+		}
+		if (condition.Status == corev1.ConditionTrue) != (tc.reason == "") {
+			t.Fatalf("%s: unexpected status %s", tc.name, condition.Status)
+		}
+		if ImageRepositoryLoggedIn(&condition) != tc.loggedIn {
+			t.Fatalf("%s: expected logged in to be %v", tc.name, tc.loggedIn)
+		}
+	}
+}
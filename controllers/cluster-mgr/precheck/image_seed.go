@@ -0,0 +1,436 @@
+package precheck
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/constants"
+	"github.com/goodrain/rainbond-operator/util/k8sutil"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	"github.com/goodrain/rainbond-operator/util/repositoryutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// ImageSeedName is the name prefix of the jobs pushing the images of the offline package into rbd-hub.
+const ImageSeedName = "rbd-image-seed"
+
+const (
+	imageSeedLabelKey = "rainbond.io/image-seed"
+	// imageSeedRequiredAnnotation records the checksum of the images required when the seed job is created,
+	// the job runs again if some images are missing and the required images change.
+	imageSeedRequiredAnnotation = "rainbond.io/required-images"
+	// imageSeedScript downloads or reads the package, verifies the md5, then pushes every image of the
+	// oci image layout into the registry. The error is reported by the termination message.
+	imageSeedScript = `set -e
+fail() {
+  echo "$*" > /dev/termination-log
+  exit 1
+}
+if [ -n "$PACKAGE_URL" ]; then
+  PACKAGE=/work/package.tgz
+  curl -fsSL --retry 3 -o "$PACKAGE" "$PACKAGE_URL" 2>/work/curl || fail "download $PACKAGE_URL: $(tail -n1 /work/curl)"
+fi
+[ -f "$PACKAGE" ] || fail "package $PACKAGE not found"
+if [ -n "$PACKAGE_MD5" ]; then
+  sum=$(md5sum "$PACKAGE" | cut -d' ' -f1)
+  [ "$sum" = "$PACKAGE_MD5" ] || fail "md5 of the package is $sum, expected $PACKAGE_MD5"
+fi
+mkdir -p /work/layout
+tar -xf "$PACKAGE" -C /work/layout 2>/work/tar || fail "extract the package: $(tail -n1 /work/tar)"
+index=$(find /work/layout -maxdepth 2 -name index.json | head -n1)
+[ -n "$index" ] || fail "the package is not an oci image layout, index.json not found"
+layout=$(dirname "$index")
+refs=$(grep -o '"org.opencontainers.image.ref.name": *"[^"]*"' "$index" | sed 's/.*"\([^"]*\)"$/\1/')
+[ -n "$refs" ] || fail "no image named by org.opencontainers.image.ref.name in the package"
+i=0
+until code=$(curl -ks -o /dev/null -w '%{http_code}' "https://$REGISTRY/v2/") && { [ "$code" = 200 ] || [ "$code" = 401 ]; }; do
+  i=$((i+1))
+  [ $i -le 120 ] || fail "registry $REGISTRY is not ready, the last status is $code"
+  sleep 5
+done
+for ref in $refs; do
+  image=${ref##*/}
+  case "$image" in
+    *:*) ;;
+    *) image="$image:latest" ;;
+  esac
+  skopeo copy --retry-times 3 --dest-tls-verify=false --dest-creds "$USERNAME:$PASSWORD" \
+    "oci:$layout:$ref" "docker://$REGISTRY/$NAMESPACE/$image" >/dev/null 2>/work/skopeo || fail "push $ref: $(tail -n1 /work/skopeo)"
+done`
+)
+
+type imageSeeder struct {
+	ctx     context.Context
+	log     logr.Logger
+	client  client.Client
+	scheme  *runtime.Scheme
+	cluster *rainbondv1alpha1.RainbondCluster
+	// manifestExists returns true if the image, without the image repository, is present in the image hub.
+	manifestExists func(image string) (bool, error)
+}
+
+// NewImageSeeder creates a new image repository prechecker, which pushes the images of the offline package into rbd-hub,
+// and passes once the images of all the components are present.
+func NewImageSeeder(ctx context.Context, client client.Client, scheme *runtime.Scheme, log logr.Logger, cluster *rainbondv1alpha1.RainbondCluster) PreChecker {
+	s := &imageSeeder{
+		ctx:     ctx,
+		log:     log.WithName("ImageSeeder"),
+		client:  client,
+		scheme:  scheme,
+		cluster: cluster,
+	}
+	s.manifestExists = s.imageHubManifestExists
+	return s
+}
+
+func (s *imageSeeder) Check() rainbondv1alpha1.RainbondClusterCondition {
+	condition := rainbondv1alpha1.RainbondClusterCondition{
+		Type:              rainbondv1alpha1.RainbondClusterConditionTypeImageRepository,
+		Status:            corev1.ConditionTrue,
+		LastHeartbeatTime: metav1.NewTime(time.Now()),
+	}
+
+	pkg := s.cluster.Spec.InstallPackageConfig
+	if pkg == nil {
+		return condition
+	}
+	if pkg.URL == "" && pkg.PersistentVolumeClaim == "" {
+		return s.failConditoin(condition, "installPackageConfig requires url or persistentVolumeClaim")
+	}
+	if s.cluster.Spec.ImageHub == nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "InProgress"
+		condition.Message = "waiting for the image hub to be configured"
+		return condition
+	}
+
+	required, err := s.requiredImages()
+	if err != nil {
+		return s.failConditoin(condition, fmt.Sprintf("list rbdcomponents: %v", err))
+	}
+	name := imageSeedJobName(s.cluster)
+	if err := s.cleanup(name); err != nil {
+		s.log.V(4).Info("clean up image seed jobs", "error", err.Error())
+	}
+
+	job := &batchv1.Job{}
+	if err := s.client.Get(s.ctx, types.NamespacedName{Namespace: s.cluster.Namespace, Name: name}, job); err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return s.failConditoin(condition, fmt.Sprintf("get job %s: %v", name, err))
+		}
+		if err := s.createJob(name, required); err != nil {
+			return s.failConditoin(condition, err.Error())
+		}
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "InProgress"
+		condition.Message = fmt.Sprintf("job %s created to push the images of the offline package", name)
+		return condition
+	}
+
+	pods, err := s.listJobPods(name)
+	if err != nil {
+		return s.failConditoin(condition, fmt.Sprintf("list pods of job %s: %v", name, err))
+	}
+	switch {
+	case job.Status.Succeeded > 0:
+		missing, err := s.missingImages(required)
+		if err != nil {
+			return s.failConditoin(condition, fmt.Sprintf("check the images in %s: %v", rbdutil.GetImageRepository(s.cluster), err))
+		}
+		if len(missing) == 0 {
+			condition.Message = fmt.Sprintf("%d images present in %s", len(required), rbdutil.GetImageRepository(s.cluster))
+			return condition
+		}
+		// the components may be changed to the images of the package after the job.
+		if job.Annotations[imageSeedRequiredAnnotation] != imagesChecksum(required) {
+			if err := s.deleteJob(job); err != nil {
+				return s.failConditoin(condition, fmt.Sprintf("delete job %s: %v", name, err))
+			}
+			condition.Status = corev1.ConditionFalse
+			condition.Reason = "InProgress"
+			condition.Message = fmt.Sprintf("the required images are changed, job %s will push the offline package again", name)
+			return condition
+		}
+		return failConditoin(condition, "ImagesMissing", fmt.Sprintf("images not found in %s: %s, delete job %s to push the offline package again",
+			rbdutil.GetImageRepository(s.cluster), strings.Join(missing, ", "), name))
+	case isJobFailed(job):
+		msg := fmt.Sprintf("job %s failed", name)
+		for i := range pods {
+			if pods[i].Status.Phase == corev1.PodFailed {
+				if m := terminationMessage(&pods[i]); m != "" {
+					msg = fmt.Sprintf("%s: %s", msg, m)
+				}
+				break
+			}
+		}
+		return s.failConditoin(condition, msg)
+	}
+
+	condition.Status = corev1.ConditionFalse
+	condition.Reason = "InProgress"
+	condition.Message = fmt.Sprintf("job %s is pushing the images of the offline package", name)
+	for i := range pods {
+		if pods[i].Status.Phase == corev1.PodPending {
+			condition.Message = fmt.Sprintf("%s, pod %s is pending: %s", condition.Message, pods[i].Name, podPendingMessage(&pods[i]))
+			break
+		}
+	}
+	return condition
+}
+
+// requiredImages returns the images of the components pulled from rbd-hub, without the image repository.
+func (s *imageSeeder) requiredImages() ([]string, error) {
+	cptList := &rainbondv1alpha1.RbdComponentList{}
+	if err := s.client.List(s.ctx, cptList, client.InNamespace(s.cluster.Namespace)); err != nil {
+		return nil, err
+	}
+	prefix := rbdutil.GetImageRepository(s.cluster) + "/"
+	var images []string
+	for _, cpt := range cptList.Items {
+		if !strings.HasPrefix(cpt.Spec.Image, prefix) {
+			continue
+		}
+		images = append(images, normalizeImageTag(strings.TrimPrefix(cpt.Spec.Image, prefix)))
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// missingImages returns the required images which are not present in the image hub.
+func (s *imageSeeder) missingImages(required []string) ([]string, error) {
+	var missing []string
+	for _, image := range required {
+		exists, err := s.manifestExists(image)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, image)
+		}
+	}
+	return missing, nil
+}
+
+func (s *imageSeeder) imageHubManifestExists(image string) (bool, error) {
+	opts, _ := imageHubLoginOptions(s.cluster)
+	// the seed job pushes without verifying the certificate either.
+	opts.Insecure = true
+	return repositoryutil.ManifestExists(s.ctx, s.cluster.Spec.ImageHub.Domain, s.cluster.Spec.ImageHub.Namespace+"/"+image, opts)
+}
+
+func (s *imageSeeder) createJob(name string, required []string) error {
+	pkg := s.cluster.Spec.InstallPackageConfig
+	imageHub := s.cluster.Spec.ImageHub
+	labels := rbdutil.LabelsForRainbond(map[string]string{
+		"name":            ImageSeedName,
+		imageSeedLabelKey: name,
+	})
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: s.cluster.Namespace,
+			Labels:    labels,
+		},
+		StringData: map[string]string{
+			"username": imageHub.Username,
+			"password": imageHub.Password,
+		},
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "PACKAGE_URL", Value: pkg.URL},
+		{Name: "PACKAGE_MD5", Value: pkg.MD5},
+		{Name: "REGISTRY", Value: imageHub.Domain},
+		{Name: "NAMESPACE", Value: imageHub.Namespace},
+		{Name: "USERNAME", ValueFrom: secretKeyRef(name, "username")},
+		{Name: "PASSWORD", ValueFrom: secretKeyRef(name, "password")},
+	}
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "work",
+			MountPath: "/work",
+		},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "work",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+	}
+	if pkg.URL == "" {
+		env = append(env, corev1.EnvVar{Name: "PACKAGE", Value: "/package/" + strings.TrimPrefix(pkg.Path, "/")})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "package",
+			MountPath: "/package",
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, corev1.Volume{
+			Name: "package",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: pkg.PersistentVolumeClaim,
+					ReadOnly:  true,
+				},
+			},
+		})
+	}
+
+	// the bundled rbd-hub is served by the gateway.
+	var hostAliases []corev1.HostAlias
+	if ip := s.cluster.InnerGatewayIngressIP(); ip != "" && s.cluster.Spec.InternalDNS == nil && strings.Split(imageHub.Domain, ":")[0] == constants.DefImageRepository {
+		hostAliases = append(hostAliases, corev1.HostAlias{
+			IP:        ip,
+			Hostnames: []string{constants.DefImageRepository},
+		})
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: s.cluster.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				imageSeedRequiredAnnotation: imagesChecksum(required),
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: commonutil.Int32(2),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					HostAliases:   hostAliases,
+					Containers: []corev1.Container{
+						{
+							Name:            ImageSeedName,
+							Image:           rbdutil.GetenvDefault("RAINBOND_IMAGE_REPOSITORY", s.cluster.ImageRepository()) + "/skopeo:v1.16.1",
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Command:         []string{"/bin/sh", "-c", imageSeedScript},
+							Env:             env,
+							VolumeMounts:    volumeMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+
+	for _, obj := range []client.Object{secret, job} {
+		if s.cluster.GetUID() != "" {
+			if err := controllerutil.SetControllerReference(s.cluster, obj, s.scheme); err != nil {
+				return err
+			}
+		}
+		if err := k8sutil.CreateIfNotExists(s.ctx, s.client, obj); err != nil {
+			return fmt.Errorf("create %s: %v", obj.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// cleanup deletes the seed jobs of the previous package or image hub, and their secrets.
+func (s *imageSeeder) cleanup(current string) error {
+	jobList := &batchv1.JobList{}
+	if err := s.client.List(s.ctx, jobList, client.InNamespace(s.cluster.Namespace), client.MatchingLabels{
+		"name": ImageSeedName,
+	}); err != nil {
+		return err
+	}
+	for i := range jobList.Items {
+		job := &jobList.Items[i]
+		if job.Name == current {
+			continue
+		}
+		if err := s.deleteJob(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteJob deletes the seed job and its secret.
+func (s *imageSeeder) deleteJob(job *batchv1.Job) error {
+	if err := s.client.Delete(s.ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !k8sErrors.IsNotFound(err) {
+		return err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name,
+			Namespace: job.Namespace,
+		},
+	}
+	if err := s.client.Delete(s.ctx, secret); err != nil && !k8sErrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *imageSeeder) listJobPods(name string) ([]corev1.Pod, error) {
+	podList := &corev1.PodList{}
+	if err := s.client.List(s.ctx, podList, client.InNamespace(s.cluster.Namespace), client.MatchingLabels{
+		imageSeedLabelKey: name,
+	}); err != nil {
+		return nil, err
+	}
+	return podList.Items, nil
+}
+
+func (s *imageSeeder) failConditoin(condition rainbondv1alpha1.RainbondClusterCondition, msg string) rainbondv1alpha1.RainbondClusterCondition {
+	return failConditoin(condition, "SeedFailed", msg)
+}
+
+// imageSeedJobName returns an unique name for the package and the destination, so that a new job runs once they change.
+func imageSeedJobName(cluster *rainbondv1alpha1.RainbondCluster) string {
+	pkg := cluster.Spec.InstallPackageConfig
+	key := strings.Join([]string{pkg.URL, pkg.MD5, pkg.PersistentVolumeClaim, pkg.Path, rbdutil.GetImageRepository(cluster)}, "\n")
+	return fmt.Sprintf("%s-%x", ImageSeedName, sha256.Sum256([]byte(key)))[:len(ImageSeedName)+11]
+}
+
+func isJobFailed(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func imagesChecksum(images []string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(images, "\n"))))
+}
+
+func normalizeImageTag(image string) string {
+	if strings.Contains(image, "@") || strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+		return image
+	}
+	return image + ":latest"
+}
+
+func secretKeyRef(name, key string) *corev1.EnvVarSource {
+	return &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		},
+	}
+}
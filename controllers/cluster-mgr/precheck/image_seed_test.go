@@ -0,0 +1,194 @@
+package precheck
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestImageSeeder(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = batchv1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "rainbondcluster",
+			Namespace: "rbd-system",
+		},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			RainbondImageRepository: "registry.example.com/rainbond",
+			NodesForGateway:         []*rainbondv1alpha1.K8sNode{{Name: "gateway-1", InternalIP: "10.0.0.10"}},
+			ImageHub: &rainbondv1alpha1.ImageHub{
+				Domain:    "goodrain.me",
+				Namespace: "rainbond",
+				Username:  "admin",
+				Password:  "secret",
+			},
+			InstallPackageConfig: &rainbondv1alpha1.InstallPackageConfig{
+				PersistentVolumeClaim: "offline",
+				Path:                  "/rainbond.tgz",
+				MD5:                   "d41d8cd98f00b204e9800998ecf8427e",
+			},
+		},
+	}
+	component := func(name, image string) *rainbondv1alpha1.RbdComponent {
+		return &rainbondv1alpha1.RbdComponent{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "rbd-system"},
+			Spec:       rainbondv1alpha1.RbdComponentSpec{Image: image},
+		}
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		component("rbd-api", "goodrain.me/rainbond/rbd-api:v6.0.0"),
+		component("rbd-worker", "goodrain.me/rainbond/rbd-worker:v6.0.0"),
+		component("rbd-hub", "registry.example.com/rainbond/registry:2.6.2"),
+	).Build()
+	ctx := context.Background()
+
+	condition := NewImageSeeder(ctx, cli, scheme, ctrl.Log, cluster).Check()
+	if condition.Type != rainbondv1alpha1.RainbondClusterConditionTypeImageRepository ||
+		condition.Status != corev1.ConditionFalse || condition.Reason != "InProgress" {
+		t.Fatalf("expected image seed in progress, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+
+	name := imageSeedJobName(cluster)
+	job := &batchv1.Job{}
+	if err := cli.Get(ctx, types.NamespacedName{Namespace: "rbd-system", Name: name}, job); err != nil {
+		t.Fatal(err)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	env := make(map[string]string)
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	if env["PACKAGE"] != "/package/rainbond.tgz" || env["REGISTRY"] != "goodrain.me" || env["NAMESPACE"] != "rainbond" {
+		t.Fatalf("unexpected env of the seed job: %v", env)
+	}
+	if container.Image != "registry.example.com/rainbond/skopeo:v1.16.1" {
+		t.Fatalf("unexpected image of the seed job: %s", container.Image)
+	}
+	if aliases := job.Spec.Template.Spec.HostAliases; len(aliases) != 1 || aliases[0].IP != "10.0.0.10" || aliases[0].Hostnames[0] != "goodrain.me" {
+		t.Fatalf("expected goodrain.me to be resolved to the gateway, got %v", aliases)
+	}
+	if err := cli.Get(ctx, types.NamespacedName{Namespace: "rbd-system", Name: name}, &corev1.Secret{}); err != nil {
+		t.Fatalf("expected the credential secret of the seed job: %v", err)
+	}
+
+	present := map[string]bool{"rbd-api:v6.0.0": true}
+	check := func() rainbondv1alpha1.RainbondClusterCondition {
+		seeder := NewImageSeeder(ctx, cli, scheme, ctrl.Log, cluster).(*imageSeeder)
+		seeder.manifestExists = func(image string) (bool, error) {
+			return present[image], nil
+		}
+		return seeder.Check()
+	}
+	succeed := func() {
+		job := &batchv1.Job{}
+		if err := cli.Get(ctx, types.NamespacedName{Namespace: "rbd-system", Name: name}, job); err != nil {
+			t.Fatal(err)
+		}
+		job.Status.Succeeded = 1
+		if err := cli.Update(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	succeed()
+	condition = check()
+	if condition.Status != corev1.ConditionFalse || condition.Reason != "ImagesMissing" ||
+		!strings.Contains(condition.Message, "rbd-worker:v6.0.0") || strings.Contains(condition.Message, "rbd-api") {
+		t.Fatalf("expected rbd-worker to be missing, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+
+	// the job runs again once the required images change.
+	if err := cli.Create(ctx, component("rbd-chaos", "goodrain.me/rainbond/rbd-chaos:v6.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	condition = check()
+	if condition.Reason != "InProgress" {
+		t.Fatalf("expected the seed job to run again, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+	if err := cli.Get(ctx, types.NamespacedName{Namespace: "rbd-system", Name: name}, &batchv1.Job{}); err == nil {
+		t.Fatal("expected the previous seed job to be deleted")
+	}
+	condition = check()
+	if condition.Reason != "InProgress" || !strings.Contains(condition.Message, "created") {
+		t.Fatalf("expected a new seed job, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+
+	succeed()
+	present["rbd-worker:v6.0.0"], present["rbd-chaos:v6.0.0"] = true, true
+	condition = check()
+	if condition.Status != corev1.ConditionTrue {
+		t.Fatalf("expected image seed passed, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+
+	// a new package replaces the previous job.
+	cluster.Spec.InstallPackageConfig = &rainbondv1alpha1.InstallPackageConfig{URL: "http://example.com/rainbond.tgz"}
+	condition = check()
+	if condition.Reason != "InProgress" {
+		t.Fatalf("expected a new image seed in progress, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+	jobs := &batchv1.JobList{}
+	if err := cli.List(ctx, jobs, client.InNamespace("rbd-system")); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 1 || jobs.Items[0].Name == name {
+		t.Fatalf("expected the previous seed job to be replaced, got %d jobs", len(jobs.Items))
+	}
+}
+
+func TestImageSeederFailed(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = batchv1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			ImageHub:             &rainbondv1alpha1.ImageHub{Domain: "goodrain.me"},
+			InstallPackageConfig: &rainbondv1alpha1.InstallPackageConfig{URL: "http://example.com/rainbond.tgz", MD5: "0"},
+		},
+	}
+	name := imageSeedJobName(cluster)
+	labels := map[string]string{"name": ImageSeedName, imageSeedLabelKey: name}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "rbd-system", Labels: labels},
+			Status: batchv1.JobStatus{
+				Conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name + "-abcde", Namespace: "rbd-system", Labels: labels},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodFailed,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{
+						State: corev1.ContainerState{
+							Terminated: &corev1.ContainerStateTerminated{Message: "md5 of the package is 1, expected 0"},
+						},
+					},
+				},
+			},
+		},
+	).Build()
+
+	condition := NewImageSeeder(context.Background(), cli, scheme, ctrl.Log, cluster).Check()
+	if condition.Status != corev1.ConditionFalse || condition.Reason != "SeedFailed" ||
+		!strings.Contains(condition.Message, "md5 of the package") {
+		t.Fatalf("expected image seed failed, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+}
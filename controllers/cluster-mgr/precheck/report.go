@@ -0,0 +1,166 @@
+package precheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// inProgressReasons are the reasons of prechecks that have not finished yet.
+var inProgressReasons = map[string]bool{
+	"InProgress":         true,
+	"SentinelNotReady":   true,
+	"WaitingForRegistry": true,
+}
+
+// remediationHints holds the hints to fix the failed prechecks, indexed by condition type.
+var remediationHints = map[rainbondv1alpha1.RainbondClusterConditionType]string{
+	rainbondv1alpha1.RainbondClusterConditionTypeDatabaseRegion:    "check the host, port, username and password of regionDatabase, and make sure the database is reachable",
+	rainbondv1alpha1.RainbondClusterConditionTypeDatabaseConsole:   "check the host, port, username and password of uiDatabase, and make sure the database is reachable",
+	rainbondv1alpha1.RainbondClusterConditionTypeKubernetesVersion: "upgrade kubernetes to 1.13.0 or later",
+	rainbondv1alpha1.RainbondClusterConditionTypeMemory:            "add nodes or memory, at least 2GB allocatable memory is required on the schedulable worker nodes",
+	rainbondv1alpha1.RainbondClusterConditionTypeStorage:           "check the provisioner of the storage class, the pvc events and the probe pods; rwx storage must be shared across nodes",
+	rainbondv1alpha1.RainbondClusterConditionTypeDNS:               "make sure the domain of rainbondImageRepository can be resolved, or use the Offline install mode",
+	rainbondv1alpha1.RainbondClusterConditionTypeContainerNetwork:  "check the cni plugin, kube-proxy and coredns for the failed nodes; the sentinel pods must be reachable from where the precheck runs",
+	rainbondv1alpha1.RainbondClusterConditionTypeEtcd:              "check the etcd endpoints and the ca-file, cert-file and key-file in the etcd secret",
+	rainbondv1alpha1.RainbondClusterConditionTypeImageRepository:   "check the domain, username and password of imageHub, and make sure rbd-hub is running; for the offline package, check the url or the pvc and md5 of installPackageConfig and the logs of the rbd-image-seed job",
+}
+
+// Result is the result of a precheck.
+type Result struct {
+	Type    rainbondv1alpha1.RainbondClusterConditionType `json:"type"`
+	Passed  bool                                          `json:"passed"`
+	Reason  string                                        `json:"reason,omitempty"`
+	Message string                                        `json:"message,omitempty"`
+	Hint    string                                        `json:"hint,omitempty"`
+}
+
+// Report is the result of all prechecks.
+type Report struct {
+	Passed  bool      `json:"passed"`
+	Results []*Result `json:"results"`
+}
+
+// NewReport creates a report based on the conditions of prechecks.
+func NewReport(conditions []rainbondv1alpha1.RainbondClusterCondition) *Report {
+	report := &Report{Passed: true}
+	for _, condition := range conditions {
+		result := &Result{
+			Type:    condition.Type,
+			Passed:  condition.Status == corev1.ConditionTrue,
+			Reason:  condition.Reason,
+			Message: condition.Message,
+		}
+		if !result.Passed {
+			report.Passed = false
+			result.Hint = remediationHints[condition.Type]
+			if inProgressReasons[condition.Reason] {
+				result.Hint = "the precheck did not finish in time, try again with a longer timeout"
+			}
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+// IsInProgress returns true if the precheck has not finished yet.
+func IsInProgress(condition rainbondv1alpha1.RainbondClusterCondition) bool {
+	return condition.Status != corev1.ConditionTrue && inProgressReasons[condition.Reason]
+}
+
+// Print prints the report in a human-readable format.
+func (r *Report) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRECHECK\tRESULT\tMESSAGE")
+	for _, result := range r.Results {
+		res := "PASS"
+		if !result.Passed {
+			res = "FAIL"
+		}
+		msg := result.Message
+		if result.Reason != "" {
+			msg = strings.TrimSpace(fmt.Sprintf("%s %s", result.Reason, msg))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Type, res, msg)
+		if result.Hint != "" {
+			fmt.Fprintf(tw, "\t\thint: %s\n", result.Hint)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if r.Passed {
+		_, err := fmt.Fprintln(w, "\nall prechecks passed")
+		return err
+	}
+	_, err := fmt.Fprintln(w, "\nsome prechecks failed")
+	return err
+}
+
+// Cleanup removes the sentinel daemonset, the network probes and the storage probes created by the prechecks
+// of a draft rainbondcluster. The objects of an installed rainbondcluster are owned by it, and are kept.
+func Cleanup(ctx context.Context, cli client.Client, namespace string) error {
+	for _, obj := range []client.Object{&appsv1.DaemonSet{}, &corev1.Service{}} {
+		if err := cli.Get(ctx, types.NamespacedName{Namespace: namespace, Name: SentinelName}, obj); err != nil {
+			if k8sErrors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("get %s: %v", SentinelName, err)
+		}
+		if err := deleteIfDraft(ctx, cli, obj); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{NetworkProbeName, StorageProbeName} {
+		podList := &corev1.PodList{}
+		labels := rbdutil.LabelsForRainbond(map[string]string{
+			"name": name,
+		})
+		if err := cli.List(ctx, podList, client.InNamespace(namespace), client.MatchingLabels(labels)); err != nil {
+			return err
+		}
+		for i := range podList.Items {
+			if err := deleteIfDraft(ctx, cli, &podList.Items[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	labels := rbdutil.LabelsForRainbond(map[string]string{
+		"name": StorageProbeName,
+	})
+	pvcList := &corev1.PersistentVolumeClaimList{}
+	if err := cli.List(ctx, pvcList, client.InNamespace(namespace), client.MatchingLabels(labels)); err != nil {
+		return err
+	}
+	for i := range pvcList.Items {
+		if err := deleteIfDraft(ctx, cli, &pvcList.Items[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteIfDraft deletes the object if it is not owned by a rainbondcluster, which means it was created for a draft.
+func deleteIfDraft(ctx context.Context, cli client.Client, obj client.Object) error {
+	if metav1.GetControllerOf(obj) != nil {
+		return nil
+	}
+	if err := cli.Delete(ctx, obj); err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("delete %s: %v", obj.GetName(), err)
+	}
+	return nil
+}
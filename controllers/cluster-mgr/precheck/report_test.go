@@ -0,0 +1,92 @@
+package precheck
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNewReport(t *testing.T) {
+	report := NewReport([]rainbondv1alpha1.RainbondClusterCondition{
+		{Type: rainbondv1alpha1.RainbondClusterConditionTypeMemory, Status: corev1.ConditionTrue},
+		{Type: rainbondv1alpha1.RainbondClusterConditionTypeEtcd, Status: corev1.ConditionFalse, Reason: "EtcdFailed", Message: "connection refused"},
+		{Type: rainbondv1alpha1.RainbondClusterConditionTypeStorage, Status: corev1.ConditionFalse, Reason: "InProgress"},
+	})
+	if report.Passed {
+		t.Fatal("expected the report to fail")
+	}
+	if report.Results[0].Hint != "" {
+		t.Fatalf("expected no hint for a passed precheck, got %q", report.Results[0].Hint)
+	}
+	if report.Results[1].Hint != remediationHints[rainbondv1alpha1.RainbondClusterConditionTypeEtcd] {
+		t.Fatalf("unexpected hint %q", report.Results[1].Hint)
+	}
+	if !strings.Contains(report.Results[2].Hint, "timeout") {
+		t.Fatalf("expected a timeout hint for an unfinished precheck, got %q", report.Results[2].Hint)
+	}
+
+	var out bytes.Buffer
+	if err := report.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "EtcdFailed connection refused") || !strings.Contains(out.String(), "some prechecks failed") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = appsv1.AddToScheme(scheme)
+
+	labels := rbdutil.LabelsForRainbond(map[string]string{"name": StorageProbeName})
+	objs := []client.Object{
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: SentinelName, Namespace: "rbd-system"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: StorageProbeName + "-rwx-0", Namespace: "rbd-system", Labels: labels}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: StorageProbeName + "-rwx", Namespace: "rbd-system", Labels: labels}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: NetworkProbeName + "-0", Namespace: "rbd-system",
+			Labels: rbdutil.LabelsForRainbond(map[string]string{"name": NetworkProbeName})}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: SentinelName, Namespace: "rbd-system"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "rbd-api", Namespace: "rbd-system"}},
+		// created by the operator for the installed rainbondcluster.
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: NetworkProbeName + "-1", Namespace: "rbd-system",
+			Labels: rbdutil.LabelsForRainbond(map[string]string{"name": NetworkProbeName}),
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "rainbond.io/v1alpha1", Kind: "RainbondCluster", Name: "rainbondcluster",
+				UID: "uid", Controller: commonutil.Bool(true)}}}},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+
+	if err := Cleanup(context.Background(), cli, "rbd-system"); err != nil {
+		t.Fatal(err)
+	}
+
+	pods := &corev1.PodList{}
+	if err := cli.List(context.Background(), pods, client.InNamespace("rbd-system")); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 2 || pods.Items[0].Name != NetworkProbeName+"-1" || pods.Items[1].Name != "rbd-api" {
+		t.Fatalf("expected only rbd-api and the probe of the operator to be left, got %v", pods.Items)
+	}
+	if err := cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: SentinelName}, &appsv1.DaemonSet{}); !k8sErrors.IsNotFound(err) {
+		t.Fatalf("expected the sentinel daemonset to be deleted, got %v", err)
+	}
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := cli.List(context.Background(), pvcs, client.InNamespace("rbd-system")); err != nil {
+		t.Fatal(err)
+	}
+	if len(pvcs.Items) != 0 {
+		t.Fatalf("expected the probe pvc to be deleted, got %v", pvcs.Items)
+	}
+}
@@ -2,31 +2,89 @@ package precheck
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-logr/logr"
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
 	"github.com/goodrain/rainbond-operator/util/k8sutil"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
+// StorageProbeName is the name prefix of the pvcs and pods created by the storage precheck.
+const StorageProbeName = "rainbond-storage-probe"
+
+const (
+	storageProbeLabelKey = "rainbond.io/storage-probe"
+	storageProbeTimeout  = 5 * time.Minute
+	// storageProbeScript writes a marker file, waits for the marker of its peer if there is one,
+	// then measures the write throughput with dd. The result is reported by the termination message.
+	storageProbeScript = `set -e
+echo "$POD_NAME" > "/data/$POD_NAME"
+if [ -n "$PEER" ]; then
+  i=0
+  until [ "$(cat "/data/$PEER" 2>/dev/null)" = "$PEER" ]; do
+    i=$((i+1))
+    if [ $i -gt 120 ]; then
+      echo "timed out waiting for the write from $PEER" > /dev/termination-log
+      exit 1
+    fi
+    sleep 1
+  done
+fi
+if ! dd if=/dev/zero of="/data/$POD_NAME.dat" bs=1M count=64 conv=fsync 2>/tmp/dd; then
+  tail -n1 /tmp/dd > /dev/termination-log
+  exit 1
+fi
+tail -n1 /tmp/dd > /dev/termination-log
+rm -f "/data/$POD_NAME.dat"`
+)
+
+// ErrStorageProbeInProgress means the storage probe has not finished yet.
+var ErrStorageProbeInProgress = errors.New("storage probe in progress")
+
+var ddResultRegexp = regexp.MustCompile(`^(\d+) bytes .*copied, ([0-9.]+) s`)
+
+type storageProbe struct {
+	name             string
+	accessMode       corev1.PersistentVolumeAccessMode
+	storageClassName string
+}
+
+func (p *storageProbe) String() string {
+	return fmt.Sprintf("%s(%s)", p.storageClassName, p.accessMode)
+}
+
 type storage struct {
-	ctx    context.Context
-	client client.Client
-	ns     string
-	rwx    *rainbondv1alpha1.RainbondVolumeSpec
+	ctx     context.Context
+	log     logr.Logger
+	client  client.Client
+	scheme  *runtime.Scheme
+	cluster *rainbondv1alpha1.RainbondCluster
 }
 
-// NewStorage -
-func NewStorage(ctx context.Context, client client.Client, ns string, rwx *rainbondv1alpha1.RainbondVolumeSpec) PreChecker {
+// NewStorage creates a new storage prechecker, which verifies the rwo and rwx storage classes with real read/write tests.
+func NewStorage(ctx context.Context, client client.Client, scheme *runtime.Scheme, log logr.Logger, cluster *rainbondv1alpha1.RainbondCluster) PreChecker {
 	return &storage{
-		ctx:    ctx,
-		client: client,
-		ns:     ns,
-		rwx:    rwx,
+		ctx:     ctx,
+		log:     log.WithName("StoragePreChecker"),
+		client:  client,
+		scheme:  scheme,
+		cluster: cluster,
 	}
 }
 
@@ -37,52 +95,397 @@ func (s *storage) Check() rainbondv1alpha1.RainbondClusterCondition {
 		LastHeartbeatTime: metav1.NewTime(time.Now()),
 	}
 
-	if s.rwx != nil && s.rwx.StorageClassName != "" {
-		if s.rwx.StorageClassName != "" {
-			// check if pvc exists
-			pvc, err := k8sutil.GetFoobarPVC(s.ctx, s.client, s.ns)
-			if err != nil {
-				return s.failConditoin(condition, err.Error())
-			}
+	if s.cluster.Spec.RainbondVolumeSpecRWX == nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "InProgress"
+		condition.Message =
+			fmt.Sprintf("precheck for %s is in progress", rainbondv1alpha1.RainbondClusterConditionTypeStorage)
+		return condition
+	}
 
-			if !s.isPVCBound(pvc) {
-				// list Events
-				eventList, err := k8sutil.EventsForPersistentVolumeClaim(pvc)
-				if err != nil {
-					return s.failConditoin(condition, err.Error())
-				}
-				return s.failConditoin(condition, eventListToString(eventList))
+	probes, skipped, err := s.probes()
+	if err != nil {
+		return s.failConditoin(condition, err.Error())
+	}
+
+	results := skipped
+	var pending, failures []string
+	for _, probe := range probes {
+		result, err := s.runProbe(probe)
+		if err != nil {
+			if err == ErrStorageProbeInProgress {
+				pending = append(pending, fmt.Sprintf("%s: %s", probe, result))
+				continue
 			}
+			failures = append(failures, fmt.Sprintf("%s: %v", probe, err))
+			continue
 		}
-		return condition
+		results = append(results, fmt.Sprintf("%s: %s", probe, result))
 	}
 
-	if s.rwx == nil {
+	if len(failures) == 0 && len(pending) > 0 {
 		condition.Status = corev1.ConditionFalse
 		condition.Reason = "InProgress"
-		condition.Message =
-			fmt.Sprintf("precheck for %s is in progress", rainbondv1alpha1.RainbondClusterConditionTypeStorage)
+		condition.Message = strings.Join(append(results, pending...), "; ")
 		return condition
 	}
 
+	// every probe has finished, the probe resources are no longer needed.
+	for _, probe := range probes {
+		if err := s.cleanup(probe); err != nil {
+			s.log.V(4).Info("clean up storage probe", "probe", probe.name, "error", err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return s.failConditoin(condition, strings.Join(append(failures, results...), "; "))
+	}
+	condition.Message = strings.Join(results, "; ")
 	return condition
 }
 
-func (s *storage) isPVCBound(pvc *corev1.PersistentVolumeClaim) bool {
-	if pvc.Status.Phase == corev1.ClaimBound {
-		return true
+// probes returns the storage classes to be verified. The rwo class is the one used by the rainbond components,
+// it may be provisioned by the operator later, so it is skipped if it does not exist yet.
+func (s *storage) probes() ([]*storageProbe, []string, error) {
+	var probes []*storageProbe
+	var skipped []string
+	if rwx := s.cluster.Spec.RainbondVolumeSpecRWX; rwx.StorageClassName != "" {
+		probes = append(probes, &storageProbe{
+			name:             StorageProbeName + "-rwx",
+			accessMode:       corev1.ReadWriteMany,
+			storageClassName: rwx.StorageClassName,
+		})
+	}
+
+	rwo := &storageProbe{
+		name:             StorageProbeName + "-rwo",
+		accessMode:       corev1.ReadWriteOnce,
+		storageClassName: rbdutil.LocalPathStorageClassName(),
 	}
-	return false
+	if s.cluster.Spec.RainbondVolumeSpecRWO != nil && s.cluster.Spec.RainbondVolumeSpecRWO.StorageClassName != "" {
+		rwo.storageClassName = s.cluster.Spec.RainbondVolumeSpecRWO.StorageClassName
+	}
+	exists, err := s.storageClassExists(rwo.storageClassName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exists {
+		probes = append(probes, rwo)
+	} else {
+		skipped = append(skipped, fmt.Sprintf("%s: skipped, storage class not found", rwo))
+	}
+
+	return probes, skipped, nil
+}
+
+func (s *storage) storageClassExists(name string) (bool, error) {
+	storageClassList := &storagev1.StorageClassList{}
+	if err := s.client.List(s.ctx, storageClassList); err != nil {
+		return false, fmt.Errorf("list storage classes: %v", err)
+	}
+	for _, sc := range storageClassList.Items {
+		if sc.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// runProbe creates the probe pvc and pods if they do not exist, and returns the result once all pods have finished.
+func (s *storage) runProbe(probe *storageProbe) (string, error) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := s.client.Get(s.ctx, types.NamespacedName{Namespace: s.cluster.Namespace, Name: probe.name}, pvc); err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return "", err
+		}
+		if err := s.createProbe(probe); err != nil {
+			return "", err
+		}
+		return "probe created", ErrStorageProbeInProgress
+	}
+	if pvc.DeletionTimestamp != nil {
+		return "waiting for the previous probe to be cleaned up", ErrStorageProbeInProgress
+	}
+
+	pods, err := s.listProbePods(probe)
+	if err != nil {
+		return "", err
+	}
+	if len(pods) != probe.replicas() {
+		if err := s.createProbe(probe); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("expected %d probe pods, but got %d", probe.replicas(), len(pods)), ErrStorageProbeInProgress
+	}
+
+	var throughput string
+	for i := range pods {
+		pod := &pods[i]
+		switch pod.Status.Phase {
+		case corev1.PodFailed:
+			return "", fmt.Errorf("pod %s on node %s failed: %s", pod.Name, pod.Spec.NodeName, terminationMessage(pod))
+		case corev1.PodSucceeded:
+			if pod.Labels["role"] != "writer" {
+				continue
+			}
+			mbps, err := parseDDResult(terminationMessage(pod))
+			if err != nil {
+				return "", fmt.Errorf("pod %s: %v", pod.Name, err)
+			}
+			throughput = fmt.Sprintf("write %.1f MB/s", mbps)
+		default:
+			if time.Since(pvc.CreationTimestamp.Time) > storageProbeTimeout {
+				return "", fmt.Errorf("pvc %s is %s, pod %s is %s after %s: %s", pvc.Name, pvc.Status.Phase,
+					pod.Name, pod.Status.Phase, storageProbeTimeout, podPendingMessage(pod))
+			}
+			return fmt.Sprintf("pvc %s, pod %s %s", pvc.Status.Phase, pod.Name, pod.Status.Phase), ErrStorageProbeInProgress
+		}
+	}
+
+	if probe.accessMode != corev1.ReadWriteMany {
+		return "ok, " + throughput, nil
+	}
+	if pods[0].Spec.NodeName == pods[1].Spec.NodeName {
+		return fmt.Sprintf("ok, shared write on single node %s, %s", pods[0].Spec.NodeName, throughput), nil
+	}
+	return fmt.Sprintf("ok, shared write across nodes %s and %s, %s", pods[0].Spec.NodeName, pods[1].Spec.NodeName, throughput), nil
+}
+
+func (p *storageProbe) replicas() int {
+	if p.accessMode == corev1.ReadWriteMany {
+		return 2
+	}
+	return 1
+}
+
+func (s *storage) createProbe(probe *storageProbe) error {
+	labels := s.labelsForProbe(probe)
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      probe.name,
+			Namespace: s.cluster.Namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{probe.accessMode},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: resource.MustParse("1Gi"),
+				},
+			},
+			StorageClassName: commonutil.String(probe.storageClassName),
+		},
+	}
+	objs := []client.Object{pvc}
+
+	if probe.replicas() == 1 {
+		objs = append(objs, s.podForProbe(probe, 0, ""))
+	} else {
+		// the second pod must run on another node if there is more than one node.
+		nodes, err := k8sutil.ListNodes(s.ctx, s.client)
+		if err != nil {
+			return err
+		}
+		writer := s.podForProbe(probe, 0, probeMemberName(probe, 1))
+		peer := s.podForProbe(probe, 1, probeMemberName(probe, 0))
+		if len(schedulableNodes(nodes)) > 1 {
+			peer.Spec.Affinity = &corev1.Affinity{
+				PodAntiAffinity: &corev1.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+						{
+							LabelSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{
+									storageProbeLabelKey: probe.name,
+									"role":               "writer",
+								},
+							},
+							TopologyKey: "kubernetes.io/hostname",
+						},
+					},
+				},
+			}
+		}
+		objs = append(objs, writer, peer)
+	}
+
+	for _, obj := range objs {
+		// a draft rainbondcluster, which is not created yet, can not be the owner.
+		if s.cluster.GetUID() != "" {
+			if err := controllerutil.SetControllerReference(s.cluster, obj, s.scheme); err != nil {
+				return err
+			}
+		}
+		if err := k8sutil.CreateIfNotExists(s.ctx, s.client, obj); err != nil {
+			return fmt.Errorf("create %s: %v", obj.GetName(), err)
+		}
+	}
+	return nil
+}
+
+func (s *storage) podForProbe(probe *storageProbe, idx int, peer string) *corev1.Pod {
+	labels := s.labelsForProbe(probe)
+	labels["role"] = "peer"
+	if idx == 0 {
+		labels["role"] = "writer"
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      probeMemberName(probe, idx),
+			Namespace: s.cluster.Namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: commonutil.Int64(0),
+			Tolerations: []corev1.Toleration{
+				{
+					Operator: corev1.TolerationOpExists, // tolerate everything.
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:            StorageProbeName,
+					Image:           rbdutil.GetenvDefault("RAINBOND_IMAGE_REPOSITORY", s.cluster.ImageRepository()) + "/alpine:3",
+					ImagePullPolicy: corev1.PullIfNotPresent,
+					Command:         []string{"/bin/sh", "-c", storageProbeScript},
+					Env: []corev1.EnvVar{
+						{
+							Name: "POD_NAME",
+							ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+							},
+						},
+						{
+							Name:  "PEER",
+							Value: peer,
+						},
+					},
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      "data",
+							MountPath: "/data",
+						},
+					},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "data",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+							ClaimName: probe.name,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *storage) listProbePods(probe *storageProbe) ([]corev1.Pod, error) {
+	podList := &corev1.PodList{}
+	err := s.client.List(s.ctx, podList, client.InNamespace(s.cluster.Namespace), client.MatchingLabels{
+		storageProbeLabelKey: probe.name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pods := podList.Items
+	// make sure the writer comes first.
+	if len(pods) == 2 && pods[0].Labels["role"] != "writer" {
+		pods[0], pods[1] = pods[1], pods[0]
+	}
+	return pods, nil
+}
+
+func (s *storage) cleanup(probe *storageProbe) error {
+	pods, err := s.listProbePods(probe)
+	if err != nil {
+		return err
+	}
+	for i := range pods {
+		if err := s.client.Delete(s.ctx, &pods[i]); err != nil && !k8sErrors.IsNotFound(err) {
+			return err
+		}
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      probe.name,
+			Namespace: s.cluster.Namespace,
+		},
+	}
+	if err := s.client.Delete(s.ctx, pvc); err != nil && !k8sErrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *storage) labelsForProbe(probe *storageProbe) map[string]string {
+	return rbdutil.LabelsForRainbond(map[string]string{
+		"name":               StorageProbeName,
+		storageProbeLabelKey: probe.name,
+	})
 }
 
 func (s *storage) failConditoin(condition rainbondv1alpha1.RainbondClusterCondition, msg string) rainbondv1alpha1.RainbondClusterCondition {
 	return failConditoin(condition, "StorageFailed", msg)
 }
 
-func eventListToString(eventList *corev1.EventList) string {
-	var res []string
-	for _, event := range eventList.Items {
-		res = append(res, fmt.Sprintf("%s: %s", event.Reason, event.Message))
+func probeMemberName(probe *storageProbe, idx int) string {
+	return fmt.Sprintf("%s-%d", probe.name, idx)
+}
+
+func schedulableNodes(nodes []corev1.Node) []corev1.Node {
+	var res []corev1.Node
+	for _, node := range nodes {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		res = append(res, node)
+	}
+	return res
+}
+
+func terminationMessage(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil {
+			return strings.TrimSpace(status.State.Terminated.Message)
+		}
+	}
+	return ""
+}
+
+func podPendingMessage(pod *corev1.Pod) string {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue && condition.Message != "" {
+			return condition.Message
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && status.State.Waiting.Message != "" {
+			return status.State.Waiting.Message
+		}
+	}
+	return "no more information"
+}
+
+// parseDDResult parses the last line of dd, and returns the write throughput in MB/s (10^6 bytes per second as dd reports).
+// eg. 67108864 bytes (64.0MB) copied, 0.123456 seconds, 518.4MB/s
+func parseDDResult(line string) (float64, error) {
+	matches := ddResultRegexp.FindStringSubmatch(line)
+	if len(matches) != 3 {
+		return 0, fmt.Errorf("unexpected output of dd: %q", line)
+	}
+	bytes, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(matches[2], 64)
+	if err != nil {
+		return 0, err
+	}
+	if seconds <= 0 {
+		return 0, fmt.Errorf("unexpected output of dd: %q", line)
 	}
-	return strings.Join(res, ",")
+	return bytes / seconds / 1e6, nil
 }
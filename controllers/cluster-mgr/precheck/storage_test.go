@@ -0,0 +1,167 @@
+package precheck
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestStoragePreCheckerProbesRWOAndRWX(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = storagev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "rainbondcluster",
+			Namespace: "rbd-system",
+		},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			RainbondVolumeSpecRWX: &rainbondv1alpha1.RainbondVolumeSpec{
+				StorageClassName: "nfs",
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "nfs"}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local-path"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}},
+	).Build()
+	ctx := context.Background()
+
+	condition := NewStorage(ctx, cli, scheme, ctrl.Log, cluster).Check()
+	if condition.Status != corev1.ConditionFalse || condition.Reason != "InProgress" {
+		t.Fatalf("expected storage precheck in progress, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+
+	pods := &corev1.PodList{}
+	if err := cli.List(ctx, pods, client.InNamespace("rbd-system")); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 3 {
+		t.Fatalf("expected 3 probe pods, got %d", len(pods.Items))
+	}
+	for i := range pods.Items {
+		pod := pods.Items[i]
+		if pod.Name == StorageProbeName+"-rwx-1" && (pod.Spec.Affinity == nil || pod.Spec.Affinity.PodAntiAffinity == nil) {
+			t.Fatal("expected the rwx peer to run on another node")
+		}
+		pod.Spec.NodeName = "node-a"
+		if pod.Labels["role"] == "peer" {
+			pod.Spec.NodeName = "node-b"
+		}
+		pod.Status.Phase = corev1.PodSucceeded
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+			{
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{
+						Message: "67108864 bytes (64.0MB) copied, 0.500000 seconds, 134.2MB/s",
+					},
+				},
+			},
+		}
+		if err := cli.Update(ctx, &pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	condition = NewStorage(ctx, cli, scheme, ctrl.Log, cluster).Check()
+	if condition.Status != corev1.ConditionTrue {
+		t.Fatalf("expected storage precheck to pass, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+	for _, want := range []string{"nfs(ReadWriteMany): ok, shared write across nodes node-a and node-b, write 134.2 MB/s", "local-path(ReadWriteOnce): ok"} {
+		if !strings.Contains(condition.Message, want) {
+			t.Fatalf("expected message to contain %q, got %q", want, condition.Message)
+		}
+	}
+
+	if err := cli.List(ctx, pods, client.InNamespace("rbd-system")); err != nil {
+		t.Fatal(err)
+	}
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := cli.List(ctx, pvcs, client.InNamespace("rbd-system")); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 || len(pvcs.Items) != 0 {
+		t.Fatalf("expected probes to be cleaned up, got %d pods and %d pvcs", len(pods.Items), len(pvcs.Items))
+	}
+}
+
+func TestStoragePreCheckerReportsFailedProbe(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = storagev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "rainbondcluster",
+			Namespace: "rbd-system",
+		},
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			RainbondVolumeSpecRWX: &rainbondv1alpha1.RainbondVolumeSpec{},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local-path"}},
+	).Build()
+	ctx := context.Background()
+
+	_ = NewStorage(ctx, cli, scheme, ctrl.Log, cluster).Check()
+
+	pod := &corev1.Pod{}
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: "rbd-system", Name: StorageProbeName + "-rwo-0"}, pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Status.Phase = corev1.PodFailed
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{
+			State: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{Message: "dd: error writing '/data/probe': No space left on device"},
+			},
+		},
+	}
+	if err := cli.Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+
+	condition := NewStorage(ctx, cli, scheme, ctrl.Log, cluster).Check()
+	if condition.Status != corev1.ConditionFalse || condition.Reason != "StorageFailed" {
+		t.Fatalf("expected storage precheck to fail, got %s(%s): %s", condition.Status, condition.Reason, condition.Message)
+	}
+	if !strings.Contains(condition.Message, "No space left on device") {
+		t.Fatalf("expected message to contain the output of the probe, got %q", condition.Message)
+	}
+}
+
+func TestParseDDResult(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    float64
+		wantErr bool
+	}{
+		{line: "67108864 bytes (64.0MB) copied, 0.500000 seconds, 134.2MB/s", want: 134.217728},
+		{line: "67108864 bytes (67 MB, 64 MiB) copied, 0.25 s, 268 MB/s", want: 268.435456},
+		{line: "dd: can't open '/data/foo': Read-only file system", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseDDResult(tc.line)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("parse %q: unexpected error %v", tc.line, err)
+		}
+		if got != tc.want {
+			t.Fatalf("parse %q: expected %v, got %v", tc.line, tc.want, got)
+		}
+	}
+}
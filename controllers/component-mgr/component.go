@@ -28,6 +28,8 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
@@ -292,6 +294,10 @@ func (r *RbdcomponentMgr) ResourceCreateIfNotExists(obj client.Object) error {
 // UpdateOrCreateResource -
 func (r *RbdcomponentMgr) UpdateOrCreateResource(obj client.Object) (reconcile.Result, error) {
 	var oldOjb = reflect.New(reflect.ValueOf(obj).Elem().Type()).Interface().(client.Object)
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		// the kind of unstructured objects is required to get them.
+		oldOjb.(*unstructured.Unstructured).SetGroupVersionKind(u.GroupVersionKind())
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
 	err := r.client.Get(ctx, types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}, oldOjb)
@@ -344,6 +350,25 @@ func (r *RbdcomponentMgr) updateRuntimeObject(old, new client.Object) client.Obj
 		o := old.(*corev1.Service)
 		n.ResourceVersion = o.ResourceVersion
 		n.Spec.ClusterIP = o.Spec.ClusterIP
+		// keep the allocated node ports, or they would be reallocated on every update.
+		for i := range n.Spec.Ports {
+			if n.Spec.Ports[i].NodePort != 0 {
+				continue
+			}
+			for _, port := range o.Spec.Ports {
+				if port.Port == n.Spec.Ports[i].Port && port.Protocol == n.Spec.Ports[i].Protocol {
+					n.Spec.Ports[i].NodePort = port.NodePort
+				}
+			}
+		}
+		if n.Spec.HealthCheckNodePort == 0 {
+			n.Spec.HealthCheckNodePort = o.Spec.HealthCheckNodePort
+		}
+		return n
+	}
+
+	if n, ok := new.(*unstructured.Unstructured); ok {
+		n.SetResourceVersion(old.GetResourceVersion())
 		return n
 	}
 
@@ -425,7 +450,8 @@ func (r *RbdcomponentMgr) DeleteResources(deleter handler.ResourcesDeleter) (*re
 
 func (r *RbdcomponentMgr) deleteResourcesIfExists(obj client.Object) error {
 	err := r.client.Delete(r.ctx, obj, &client.DeleteOptions{GracePeriodSeconds: commonutil.Int64(0)})
-	if err != nil && !k8sErrors.IsNotFound(err) {
+	// the kind may not be supported by the cluster, such as CronJob of batch/v1 before kubernetes 1.21.
+	if err != nil && !k8sErrors.IsNotFound(err) && !meta.IsNoMatchError(err) {
 		return err
 	}
 	return nil
@@ -6,6 +6,7 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
 )
 
 func TestRbdDBStatefulSetCanUpdatePodTemplate(t *testing.T) {
@@ -86,3 +87,47 @@ func TestUpdateRuntimeObjectPreservesStatefulSetImmutableFields(t *testing.T) {
 		t.Fatalf("expected updated pod template, got priority class %q", got.Spec.Template.Spec.PriorityClassName)
 	}
 }
+
+func TestUpdateRuntimeObjectPreservesServiceNodePorts(t *testing.T) {
+	t.Parallel()
+
+	old := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "rbd-gateway", ResourceVersion: "7"},
+		Spec: corev1.ServiceSpec{
+			Type:                  corev1.ServiceTypeLoadBalancer,
+			ClusterIP:             "10.43.0.10",
+			ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			HealthCheckNodePort:   32000,
+			Ports: []corev1.ServicePort{
+				{Name: "http-80", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080},
+				{Name: "https-443", Protocol: corev1.ProtocolTCP, Port: 443, NodePort: 30443},
+			},
+		},
+	}
+	newService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "rbd-gateway"},
+		Spec: corev1.ServiceSpec{
+			Type:                  corev1.ServiceTypeLoadBalancer,
+			ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			Ports: []corev1.ServicePort{
+				{Name: "http-80", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "https-8443", Protocol: corev1.ProtocolTCP, Port: 8443},
+			},
+		},
+	}
+
+	mgr := &RbdcomponentMgr{log: ctrl.Log.WithName("test")}
+	got := mgr.updateRuntimeObject(old, newService).(*corev1.Service)
+	if got.ResourceVersion != "7" || got.Spec.ClusterIP != "10.43.0.10" {
+		t.Fatalf("expected the resource version and cluster ip to be kept, got %q %q", got.ResourceVersion, got.Spec.ClusterIP)
+	}
+	if got.Spec.Ports[0].NodePort != 30080 {
+		t.Fatalf("expected the node port of port 80 to be kept, got %d", got.Spec.Ports[0].NodePort)
+	}
+	if got.Spec.Ports[1].NodePort != 0 {
+		t.Fatalf("expected the node port of the new port to be allocated, got %d", got.Spec.Ports[1].NodePort)
+	}
+	if got.Spec.HealthCheckNodePort != 32000 {
+		t.Fatalf("expected the health check node port to be kept, got %d", got.Spec.HealthCheckNodePort)
+	}
+}
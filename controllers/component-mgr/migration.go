@@ -0,0 +1,114 @@
+package componentmgr
+
+import (
+	"fmt"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/controllers/handler"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// podLogs returns the logs of the container, which is replaced in tests.
+var podLogs = getPodLogs
+
+// Migrate runs the job which migrates the schemas to the given version. It returns a result to requeue
+// until the job succeeds, the workloads of the component must not be rolled out before that.
+// A failed job is kept for its logs, delete it to migrate again.
+func (r *RbdcomponentMgr) Migrate(version string, job *batchv1.Job) (*reconcile.Result, error) {
+	if job == nil || r.cpt.Status.SchemaVersion == version {
+		return nil, nil
+	}
+
+	old := &batchv1.Job{}
+	if err := r.client.Get(r.ctx, types.NamespacedName{Namespace: job.Namespace, Name: job.Name}, old); err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return nil, fmt.Errorf("get migration job %s: %v", job.Name, err)
+		}
+		r.log.Info("Creating the migration job", "Name", job.Name, "SchemaVersion", version)
+		if err := r.client.Create(r.ctx, job); err != nil {
+			return nil, fmt.Errorf("create migration job %s: %v", job.Name, err)
+		}
+		return r.waitForMigration(job.Name, version)
+	}
+
+	if old.Status.Succeeded > 0 {
+		r.cpt.Status.SchemaVersion = version
+		if _, condition := r.cpt.Status.GetCondition(rainbondv1alpha1.RbdComponentMigrationFailed); condition != nil {
+			r.cpt.Status.UpdateCondition(rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentMigrationFailed,
+				corev1.ConditionFalse, "Migrated", ""))
+		}
+		r.recorder.Event(r.cpt, corev1.EventTypeNormal, "Migrated", fmt.Sprintf("the schemas are migrated to %s", version))
+		return nil, r.deleteOldMigrationJobs(old.Name)
+	}
+
+	for _, condition := range old.Status.Conditions {
+		if condition.Type != batchv1.JobFailed || condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		msg := fmt.Sprintf("job %s failed: %s", old.Name, condition.Message)
+		if logs := r.migrationLogs(old); logs != "" {
+			msg += "\n" + logs
+		}
+		failed := rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentMigrationFailed, corev1.ConditionTrue, condition.Reason, msg)
+		if r.cpt.Status.UpdateCondition(failed) {
+			r.recorder.Event(r.cpt, corev1.EventTypeWarning, "MigrationFailed", fmt.Sprintf("job %s failed: %s", old.Name, condition.Message))
+		}
+		ready := rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentReady, corev1.ConditionFalse, "MigrationFailed",
+			fmt.Sprintf("failed to migrate the schemas to %s, delete job %s to retry", version, old.Name))
+		r.cpt.Status.UpdateCondition(ready)
+		return &reconcile.Result{RequeueAfter: time.Minute}, r.UpdateStatus()
+	}
+
+	return r.waitForMigration(old.Name, version)
+}
+
+func (r *RbdcomponentMgr) waitForMigration(name, version string) (*reconcile.Result, error) {
+	condition := rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentReady, corev1.ConditionFalse, "Migrating",
+		fmt.Sprintf("waiting for job %s to migrate the schemas to %s", name, version))
+	if r.cpt.Status.UpdateCondition(condition) {
+		return &reconcile.Result{RequeueAfter: 5 * time.Second}, r.UpdateStatus()
+	}
+	return &reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+}
+
+// migrationLogs returns the logs of the last pod of the job.
+func (r *RbdcomponentMgr) migrationLogs(job *batchv1.Job) string {
+	pods := &corev1.PodList{}
+	if err := r.client.List(r.ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		r.log.V(4).Info("list pods of the migration job", "Name", job.Name, "error", err.Error())
+		return ""
+	}
+	var last *corev1.Pod
+	for i := range pods.Items {
+		if last == nil || last.CreationTimestamp.Before(&pods.Items[i].CreationTimestamp) {
+			last = &pods.Items[i]
+		}
+	}
+	if last == nil {
+		return ""
+	}
+	return podLogs(*last, "migrate")
+}
+
+// deleteOldMigrationJobs deletes the jobs of the previous versions.
+func (r *RbdcomponentMgr) deleteOldMigrationJobs(current string) error {
+	jobs := &batchv1.JobList{}
+	if err := r.client.List(r.ctx, jobs, client.InNamespace(r.cpt.Namespace), client.MatchingLabels{handler.MigrationLabelKey: r.cpt.Name}); err != nil {
+		return fmt.Errorf("list migration jobs: %v", err)
+	}
+	for i := range jobs.Items {
+		if jobs.Items[i].Name == current {
+			continue
+		}
+		if err := r.client.Delete(r.ctx, &jobs.Items[i], client.PropagationPolicy("Background")); err != nil && !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("delete migration job %s: %v", jobs.Items[i].Name, err)
+		}
+	}
+	return nil
+}
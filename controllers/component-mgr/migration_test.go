@@ -0,0 +1,90 @@
+package componentmgr
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/controllers/handler"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newMigrationJob(name string) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "rbd-system",
+			Labels:    map[string]string{handler.MigrationLabelKey: "rbd-api"},
+		},
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = batchv1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cpt := &rainbondv1alpha1.RbdComponent{ObjectMeta: metav1.ObjectMeta{Name: "rbd-api", Namespace: "rbd-system"}}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cpt, newMigrationJob("rbd-api-migrate-old")).Build()
+	mgr := NewRbdcomponentMgr(context.Background(), cli, record.NewFakeRecorder(10), ctrl.Log, cpt)
+
+	old := podLogs
+	podLogs = func(pod corev1.Pod, container string) string { return "table already exists" }
+	t.Cleanup(func() { podLogs = old })
+
+	result, err := mgr.Migrate("v2", newMigrationJob("rbd-api-migrate-v2"))
+	if err != nil || result == nil {
+		t.Fatalf("expected to wait for the migration job, got %v, %v", result, err)
+	}
+	job := &batchv1.Job{}
+	if err := cli.Get(context.Background(), types.NamespacedName{Namespace: "rbd-system", Name: "rbd-api-migrate-v2"}, job); err != nil {
+		t.Fatal(err)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded", Message: "Job has reached the specified backoff limit"}}
+	if err := cli.Status().Update(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "rbd-api-migrate-v2-x", Namespace: "rbd-system", Labels: map[string]string{"job-name": job.Name}}}
+	if err := cli.Create(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := mgr.Migrate("v2", newMigrationJob("rbd-api-migrate-v2")); result == nil {
+		t.Fatal("expected the rollout to be blocked when the migration failed")
+	}
+	_, condition := cpt.Status.GetCondition(rainbondv1alpha1.RbdComponentMigrationFailed)
+	if condition == nil || condition.Status != corev1.ConditionTrue || !strings.Contains(condition.Message, "table already exists") {
+		t.Fatalf("expected the logs of the job in condition MigrationFailed, got %+v", condition)
+	}
+
+	job.Status.Conditions = nil
+	job.Status.Succeeded = 1
+	if err := cli.Status().Update(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := mgr.Migrate("v2", newMigrationJob("rbd-api-migrate-v2")); result != nil || err != nil {
+		t.Fatalf("expected the rollout to continue after the migration, got %v, %v", result, err)
+	}
+	if cpt.Status.SchemaVersion != "v2" {
+		t.Fatalf("expected schema version v2, got %q", cpt.Status.SchemaVersion)
+	}
+	if _, condition := cpt.Status.GetCondition(rainbondv1alpha1.RbdComponentMigrationFailed); condition.Status != corev1.ConditionFalse {
+		t.Fatal("expected condition MigrationFailed to be cleared")
+	}
+	jobs := &batchv1.JobList{}
+	if err := cli.List(context.Background(), jobs, client.InNamespace("rbd-system")); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 1 || jobs.Items[0].Name != "rbd-api-migrate-v2" {
+		t.Fatalf("expected the jobs of the previous versions to be deleted, got %d jobs", len(jobs.Items))
+	}
+}
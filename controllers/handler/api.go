@@ -15,6 +15,7 @@ import (
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
 	"github.com/goodrain/rainbond-operator/util/commonutil"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -30,6 +31,19 @@ var apiServerSecretName = "rbd-api-server-cert"
 var apiCASecretName = "rbd-api-ca-cert"
 var apiClientSecretName = "rbd-api-client-cert"
 
+// apiMigrateScript runs the entrypoint of the rbd-api image until the api is healthy and stops it. rbd-api
+// migrates the region database on startup, before it serves /v2/health, so the job exits 0 only if the
+// schemas are migrated.
+const apiMigrateScript = `
+/run/entrypoint.sh "$@" &
+pid=$!
+until wget -q -O /dev/null http://127.0.0.1:8888/v2/health; do
+	kill -0 "$pid" 2>/dev/null || exit 1
+	sleep 2
+done
+kill "$pid"
+`
+
 type api struct {
 	ctx                      context.Context
 	client                   client.Client
@@ -44,6 +58,7 @@ type api struct {
 }
 
 var _ ComponentHandler = &api{}
+var _ Migrator = &api{}
 
 // NewAPI new api handle
 func NewAPI(ctx context.Context, client client.Client, component *rainbondv1alpha1.RbdComponent, cluster *rainbondv1alpha1.RainbondCluster) ComponentHandler {
@@ -60,7 +75,7 @@ func NewAPI(ctx context.Context, client client.Client, component *rainbondv1alph
 
 func (a *api) Before() error {
 	if !checksqllite.IsSQLLite() {
-		db, err := getDefaultDBInfo(a.ctx, a.client, a.cluster.Spec.RegionDatabase, a.component.Namespace, DBName)
+		db, err := getDefaultDBInfo(a.ctx, a.client, a.cluster.Spec.RegionDatabase, a.component.Namespace, DBName, APIName)
 		if err != nil {
 			return fmt.Errorf("get db info: %v", err)
 		}
@@ -92,6 +107,18 @@ func (a *api) After() error {
 	return nil
 }
 
+// MigrationJob migrates the region database with the same args as rbd-api, see apiMigrateScript.
+func (a *api) MigrationJob() (string, *batchv1.Job) {
+	if checksqllite.IsSQLLite() {
+		return "", nil
+	}
+	deploy := a.deployment().(*appsv1.Deployment)
+	container := deploy.Spec.Template.Spec.Containers[0]
+	version := schemaVersion(a.component.Spec.Image)
+	return version, migrationJob(APIName, a.component.Namespace, version, deploy.Spec.Template,
+		[]string{"sh", "-c", apiMigrateScript, "migrate"}, container.Args)
+}
+
 func (a *api) ListPods() ([]corev1.Pod, error) {
 	return listPods(a.ctx, a.client, a.component.Namespace, a.labels)
 }
@@ -116,6 +143,7 @@ func (a *api) deployment() client.Object {
 	if !checksqllite.IsSQLLite() {
 		args = append(args, a.db.RegionDataSource())
 	}
+	args = append(args, etcdArgs(a.cluster)...)
 	if a.etcdSecret != nil {
 		volume, mount := volumeByEtcd(a.etcdSecret)
 		volumeMounts = append(volumeMounts, mount)
@@ -13,6 +13,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -216,3 +217,117 @@ func (staticStatusWriter) Update(context.Context, client.Object, ...client.Updat
 func (staticStatusWriter) Patch(context.Context, client.Object, client.Patch, ...client.PatchOption) error {
 	panic("unexpected Status().Patch call in test")
 }
+
+func TestAPIDeploymentPassesExternalEtcdTLSArgs(t *testing.T) {
+	t.Setenv("IS_SQLLITE", "true")
+
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      APIName,
+			Namespace: "rbd-system",
+		},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			EtcdConfig: &rainbondv1alpha1.EtcdConfig{
+				Endpoints:  []string{"https://10.0.0.1:2379", "https://10.0.0.2:2379"},
+				SecretName: "rbd-etcd-secret",
+			},
+		},
+	}
+	handler := &api{
+		ctx:        context.Background(),
+		component:  component,
+		cluster:    cluster,
+		labels:     LabelsForRainbondComponent(component),
+		etcdSecret: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "rbd-etcd-secret"}},
+	}
+
+	deployment := handler.deployment().(*appsv1.Deployment)
+	args := strings.Join(deployment.Spec.Template.Spec.Containers[0].Args, " ")
+	for _, want := range []string{
+		"--etcd=https://10.0.0.1:2379,https://10.0.0.2:2379",
+		"--etcd-ca=/run/ssl/etcd/ca-file",
+		"--etcd-cert=/run/ssl/etcd/cert-file",
+		"--etcd-key=/run/ssl/etcd/key-file",
+	} {
+		if !strings.Contains(args, want) {
+			t.Fatalf("expected args to contain %q, got %q", want, args)
+		}
+	}
+}
+
+func TestAPIDeploymentUsesDatabaseTLS(t *testing.T) {
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      APIName,
+			Namespace: "rbd-system",
+		},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "rbd-system"}}
+	handler := &api{
+		ctx:       context.Background(),
+		component: component,
+		cluster:   cluster,
+		labels:    LabelsForRainbondComponent(component),
+		db: &rainbondv1alpha1.Database{
+			Host:     "mysql.example.com",
+			Port:     3306,
+			Username: "region",
+			Password: "pass",
+			Name:     "region",
+			TLS:      &rainbondv1alpha1.DatabaseTLS{Mode: rainbondv1alpha1.DatabaseTLSVerifyFull},
+			Charset:  "utf8mb4",
+		},
+	}
+	deployment := handler.deployment().(*appsv1.Deployment)
+	container := deployment.Spec.Template.Spec.Containers[0]
+	wantArg := "--mysql=region:pass@tcp(mysql.example.com:3306)/region?charset=utf8mb4&tls=true"
+	if !containsString(container.Args, wantArg) {
+		t.Fatalf("expected arg %q, got %v", wantArg, container.Args)
+	}
+	for _, env := range container.Env {
+		if strings.HasPrefix(env.Name, "DB_") {
+			t.Fatalf("unexpected database env %s", env.Name)
+		}
+	}
+}
+
+func TestAPIMigrationJob(t *testing.T) {
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      APIName,
+			Namespace: "rbd-system",
+		},
+		Spec: rainbondv1alpha1.RbdComponentSpec{Image: "registry.example.com:5000/rainbond/rbd-api:v6.1.0-release"},
+	}
+	handler := &api{
+		ctx:       context.Background(),
+		component: component,
+		cluster:   &rainbondv1alpha1.RainbondCluster{},
+		labels:    LabelsForRainbondComponent(component),
+		db:        &rainbondv1alpha1.Database{Host: "rbd-db-rw", Port: 3306, Username: "region", Password: "pass", Name: "region"},
+	}
+
+	version, job := handler.MigrationJob()
+	if version != "v6.1.0-release" {
+		t.Fatalf("expected the schema version from the image tag, got %q", version)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	if !containsString(container.Command, apiMigrateScript) || !containsString(container.Args, handler.db.RegionDataSource()) {
+		t.Fatalf("expected to run rbd-api with its args until it is healthy, got %v %v", container.Command, container.Args)
+	}
+	if container.ReadinessProbe != nil || job.Spec.Template.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Fatal("expected a one-shot container without probes")
+	}
+	if _, ok := job.Spec.Template.Labels["name"]; ok {
+		t.Fatal("expected the pods of the job not to be selected by the component")
+	}
+	if errs := validation.IsDNS1123Label(job.Name); len(errs) > 0 {
+		t.Fatalf("invalid job name %q: %v", job.Name, errs)
+	}
+	component.Spec.Image = "registry.example.com:5000/rainbond/rbd-api:v6.2.0-release"
+	if _, next := handler.MigrationJob(); next.Name == job.Name {
+		t.Fatal("expected a new job for every version")
+	}
+}
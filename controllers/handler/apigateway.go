@@ -12,7 +12,6 @@ import (
 	"github.com/goodrain/rainbond-operator/util/k8sutil"
 	"github.com/goodrain/rainbond-operator/util/rbdutil"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v3"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -27,17 +26,43 @@ var ApiGatewayName = "rbd-gateway"
 
 const (
 	apiGatewayResourceRequestEphemeralStorage = "512Mi"
-	apisixAdminKey                            = "edd1c9f034335f136f87ad84b625c8f1"
+	apisixConfigChecksumAnnotation            = "rainbond.io/config-checksum"
+	// apisixIngressConfigName is the ConfigMap of the config file of the ingress controller.
+	apisixIngressConfigName = "apisix-ingress-config.yaml"
 )
 
+// apisixIngressConfig is the config file of the ingress controller. The ingress controller renders it with the
+// environment variables, so that the admin key is read from the secret instead of the command line.
+var apisixIngressConfig = fmt.Sprintf(`log_output: stdout
+http_listen: ":7080"
+apisix_resource_sync_interval: 1h
+apisix_resource_sync_comparison: true
+kubernetes:
+  api_version: apisix.apache.org/v2
+  disable_status_updates: false
+apisix:
+  admin_api_version: v3
+  default_cluster_name: default
+  default_cluster_base_url: http://127.0.0.1:%d/apisix/admin
+  default_cluster_admin_key: "{{ .%s }}"
+etcdserver:
+  enabled: true
+`, apisixAdminPort, apisixAdminKeyEnv)
+
 type apigateway struct {
 	ctx       context.Context
 	client    client.Client
 	cluster   *rainbondv1alpha1.RainbondCluster
 	component *rainbondv1alpha1.RbdComponent
 	labels    map[string]string
+	// config is config.yaml of APISIX, the pods are restarted once it is changed.
+	config          string
+	adminKeySecret  *corev1.Secret
+	rotationPending bool
 }
 
+var _ ResyncPerioder = &apigateway{}
+
 // NewApiGateway returns a new rbd-gateway handler.
 func NewApiGateway(ctx context.Context, client client.Client, component *rainbondv1alpha1.RbdComponent, cluster *rainbondv1alpha1.RainbondCluster) ComponentHandler {
 	return &apigateway{
@@ -106,148 +131,56 @@ func (a *apigateway) Before() error {
 			}
 		}
 	}
+
+	if err := a.checkHostNetworkNodes(); err != nil {
+		return err
+	}
+
+	secret, err := a.ensureAdminKeySecret()
+	if err != nil {
+		return err
+	}
+	a.adminKeySecret = secret
 	return nil
 }
 
 // Resources -
 func (a *apigateway) Resources() []client.Object {
-	// 检查 configmap 是否存在，不存在才创建
-	var objs []client.Object
+	objs := []client.Object{
+		a.ingressConfigMap(),
+		a.monitorGlobalRule(),
+		a.monitorService(),
+	}
+	// 合并网关配置到已有的 configmap，保留其他的自定义配置
 	var cm corev1.ConfigMap
 	err := a.client.Get(a.ctx, client.ObjectKey{
 		Name:      "apisix-gw-config.yaml",
 		Namespace: a.component.Namespace,
 	}, &cm)
 	if err != nil {
-		if apierrors.IsNotFound(err) {
-			objs = append(objs, a.configmap())
-		} else {
+		if !apierrors.IsNotFound(err) {
+			// the pods would be restarted without the checksum of the config.
 			logrus.WithError(err).Warn("failed to get APISIX config map")
+			return objs
 		}
-	} else {
-		changed, migrateErr := ensureAPISIXAdminConfig(&cm)
-		if migrateErr != nil {
-			logrus.WithError(migrateErr).Warn("failed to migrate APISIX admin configuration")
-		} else if changed {
-			objs = append(objs, &cm)
-		}
-	}
-	objs = append(objs,
-		a.deploy(),
-		a.monitorGlobalRule(),
-		a.monitorService(),
-	)
-	return objs
-}
-
-func ensureAPISIXAdminConfig(configMap *corev1.ConfigMap) (bool, error) {
-	config, ok := configMap.Data["config.yaml"]
-	if !ok {
-		return false, fmt.Errorf("config.yaml not found in ConfigMap %s/%s", configMap.Namespace, configMap.Name)
-	}
-
-	var document yaml.Node
-	if err := yaml.Unmarshal([]byte(config), &document); err != nil {
-		return false, fmt.Errorf("parse config.yaml: %w", err)
-	}
-	if len(document.Content) != 1 || document.Content[0].Kind != yaml.MappingNode {
-		return false, fmt.Errorf("config.yaml root must be a mapping")
+		configMap := a.configmap().(*corev1.ConfigMap)
+		a.config = configMap.Data["config.yaml"]
+		return append(append([]client.Object{configMap, a.workload()}, objs...), a.exposeServices()...)
 	}
 
-	root := document.Content[0]
-	deployment, changed := ensureYAMLMapping(root, "deployment")
-	admin, adminChanged := ensureYAMLMapping(deployment, "admin")
-	changed = changed || adminChanged
-	changed = setYAMLScalar(admin, "admin_key_required", "!!bool", "true") || changed
-	changed = setYAMLScalar(admin, "admin_api_version", "!!str", "v3") || changed
-
-	adminKeys, keysChanged := ensureYAMLSequence(admin, "admin_key")
-	changed = changed || keysChanged
-	adminEntry := findYAMLMappingByScalar(adminKeys, "name", "admin")
-	if adminEntry == nil {
-		adminEntry = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
-		adminKeys.Content = append(adminKeys.Content, adminEntry)
-		changed = true
-	}
-	changed = setYAMLScalar(adminEntry, "name", "!!str", "admin") || changed
-	changed = setYAMLScalar(adminEntry, "key", "!!str", apisixAdminKey) || changed
-	changed = setYAMLScalar(adminEntry, "role", "!!str", "admin") || changed
-
-	if !changed {
-		return false, nil
-	}
-	updated, err := yaml.Marshal(&document)
+	changed, err := patchAPISIXConfig(&cm, apisixConfigPatches(a.cluster)...)
 	if err != nil {
-		return false, fmt.Errorf("marshal config.yaml: %w", err)
+		logrus.WithError(err).Warn("failed to merge APISIX configuration")
+	} else if changed {
+		objs = append([]client.Object{&cm}, objs...)
 	}
-	configMap.Data["config.yaml"] = string(updated)
-	return true, nil
-}
-
-func ensureYAMLMapping(parent *yaml.Node, key string) (*yaml.Node, bool) {
-	if existing := yamlMappingValue(parent, key); existing != nil && existing.Kind == yaml.MappingNode {
-		return existing, false
-	}
-	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
-	setYAMLValue(parent, key, value)
-	return value, true
-}
-
-func ensureYAMLSequence(parent *yaml.Node, key string) (*yaml.Node, bool) {
-	if existing := yamlMappingValue(parent, key); existing != nil && existing.Kind == yaml.SequenceNode {
-		return existing, false
-	}
-	value := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
-	setYAMLValue(parent, key, value)
-	return value, true
-}
-
-func setYAMLScalar(parent *yaml.Node, key, tag, value string) bool {
-	existing := yamlMappingValue(parent, key)
-	if existing != nil && existing.Kind == yaml.ScalarNode && existing.Tag == tag && existing.Value == value {
-		return false
-	}
-	setYAMLValue(parent, key, &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value})
-	return true
-}
-
-func setYAMLValue(parent *yaml.Node, key string, value *yaml.Node) {
-	for i := 0; i+1 < len(parent.Content); i += 2 {
-		if parent.Content[i].Value == key {
-			parent.Content[i+1] = value
-			return
-		}
-	}
-	parent.Content = append(parent.Content,
-		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
-		value,
-	)
-}
-
-func yamlMappingValue(parent *yaml.Node, key string) *yaml.Node {
-	for i := 0; i+1 < len(parent.Content); i += 2 {
-		if parent.Content[i].Value == key {
-			return parent.Content[i+1]
-		}
-	}
-	return nil
-}
-
-func findYAMLMappingByScalar(sequence *yaml.Node, key, value string) *yaml.Node {
-	for _, item := range sequence.Content {
-		if item.Kind != yaml.MappingNode {
-			continue
-		}
-		if field := yamlMappingValue(item, key); field != nil && field.Value == value {
-			return item
-		}
-	}
-	return nil
+	a.config = cm.Data["config.yaml"]
+	return append(append(objs, a.workload()), a.exposeServices()...)
 }
 
 // After -
 func (a *apigateway) After() error {
-	return nil
+	return a.rotateAdminKey()
 }
 
 // ListPods -
@@ -257,15 +190,7 @@ func (a *apigateway) ListPods() ([]corev1.Pod, error) {
 
 // deploy -
 func (a *apigateway) deploy() client.Object {
-	var nodeNames []string
-	for _, n := range a.cluster.Spec.NodesForGateway {
-		nodeNames = append(nodeNames, n.Name)
-
-		//转换小写如果不一致，则增加一份小写，兼容rke2，rke2安装的k8s的hostname被转小写了
-		if strings.ToLower(n.Name) != n.Name {
-			nodeNames = append(nodeNames, strings.ToLower(n.Name))
-		}
-	}
+	nodeNames := a.gatewayNodeNames()
 	var affinity *corev1.Affinity
 	if len(nodeNames) > 0 {
 		affinity = affinityForRequiredNodes(nodeNames)
@@ -274,10 +199,42 @@ func (a *apigateway) deploy() client.Object {
 	affinity = mergeAffinity(affinity, a.component.Spec.Affinity)
 
 	if affinity == nil {
+		// refused by checkHostNetworkNodes.
 		return nil
 	}
 	affinity = addAPIGatewayPodAntiAffinity(affinity)
-	replicas := int32(len(nodeNames))
+	// one on each of nodesForGateway, the lower-case names are not counted.
+	replicas := int32(len(a.cluster.Spec.NodesForGateway))
+	if replicas == 0 {
+		replicas = a.serviceReplicas()
+	}
+	maxUnavailable := intstr.FromInt(1)
+	maxSurge := intstr.FromInt(0)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ApiGatewayName,
+			Namespace: rbdutil.GetenvDefault("RBD_NAMESPACE", constants.Namespace),
+			Labels:    a.labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: a.labels,
+			},
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RollingUpdateDeploymentStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDeployment{
+					MaxUnavailable: &maxUnavailable,
+					MaxSurge:       &maxSurge,
+				},
+			},
+			Template: a.podTemplate(affinity, true),
+		},
+	}
+}
+
+// podTemplate returns the pod template of rbd-gateway, the ports are only declared without the host network.
+func (a *apigateway) podTemplate(affinity *corev1.Affinity, hostNetwork bool) corev1.PodTemplateSpec {
 	envs := append(a.component.Spec.Env, []corev1.EnvVar{
 		{
 			Name:  "RBD_NAMESPACE",
@@ -302,6 +259,8 @@ func (a *apigateway) deploy() client.Object {
 			},
 		},
 	}...)
+	// the ingress controller only uses the current admin key.
+	envs = append(envs, adminKeyEnvs()[0])
 
 	vms := append(a.component.Spec.VolumeMounts, []corev1.VolumeMount{
 		{
@@ -323,137 +282,130 @@ func (a *apigateway) deploy() client.Object {
 				},
 			},
 		},
+		{
+			Name: "apisix-ingress-config",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: apisixIngressConfigName,
+					},
+				},
+			},
+		},
 	}...)
 	images := strings.Split(a.component.Spec.Image, "@")
 	resources := setDefaultAPIGatewayResources(a.component.Spec.Resources)
-	maxUnavailable := intstr.FromInt(1)
-	maxSurge := intstr.FromInt(0)
-	return &appsv1.Deployment{
+	template := corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      ApiGatewayName,
 			Namespace: rbdutil.GetenvDefault("RBD_NAMESPACE", constants.Namespace),
 			Labels:    a.labels,
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: &replicas,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: a.labels,
+			Annotations: map[string]string{
+				// config.yaml is mounted by subPath, which is not updated in the running pods.
+				apisixConfigChecksumAnnotation: checksum(a.config, apisixIngressConfig),
+				// the admin keys are injected by environment variables.
+				apisixAdminKeyChecksumAnnotation: adminKeyChecksum(a.adminKeySecret),
 			},
-			Strategy: appsv1.DeploymentStrategy{
-				Type: appsv1.RollingUpdateDeploymentStrategyType,
-				RollingUpdate: &appsv1.RollingUpdateDeployment{
-					MaxUnavailable: &maxUnavailable,
-					MaxSurge:       &maxSurge,
+		},
+		Spec: corev1.PodSpec{
+			Affinity:                      affinity,
+			PriorityClassName:             constants.SystemClusterCriticalPriorityClassName,
+			TerminationGracePeriodSeconds: commonutil.Int64(0),
+			ServiceAccountName:            rbdutil.GetenvDefault("SERVICE_ACCOUNT_NAME", "rainbond-operator"),
+			HostNetwork:                   hostNetwork,
+			DNSPolicy:                     corev1.DNSClusterFirst,
+			RestartPolicy:                 corev1.RestartPolicyAlways,
+			SchedulerName:                 "default-scheduler",
+			Tolerations: []corev1.Toleration{
+				{
+					Operator: corev1.TolerationOpExists,
 				},
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      ApiGatewayName,
-					Namespace: rbdutil.GetenvDefault("RBD_NAMESPACE", constants.Namespace),
-					Labels:    a.labels,
-				},
-				Spec: corev1.PodSpec{
-					Affinity:                      affinity,
-					PriorityClassName:             constants.SystemClusterCriticalPriorityClassName,
-					TerminationGracePeriodSeconds: commonutil.Int64(0),
-					ServiceAccountName:            rbdutil.GetenvDefault("SERVICE_ACCOUNT_NAME", "rainbond-operator"),
-					HostNetwork:                   true,
-					DNSPolicy:                     corev1.DNSClusterFirst,
-					RestartPolicy:                 corev1.RestartPolicyAlways,
-					SchedulerName:                 "default-scheduler",
-					Tolerations: []corev1.Toleration{
+			Containers: []corev1.Container{
+				{
+					Name:            "ingress-apisix",
+					Image:           images[0],
+					ImagePullPolicy: a.component.ImagePullPolicy(),
+					Command: []string{
+						"/ingress-apisix/apisix-ingress-controller",
+						"ingress",
+						"--config-path",
+						"/ingress-apisix/config/config.yaml",
+					},
+					Env: envs,
+					VolumeMounts: []corev1.VolumeMount{
 						{
-							Operator: corev1.TolerationOpExists,
+							Name:      "apisix-ingress-config",
+							MountPath: "/ingress-apisix/config",
+							ReadOnly:  true,
 						},
 					},
-					SecurityContext: &corev1.PodSecurityContext{
-						RunAsUser: commonutil.Int64(0),
-					},
-					Containers: []corev1.Container{
-						{
-							Name:            "ingress-apisix",
-							Image:           images[0],
-							ImagePullPolicy: a.component.ImagePullPolicy(),
-							SecurityContext: &corev1.SecurityContext{
-								Privileged: commonutil.Bool(true),
-							},
-							Command: []string{
-								"/ingress-apisix/apisix-ingress-controller",
-								"ingress",
-								"--log-output",
-								"stdout",
-								"--apisix-resource-sync-interval",
-								"1h",
-								"--apisix-resource-sync-comparison=true",
-								"--http-listen",
-								":7080",
-								//"--https-listen",
-								//":7443",
-								"--default-apisix-cluster-name",
-								"default",
-								"--default-apisix-cluster-base-url",
-								"http://127.0.0.1:9180/apisix/admin",
-								"--apisix-admin-api-version",
-								"v3",
-								"--default-apisix-cluster-admin-key",
-								apisixAdminKey,
-								"--api-version",
-								"apisix.apache.org/v2",
-								"--ingress-status-address",
-								"",
-								"--disable-status-updates=false",
-								"--etcd-server-enabled=true",
-							},
-							Env:                      envs,
-							TerminationMessagePath:   "/dev/termination-log",
-							TerminationMessagePolicy: corev1.TerminationMessageReadFile,
-							Resources:                resources,
-							LivenessProbe: &corev1.Probe{
-								Handler: corev1.Handler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path: "/healthz",
-										Port: intstr.FromInt(7080),
-									},
-								},
-								InitialDelaySeconds: 60,
-								TimeoutSeconds:      10,
-								PeriodSeconds:       30,
-								SuccessThreshold:    1,
-								FailureThreshold:    5,
-							},
-							ReadinessProbe: &corev1.Probe{
-								Handler: corev1.Handler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path: "/healthz",
-										Port: intstr.FromInt(7080),
-									},
-								},
-								InitialDelaySeconds: 5,
-								TimeoutSeconds:      3,
-								PeriodSeconds:       3,
-								SuccessThreshold:    1,
-								FailureThreshold:    6,
+					TerminationMessagePath:   "/dev/termination-log",
+					TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+					Resources:                resources,
+					LivenessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: "/healthz",
+								Port: intstr.FromInt(7080),
 							},
 						},
-						{
-							Name:            "apisix",
-							Image:           images[1],
-							ImagePullPolicy: a.component.ImagePullPolicy(),
-							SecurityContext: &corev1.SecurityContext{
-								RunAsUser:  commonutil.Int64(0),
-								Privileged: commonutil.Bool(true),
+						InitialDelaySeconds: 60,
+						TimeoutSeconds:      10,
+						PeriodSeconds:       30,
+						SuccessThreshold:    1,
+						FailureThreshold:    5,
+					},
+					ReadinessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: "/healthz",
+								Port: intstr.FromInt(7080),
 							},
-							VolumeMounts:             vms,
-							TerminationMessagePath:   "/dev/termination-log",
-							TerminationMessagePolicy: corev1.TerminationMessageReadFile,
-							Resources:                resources,
 						},
+						InitialDelaySeconds: 5,
+						TimeoutSeconds:      3,
+						PeriodSeconds:       3,
+						SuccessThreshold:    1,
+						FailureThreshold:    6,
 					},
-					Volumes: vs,
+				},
+				{
+					Name:                     "apisix",
+					Image:                    images[1],
+					ImagePullPolicy:          a.component.ImagePullPolicy(),
+					Env:                      adminKeyEnvs(),
+					VolumeMounts:             vms,
+					TerminationMessagePath:   "/dev/termination-log",
+					TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+					Resources:                resources,
 				},
 			},
+			Volumes: vs,
 		},
 	}
+	if hostNetwork {
+		// the ports of the nodes are taken by root.
+		template.Spec.SecurityContext = &corev1.PodSecurityContext{
+			RunAsUser: commonutil.Int64(0),
+		}
+		template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+			Privileged: commonutil.Bool(true),
+		}
+		template.Spec.Containers[1].SecurityContext = &corev1.SecurityContext{
+			RunAsUser:  commonutil.Int64(0),
+			Privileged: commonutil.Bool(true),
+		}
+	} else {
+		template.Spec.Containers[1].Ports = a.containerPorts()
+		// APISIX still listens on the ports below 1024 in the pod network.
+		template.Spec.Containers[1].SecurityContext = &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{
+				Add: []corev1.Capability{"NET_BIND_SERVICE"},
+			},
+		}
+	}
+	return template
 }
 
 func setDefaultAPIGatewayResources(resources corev1.ResourceRequirements) corev1.ResourceRequirements {
@@ -481,6 +433,19 @@ func addAPIGatewayPodAntiAffinity(affinity *corev1.Affinity) *corev1.Affinity {
 	return result
 }
 
+func (a *apigateway) ingressConfigMap() client.Object {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      apisixIngressConfigName,
+			Namespace: a.component.Namespace,
+			Labels:    copyLabels(a.labels),
+		},
+		Data: map[string]string{
+			"config.yaml": apisixIngressConfig,
+		},
+	}
+}
+
 // monitorService 这里地址不能改变，因为rbd-monitor 会读取这个service
 func (a *apigateway) monitorService() client.Object {
 	return &corev1.Service{
@@ -530,7 +495,7 @@ func (a *apigateway) monitorGlobalRule() client.Object {
 
 // configmap 配置文件
 func (a *apigateway) configmap() client.Object {
-	configYaml := fmt.Sprintf(`
+	configYaml := `
 plugin_attr:
   prometheus:
     metrics:
@@ -543,19 +508,6 @@ plugin_attr:
       port: 8099
 
 deployment:
-  admin:
-    admin_key_required: true
-    admin_key:
-      - name: admin
-        key: %s
-        role: admin
-    admin_api_version: v3
-    allow_admin:
-      - 127.0.0.0/24
-      - 0.0.0.0/0
-    admin_listen:
-      ip: 0.0.0.0
-      port: 9180
   etcd:
     host:
       - "http://127.0.0.1:12379"
@@ -566,109 +518,13 @@ apisix:
   proxy_mode: "http&stream"
   ssl:
     enable: true
-    listen:
-      - port: 443
-  enable_ipv6: false
   enable_control: true
   control:
     ip: "127.0.0.1"
     port: 9009
   enable_reuseport: true
-  node_listen:
-    - 80
-  stream_proxy:
-    tcp:
-      - addr: 8443
-      - addr: 8889
-      - addr: 6060
-      - addr: 7070
-
-plugins: # plugin list (sorted by priority)
-  - real-ip                        # priority: 23000
-  - ai                             # priority: 22900
-  - client-control                 # priority: 22000
-  - proxy-control                  # priority: 21990
-  - request-id                     # priority: 12015
-  - zipkin                         # priority: 12011
-  #- skywalking                    # priority: 12010
-  #- opentelemetry                 # priority: 12009
-  - ext-plugin-pre-req             # priority: 12000
-  - fault-injection                # priority: 11000
-  - mocking                        # priority: 10900
-  - serverless-pre-function        # priority: 10000
-  #- batch-requests                # priority: 4010
-  - cors                           # priority: 4000
-  - ip-restriction                 # priority: 3000
-  - ua-restriction                 # priority: 2999
-  - referer-restriction            # priority: 2990
-  - csrf                           # priority: 2980
-  - uri-blocker                    # priority: 2900
-  - request-validation             # priority: 2800
-  - openid-connect                 # priority: 2599
-  - cas-auth                       # priority: 2597
-  - authz-casbin                   # priority: 2560
-  - authz-casdoor                  # priority: 2559
-  - wolf-rbac                      # priority: 2555
-  - ldap-auth                      # priority: 2540
-  - hmac-auth                      # priority: 2530
-  - basic-auth                     # priority: 2520
-  - jwt-auth                       # priority: 2510
-  - key-auth                       # priority: 2500
-  - consumer-restriction           # priority: 2400
-  - forward-auth                   # priority: 2002
-  - opa                            # priority: 2001
-  - authz-keycloak                 # priority: 2000
-  #- error-log-logger              # priority: 1091
-  - proxy-mirror                   # priority: 1010
-  - proxy-cache                    # priority: 1009
-  - proxy-rewrite                  # priority: 1008
-  - workflow                       # priority: 1006
-  - api-breaker                    # priority: 1005
-  - limit-conn                     # priority: 1003
-  - limit-count                    # priority: 1002
-  - limit-req                      # priority: 1001
-  #- node-status                   # priority: 1000
-  - gzip                           # priority: 995
-  - traffic-split                  # priority: 966
-  - redirect                       # priority: 900
-  - response-rewrite               # priority: 899
-  - kafka-proxy                    # priority: 508
-  #- dubbo-proxy                   # priority: 507
-  - grpc-transcode                 # priority: 506
-  - grpc-web                       # priority: 505
-  - public-api                     # priority: 501
-  - prometheus                     # priority: 500
-  - datadog                        # priority: 495
-  - elasticsearch-logger           # priority: 413
-  - echo                           # priority: 412
-  - loggly                         # priority: 411
-  - http-logger                    # priority: 410
-  - splunk-hec-logging             # priority: 409
-  - skywalking-logger              # priority: 408
-  - google-cloud-logging           # priority: 407
-  - sls-logger                     # priority: 406
-  - tcp-logger                     # priority: 405
-  - kafka-logger                   # priority: 403
-  - rocketmq-logger                # priority: 402
-  - syslog                         # priority: 401
-  - udp-logger                     # priority: 400
-  - file-logger                    # priority: 399
-  - clickhouse-logger              # priority: 398
-  - tencent-cloud-cls              # priority: 397
-  - inspect                        # priority: 200
-  #- log-rotate                    # priority: 100
-  # <- recommend to use priority (0, 100) for your custom plugins
-  - example-plugin                 # priority: 0
-  #- gm                            # priority: -43
-  - aws-lambda                     # priority: -1899
-  - azure-functions                # priority: -1900
-  - openwhisk                      # priority: -1901
-  - openfunction                   # priority: -1902
-  - serverless-post-function       # priority: -2000
-  - ext-plugin-post-req            # priority: -3000
-  - ext-plugin-post-resp           # priority: -4000
-`, apisixAdminKey)
-	return &corev1.ConfigMap{
+`
+	configMap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "apisix-gw-config.yaml",
 			Namespace: rbdutil.GetenvDefault("RBD_NAMESPACE", constants.Namespace),
@@ -677,4 +533,9 @@ plugins: # plugin list (sorted by priority)
 			"config.yaml": FormatYAMLConfig(configYaml),
 		},
 	}
+	// the admin api, ports and plugins are filled in from the gateway configuration of the cluster.
+	if _, err := patchAPISIXConfig(configMap, apisixConfigPatches(a.cluster)...); err != nil {
+		logrus.WithError(err).Warn("failed to merge APISIX configuration")
+	}
+	return configMap
 }
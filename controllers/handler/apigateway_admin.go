@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/k8sutil"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// APIGatewayRotateAdminKeyAnnotation on rbd-gateway triggers a rotation of the APISIX admin key whenever its value changes.
+	APIGatewayRotateAdminKeyAnnotation = "rainbond.io/rotate-apisix-admin-key"
+
+	// apisixAdminSecretName is the secret of the APISIX admin key, which is generated for each installation.
+	apisixAdminSecretName = "rbd-gateway-admin-key"
+	apisixAdminKeyKey     = "admin-key"
+	// apisixPreviousAdminKeyKey is the admin key before the rotation, it is the same as the admin key
+	// unless the pods of rbd-gateway are rolling out with a new one.
+	apisixPreviousAdminKeyKey = "previous-admin-key"
+	// apisixAdminKeyRotationTokenAnnotation on the secret records the rotation which generated the admin key.
+	apisixAdminKeyRotationTokenAnnotation = "rainbond.io/admin-key-rotation-token"
+	// apisixAdminKeyChecksumAnnotation restarts the pods when the admin keys are changed.
+	apisixAdminKeyChecksumAnnotation = "rainbond.io/admin-key-checksum"
+
+	apisixAdminKeyEnv         = "APISIX_ADMIN_KEY"
+	apisixPreviousAdminKeyEnv = "APISIX_PREVIOUS_ADMIN_KEY"
+	apisixAdminPort           = 9180
+
+	apiGatewayResyncPeriod = 10 * time.Second
+)
+
+// ensureAdminKeySecret returns the secret of the admin key, a random key is generated if it does not exist.
+func (a *apigateway) ensureAdminKeySecret() (*corev1.Secret, error) {
+	secret, err := getSecret(a.ctx, a.client, a.component.Namespace, apisixAdminSecretName)
+	if err == nil {
+		return secret, nil
+	}
+	if !k8sErrors.IsNotFound(err) {
+		return nil, fmt.Errorf("get secret %s: %v", apisixAdminSecretName, err)
+	}
+	key := randomSecretKey()
+	if key == "" {
+		return nil, fmt.Errorf("generate APISIX admin key")
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      apisixAdminSecretName,
+			Namespace: a.component.Namespace,
+			Labels:    copyLabels(a.labels),
+		},
+		Data: map[string][]byte{
+			apisixAdminKeyKey:         []byte(key),
+			apisixPreviousAdminKeyKey: []byte(key),
+		},
+	}
+	if err := a.client.Create(a.ctx, secret); err != nil {
+		return nil, fmt.Errorf("create secret %s: %v", apisixAdminSecretName, err)
+	}
+	return secret, nil
+}
+
+// rotateAdminKey rotates the admin key in two steps. APISIX accepts both the new and the previous key while the pods
+// are rolling out with the new key, and the ingress controller in the same pod switches to the new key along with it.
+// The previous key is discarded once all the pods use the new key.
+func (a *apigateway) rotateAdminKey() error {
+	a.rotationPending = false
+	token := a.component.Annotations[APIGatewayRotateAdminKeyAnnotation]
+	if token == "" || a.adminKeySecret == nil {
+		return nil
+	}
+	status := a.component.Status.PasswordRotation
+	if status == nil || status.Token != token {
+		status = &rainbondv1alpha1.PasswordRotationStatus{Token: token}
+		a.component.Status.PasswordRotation = status
+	}
+
+	secret := a.adminKeySecret
+	if secret.Annotations[apisixAdminKeyRotationTokenAnnotation] != token {
+		next := randomSecretKey()
+		if next == "" {
+			return fmt.Errorf("generate APISIX admin key")
+		}
+		if err := a.updateAdminKeySecret(func(secret *corev1.Secret) {
+			secret.Data[apisixPreviousAdminKeyKey] = secret.Data[apisixAdminKeyKey]
+			secret.Data[apisixAdminKeyKey] = []byte(next)
+			secret.Annotations[apisixAdminKeyRotationTokenAnnotation] = token
+		}); err != nil {
+			return err
+		}
+		log.Info("rotate APISIX admin key", "token", token)
+		status.Phase = rainbondv1alpha1.PasswordRotationRotating
+		status.User = "admin"
+		status.Message = "waiting for the pods of rbd-gateway to use the new admin key"
+		status.CompletionTime = nil
+		a.rotationPending = true
+		return nil
+	}
+	if status.Phase == rainbondv1alpha1.PasswordRotationCompleted {
+		return nil
+	}
+
+	a.rotationPending = true
+	rolledOut, err := a.adminKeyRolledOut()
+	if err != nil || !rolledOut {
+		return err
+	}
+	if string(secret.Data[apisixPreviousAdminKeyKey]) != string(secret.Data[apisixAdminKeyKey]) {
+		if err := a.updateAdminKeySecret(func(secret *corev1.Secret) {
+			secret.Data[apisixPreviousAdminKeyKey] = secret.Data[apisixAdminKeyKey]
+		}); err != nil {
+			return err
+		}
+		status.Message = "waiting for the pods of rbd-gateway to discard the previous admin key"
+		return nil
+	}
+
+	log.Info("rotated APISIX admin key", "token", token)
+	a.rotationPending = false
+	status.Phase = rainbondv1alpha1.PasswordRotationCompleted
+	status.User = ""
+	status.Message = ""
+	now := metav1.Now()
+	status.CompletionTime = &now
+	return nil
+}
+
+// adminKeyRolledOut returns true if all the pods of rbd-gateway are ready and use the current admin keys.
+func (a *apigateway) adminKeyRolledOut() (bool, error) {
+	pods, err := listPods(a.ctx, a.client, a.component.Namespace, a.labels)
+	if err != nil || len(pods) == 0 {
+		return false, err
+	}
+	checksum := adminKeyChecksum(a.adminKeySecret)
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || !k8sutil.IsPodReady(pod) || pod.Annotations[apisixAdminKeyChecksumAnnotation] != checksum {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (a *apigateway) updateAdminKeySecret(mutate func(secret *corev1.Secret)) error {
+	secret := a.adminKeySecret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	mutate(secret)
+	if err := a.client.Update(a.ctx, secret); err != nil {
+		return fmt.Errorf("update secret %s: %v", secret.Name, err)
+	}
+	a.adminKeySecret = secret
+	return nil
+}
+
+// ResyncPeriod keeps watching the pods of rbd-gateway until the admin key is rotated.
+func (a *apigateway) ResyncPeriod() time.Duration {
+	if a.rotationPending {
+		return apiGatewayResyncPeriod
+	}
+	return 0
+}
+
+func adminKeyChecksum(secret *corev1.Secret) string {
+	if secret == nil {
+		return ""
+	}
+	return checksum(string(secret.Data[apisixAdminKeyKey]), string(secret.Data[apisixPreviousAdminKeyKey]))
+}
+
+func adminKeyEnvs() []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: apisixAdminKeyEnv, ValueFrom: secretKeyRef(apisixAdminSecretName, apisixAdminKeyKey)},
+		{Name: apisixPreviousAdminKeyEnv, ValueFrom: secretKeyRef(apisixAdminSecretName, apisixPreviousAdminKeyKey)},
+	}
+}
@@ -0,0 +1,344 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultAPISIXPlugins are the plugins enabled in rbd-gateway, sorted by priority.
+// skywalking, opentelemetry, batch-requests, error-log-logger, node-status, dubbo-proxy, log-rotate and gm are disabled.
+var defaultAPISIXPlugins = []string{
+	"real-ip", "ai", "client-control", "proxy-control", "request-id", "zipkin",
+	"ext-plugin-pre-req", "fault-injection", "mocking", "serverless-pre-function",
+	"cors", "ip-restriction", "ua-restriction", "referer-restriction", "csrf", "uri-blocker", "request-validation",
+	"openid-connect", "cas-auth", "authz-casbin", "authz-casdoor", "wolf-rbac", "ldap-auth", "hmac-auth",
+	"basic-auth", "jwt-auth", "key-auth", "consumer-restriction", "forward-auth", "opa", "authz-keycloak",
+	"proxy-mirror", "proxy-cache", "proxy-rewrite", "workflow", "api-breaker", "limit-conn", "limit-count", "limit-req",
+	"gzip", "traffic-split", "redirect", "response-rewrite", "kafka-proxy", "grpc-transcode", "grpc-web", "public-api",
+	"prometheus", "datadog", "elasticsearch-logger", "echo", "loggly", "http-logger", "splunk-hec-logging",
+	"skywalking-logger", "google-cloud-logging", "sls-logger", "tcp-logger", "kafka-logger", "rocketmq-logger",
+	"syslog", "udp-logger", "file-logger", "clickhouse-logger", "tencent-cloud-cls", "inspect", "example-plugin",
+	"aws-lambda", "azure-functions", "openwhisk", "openfunction", "serverless-post-function",
+	"ext-plugin-post-req", "ext-plugin-post-resp",
+}
+
+// apiGatewayConfig returns the gateway configuration of the cluster with the defaults filled in.
+func apiGatewayConfig(cluster *rainbondv1alpha1.RainbondCluster) *rainbondv1alpha1.APIGatewayConfig {
+	config := &rainbondv1alpha1.APIGatewayConfig{}
+	if cluster != nil && cluster.Spec.APIGateway != nil {
+		config = cluster.Spec.APIGateway.DeepCopy()
+	}
+	if len(config.HTTPPorts) == 0 {
+		config.HTTPPorts = []int32{80}
+	}
+	if len(config.HTTPSPorts) == 0 {
+		config.HTTPSPorts = []int32{443}
+	}
+	if len(config.StreamTCPPorts) == 0 {
+		config.StreamTCPPorts = []int32{8443, 8889, 6060, 7070}
+	}
+	if len(config.Plugins) == 0 {
+		config.Plugins = defaultAPISIXPlugins
+	}
+	if len(config.RealIPTrustedCIDRs) > 0 && config.RealIPHeader == "" {
+		config.RealIPHeader = "X-Real-IP"
+	}
+	return config
+}
+
+// patchAPISIXConfig applies the patches to config.yaml of the ConfigMap. The settings the patches do not touch,
+// including the comments, are kept as they are. It returns true if config.yaml is changed.
+func patchAPISIXConfig(configMap *corev1.ConfigMap, patches ...func(root *yaml.Node) bool) (bool, error) {
+	config, ok := configMap.Data["config.yaml"]
+	if !ok {
+		return false, fmt.Errorf("config.yaml not found in ConfigMap %s/%s", configMap.Namespace, configMap.Name)
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(config), &document); err != nil {
+		return false, fmt.Errorf("parse config.yaml: %w", err)
+	}
+	if len(document.Content) != 1 || document.Content[0].Kind != yaml.MappingNode {
+		return false, fmt.Errorf("config.yaml root must be a mapping")
+	}
+
+	changed := false
+	for _, patch := range patches {
+		changed = patch(document.Content[0]) || changed
+	}
+	if !changed {
+		return false, nil
+	}
+	updated, err := yaml.Marshal(&document)
+	if err != nil {
+		return false, fmt.Errorf("marshal config.yaml: %w", err)
+	}
+	configMap.Data["config.yaml"] = string(updated)
+	return true, nil
+}
+
+// apisixConfigPatches returns the patches to merge the configuration of the cluster into config.yaml.
+func apisixConfigPatches(cluster *rainbondv1alpha1.RainbondCluster) []func(root *yaml.Node) bool {
+	config := apiGatewayConfig(cluster)
+	return []func(root *yaml.Node) bool{apisixAdminConfigPatch(config), apisixGatewayConfigPatch(config)}
+}
+
+// apisixAdminConfigPatch locks down the admin api. It only listens on the loopback unless the allowed addresses are
+// specified, and accepts both the current and the previous admin key, which are injected by environment variables,
+// so that the ingress controller keeps working while the key is being rotated.
+func apisixAdminConfigPatch(config *rainbondv1alpha1.APIGatewayConfig) func(root *yaml.Node) bool {
+	return func(root *yaml.Node) bool {
+		deployment, changed := ensureYAMLMapping(root, "deployment")
+		admin, adminChanged := ensureYAMLMapping(deployment, "admin")
+		changed = changed || adminChanged
+		changed = setYAMLScalar(admin, "admin_key_required", "!!bool", "true") || changed
+		changed = setYAMLScalar(admin, "admin_api_version", "!!str", "v3") || changed
+
+		adminKeys, keysChanged := ensureYAMLSequence(admin, "admin_key")
+		changed = changed || keysChanged
+		for _, key := range []struct{ name, env string }{{"admin", apisixAdminKeyEnv}, {"admin-previous", apisixPreviousAdminKeyEnv}} {
+			name, env := key.name, key.env
+			entry := findYAMLMappingByScalar(adminKeys, "name", name)
+			if entry == nil {
+				entry = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				adminKeys.Content = append(adminKeys.Content, entry)
+				changed = true
+			}
+			changed = setYAMLScalar(entry, "name", "!!str", name) || changed
+			changed = setYAMLScalar(entry, "key", "!!str", "${{"+env+"}}") || changed
+			changed = setYAMLScalar(entry, "role", "!!str", "admin") || changed
+		}
+
+		allowAdmin := append([]string{"127.0.0.0/8"}, config.AdminAllowCIDRs...)
+		changed = setYAMLValueIfChanged(admin, "allow_admin", yamlStringSequence(yamlMappingValue(admin, "allow_admin"), allowAdmin)) || changed
+		adminListen, listenChanged := ensureYAMLMapping(admin, "admin_listen")
+		changed = changed || listenChanged
+		ip := "127.0.0.1"
+		if len(config.AdminAllowCIDRs) > 0 {
+			ip = "0.0.0.0"
+		}
+		changed = setYAMLScalar(adminListen, "ip", "!!str", ip) || changed
+		changed = setYAMLScalar(adminListen, "port", "!!int", strconv.Itoa(apisixAdminPort)) || changed
+		return changed
+	}
+}
+
+// apisixGatewayConfigPatch merges the gateway configuration into config.yaml. The ports, ipv6 and plugins are always
+// managed, while the real ip, log format and worker processes are only managed once they are specified.
+func apisixGatewayConfigPatch(config *rainbondv1alpha1.APIGatewayConfig) func(root *yaml.Node) bool {
+	return func(root *yaml.Node) bool {
+		apisix, changed := ensureYAMLMapping(root, "apisix")
+		changed = setYAMLValueIfChanged(apisix, "node_listen", yamlPortSequence(yamlMappingValue(apisix, "node_listen"), "", config.HTTPPorts)) || changed
+		ssl, sslChanged := ensureYAMLMapping(apisix, "ssl")
+		changed = changed || sslChanged
+		changed = setYAMLValueIfChanged(ssl, "listen", yamlPortSequence(yamlMappingValue(ssl, "listen"), "port", config.HTTPSPorts)) || changed
+		changed = setYAMLScalar(apisix, "enable_ipv6", "!!bool", strconv.FormatBool(config.EnableIPv6)) || changed
+
+		streamProxy, streamChanged := ensureYAMLMapping(apisix, "stream_proxy")
+		changed = changed || streamChanged
+		changed = setYAMLValueIfChanged(streamProxy, "tcp", yamlPortSequence(yamlMappingValue(streamProxy, "tcp"), "addr", config.StreamTCPPorts)) || changed
+		if len(config.StreamUDPPorts) > 0 {
+			changed = setYAMLValueIfChanged(streamProxy, "udp", yamlPortSequence(yamlMappingValue(streamProxy, "udp"), "addr", config.StreamUDPPorts)) || changed
+		} else {
+			changed = deleteYAMLKey(streamProxy, "udp") || changed
+		}
+
+		disabled := make(map[string]struct{}, len(config.DisabledPlugins))
+		for _, plugin := range config.DisabledPlugins {
+			disabled[plugin] = struct{}{}
+		}
+		var plugins []string
+		for _, plugin := range config.Plugins {
+			if _, ok := disabled[plugin]; !ok {
+				plugins = append(plugins, plugin)
+			}
+		}
+		changed = setYAMLValueIfChanged(root, "plugins", yamlStringSequence(yamlMappingValue(root, "plugins"), plugins)) || changed
+
+		if len(config.RealIPTrustedCIDRs) == 0 && config.AccessLogFormat == "" && config.WorkerProcesses == "" {
+			return changed
+		}
+		nginxConfig, nginxChanged := ensureYAMLMapping(root, "nginx_config")
+		changed = changed || nginxChanged
+		if config.WorkerProcesses != "" {
+			tag := "!!str"
+			if _, err := strconv.Atoi(config.WorkerProcesses); err == nil {
+				tag = "!!int"
+			}
+			changed = setYAMLScalar(nginxConfig, "worker_processes", tag, config.WorkerProcesses) || changed
+		}
+		if len(config.RealIPTrustedCIDRs) == 0 && config.AccessLogFormat == "" {
+			return changed
+		}
+		http, httpChanged := ensureYAMLMapping(nginxConfig, "http")
+		changed = changed || httpChanged
+		if len(config.RealIPTrustedCIDRs) > 0 {
+			changed = setYAMLScalar(http, "real_ip_header", "!!str", config.RealIPHeader) || changed
+			changed = setYAMLValueIfChanged(http, "real_ip_from", yamlStringSequence(yamlMappingValue(http, "real_ip_from"), config.RealIPTrustedCIDRs)) || changed
+		}
+		if config.AccessLogFormat != "" {
+			changed = setYAMLScalar(http, "access_log_format", "!!str", config.AccessLogFormat) || changed
+		}
+		return changed
+	}
+}
+
+// yamlPortSequence returns a sequence of the ports, either plain ports or mappings with the port in key.
+// The existing items of the same ports are reused, so that their other settings and comments are kept.
+func yamlPortSequence(existing *yaml.Node, key string, ports []int32) *yaml.Node {
+	sequence := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, port := range ports {
+		value := strconv.Itoa(int(port))
+		var item *yaml.Node
+		if existing != nil && existing.Kind == yaml.SequenceNode {
+			for _, candidate := range existing.Content {
+				if key == "" && candidate.Kind == yaml.ScalarNode && candidate.Value == value {
+					item = candidate
+					break
+				}
+				if field := yamlMappingValue(candidate, key); key != "" && candidate.Kind == yaml.MappingNode && field != nil && field.Value == value {
+					item = candidate
+					break
+				}
+			}
+		}
+		if item == nil {
+			item = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: value}
+			if key != "" {
+				item = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+					{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, item,
+				}}
+			}
+		}
+		sequence.Content = append(sequence.Content, item)
+	}
+	return sequence
+}
+
+// yamlStringSequence returns a sequence of the values, reusing the existing items to keep their comments.
+func yamlStringSequence(existing *yaml.Node, values []string) *yaml.Node {
+	sequence := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, value := range values {
+		var item *yaml.Node
+		if existing != nil && existing.Kind == yaml.SequenceNode {
+			for _, candidate := range existing.Content {
+				if candidate.Kind == yaml.ScalarNode && candidate.Value == value {
+					item = candidate
+					break
+				}
+			}
+		}
+		if item == nil {
+			item = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		}
+		sequence.Content = append(sequence.Content, item)
+	}
+	return sequence
+}
+
+func ensureYAMLMapping(parent *yaml.Node, key string) (*yaml.Node, bool) {
+	if existing := yamlMappingValue(parent, key); existing != nil && existing.Kind == yaml.MappingNode {
+		return existing, false
+	}
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setYAMLValue(parent, key, value)
+	return value, true
+}
+
+func ensureYAMLSequence(parent *yaml.Node, key string) (*yaml.Node, bool) {
+	if existing := yamlMappingValue(parent, key); existing != nil && existing.Kind == yaml.SequenceNode {
+		return existing, false
+	}
+	value := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	setYAMLValue(parent, key, value)
+	return value, true
+}
+
+func setYAMLScalar(parent *yaml.Node, key, tag, value string) bool {
+	return setYAMLValueIfChanged(parent, key, &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value})
+}
+
+// setYAMLValueIfChanged sets the value of key unless the existing one is equal to it, regardless of comments and styles.
+func setYAMLValueIfChanged(parent *yaml.Node, key string, value *yaml.Node) bool {
+	if yamlNodeEqual(yamlMappingValue(parent, key), value) {
+		return false
+	}
+	setYAMLValue(parent, key, value)
+	return true
+}
+
+func setYAMLValue(parent *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			parent.Content[i+1] = value
+			return
+		}
+	}
+	parent.Content = append(parent.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		value,
+	)
+}
+
+func deleteYAMLKey(parent *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			parent.Content = append(parent.Content[:i], parent.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func yamlMappingValue(parent *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			return parent.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func findYAMLMappingByScalar(sequence *yaml.Node, key, value string) *yaml.Node {
+	for _, item := range sequence.Content {
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		if field := yamlMappingValue(item, key); field != nil && field.Value == value {
+			return item
+		}
+	}
+	return nil
+}
+
+// yamlNodeEqual compares the content of the nodes, ignoring comments and styles.
+func yamlNodeEqual(a, b *yaml.Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Kind == yaml.AliasNode {
+		return yamlNodeEqual(a.Alias, b)
+	}
+	if b.Kind == yaml.AliasNode {
+		return yamlNodeEqual(a, b.Alias)
+	}
+	if a.Kind != b.Kind {
+		return false
+	}
+	if a.Kind == yaml.ScalarNode {
+		return a.ShortTag() == b.ShortTag() && a.Value == b.Value
+	}
+	if len(a.Content) != len(b.Content) {
+		return false
+	}
+	for i := range a.Content {
+		if !yamlNodeEqual(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// apiGatewayUDPServiceName is the service of the udp ports, a LoadBalancer service can not mix the protocols
+// before kubernetes 1.24.
+var apiGatewayUDPServiceName = ApiGatewayName + "-udp"
+
+const apiGatewayDefaultReplicas int32 = 2
+
+var _ ResourcesDeleter = &apigateway{}
+var _ Replicaser = &apigateway{}
+
+// workload returns the workload of rbd-gateway for the gateway mode of the cluster.
+func (a *apigateway) workload() client.Object {
+	switch a.cluster.GatewayMode() {
+	case rainbondv1alpha1.GatewayModeDaemonSet:
+		return a.daemonSet()
+	case rainbondv1alpha1.GatewayModeLoadBalancer, rainbondv1alpha1.GatewayModeNodePort:
+		return a.deployForService()
+	default:
+		return a.deploy()
+	}
+}
+
+// serviceMode returns true if rbd-gateway is exposed by services instead of the host network.
+func (a *apigateway) serviceMode() bool {
+	mode := a.cluster.GatewayMode()
+	return mode == rainbondv1alpha1.GatewayModeLoadBalancer || mode == rainbondv1alpha1.GatewayModeNodePort
+}
+
+// checkHostNetworkNodes makes sure rbd-gateway with the host network can be scheduled, it runs on
+// nodesForGateway, or on the nodes selected by the affinity of rbd-gateway.
+func (a *apigateway) checkHostNetworkNodes() error {
+	if a.cluster.GatewayMode() != rainbondv1alpha1.GatewayModeHostNetwork {
+		return nil
+	}
+	if len(a.gatewayNodeNames()) == 0 && a.component.Spec.Affinity == nil {
+		return fmt.Errorf("no node for %s with the host network, specify nodesForGateway or the affinity of %s", ApiGatewayName, ApiGatewayName)
+	}
+	return nil
+}
+
+// gatewayNodeNames returns the names of nodesForGateway.
+func (a *apigateway) gatewayNodeNames() []string {
+	var nodeNames []string
+	for _, n := range a.cluster.Spec.NodesForGateway {
+		nodeNames = append(nodeNames, n.Name)
+
+		//转换小写如果不一致，则增加一份小写，兼容rke2，rke2安装的k8s的hostname被转小写了
+		if strings.ToLower(n.Name) != n.Name {
+			nodeNames = append(nodeNames, strings.ToLower(n.Name))
+		}
+	}
+	return nodeNames
+}
+
+// daemonSet runs rbd-gateway with the host network on every node selected by the node selector,
+// or on nodesForGateway if there is no node selector.
+func (a *apigateway) daemonSet() client.Object {
+	config := apiGatewayConfig(a.cluster)
+	var affinity *corev1.Affinity
+	if nodeNames := a.gatewayNodeNames(); len(config.NodeSelector) == 0 && len(nodeNames) > 0 {
+		affinity = affinityForRequiredNodes(nodeNames)
+	}
+	affinity = mergeAffinity(affinity, a.component.Spec.Affinity)
+
+	template := a.podTemplate(affinity, true)
+	template.Spec.NodeSelector = config.NodeSelector
+	maxUnavailable := intstr.FromInt(1)
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ApiGatewayName,
+			Namespace: a.component.Namespace,
+			Labels:    a.labels,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: a.labels,
+			},
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
+				Type: appsv1.RollingUpdateDaemonSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDaemonSet{
+					MaxUnavailable: &maxUnavailable,
+				},
+			},
+			Template: template,
+		},
+	}
+}
+
+// deployForService runs rbd-gateway without the host network, it is exposed by the services.
+func (a *apigateway) deployForService() client.Object {
+	config := apiGatewayConfig(a.cluster)
+	affinity := mergeAffinity(nil, a.component.Spec.Affinity)
+	if affinity == nil {
+		affinity = &corev1.Affinity{}
+	} else {
+		affinity = affinity.DeepCopy()
+	}
+	if affinity.PodAntiAffinity == nil {
+		affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+	}
+	affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+		affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+		corev1.WeightedPodAffinityTerm{
+			Weight: 100,
+			PodAffinityTerm: corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"name": ApiGatewayName},
+				},
+				TopologyKey: "kubernetes.io/hostname",
+			},
+		},
+	)
+
+	template := a.podTemplate(affinity, false)
+	template.Spec.NodeSelector = config.NodeSelector
+	replicas := a.serviceReplicas()
+	// keeps the gateway available while rolling out.
+	maxUnavailable := intstr.FromInt(0)
+	maxSurge := intstr.FromInt(1)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ApiGatewayName,
+			Namespace: a.component.Namespace,
+			Labels:    a.labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: a.labels,
+			},
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RollingUpdateDeploymentStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDeployment{
+					MaxUnavailable: &maxUnavailable,
+					MaxSurge:       &maxSurge,
+				},
+			},
+			Template: template,
+		},
+	}
+}
+
+func (a *apigateway) serviceReplicas() int32 {
+	if config := a.cluster.Spec.APIGateway; config != nil && config.Replicas != nil {
+		return *config.Replicas
+	}
+	return apiGatewayDefaultReplicas
+}
+
+// containerPorts returns the ports APISIX listens on.
+func (a *apigateway) containerPorts() []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, port := range a.servicePorts() {
+		ports = append(ports, corev1.ContainerPort{
+			Name:          port.Name,
+			ContainerPort: port.Port,
+			Protocol:      port.Protocol,
+		})
+	}
+	return ports
+}
+
+// servicePorts returns the ports of the http, https and stream proxy of APISIX.
+func (a *apigateway) servicePorts() []corev1.ServicePort {
+	config := apiGatewayConfig(a.cluster)
+	var ports []corev1.ServicePort
+	add := func(prefix string, protocol corev1.Protocol, list []int32) {
+		for _, port := range list {
+			ports = append(ports, corev1.ServicePort{
+				Name:       fmt.Sprintf("%s-%d", prefix, port),
+				Protocol:   protocol,
+				Port:       port,
+				TargetPort: intstr.FromInt(int(port)),
+			})
+		}
+	}
+	add("http", corev1.ProtocolTCP, config.HTTPPorts)
+	add("https", corev1.ProtocolTCP, config.HTTPSPorts)
+	add("tcp", corev1.ProtocolTCP, config.StreamTCPPorts)
+	add("udp", corev1.ProtocolUDP, config.StreamUDPPorts)
+	return ports
+}
+
+// services returns the services which expose rbd-gateway in LoadBalancer and NodePort mode,
+// the udp ports are exposed by a separate service.
+func (a *apigateway) services() []client.Object {
+	var tcpPorts, udpPorts []corev1.ServicePort
+	for _, port := range a.servicePorts() {
+		if port.Protocol == corev1.ProtocolUDP {
+			udpPorts = append(udpPorts, port)
+		} else {
+			tcpPorts = append(tcpPorts, port)
+		}
+	}
+	objs := []client.Object{a.service(ApiGatewayName, tcpPorts)}
+	if len(udpPorts) > 0 {
+		objs = append(objs, a.service(apiGatewayUDPServiceName, udpPorts))
+	}
+	return objs
+}
+
+func (a *apigateway) service(name string, ports []corev1.ServicePort) *corev1.Service {
+	config := apiGatewayConfig(a.cluster)
+	serviceType := corev1.ServiceTypeNodePort
+	if a.cluster.GatewayMode() == rainbondv1alpha1.GatewayModeLoadBalancer {
+		serviceType = corev1.ServiceTypeLoadBalancer
+	}
+	var annotations map[string]string
+	if len(config.ServiceAnnotations) > 0 {
+		annotations = make(map[string]string, len(config.ServiceAnnotations))
+		for k, v := range config.ServiceAnnotations {
+			annotations[k] = v
+		}
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   a.component.Namespace,
+			Labels:      copyLabels(a.labels),
+			Annotations: annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:                  serviceType,
+			Ports:                 ports,
+			Selector:              a.labels,
+			ExternalTrafficPolicy: config.ExternalTrafficPolicy,
+		},
+	}
+}
+
+// ResourcesNeedDelete deletes the workload and the services left by the previous gateway mode.
+func (a *apigateway) ResourcesNeedDelete() []client.Object {
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: a.component.Namespace}
+	}
+	var objs []client.Object
+	if a.cluster.GatewayMode() == rainbondv1alpha1.GatewayModeDaemonSet {
+		objs = append(objs, &appsv1.Deployment{ObjectMeta: meta(ApiGatewayName)})
+	} else {
+		objs = append(objs, &appsv1.DaemonSet{ObjectMeta: meta(ApiGatewayName)})
+	}
+	if !a.serviceMode() {
+		objs = append(objs, &corev1.Service{ObjectMeta: meta(ApiGatewayName)})
+	}
+	if !a.serviceMode() || len(apiGatewayConfig(a.cluster).StreamUDPPorts) == 0 {
+		objs = append(objs, &corev1.Service{ObjectMeta: meta(apiGatewayUDPServiceName)})
+	}
+	return objs
+}
+
+// Replicas returns the number of the nodes scheduled in DaemonSet mode, and the replicas in LoadBalancer and NodePort mode.
+func (a *apigateway) Replicas() *int32 {
+	switch a.cluster.GatewayMode() {
+	case rainbondv1alpha1.GatewayModeDaemonSet:
+		ds := &appsv1.DaemonSet{}
+		err := a.client.Get(a.ctx, client.ObjectKey{Namespace: a.component.Namespace, Name: ApiGatewayName}, ds)
+		if err != nil || ds.Status.DesiredNumberScheduled == 0 {
+			return nil
+		}
+		return commonutil.Int32(ds.Status.DesiredNumberScheduled)
+	case rainbondv1alpha1.GatewayModeLoadBalancer, rainbondv1alpha1.GatewayModeNodePort:
+		return commonutil.Int32(a.serviceReplicas())
+	}
+	return nil
+}
+
+// exposeServices returns the services of rbd-gateway, there is no service with the host network.
+func (a *apigateway) exposeServices() []client.Object {
+	if !a.serviceMode() {
+		return nil
+	}
+	return a.services()
+}
@@ -2,8 +2,10 @@ package handler
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
 	v2 "github.com/goodrain/rainbond-operator/api/v2"
@@ -13,6 +15,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestAPIGatewayResourcesPreserveConfiguredEphemeralStorageRequest(t *testing.T) {
@@ -75,8 +78,8 @@ func TestAPIGatewayDeploymentIsCriticalAndRunsOncePerGatewayNode(t *testing.T) {
 	if got := ingressContainer.Image; got != "example.com/apisix-ingress:1.8.4" {
 		t.Fatalf("expected APISIX ingress controller 1.8.4 image, got %q", got)
 	}
-	if !strings.Contains(strings.Join(ingressContainer.Command, " "), "--apisix-admin-api-version v3") {
-		t.Fatalf("expected ingress controller to use APISIX Admin API v3, got %v", ingressContainer.Command)
+	if !strings.Contains(apisixIngressConfig, "admin_api_version: v3") {
+		t.Fatalf("expected ingress controller to use APISIX Admin API v3, got:\n%s", apisixIngressConfig)
 	}
 	if apisixContainer == nil {
 		t.Fatal("expected apisix container")
@@ -144,14 +147,52 @@ func TestAPIGatewayConfigUsesSameAdminKeyAndAPIVersionAsIngressController(t *tes
 		"admin_key_required: true",
 		"admin_key:",
 		"name: admin",
-		"key: " + apisixAdminKey,
+		"key: ${{APISIX_ADMIN_KEY}}",
+		"name: admin-previous",
+		"key: ${{APISIX_PREVIOUS_ADMIN_KEY}}",
 		"role: admin",
 		"admin_api_version: v3",
+		"ip: 127.0.0.1\n            port: 9180",
 	} {
 		if !strings.Contains(config, expected) {
 			t.Fatalf("expected APISIX config to contain %q, got:\n%s", expected, config)
 		}
 	}
+	if strings.Contains(config, "0.0.0.0/0") {
+		t.Fatalf("expected the admin api to be locked down, got:\n%s", config)
+	}
+
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: ApiGatewayName, Namespace: "rbd-system"},
+		Spec:       rainbondv1alpha1.RbdComponentSpec{Image: "apisix-ingress@apisix"},
+	}
+	handler := &apigateway{
+		component: component,
+		cluster: &rainbondv1alpha1.RainbondCluster{Spec: rainbondv1alpha1.RainbondClusterSpec{
+			NodesForGateway: []*rainbondv1alpha1.K8sNode{{Name: "gateway-1"}},
+		}},
+		labels: LabelsForRainbondComponent(component),
+	}
+	containers := handler.deploy().(*appsv1.Deployment).Spec.Template.Spec.Containers
+	if command := strings.Join(containers[0].Command, " "); strings.Contains(command, "admin-key") || !strings.Contains(command, "--config-path") {
+		t.Fatalf("expected the ingress controller to read the admin key from the config file, got %s", command)
+	}
+	ingressConfig := handler.ingressConfigMap().(*corev1.ConfigMap).Data["config.yaml"]
+	if !strings.Contains(ingressConfig, `default_cluster_admin_key: "{{ .APISIX_ADMIN_KEY }}"`) {
+		t.Fatalf("expected the config file to be rendered with the admin key from the environment, got:\n%s", ingressConfig)
+	}
+	for _, container := range containers {
+		var found bool
+		for _, env := range container.Env {
+			if env.Name == "APISIX_ADMIN_KEY" && env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil &&
+				env.ValueFrom.SecretKeyRef.Name == apisixAdminSecretName {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected %s to read the admin key from the secret", container.Name)
+		}
+	}
 }
 
 func TestAPIGatewayResourcesMigratesAdminConfigWithoutReplacingCustomSettings(t *testing.T) {
@@ -210,18 +251,21 @@ custom_setting:
 	for _, expected := range []string{
 		"admin_key_required: true",
 		"admin_api_version: v3",
-		"key: " + apisixAdminKey,
+		"key: ${{APISIX_ADMIN_KEY}}",
 		"key: read-only",
 		"role: viewer",
-		"10.0.0.0/8",
 		"custom_setting:",
 		"preserved: true",
+		"- 127.0.0.0/8",
 	} {
 		if !strings.Contains(config, expected) {
 			t.Fatalf("expected migrated APISIX config to contain %q, got:\n%s", expected, config)
 		}
 	}
-	changed, err := ensureAPISIXAdminConfig(migrated)
+	if strings.Contains(config, "10.0.0.0/8") {
+		t.Fatalf("expected the admin api to only allow the loopback, got:\n%s", config)
+	}
+	changed, err := patchAPISIXConfig(migrated, apisixConfigPatches(handler.cluster)...)
 	if err != nil {
 		t.Fatalf("expected migrated APISIX config to remain valid: %v", err)
 	}
@@ -229,3 +273,356 @@ custom_setting:
 		t.Fatal("expected APISIX admin config migration to be idempotent")
 	}
 }
+
+func TestAPIGatewayResourcesMergesTypedConfig(t *testing.T) {
+	t.Parallel()
+
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: ApiGatewayName, Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RbdComponentSpec{
+			Image: "example.com/apisix-ingress:1.8.4@example.com/apisix:3.14.1-debian",
+		},
+	}
+	existing := (&apigateway{}).configmap().(*corev1.ConfigMap)
+	existing.Namespace = component.Namespace
+	existing.Data["config.yaml"] += "custom_setting:\n  preserved: true\n"
+	k8sClient := &staticClient{
+		scheme: runtime.NewScheme(),
+		objects: map[client.ObjectKey]client.Object{
+			{Name: existing.Name, Namespace: existing.Namespace}: existing,
+		},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			NodesForGateway: []*rainbondv1alpha1.K8sNode{{Name: "gateway-1"}},
+		},
+	}
+	resources := func() (*corev1.ConfigMap, *appsv1.Deployment) {
+		handler := &apigateway{
+			ctx:       context.Background(),
+			client:    k8sClient,
+			component: component,
+			cluster:   cluster,
+			labels:    LabelsForRainbondComponent(component),
+		}
+		var configMap *corev1.ConfigMap
+		var deployment *appsv1.Deployment
+		for _, object := range handler.Resources() {
+			switch o := object.(type) {
+			case *corev1.ConfigMap:
+				if o.Name != apisixIngressConfigName {
+					configMap = o
+				}
+			case *appsv1.Deployment:
+				deployment = o
+			}
+		}
+		return configMap, deployment
+	}
+
+	if configMap, _ := resources(); configMap != nil {
+		t.Fatalf("expected the default config to be up to date, got:\n%s", configMap.Data["config.yaml"])
+	}
+	_, deployment := resources()
+	checksum := deployment.Spec.Template.Annotations[apisixConfigChecksumAnnotation]
+
+	cluster.Spec.APIGateway = &rainbondv1alpha1.APIGatewayConfig{
+		HTTPPorts:          []int32{8080},
+		StreamUDPPorts:     []int32{53},
+		DisabledPlugins:    []string{"ai", "example-plugin"},
+		EnableIPv6:         true,
+		RealIPTrustedCIDRs: []string{"10.0.0.0/8"},
+		WorkerProcesses:    "4",
+	}
+	configMap, deployment := resources()
+	if configMap == nil {
+		t.Fatal("expected the typed gateway config to be merged")
+	}
+	config := configMap.Data["config.yaml"]
+	for _, expected := range []string{
+		"- 8080",
+		"- port: 443",
+		"- addr: 7070",
+		"udp:\n            - addr: 53",
+		"enable_ipv6: true",
+		"real_ip_header: X-Real-IP",
+		"- 10.0.0.0/8",
+		"worker_processes: 4",
+		"- prometheus",
+		"key: ${{APISIX_ADMIN_KEY}}",
+		"preserved: true",
+	} {
+		if !strings.Contains(config, expected) {
+			t.Fatalf("expected APISIX config to contain %q, got:\n%s", expected, config)
+		}
+	}
+	for _, unexpected := range []string{"- 80\n", "- ai\n", "- example-plugin\n"} {
+		if strings.Contains(config, unexpected) {
+			t.Fatalf("expected APISIX config not to contain %q, got:\n%s", unexpected, config)
+		}
+	}
+	if deployment.Spec.Template.Annotations[apisixConfigChecksumAnnotation] == checksum {
+		t.Fatal("expected the pods to be restarted with the changed config")
+	}
+
+	existing.Data["config.yaml"] = config
+	if configMap, _ := resources(); configMap != nil {
+		t.Fatal("expected merging the typed gateway config to be idempotent")
+	}
+}
+
+func TestAPIGatewayAdminKeyRotation(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: ApiGatewayName, Namespace: "rbd-system"},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{NodesForGateway: []*rainbondv1alpha1.K8sNode{{Name: "gateway-1"}}},
+	}
+	handler := NewApiGateway(context.Background(), cli, component, cluster).(*apigateway)
+	if err := handler.Before(); err != nil {
+		t.Fatal(err)
+	}
+	key := string(handler.adminKeySecret.Data[apisixAdminKeyKey])
+	if key == "" || string(handler.adminKeySecret.Data[apisixPreviousAdminKeyKey]) != key {
+		t.Fatalf("expected a random admin key to be generated, got %v", handler.adminKeySecret.Data)
+	}
+	if secret, err := handler.ensureAdminKeySecret(); err != nil || string(secret.Data[apisixAdminKeyKey]) != key {
+		t.Fatalf("expected the admin key to be kept, got %v: %v", secret, err)
+	}
+
+	pod := dbPod(ApiGatewayName+"-0", "10.0.0.1", true, time.Now())
+	pod.Labels = handler.labels
+	pod.Annotations = map[string]string{apisixAdminKeyChecksumAnnotation: adminKeyChecksum(handler.adminKeySecret)}
+	if err := cli.Create(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	rollOut := func() {
+		pod.Annotations[apisixAdminKeyChecksumAnnotation] = adminKeyChecksum(handler.adminKeySecret)
+		if err := cli.Update(context.Background(), pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate := func() *rainbondv1alpha1.PasswordRotationStatus {
+		if err := handler.rotateAdminKey(); err != nil {
+			t.Fatal(err)
+		}
+		return component.Status.PasswordRotation
+	}
+
+	component.Annotations = map[string]string{APIGatewayRotateAdminKeyAnnotation: "1"}
+	status := rotate()
+	next := string(handler.adminKeySecret.Data[apisixAdminKeyKey])
+	if next == key || string(handler.adminKeySecret.Data[apisixPreviousAdminKeyKey]) != key {
+		t.Fatal("expected APISIX to accept both the new and the previous admin key")
+	}
+	if status.Phase != rainbondv1alpha1.PasswordRotationRotating || handler.ResyncPeriod() == 0 {
+		t.Fatalf("expected the rotation to be in progress, got %+v", status)
+	}
+
+	// the previous key is kept until the pods use the new one.
+	rotate()
+	if string(handler.adminKeySecret.Data[apisixPreviousAdminKeyKey]) != key {
+		t.Fatal("expected the previous admin key to be kept until the pods are rolled out")
+	}
+	rollOut()
+	rotate()
+	if string(handler.adminKeySecret.Data[apisixPreviousAdminKeyKey]) != next {
+		t.Fatal("expected the previous admin key to be discarded")
+	}
+	if status := rotate(); status.Phase != rainbondv1alpha1.PasswordRotationRotating {
+		t.Fatalf("expected to wait for the pods to discard the previous admin key, got %+v", status)
+	}
+	rollOut()
+	if status := rotate(); status.Phase != rainbondv1alpha1.PasswordRotationCompleted || handler.ResyncPeriod() != 0 {
+		t.Fatalf("expected the rotation to be completed, got %+v", status)
+	}
+	if rotate(); string(handler.adminKeySecret.Data[apisixAdminKeyKey]) != next {
+		t.Fatal("expected the admin key not to be rotated again with the same token")
+	}
+}
+
+func TestAPIGatewayLoadBalancerMode(t *testing.T) {
+	t.Parallel()
+
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: ApiGatewayName, Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RbdComponentSpec{
+			Image: "example.com/apisix-ingress:1.8.4@example.com/apisix:3.14.1-debian",
+		},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			NodesForGateway: []*rainbondv1alpha1.K8sNode{{Name: "gateway-1"}},
+			APIGateway: &rainbondv1alpha1.APIGatewayConfig{
+				Mode:                  rainbondv1alpha1.GatewayModeLoadBalancer,
+				NodeSelector:          map[string]string{"node-role/gateway": "true"},
+				ServiceAnnotations:    map[string]string{"service.beta.kubernetes.io/alibaba-cloud-loadbalancer-spec": "slb.s1.small"},
+				ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+				StreamUDPPorts:        []int32{5353},
+			},
+		},
+	}
+	handler := &apigateway{
+		ctx:       context.Background(),
+		component: component,
+		cluster:   cluster,
+		labels:    LabelsForRainbondComponent(component),
+	}
+
+	deployment, ok := handler.workload().(*appsv1.Deployment)
+	if !ok {
+		t.Fatalf("expected *appsv1.Deployment, got %T", handler.workload())
+	}
+	podSpec := deployment.Spec.Template.Spec
+	if podSpec.HostNetwork {
+		t.Fatal("expected rbd-gateway to run without the host network")
+	}
+	if podSpec.SecurityContext != nil || podSpec.Containers[1].SecurityContext.Privileged != nil {
+		t.Fatal("expected rbd-gateway to run without privileges outside the host network")
+	}
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != apiGatewayDefaultReplicas {
+		t.Fatalf("expected %d replicas, got %v", apiGatewayDefaultReplicas, deployment.Spec.Replicas)
+	}
+	if podSpec.NodeSelector["node-role/gateway"] != "true" {
+		t.Fatalf("expected the node selector of the gateway, got %v", podSpec.NodeSelector)
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity != nil {
+		t.Fatalf("expected no node affinity for nodesForGateway, got %#v", podSpec.Affinity)
+	}
+	var udp bool
+	for _, port := range podSpec.Containers[1].Ports {
+		if port.Name == "udp-5353" && port.ContainerPort == 5353 && port.Protocol == corev1.ProtocolUDP {
+			udp = true
+		}
+	}
+	if !udp {
+		t.Fatalf("expected the udp port to be declared, got %v", podSpec.Containers[1].Ports)
+	}
+
+	services := handler.exposeServices()
+	if len(services) != 2 {
+		t.Fatalf("expected the tcp and udp services, got %d", len(services))
+	}
+	svc := services[0].(*corev1.Service)
+	if svc.Name != ApiGatewayName || svc.Spec.Type != corev1.ServiceTypeLoadBalancer ||
+		svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyTypeLocal ||
+		svc.Annotations["service.beta.kubernetes.io/alibaba-cloud-loadbalancer-spec"] != "slb.s1.small" {
+		t.Fatalf("unexpected service %#v", svc)
+	}
+	if len(svc.Spec.Ports) != 6 || svc.Spec.Ports[0].Name != "http-80" || svc.Spec.Ports[1].Name != "https-443" {
+		t.Fatalf("expected the http, https and tcp ports, got %v", svc.Spec.Ports)
+	}
+	udpSvc := services[1].(*corev1.Service)
+	if udpSvc.Name != apiGatewayUDPServiceName || len(udpSvc.Spec.Ports) != 1 || udpSvc.Spec.Ports[0].Protocol != corev1.ProtocolUDP {
+		t.Fatalf("unexpected udp service %#v", udpSvc)
+	}
+
+	for _, obj := range handler.ResourcesNeedDelete() {
+		if _, ok := obj.(*corev1.Service); ok {
+			t.Fatalf("expected the services to be kept, got %s deleted", obj.GetName())
+		}
+	}
+	if got := handler.Replicas(); got == nil || *got != apiGatewayDefaultReplicas {
+		t.Fatalf("expected %d replicas, got %v", apiGatewayDefaultReplicas, got)
+	}
+}
+
+func TestAPIGatewayDaemonSetMode(t *testing.T) {
+	t.Parallel()
+
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: ApiGatewayName, Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RbdComponentSpec{
+			Image: "example.com/apisix-ingress:1.8.4@example.com/apisix:3.14.1-debian",
+		},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			NodesForGateway: []*rainbondv1alpha1.K8sNode{{Name: "gateway-1"}},
+			APIGateway: &rainbondv1alpha1.APIGatewayConfig{
+				Mode: rainbondv1alpha1.GatewayModeDaemonSet,
+			},
+		},
+	}
+	handler := &apigateway{
+		ctx:       context.Background(),
+		client:    fake.NewClientBuilder().Build(),
+		component: component,
+		cluster:   cluster,
+		labels:    LabelsForRainbondComponent(component),
+	}
+
+	ds, ok := handler.workload().(*appsv1.DaemonSet)
+	if !ok {
+		t.Fatalf("expected *appsv1.DaemonSet, got %T", handler.workload())
+	}
+	podSpec := ds.Spec.Template.Spec
+	if !podSpec.HostNetwork || len(podSpec.Containers[1].Ports) != 0 {
+		t.Fatalf("expected rbd-gateway to run with the host network, got %v %v", podSpec.HostNetwork, podSpec.Containers[1].Ports)
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil {
+		t.Fatal("expected the daemonset to run on nodesForGateway without a node selector")
+	}
+	if handler.exposeServices() != nil {
+		t.Fatal("expected no service with the host network")
+	}
+
+	deleted := map[string]bool{}
+	for _, obj := range handler.ResourcesNeedDelete() {
+		deleted[strings.TrimPrefix(fmt.Sprintf("%T", obj), "*")+"/"+obj.GetName()] = true
+	}
+	for _, key := range []string{"v1.Deployment/" + ApiGatewayName, "v1.Service/" + ApiGatewayName, "v1.Service/" + apiGatewayUDPServiceName} {
+		if !deleted[key] {
+			t.Fatalf("expected %s to be deleted, got %v", key, deleted)
+		}
+	}
+	if deleted["v1.DaemonSet/"+ApiGatewayName] {
+		t.Fatal("expected the daemonset to be kept")
+	}
+	if got := handler.Replicas(); got != nil {
+		t.Fatalf("expected no replicas before the daemonset is scheduled, got %d", *got)
+	}
+}
+
+func TestAPIGatewayHostNetworkMode(t *testing.T) {
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: ApiGatewayName, Namespace: "rbd-system"},
+		Spec: rainbondv1alpha1.RbdComponentSpec{
+			Image: "example.com/apisix-ingress:1.8.4@example.com/apisix:3.14.1-debian",
+		},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{}
+	handler := &apigateway{
+		ctx:       context.Background(),
+		component: component,
+		cluster:   cluster,
+		labels:    LabelsForRainbondComponent(component),
+	}
+	if err := handler.checkHostNetworkNodes(); err == nil {
+		t.Fatal("expected rbd-gateway without nodes to be refused")
+	}
+
+	// scheduled by the affinity of the component only.
+	component.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{}}
+	if err := handler.checkHostNetworkNodes(); err != nil {
+		t.Fatal(err)
+	}
+	deployment := handler.workload().(*appsv1.Deployment)
+	if *deployment.Spec.Replicas != apiGatewayDefaultReplicas {
+		t.Fatalf("expected %d replicas, got %d", apiGatewayDefaultReplicas, *deployment.Spec.Replicas)
+	}
+
+	cluster.Spec.NodesForGateway = []*rainbondv1alpha1.K8sNode{{Name: "Gateway-1"}, {Name: "gateway-2"}}
+	deployment = handler.workload().(*appsv1.Deployment)
+	podSpec := deployment.Spec.Template.Spec
+	if *deployment.Spec.Replicas != 2 {
+		t.Fatalf("expected one replica on each node, got %d", *deployment.Spec.Replicas)
+	}
+	if !podSpec.HostNetwork || *podSpec.SecurityContext.RunAsUser != 0 || !*podSpec.Containers[1].SecurityContext.Privileged {
+		t.Fatal("expected rbd-gateway to run as root with the host network")
+	}
+}
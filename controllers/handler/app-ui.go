@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/goodrain/rainbond-operator/util/commonutil"
 	"github.com/goodrain/rainbond-operator/util/rbdutil"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -46,6 +48,7 @@ type appui struct {
 }
 
 var _ ComponentHandler = &appui{}
+var _ Migrator = &appui{}
 
 // NewAppUI creates a new rbd-app-ui handler.
 func NewAppUI(ctx context.Context, client client.Client, component *rainbondv1alpha1.RbdComponent, cluster *rainbondv1alpha1.RainbondCluster) ComponentHandler {
@@ -61,7 +64,7 @@ func NewAppUI(ctx context.Context, client client.Client, component *rainbondv1al
 
 func (a *appui) Before() error {
 	if !checksqllite.IsSQLLite() {
-		db, err := getDefaultDBInfo(a.ctx, a.client, a.cluster.Spec.UIDatabase, a.component.Namespace, DBName)
+		db, err := getDefaultDBInfo(a.ctx, a.client, a.cluster.Spec.UIDatabase, a.component.Namespace, DBName, AppUIName)
 		if err != nil {
 			return fmt.Errorf("get db info: %v", err)
 		}
@@ -117,6 +120,35 @@ func (a *appui) After() error {
 	return nil
 }
 
+// MigrationJob migrates the console database with the django migrations in the image.
+func (a *appui) MigrationJob() (string, *batchv1.Job) {
+	if checksqllite.IsSQLLite() {
+		return "", nil
+	}
+	deploy := a.deploymentForAppUI().(*appsv1.Deployment)
+	version := schemaVersion(a.component.Spec.Image)
+	job := migrationJob(AppUIName, a.component.Namespace, version, deploy.Spec.Template,
+		[]string{"python", "manage.py", "migrate", "--noinput"}, nil)
+	job.Spec.Template.Spec.Containers[0].WorkingDir = "/app/ui"
+	// the migrations are kept in the volume rbd-app-ui-data, which is ReadWriteOnce and may only be attached
+	// to the node of rbd-app-ui. There is no pod of rbd-app-ui to follow on the first installation.
+	if pods, err := a.ListPods(); err != nil {
+		log.Error(err, "list pods of rbd-app-ui")
+	} else if len(pods) > 0 && job.Spec.Template.Spec.Affinity == nil {
+		job.Spec.Template.Spec.Affinity = &corev1.Affinity{
+			PodAffinity: &corev1.PodAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+					{
+						LabelSelector: &metav1.LabelSelector{MatchLabels: a.labels},
+						TopologyKey:   "kubernetes.io/hostname",
+					},
+				},
+			},
+		}
+	}
+	return version, job
+}
+
 func (a *appui) ListPods() ([]corev1.Pod, error) {
 	return listPods(a.ctx, a.client, a.component.Namespace, a.labels)
 }
@@ -191,6 +223,20 @@ func (a *appui) deploymentForAppUI() client.Object {
 				Value: a.db.Name,
 			},
 		}
+		// the console does not use the data source name of the go driver.
+		if a.db.Charset != "" {
+			mysqlEnvs = append(mysqlEnvs, corev1.EnvVar{Name: "MYSQL_CHARSET", Value: a.db.Charset})
+		}
+		if a.db.Timezone != "" {
+			mysqlEnvs = append(mysqlEnvs, corev1.EnvVar{Name: "MYSQL_TIMEZONE", Value: a.db.Timezone})
+		}
+		if len(a.db.Params) > 0 {
+			options := url.Values{}
+			for key, value := range a.db.Params {
+				options.Set(key, value)
+			}
+			mysqlEnvs = append(mysqlEnvs, corev1.EnvVar{Name: "MYSQL_OPTIONS", Value: options.Encode()})
+		}
 		envs = append(envs, mysqlEnvs...)
 	}
 	volumes := []corev1.Volume{
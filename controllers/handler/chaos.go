@@ -58,7 +58,7 @@ func NewChaos(ctx context.Context, client client.Client, component *rainbondv1al
 
 func (c *chaos) Before() error {
 	if !checksqllite.IsSQLLite() {
-		db, err := getDefaultDBInfo(c.ctx, c.client, c.cluster.Spec.RegionDatabase, c.component.Namespace, DBName)
+		db, err := getDefaultDBInfo(c.ctx, c.client, c.cluster.Spec.RegionDatabase, c.component.Namespace, DBName, ChaosName)
 		if err != nil {
 			return fmt.Errorf("get db info: %v", err)
 		}
@@ -148,6 +148,7 @@ func (c *chaos) deployment() client.Object {
 		volumeMounts = append(volumeMounts, mount)
 		volumes = append(volumes, volume)
 	}
+	args = append(args, etcdArgs(c.cluster)...)
 	if c.etcdSecret != nil {
 		volume, mount := volumeByEtcd(c.etcdSecret)
 		volumeMounts = append(volumeMounts, mount)
@@ -2,9 +2,11 @@ package handler
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/goodrain/rainbond-operator/util/rbdutil"
 
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	networkingv1beta1 "k8s.io/api/networking/v1beta1"
@@ -80,7 +83,9 @@ func isUIDBReady(ctx context.Context, cli client.Client, cpt *rainbondv1alpha1.R
 	return nil
 }
 
-func getDefaultDBInfo(ctx context.Context, cli client.Client, in *rainbondv1alpha1.Database, namespace, name string) (*rainbondv1alpha1.Database, error) {
+// getDefaultDBInfo returns the custom database, or the bundled database with the user of the consumer,
+// root is used if the user of the consumer has not been created yet.
+func getDefaultDBInfo(ctx context.Context, cli client.Client, in *rainbondv1alpha1.Database, namespace, name, consumer string) (*rainbondv1alpha1.Database, error) {
 	if in != nil {
 		// use custom db
 		return in, nil
@@ -95,10 +100,14 @@ func getDefaultDBInfo(ctx context.Context, cli client.Client, in *rainbondv1alph
 	}
 	user := string(secret.Data[mysqlUserKey])
 	pass := string(secret.Data[mysqlPasswordKey])
+	if consumerPass := string(secret.Data[dbConsumerPasswordKey(consumer)]); consumerPass != "" {
+		user = string(secret.Data[dbConsumerUserKey(consumer)])
+		pass = consumerPass
+	}
 
 	return &rainbondv1alpha1.Database{
 		Host:     dbhost,
-		Port:     3306,
+		Port:     mysqlPort,
 		Username: user,
 		Password: pass,
 	}, nil
@@ -192,18 +201,25 @@ func volumeByAPISecret(apiServerSecret *corev1.Secret) (corev1.Volume, corev1.Vo
 	return volume, mount
 }
 
+// etcdArgs returns the etcd endpoints args for the rainbond components if an external etcd is specified.
+func etcdArgs(cluster *rainbondv1alpha1.RainbondCluster) []string {
+	if cluster.Spec.EtcdConfig == nil || len(cluster.Spec.EtcdConfig.Endpoints) == 0 {
+		return nil
+	}
+	return []string{"--etcd=" + strings.Join(etcdEndpoints(cluster), ",")}
+}
+
 func etcdSSLArgs() []string {
-	return []string{}
+	return []string{
+		"--etcd-ca=" + path.Join(EtcdSSLPath, constants.EtcdCAFileKey),
+		"--etcd-cert=" + path.Join(EtcdSSLPath, constants.EtcdCertFileKey),
+		"--etcd-key=" + path.Join(EtcdSSLPath, constants.EtcdKeyFileKey),
+	}
 }
 
 func storageClassNameFromLocalPath() *pvcParameters {
-	// Check environment variable first, fall back to local-path
-	scName := os.Getenv("STORAGE_CLASS_NAME")
-	if scName == "" {
-		scName = "local-path"
-	}
 	return &pvcParameters{
-		storageClassName: scName,
+		storageClassName: rbdutil.LocalPathStorageClassName(),
 	}
 }
 
@@ -311,6 +327,10 @@ func copyLabels(m map[string]string) map[string]string {
 }
 
 func hostsAliases(cluster *rainbondv1alpha1.RainbondCluster) []corev1.HostAlias {
+	// the internal domains are resolved by CoreDNS.
+	if cluster.Spec.InternalDNS != nil {
+		return nil
+	}
 	var hostAliases []corev1.HostAlias
 	imageRepo := rbdutil.GetImageRepository(cluster)
 
@@ -321,9 +341,9 @@ func hostsAliases(cluster *rainbondv1alpha1.RainbondCluster) []corev1.HostAlias
 	}
 
 	// 判断域名是否为默认镜像仓库(支持带端口或不带端口)
-	if domain == constants.DefImageRepository || imageRepo == constants.DefImageRepository {
+	if ip := cluster.InnerGatewayIngressIP(); ip != "" && (domain == constants.DefImageRepository || imageRepo == constants.DefImageRepository) {
 		hostAliases = append(hostAliases, corev1.HostAlias{
-			IP:        cluster.InnerGatewayIngressIP(),
+			IP:        ip,
 			Hostnames: []string{domain}, // 使用不带端口的域名
 		})
 	}
@@ -524,3 +544,54 @@ func setDefaultResources(resources corev1.ResourceRequirements) corev1.ResourceR
 
 	return *result
 }
+
+// isJobFailed returns true if the job has failed.
+func isJobFailed(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// jobTerminationMessage returns the termination message of the last pod of the job, or why the job failed.
+func jobTerminationMessage(ctx context.Context, cli client.Client, job *batchv1.Job) (string, error) {
+	pods := &corev1.PodList{}
+	if err := cli.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return "", fmt.Errorf("list pods of job %s: %v", job.Name, err)
+	}
+	var last *corev1.Pod
+	for i := range pods.Items {
+		if last == nil || last.CreationTimestamp.Before(&pods.Items[i].CreationTimestamp) {
+			last = &pods.Items[i]
+		}
+	}
+	if last != nil {
+		for _, status := range last.Status.ContainerStatuses {
+			if status.State.Terminated != nil && status.State.Terminated.Message != "" {
+				return strings.TrimSpace(status.State.Terminated.Message), nil
+			}
+		}
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Message != "" {
+			return condition.Message, nil
+		}
+	}
+	return "", nil
+}
+
+// checksum returns the sha256 of the values joined by newlines, which restarts the pods in an annotation once they change.
+func checksum(values ...string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(values, "\n"))))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
 	"github.com/goodrain/rainbond-operator/util/commonutil"
-	"github.com/goodrain/rainbond-operator/util/uuidutil"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
@@ -27,6 +27,8 @@ var (
 	mysqlPasswordKey = "mysql-password"
 )
 
+const mysqlPort = 3306
+
 type db struct {
 	ctx       context.Context
 	client    client.Client
@@ -37,8 +39,12 @@ type db struct {
 
 	secret                   *corev1.Secret
 	mysqlUser, mysqlPassword string
-	enableMysqlOperator      bool
 	databases                []string
+	minioImage               string
+	// usersPending is true if the users are not created, or the passwords are being rotated.
+	usersPending bool
+	// bundledVolumes are the volumes of rbd-db deleted after the migration.
+	bundledVolumes []*corev1.PersistentVolumeClaim
 
 	pvcParametersRWO *pvcParameters
 	storageRequest   int64
@@ -46,6 +52,8 @@ type db struct {
 
 var _ ComponentHandler = &db{}
 var _ StorageClassRWOer = &db{}
+var _ Replicaser = &db{}
+var _ ResyncPerioder = &db{}
 
 // NewDB new db
 func NewDB(ctx context.Context, client client.Client, component *rainbondv1alpha1.RbdComponent, cluster *rainbondv1alpha1.RainbondCluster) ComponentHandler {
@@ -68,11 +76,14 @@ func NewDB(ctx context.Context, client client.Client, component *rainbondv1alpha
 }
 
 func (d *db) Before() error {
-	if os.Getenv("CONSOLE_DOMAIN") != "" && d.cluster.Spec.RegionDatabase != nil {
-		return NewIgnoreError("use custom region database")
-	}
-	if d.cluster.Spec.RegionDatabase != nil && d.cluster.Spec.UIDatabase != nil {
-		return NewIgnoreError("use custom regionDB and uiDB")
+	// rbd-db is still the source of the migration, or retired by it.
+	if d.migration() == nil {
+		if os.Getenv("CONSOLE_DOMAIN") != "" && d.cluster.Spec.RegionDatabase != nil {
+			return NewIgnoreError("use custom region database")
+		}
+		if d.cluster.Spec.RegionDatabase != nil && d.cluster.Spec.UIDatabase != nil {
+			return NewIgnoreError("use custom regionDB and uiDB")
+		}
 	}
 
 	secret := &corev1.Secret{}
@@ -88,17 +99,30 @@ func (d *db) Before() error {
 		d.mysqlUser = string(d.secret.Data[mysqlUserKey])
 		d.mysqlPassword = string(d.secret.Data[mysqlPasswordKey])
 	} else {
-		kubeSystemNS := &corev1.Namespace{}
-		if err := d.client.Get(d.ctx, types.NamespacedName{Name: "kube-system"}, kubeSystemNS); err != nil {
-			return fmt.Errorf("failed to get kube-system namespace for password generation: %v", err)
+		// a new install gets a random password as strong as the rotated ones.
+		d.mysqlPassword = randomSecretKey()
+		if d.mysqlPassword == "" {
+			return fmt.Errorf("generate password for %s", DBName)
+		}
+	}
+
+	if err := d.validateMySQLConfig(); err != nil {
+		return err
+	}
+	if d.migration() != nil {
+		if err := d.prepareMigration(); err != nil {
+			return err
 		}
-		d.mysqlPassword = uuidutil.NewStableUUID(string(kubeSystemNS.UID) + "-mysql-password")[:8]
 	}
 
 	if err := setStorageCassName(d.ctx, d.client, d.component.Namespace, d); err != nil {
 		return err
 	}
 
+	if err := d.setMinIOImage(); err != nil {
+		return err
+	}
+
 	affinity, err := nodeAffnityNodesForChaos(d.cluster)
 	if err != nil {
 		return err
@@ -109,27 +133,47 @@ func (d *db) Before() error {
 }
 
 func (d *db) Resources() []client.Object {
-	return []client.Object{
+	if d.retired() {
+		return d.retiredResources()
+	}
+	return append([]client.Object{
 		d.secretForDB(),
 		d.configMapForMyCnf(),
 		d.initdbCMForDB(),
 		d.statefulsetForDB(),
 		d.serviceForDB(),
-	}
+		d.serviceForReadOnly(),
+	}, append(d.backupResources(), d.migrationResources()...)...)
 }
 
 func (d *db) After() error {
-	return nil
+	if d.retired() {
+		return nil
+	}
+	if d.backup() != nil {
+		if err := d.updateBackupStatus(); err != nil {
+			return err
+		}
+	}
+	if d.cluster.Spec.EnableHA {
+		if err := d.reconcileReplication(); err != nil {
+			return err
+		}
+	}
+	if d.migration() != nil {
+		if err := d.reconcileMigration(); err != nil {
+			return err
+		}
+		// rbd-db is read-only until the migration fails.
+		if status := d.component.Status.DatabaseMigration; status == nil || status.Phase != rainbondv1alpha1.DatabaseMigrationFailed {
+			return nil
+		}
+	}
+	return d.reconcileUsers()
 }
 
 func (d *db) ListPods() ([]corev1.Pod, error) {
-	labels := d.labels
-	if d.enableMysqlOperator {
-		labels = map[string]string{
-			"v1alpha1.mysql.oracle.com/cluster": DBName,
-		}
-	}
-	return listPods(d.ctx, d.client, d.component.Namespace, labels)
+	return listPods(d.ctx, d.client, d.component.Namespace, d.labels)
 }
 
 func (d *db) SetStorageClassNameRWO(pvcParameters *pvcParameters) {
@@ -137,10 +181,34 @@ func (d *db) SetStorageClassNameRWO(pvcParameters *pvcParameters) {
 }
 
 func (d *db) Replicas() *int32 {
-	if !d.enableMysqlOperator {
-		commonutil.Int32(1)
+	return commonutil.Int32(d.replicas())
+}
+
+// ResyncPeriod keeps watching the primary in HA mode, so that it can be failed over in time,
+// the users until they are created and their passwords are rotated, and the migration until it is completed.
+func (d *db) ResyncPeriod() time.Duration {
+	if d.migration() != nil && !d.retired() {
+		return dbResyncPeriod
 	}
-	return nil
+	if !d.cluster.Spec.EnableHA && !d.usersPending {
+		return 0
+	}
+	return dbResyncPeriod
+}
+
+// replicas returns the number of the mysql servers, a primary and at least one replica in HA mode.
+func (d *db) replicas() int32 {
+	if d.retired() {
+		// the data is kept until deleteBundledDatabase is set.
+		return 0
+	}
+	if !d.cluster.Spec.EnableHA {
+		return 1
+	}
+	if d.component.Spec.Replicas != nil && *d.component.Spec.Replicas > 1 {
+		return *d.component.Spec.Replicas
+	}
+	return 2
 }
 
 func (d *db) statefulsetForDB() client.Object {
@@ -223,6 +291,29 @@ func (d *db) statefulsetForDB() client.Object {
 	volumes = mergeVolumes(volumes, d.component.Spec.Volumes)
 	resources := setDefaultResources(d.component.Spec.Resources)
 
+	var command []string
+	var affinity *corev1.Affinity
+	if d.cluster.Spec.EnableHA {
+		// every mysql server needs an unique server id, which is derived from the ordinal of the pod.
+		command = []string{"sh", "-c", `exec docker-entrypoint.sh mysqld --server-id=$((${HOSTNAME##*-}+1)) --report-host=${HOSTNAME}`}
+		affinity = &corev1.Affinity{
+			PodAntiAffinity: &corev1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+					{
+						Weight: 100,
+						PodAffinityTerm: corev1.PodAffinityTerm{
+							LabelSelector: &metav1.LabelSelector{MatchLabels: d.labels},
+							TopologyKey:   "kubernetes.io/hostname",
+						},
+					},
+				},
+			},
+		}
+	}
+	if d.component.Spec.Affinity != nil {
+		affinity = d.component.Spec.Affinity
+	}
+
 	sts := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      DBName,
@@ -230,7 +321,7 @@ func (d *db) statefulsetForDB() client.Object {
 			Labels:    d.labels,
 		},
 		Spec: appsv1.StatefulSetSpec{
-			Replicas: commonutil.Int32(1),
+			Replicas: commonutil.Int32(d.replicas()),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: d.labels,
 			},
@@ -238,10 +329,14 @@ func (d *db) statefulsetForDB() client.Object {
 				ObjectMeta: metav1.ObjectMeta{
 					Name:   DBName,
 					Labels: d.labels,
+					Annotations: map[string]string{
+						dbMyCnfChecksumAnnotation: checksum(d.myCnf()),
+					},
 				},
 				Spec: corev1.PodSpec{
 					ImagePullSecrets:              imagePullSecrets(d.component, d.cluster),
 					TerminationGracePeriodSeconds: commonutil.Int64(0),
+					Affinity:                      affinity,
 					Tolerations: []corev1.Toleration{
 						{
 							Operator: corev1.TolerationOpExists, // tolerate everything.
@@ -252,11 +347,13 @@ func (d *db) statefulsetForDB() client.Object {
 							Name:            DBName,
 							Image:           d.component.Spec.Image,
 							ImagePullPolicy: d.component.ImagePullPolicy(),
+							Command:         command,
 							Env:             env,
 							VolumeMounts:    volumeMounts,
 							ReadinessProbe: &corev1.Probe{
 								Handler: corev1.Handler{
-									Exec: &corev1.ExecAction{Command: []string{"mysql", "-u" + d.mysqlUser, "-p" + d.mysqlPassword, "-e", "SELECT 1"}},
+									// without credentials, so that the pods are not restarted when the password is rotated.
+									Exec: &corev1.ExecAction{Command: []string{"mysqladmin", "ping", "-h", "127.0.0.1", "--silent"}},
 								},
 								InitialDelaySeconds: 5,
 								PeriodSeconds:       2,
@@ -276,6 +373,11 @@ func (d *db) statefulsetForDB() client.Object {
 }
 
 func (d *db) serviceForDB() client.Object {
+	selector := d.labels
+	if d.cluster.Spec.EnableHA {
+		// always points to the writable primary.
+		selector = d.selectorForRole(dbRolePrimary)
+	}
 	mysqlSvc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      dbhost,
@@ -287,15 +389,47 @@ func (d *db) serviceForDB() client.Object {
 			Ports: []corev1.ServicePort{
 				{
 					Name: "main",
-					Port: 3306,
+					Port: mysqlPort,
 				},
 			},
-			Selector: d.labels,
+			Selector: selector,
 		},
 	}
 	return mysqlSvc
 }
 
+// serviceForReadOnly returns the service of the read-only replicas in HA mode.
+func (d *db) serviceForReadOnly() client.Object {
+	if !d.cluster.Spec.EnableHA {
+		return nil
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dbReadOnlyHost,
+			Namespace: d.component.Namespace,
+			Labels:    d.labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Name: "main",
+					Port: mysqlPort,
+				},
+			},
+			Selector: d.selectorForRole(dbRoleReplica),
+		},
+	}
+}
+
+func (d *db) selectorForRole(role string) map[string]string {
+	selector := make(map[string]string, len(d.labels)+1)
+	for k, v := range d.labels {
+		selector[k] = v
+	}
+	selector[dbRoleLabelKey] = role
+	return selector
+}
+
 func (d *db) initdbCMForDB() client.Object {
 	cm := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -330,18 +464,51 @@ func (d *db) secretForDB() client.Object {
 }
 
 func (d *db) configMapForMyCnf() client.Object {
-	var innodbDirs []string
-	for _, database := range d.databases {
-		innodbDirs = append(innodbDirs, "/var/lib/mysql/"+database)
-	}
-
 	cm := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      mycnf,
 			Namespace: d.component.Namespace,
 		},
 		Data: map[string]string{
-			"my.cnf": fmt.Sprintf(`
+			"my.cnf": d.myCnf(),
+		},
+	}
+
+	return cm
+}
+
+func (d *db) myCnf() string {
+	var innodbDirs []string
+	for _, database := range d.databases {
+		innodbDirs = append(innodbDirs, "/var/lib/mysql/"+database)
+	}
+
+	var replication string
+	if d.cluster.Spec.EnableHA || (d.backup() != nil && d.backup().BinlogArchive) {
+		replication = `
+#
+# * Binary log, for replication and point-in-time recovery.
+#   mysql 5.7 refuses to start with log_bin but no server id, which is overridden by the command line with HA.
+#
+server_id                = 1
+log_bin                  = mysql-bin
+binlog_format            = ROW
+`
+	}
+	if d.cluster.Spec.EnableHA {
+		replication += `
+#
+# * Replication, the server id is set by the command line
+#
+gtid_mode                = ON
+enforce_gtid_consistency = ON
+log_slave_updates        = ON
+relay_log                = relay-bin
+relay_log_recovery       = ON
+`
+	}
+
+	return fmt.Sprintf(`
 [client]
 # Default is Latin1, if you need UTF-8 set this (also in server section)
 default-character-set = utf8mb4
@@ -364,9 +531,5 @@ collation_server       = utf8mb4_unicode_ci
 default_authentication_plugin=mysql_native_password
 skip-host-cache
 skip-name-resolve
-`, strings.Join(innodbDirs, ";")),
-		},
-	}
-
-	return cm
+%s%s`, strings.Join(innodbDirs, ";"), replication, d.tuningSection())
 }
@@ -0,0 +1,426 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	dbBackupName        = DBName + "-backup"
+	dbBackupScriptsName = DBName + "-backup-scripts"
+)
+
+const (
+	defaultDBBackupSchedule  = "0 2 * * *"
+	defaultDBBackupRetention = 7
+	dbBackupDir              = "/backup"
+)
+
+// cronJobGVK is the CronJob of batch/v1, which is not in the vendored k8s.io/api yet.
+// The spec of batch/v1 is the same as batch/v1beta1, which is removed since kubernetes 1.25.
+var cronJobGVK = schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"}
+
+// dbBackupScript dumps all databases in a consistent snapshot, archives the binlogs, and removes the expired backups.
+// Each backup is a directory named by the time, with the dump and the binlog position of the dump.
+const dbBackupScript = `set -eo pipefail
+dir="$BACKUP_DIR/$(date -u +%Y%m%d%H%M%S)"
+mkdir -p "$dir"
+opts="--single-transaction --routines --triggers --events --set-gtid-purged=OFF"
+if [ "$BINLOG_ARCHIVE" = "true" ]; then
+  opts="$opts --master-data=2"
+fi
+mysqldump -h "$DB_HOST" -u "$MYSQL_USER" $opts --databases $DATABASES | gzip > "$dir/dump.sql.gz.tmp"
+mv "$dir/dump.sql.gz.tmp" "$dir/dump.sql.gz"
+
+if [ "$BINLOG_ARCHIVE" = "true" ]; then
+  gunzip -c "$dir/dump.sql.gz" | head -n 100 | sed -n "s/.*_LOG_FILE='\([^']*\)', [A-Z]*_LOG_POS=\([0-9]*\).*/\1 \2/p" > "$dir/binlog-position"
+  mkdir -p "$BACKUP_DIR/binlog"
+  # the archived binlogs are complete except the last one.
+  last=$(ls -1 "$BACKUP_DIR/binlog" | sort | tail -n 1)
+  binlogs=""
+  for f in $(mysql -h "$DB_HOST" -u "$MYSQL_USER" -N -e "SHOW BINARY LOGS" | cut -f1); do
+    if [ -z "$last" ] || [[ ! "$f" < "$last" ]]; then
+      binlogs="$binlogs $f"
+    fi
+  done
+  (cd "$BACKUP_DIR/binlog" && mysqlbinlog --read-from-remote-server --raw --host="$DB_HOST" --user="$MYSQL_USER" $binlogs)
+fi
+
+for expired in $(ls -1d "$BACKUP_DIR"/[0-9]* | sort -r | tail -n +$((RETENTION+1))); do
+  rm -rf "$expired"
+done
+oldest=$(ls -1d "$BACKUP_DIR"/[0-9]* | sort | head -n 1)
+if [ -s "$oldest/binlog-position" ]; then
+  read -r first pos < "$oldest/binlog-position"
+  # the binlogs before the oldest backup are no longer needed.
+  for f in $(ls -1 "$BACKUP_DIR/binlog"); do
+    if [[ "$f" < "$first" ]]; then
+      rm -f "$BACKUP_DIR/binlog/$f"
+    fi
+  done
+fi
+`
+
+// dbUploadScript uploads the backups to minio, and removes the expired backups and binlogs in the bucket.
+const dbUploadScript = `set -eo pipefail
+mc alias set backup "$MINIO_ENDPOINT" "$MINIO_ACCESS_KEY" "$MINIO_SECRET_KEY" > /dev/null
+mc mb --ignore-existing "backup/$BUCKET"
+mc mirror --overwrite "$BACKUP_DIR/" "backup/$BUCKET/"
+
+backups=()
+while read -r line; do
+  name=${line##* }
+  name=${name%/}
+  if [[ "$name" =~ ^[0-9]+$ ]]; then
+    backups+=("$name")
+  fi
+done < <(mc ls "backup/$BUCKET/")
+backups=($(printf '%s\n' "${backups[@]}" | sort -r))
+for ((i = RETENTION; i < ${#backups[@]}; i++)); do
+  mc rm --recursive --force "backup/$BUCKET/${backups[$i]}"
+done
+
+kept=$((${#backups[@]} < RETENTION ? ${#backups[@]} : RETENTION))
+if [ $kept -gt 0 ]; then
+  oldest=${backups[$((kept - 1))]}
+  if position=$(mc cat "backup/$BUCKET/$oldest/binlog-position" 2> /dev/null) && [ -n "$position" ]; then
+    first=${position%% *}
+    while read -r line; do
+      name=${line##* }
+      if [[ "$name" < "$first" ]]; then
+        mc rm "backup/$BUCKET/binlog/$name"
+      fi
+    done < <(mc ls "backup/$BUCKET/binlog/")
+  fi
+fi
+`
+
+// dbRestoreScript restores a backup, and replays the archived binlogs until the given time for point-in-time recovery.
+// Usage: restore.sh <backup dir> [stop datetime, eg. "2024-01-02 15:04:05"]
+const dbRestoreScript = `set -eo pipefail
+dir=$1
+stop=$2
+gunzip -c "$dir/dump.sql.gz" | mysql -h "$DB_HOST" -u "$MYSQL_USER"
+if [ -z "$stop" ]; then
+  exit 0
+fi
+if [ ! -s "$dir/binlog-position" ]; then
+  echo "no binlog position in $dir, binlogArchive is not enabled" >&2
+  exit 1
+fi
+read -r first pos < "$dir/binlog-position"
+binlogs=()
+for f in $(ls -1 "$BACKUP_DIR/binlog" | sort); do
+  if [[ ! "$f" < "$first" ]]; then
+    binlogs+=("$BACKUP_DIR/binlog/$f")
+  fi
+done
+mysqlbinlog --skip-gtids --start-position="$pos" --stop-datetime="$stop" "${binlogs[@]}" | mysql -h "$DB_HOST" -u "$MYSQL_USER"
+`
+
+// backup returns the backup configuration with defaults, nil if the backups are not enabled.
+func (d *db) backup() *rainbondv1alpha1.DatabaseBackup {
+	if d.cluster.Spec.DatabaseBackup == nil {
+		return nil
+	}
+	backup := d.cluster.Spec.DatabaseBackup.DeepCopy()
+	if backup.Schedule == "" {
+		backup.Schedule = defaultDBBackupSchedule
+	}
+	if backup.Retention <= 0 {
+		backup.Retention = defaultDBBackupRetention
+	}
+	if backup.Storage == "" {
+		backup.Storage = rainbondv1alpha1.DatabaseBackupStoragePVC
+	}
+	return backup
+}
+
+// setMinIOImage finds the image of the bundled minio, which has the minio client to upload the backups.
+func (d *db) setMinIOImage() error {
+	backup := d.backup()
+	if backup == nil || backup.Storage != rainbondv1alpha1.DatabaseBackupStorageMinIO {
+		return nil
+	}
+	minio := &rainbondv1alpha1.RbdComponent{}
+	if err := d.client.Get(d.ctx, types.NamespacedName{Namespace: d.component.Namespace, Name: MinIOName}, minio); err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("the bundled minio is required to store the backups of %s", DBName)
+		}
+		return fmt.Errorf("get rbdcomponent %s: %v", MinIOName, err)
+	}
+	d.minioImage = d.cluster.ComponentImage(minio.Spec.Image)
+	return nil
+}
+
+func (d *db) backupResources() []client.Object {
+	backup := d.backup()
+	if backup == nil {
+		return nil
+	}
+	objs := []client.Object{d.configMapForBackupScripts()}
+	if cronJob := d.cronJobForBackup(backup); cronJob != nil {
+		objs = append(objs, cronJob)
+	}
+	// the pvc is the working copy with minio storage, which keeps the binlogs archived since the last backup.
+	objs = append(objs, createPersistentVolumeClaimRWO(d.component.Namespace, dbBackupName, d.pvcParametersRWO,
+		d.labelsForBackup(), getStorageRequest("DB_BACKUP_STORAGE_REQUEST", 20)))
+	return objs
+}
+
+// ResourcesNeedDelete deletes the backup cronjob if the backups are disabled. The backups are kept.
+// The statefulset and its volumes are deleted if it is confirmed after the migration.
+func (d *db) ResourcesNeedDelete() []client.Object {
+	objs := d.retiredResourcesNeedDelete()
+	if d.backup() != nil {
+		return objs
+	}
+	cronJob := &unstructured.Unstructured{}
+	cronJob.SetGroupVersionKind(cronJobGVK)
+	cronJob.SetName(dbBackupName)
+	cronJob.SetNamespace(d.component.Namespace)
+	return append(objs, cronJob)
+}
+
+func (d *db) labelsForBackup() map[string]string {
+	return rbdutil.LabelsForRainbond(map[string]string{
+		"name": dbBackupName,
+	})
+}
+
+func (d *db) configMapForBackupScripts() client.Object {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dbBackupScriptsName,
+			Namespace: d.component.Namespace,
+			Labels:    d.labelsForBackup(),
+		},
+		Data: map[string]string{
+			"backup.sh":  dbBackupScript,
+			"upload.sh":  dbUploadScript,
+			"restore.sh": dbRestoreScript,
+		},
+	}
+}
+
+func (d *db) cronJobForBackup(backup *rainbondv1alpha1.DatabaseBackup) client.Object {
+	labels := d.labelsForBackup()
+	env := []corev1.EnvVar{
+		{
+			Name: "MYSQL_USER",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: DBName},
+					Key:                  mysqlUserKey,
+				},
+			},
+		},
+		{
+			// read by the mysql clients, so that the password is not in the command line.
+			Name: "MYSQL_PWD",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: DBName},
+					Key:                  mysqlPasswordKey,
+				},
+			},
+		},
+		{
+			Name:  "DB_HOST",
+			Value: dbhost,
+		},
+		{
+			Name:  "DATABASES",
+			Value: strings.Join(d.databases, " "),
+		},
+		{
+			Name:  "BACKUP_DIR",
+			Value: dbBackupDir,
+		},
+		{
+			Name:  "RETENTION",
+			Value: strconv.Itoa(int(backup.Retention)),
+		},
+		{
+			Name:  "BINLOG_ARCHIVE",
+			Value: strconv.FormatBool(backup.BinlogArchive),
+		},
+	}
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "scripts",
+			MountPath: "/scripts",
+		},
+		{
+			Name:      "backup",
+			MountPath: dbBackupDir,
+		},
+	}
+	backupVolume := corev1.Volume{
+		Name: "backup",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: dbBackupName,
+			},
+		},
+	}
+
+	dump := corev1.Container{
+		Name:            "backup",
+		Image:           d.component.Spec.Image,
+		ImagePullPolicy: d.component.ImagePullPolicy(),
+		Command:         []string{"/bin/bash", "/scripts/backup.sh"},
+		Env:             env,
+		VolumeMounts:    volumeMounts,
+	}
+	var initContainers []corev1.Container
+	containers := []corev1.Container{dump}
+	if backup.Storage == rainbondv1alpha1.DatabaseBackupStorageMinIO {
+		// dump to the pvc first, then upload to minio.
+		initContainers = containers
+		containers = []corev1.Container{
+			{
+				Name:            "upload",
+				Image:           d.minioImage,
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				Command:         []string{"/bin/bash", "/scripts/upload.sh"},
+				Env: []corev1.EnvVar{
+					{
+						Name:  "MINIO_ENDPOINT",
+						Value: minioEndpoint,
+					},
+					{
+						Name:      "MINIO_ACCESS_KEY",
+						ValueFrom: secretKeyRef(minioCredentialsSecret, hubS3AccessKey),
+					},
+					{
+						Name:      "MINIO_SECRET_KEY",
+						ValueFrom: secretKeyRef(minioCredentialsSecret, hubS3SecretKey),
+					},
+					{
+						Name:  "BUCKET",
+						Value: dbBackupName,
+					},
+					{
+						Name:  "BACKUP_DIR",
+						Value: dbBackupDir,
+					},
+					{
+						Name:  "RETENTION",
+						Value: strconv.Itoa(int(backup.Retention)),
+					},
+				},
+				VolumeMounts: volumeMounts,
+			},
+		}
+	}
+
+	cronJob := &batchv1beta1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dbBackupName,
+			Namespace: d.component.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1beta1.CronJobSpec{
+			Schedule:                   backup.Schedule,
+			ConcurrencyPolicy:          batchv1beta1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: commonutil.Int32(3),
+			FailedJobsHistoryLimit:     commonutil.Int32(3),
+			JobTemplate: batchv1beta1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: batchv1.JobSpec{
+					BackoffLimit: commonutil.Int32(2),
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: labels,
+						},
+						Spec: corev1.PodSpec{
+							ImagePullSecrets: imagePullSecrets(d.component, d.cluster),
+							RestartPolicy:    corev1.RestartPolicyNever,
+							InitContainers:   initContainers,
+							Containers:       containers,
+							Volumes: []corev1.Volume{
+								{
+									Name: "scripts",
+									VolumeSource: corev1.VolumeSource{
+										ConfigMap: &corev1.ConfigMapVolumeSource{
+											LocalObjectReference: corev1.LocalObjectReference{Name: dbBackupScriptsName},
+										},
+									},
+								},
+								backupVolume,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(cronJob)
+	if err != nil {
+		log.Error(err, "convert cronjob to unstructured")
+		return nil
+	}
+	obj := &unstructured.Unstructured{Object: content}
+	obj.SetGroupVersionKind(cronJobGVK)
+	unstructured.RemoveNestedField(obj.Object, "status")
+	return obj
+}
+
+// updateBackupStatus records the last successful backup, and the failed backup after it.
+func (d *db) updateBackupStatus() error {
+	jobList := &batchv1.JobList{}
+	if err := d.client.List(d.ctx, jobList, client.InNamespace(d.component.Namespace), client.MatchingLabels(d.labelsForBackup())); err != nil {
+		return fmt.Errorf("list backup jobs: %v", err)
+	}
+
+	status := d.component.Status.Backup
+	if status == nil {
+		status = &rainbondv1alpha1.BackupStatus{}
+	}
+	for i := range jobList.Items {
+		job := &jobList.Items[i]
+		if job.Status.Succeeded > 0 && job.Status.CompletionTime != nil {
+			if status.LastSuccessfulTime == nil || status.LastSuccessfulTime.Before(job.Status.CompletionTime) {
+				status.LastSuccessfulTime = job.Status.CompletionTime.DeepCopy()
+			}
+		}
+	}
+	status.LastFailedJob = ""
+	var lastFailed *batchv1.Job
+	for i := range jobList.Items {
+		job := &jobList.Items[i]
+		if !isJobFailed(job) {
+			continue
+		}
+		if status.LastSuccessfulTime != nil && !status.LastSuccessfulTime.Before(&job.CreationTimestamp) {
+			continue
+		}
+		if lastFailed == nil || lastFailed.CreationTimestamp.Before(&job.CreationTimestamp) {
+			lastFailed = job
+		}
+	}
+	if lastFailed != nil {
+		status.LastFailedJob = lastFailed.Name
+	}
+	d.component.Status.Backup = status
+	return nil
+}
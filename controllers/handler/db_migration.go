@@ -0,0 +1,509 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var dbMigrationName = DBName + "-migration"
+
+// dbMigrationScript migrates a database of rbd-db to the external mysql, and verifies the row count of every table.
+// Usage: migrate.sh <NAME>, the databases are read from the variables prefixed with <NAME>_.
+// The result is appended to the termination log, which is recorded in the status of rbd-db. A target which
+// fails is reset, so that the job can be created again. A target migrated by a failed job is verified again,
+// and migrated again if the data of rbd-db has changed since then.
+const dbMigrationScript = `set -eo pipefail
+name=$1
+v() { local var="${name}_$1"; echo "${!var}"; }
+fail() { echo "$name: $1" | tee -a /dev/termination-log >&2; exit 1; }
+src() { mysql -h "$DB_HOST" -u "$MYSQL_USER" "$@"; }
+target() { MYSQL_PWD="$(v PASSWORD)" mysql -h "$(v HOST)" -P "$(v PORT)" -u "$(v USER)" $(v SSL_OPTS) "$@"; }
+source_db=$(v SOURCE_DB)
+target_db=$(v DB)
+create() { target -e "CREATE DATABASE ` + "\\`$target_db\\`" + ` DEFAULT CHARACTER SET utf8mb4"; }
+reset() { target -e "DROP DATABASE ` + "\\`$target_db\\`" + `" && create; }
+verify() {
+  count=0
+  rows=0
+  for table in $(src -N -e "SELECT table_name FROM information_schema.tables WHERE table_schema = '$source_db' AND table_type = 'BASE TABLE'"); do
+    expected=$(src -N -e "SELECT COUNT(*) FROM ` + "\\`$source_db\\`.\\`$table\\`" + `")
+    actual=$(target -N -e "SELECT COUNT(*) FROM ` + "\\`$target_db\\`.\\`$table\\`" + `" || true)
+    if [ "$expected" != "$actual" ]; then
+      mismatch="table $table has ${actual:-no} rows, expected $expected"
+      return 1
+    fi
+    count=$((count + 1))
+    rows=$((rows + expected))
+  done
+}
+
+if [ -z "$(target -N -e "SHOW DATABASES LIKE '$target_db'")" ]; then
+  create
+fi
+tables=$(target -N -e "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = '$target_db'")
+if [ "$tables" != "0" ]; then
+  if [ "$(v MIGRATED)" != "true" ]; then
+    fail "database $target_db is not empty"
+  fi
+  if verify; then
+    echo "$name: verified $count tables and $rows rows" | tee -a /dev/termination-log
+    exit 0
+  fi
+  echo "$name: $mismatch, migrating again"
+  reset
+fi
+trap '[ $? -eq 0 ] || { reset && echo "$name: database $target_db is reset" | tee -a /dev/termination-log; }' EXIT
+mysqldump -h "$DB_HOST" -u "$MYSQL_USER" --single-transaction --routines --triggers --events --set-gtid-purged=OFF "$source_db" | target "$target_db"
+verify || fail "$mismatch"
+trap - EXIT
+echo "$name: verified $count tables and $rows rows" | tee -a /dev/termination-log
+`
+
+// dbMigrationTarget is a database of rbd-db to migrate.
+type dbMigrationTarget struct {
+	// name is the prefix of the variables of the database in the migration job.
+	name     string
+	sourceDB string
+	target   *rainbondv1alpha1.Database
+	// migrated is true if the database has been migrated by a failed job.
+	migrated bool
+	// switchTo switches the components to the external database.
+	switchTo func(spec *rainbondv1alpha1.RainbondClusterSpec)
+}
+
+func (d *db) migration() *rainbondv1alpha1.DatabaseMigration {
+	return d.cluster.Spec.DatabaseMigration
+}
+
+// retired returns true if the components have been switched to the external databases,
+// the bundled rbd-db is scaled down then.
+func (d *db) retired() bool {
+	status := d.component.Status.DatabaseMigration
+	return d.migration() != nil && status != nil && status.Phase == rainbondv1alpha1.DatabaseMigrationCompleted
+}
+
+// migrating returns true if rbd-db is read-only for the migration, which is until the migration fails.
+func (d *db) migrating() bool {
+	if d.migration() == nil || d.retired() {
+		return false
+	}
+	status := d.component.Status.DatabaseMigration
+	return status == nil || status.Phase != rainbondv1alpha1.DatabaseMigrationFailed
+}
+
+// migratedDatabases returns the targets migrated by the failed jobs.
+func (d *db) migratedDatabases() []string {
+	if status := d.component.Status.DatabaseMigration; status != nil {
+		return status.MigratedDatabases
+	}
+	return nil
+}
+
+// migrationTargets returns the databases which are still in rbd-db, the components are switched to
+// the targets with the default name and port filled in.
+func (d *db) migrationTargets() []dbMigrationTarget {
+	migration := d.migration()
+	var targets []dbMigrationTarget
+	if d.cluster.Spec.RegionDatabase == nil && migration.RegionDatabase != nil {
+		target := migration.RegionDatabase.DeepCopy()
+		if target.Name == "" {
+			target.Name = RegionDatabaseName
+		}
+		if target.Port == 0 {
+			target.Port = mysqlPort
+		}
+		targets = append(targets, dbMigrationTarget{
+			name:     "REGION",
+			sourceDB: d.databases[1],
+			target:   target,
+			migrated: containsString(d.migratedDatabases(), "REGION"),
+			switchTo: func(spec *rainbondv1alpha1.RainbondClusterSpec) {
+				spec.RegionDatabase = target
+			},
+		})
+	}
+	if d.cluster.Spec.UIDatabase == nil && migration.UIDatabase != nil {
+		target := migration.UIDatabase.DeepCopy()
+		if target.Name == "" {
+			target.Name = ConsoleDatabaseName
+		}
+		if target.Port == 0 {
+			target.Port = mysqlPort
+		}
+		targets = append(targets, dbMigrationTarget{
+			name:     "CONSOLE",
+			sourceDB: d.databases[0],
+			target:   target,
+			migrated: containsString(d.migratedDatabases(), "CONSOLE"),
+			switchTo: func(spec *rainbondv1alpha1.RainbondClusterSpec) {
+				spec.UIDatabase = target
+			},
+		})
+	}
+	return targets
+}
+
+func (d *db) validateMigration() error {
+	migration := d.migration()
+	if d.cluster.Spec.RegionDatabase == nil && migration.RegionDatabase == nil {
+		return fmt.Errorf("regionDatabase of databaseMigration is required")
+	}
+	if d.cluster.Spec.UIDatabase == nil && migration.UIDatabase == nil {
+		return fmt.Errorf("uiDatabase of databaseMigration is required")
+	}
+	targets := d.migrationTargets()
+	if len(targets) == 0 {
+		return fmt.Errorf("nothing to migrate, regionDatabase and uiDatabase are specified")
+	}
+	for _, target := range targets {
+		if target.target.Host == "" || target.target.Username == "" {
+			return fmt.Errorf("host and username of the %s database are required", strings.ToLower(target.name))
+		}
+	}
+	return nil
+}
+
+// prepareMigration makes rbd-db read-only before the migration job is created, so that nothing
+// written after the dump is lost. It is writable again if the migration fails.
+func (d *db) prepareMigration() error {
+	if d.retired() {
+		if d.migration().DeleteBundledDatabase {
+			return d.listBundledVolumes()
+		}
+		return nil
+	}
+	if err := d.validateMigration(); err != nil {
+		return err
+	}
+	job := &batchv1.Job{}
+	err := d.client.Get(d.ctx, types.NamespacedName{Namespace: d.component.Namespace, Name: dbMigrationName}, job)
+	if err == nil {
+		return nil
+	}
+	if !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("get job %s: %v", dbMigrationName, err)
+	}
+	if d.secret == nil {
+		return fmt.Errorf("secret %s not found", DBName)
+	}
+	return d.withPrimary(func(instance mysqlInstance) error {
+		return instance.SetReadOnly()
+	})
+}
+
+func (d *db) withPrimary(fn func(instance mysqlInstance) error) error {
+	primary, err := d.primaryPod()
+	if err != nil {
+		return err
+	}
+	if primary == nil {
+		return fmt.Errorf("the primary of %s is not ready", DBName)
+	}
+	instance, err := d.dialPrimary(primary.Status.PodIP)
+	if err != nil {
+		return fmt.Errorf("connect to primary %s: %v", primary.Name, err)
+	}
+	defer instance.Close()
+	return fn(instance)
+}
+
+// listBundledVolumes lists the volumes of the statefulset, which are deleted along with it.
+func (d *db) listBundledVolumes() error {
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := d.client.List(d.ctx, pvcs, client.InNamespace(d.component.Namespace), client.MatchingLabels(d.labels)); err != nil {
+		return fmt.Errorf("list volumes of %s: %v", DBName, err)
+	}
+	d.bundledVolumes = nil
+	for i := range pvcs.Items {
+		// the volumes of the statefulset are named <volume claim template>-<pod>.
+		if strings.HasPrefix(pvcs.Items[i].Name, DBName+"-"+DBName+"-") {
+			d.bundledVolumes = append(d.bundledVolumes, &pvcs.Items[i])
+		}
+	}
+	return nil
+}
+
+// retiredResources returns the statefulset scaled down after the migration, nil if it is going to be deleted.
+func (d *db) retiredResources() []client.Object {
+	if d.migration().DeleteBundledDatabase {
+		return nil
+	}
+	return []client.Object{d.statefulsetForDB()}
+}
+
+// retiredResourcesNeedDelete returns the statefulset and its volumes if the deletion is confirmed.
+func (d *db) retiredResourcesNeedDelete() []client.Object {
+	if !d.retired() || !d.migration().DeleteBundledDatabase {
+		return nil
+	}
+	objs := []client.Object{d.statefulsetForDB()}
+	for _, pvc := range d.bundledVolumes {
+		objs = append(objs, pvc)
+	}
+	return objs
+}
+
+// reconcileMigration records the progress of the migration job, and switches the components
+// to the external databases after the data is verified.
+func (d *db) reconcileMigration() error {
+	if d.retired() {
+		return nil
+	}
+	status := &rainbondv1alpha1.DatabaseMigrationStatus{
+		Phase:             rainbondv1alpha1.DatabaseMigrationMigrating,
+		Job:               dbMigrationName,
+		MigratedDatabases: d.migratedDatabases(),
+	}
+	job := &batchv1.Job{}
+	if err := d.client.Get(d.ctx, types.NamespacedName{Namespace: d.component.Namespace, Name: dbMigrationName}, job); err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("get job %s: %v", dbMigrationName, err)
+		}
+		d.component.Status.DatabaseMigration = status
+		return nil
+	}
+
+	switch {
+	case job.Status.Succeeded > 0:
+		message, err := jobTerminationMessage(d.ctx, d.client, job)
+		if err != nil {
+			return err
+		}
+		if err := d.switchToExternal(); err != nil {
+			return err
+		}
+		log.Info("switched to the external databases", "message", message)
+		now := metav1.Now()
+		status.Phase = rainbondv1alpha1.DatabaseMigrationCompleted
+		status.Message = message
+		status.CompletionTime = &now
+	case isJobFailed(job):
+		message, err := jobTerminationMessage(d.ctx, d.client, job)
+		if err != nil {
+			return err
+		}
+		status.Phase = rainbondv1alpha1.DatabaseMigrationFailed
+		status.Message = fmt.Sprintf("%s, delete job %s to migrate again", message, dbMigrationName)
+		status.MigratedDatabases = appendMigratedDatabases(status.MigratedDatabases, message)
+		if old := d.component.Status.DatabaseMigration; old == nil || old.Phase != rainbondv1alpha1.DatabaseMigrationFailed {
+			// the components keep working with rbd-db.
+			if err := d.withPrimary(func(instance mysqlInstance) error {
+				return instance.SetWritable()
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	d.component.Status.DatabaseMigration = status
+	return nil
+}
+
+// switchToExternal sets regionDatabase and uiDatabase to the external databases, and reconciles the consumers.
+func (d *db) switchToExternal() error {
+	consumers, err := d.dbConsumers()
+	if err != nil {
+		return err
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{}
+	if err := d.client.Get(d.ctx, types.NamespacedName{Namespace: d.cluster.Namespace, Name: d.cluster.Name}, cluster); err != nil {
+		return fmt.Errorf("get rainbondcluster: %v", err)
+	}
+	patch := client.MergeFrom(cluster.DeepCopy())
+	for _, target := range d.migrationTargets() {
+		target.switchTo(&cluster.Spec)
+	}
+	if err := d.client.Patch(d.ctx, cluster, patch); err != nil {
+		return fmt.Errorf("switch to the external databases: %v", err)
+	}
+	d.cluster.Spec.RegionDatabase = cluster.Spec.RegionDatabase
+	d.cluster.Spec.UIDatabase = cluster.Spec.UIDatabase
+	for _, consumer := range consumers {
+		if err := d.notifyConsumer(consumer.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *db) configMapForMigrationScripts() client.Object {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dbMigrationName,
+			Namespace: d.component.Namespace,
+			Labels:    d.labelsForMigration(),
+		},
+		Data: map[string]string{
+			"migrate.sh": dbMigrationScript,
+		},
+	}
+}
+
+func (d *db) labelsForMigration() map[string]string {
+	return rbdutil.LabelsForRainbond(map[string]string{
+		"name": dbMigrationName,
+	})
+}
+
+// migrationResources returns the job which migrates the data, it is not retried by the job controller,
+// the failed target is reset and the job is created again once it is deleted.
+func (d *db) migrationResources() []client.Object {
+	if d.migration() == nil {
+		return nil
+	}
+	env := []corev1.EnvVar{
+		{
+			Name: "MYSQL_USER",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: DBName},
+					Key:                  mysqlUserKey,
+				},
+			},
+		},
+		{
+			Name: "MYSQL_PWD",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: DBName},
+					Key:                  mysqlPasswordKey,
+				},
+			},
+		},
+		{
+			Name:  "DB_HOST",
+			Value: dbhost,
+		},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "scripts",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: dbMigrationName},
+				},
+			},
+		},
+	}
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "scripts",
+			MountPath: "/scripts",
+		},
+	}
+	var commands []string
+	for _, target := range d.migrationTargets() {
+		env = append(env, migrationTargetEnvs(target)...)
+		commands = append(commands, "/bin/bash /scripts/migrate.sh "+target.name)
+	}
+
+	return []client.Object{
+		d.configMapForMigrationScripts(),
+		d.secretForMigration(),
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      dbMigrationName,
+				Namespace: d.component.Namespace,
+				Labels:    d.labelsForMigration(),
+			},
+			Spec: batchv1.JobSpec{
+				BackoffLimit: commonutil.Int32(0),
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Labels: d.labelsForMigration(),
+					},
+					Spec: corev1.PodSpec{
+						ImagePullSecrets: imagePullSecrets(d.component, d.cluster),
+						RestartPolicy:    corev1.RestartPolicyNever,
+						Containers: []corev1.Container{
+							{
+								Name:                     "migrate",
+								Image:                    d.component.Spec.Image,
+								ImagePullPolicy:          d.component.ImagePullPolicy(),
+								Command:                  []string{"/bin/bash", "-c", strings.Join(commands, " && ")},
+								Env:                      env,
+								VolumeMounts:             volumeMounts,
+								TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							},
+						},
+						Volumes: volumes,
+					},
+				},
+			},
+		},
+	}
+}
+
+// secretForMigration returns the passwords of the external databases.
+func (d *db) secretForMigration() client.Object {
+	data := make(map[string][]byte)
+	for _, target := range d.migrationTargets() {
+		data[migrationPasswordKey(target)] = []byte(target.target.Password)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dbMigrationName,
+			Namespace: d.component.Namespace,
+			Labels:    d.labelsForMigration(),
+		},
+		Data: data,
+	}
+}
+
+func migrationPasswordKey(target dbMigrationTarget) string {
+	return strings.ToLower(target.name) + "-password"
+}
+
+func migrationTargetEnvs(target dbMigrationTarget) []corev1.EnvVar {
+	db := target.target
+	return []corev1.EnvVar{
+		{Name: target.name + "_SOURCE_DB", Value: target.sourceDB},
+		{Name: target.name + "_HOST", Value: db.Host},
+		{Name: target.name + "_PORT", Value: strconv.Itoa(db.Port)},
+		{Name: target.name + "_USER", Value: db.Username},
+		{Name: target.name + "_PASSWORD", ValueFrom: secretKeyRef(dbMigrationName, migrationPasswordKey(target))},
+		{Name: target.name + "_DB", Value: db.Name},
+		{Name: target.name + "_SSL_OPTS", Value: mysqlClientSSLOptions(db.TLS)},
+		{Name: target.name + "_MIGRATED", Value: strconv.FormatBool(target.migrated)},
+	}
+}
+
+// appendMigratedDatabases appends the targets verified by a failed job, see dbMigrationScript.
+func appendMigratedDatabases(migrated []string, message string) []string {
+	for _, line := range strings.Split(message, "\n") {
+		name := strings.SplitN(line, ":", 2)[0]
+		if strings.HasPrefix(line, name+": verified ") && !containsString(migrated, name) {
+			migrated = append(migrated, name)
+		}
+	}
+	return migrated
+}
+
+// mysqlClientSSLOptions returns the options of the mysql client for the tls of the database,
+// the server is verified with the system ca certificates as the components do.
+func mysqlClientSSLOptions(tls *rainbondv1alpha1.DatabaseTLS) string {
+	if tls == nil {
+		return "--ssl-mode=DISABLED"
+	}
+	switch tls.Mode {
+	case rainbondv1alpha1.DatabaseTLSPreferred:
+		return "--ssl-mode=PREFERRED"
+	case rainbondv1alpha1.DatabaseTLSRequired:
+		return "--ssl-mode=REQUIRED"
+	case rainbondv1alpha1.DatabaseTLSVerifyCA:
+		return "--ssl-mode=VERIFY_CA --ssl-capath=/etc/ssl/certs"
+	case rainbondv1alpha1.DatabaseTLSVerifyFull:
+		return "--ssl-mode=VERIFY_IDENTITY --ssl-capath=/etc/ssl/certs"
+	}
+	return "--ssl-mode=DISABLED"
+}
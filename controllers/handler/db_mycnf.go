@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// dbMyCnfChecksumAnnotation restarts the mysql servers one by one when my.cnf is changed.
+	dbMyCnfChecksumAnnotation = "rainbond.io/mycnf-checksum"
+
+	minInnodbBufferPoolSize = 5 << 20
+	// the default innodb_buffer_pool_chunk_size of mysql.
+	innodbBufferPoolChunkSize = 128 << 20
+	// the memory of mysql other than the innodb buffer pool, such as the buffers of the connections.
+	memoryPerConnection = 16 << 20
+	minMaxConnections   = 151
+	maxMaxConnections   = 1000
+)
+
+var (
+	mysqlOptionName = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+	// the options managed by the operator, with '-' replaced by '_'.
+	reservedMySQLOptions = map[string]bool{
+		"user":                     true,
+		"datadir":                  true,
+		"socket":                   true,
+		"port":                     true,
+		"innodb_directories":       true,
+		"server_id":                true,
+		"report_host":              true,
+		"log_bin":                  true,
+		"binlog_format":            true,
+		"gtid_mode":                true,
+		"enforce_gtid_consistency": true,
+		"log_slave_updates":        true,
+		"log_replica_updates":      true,
+		"relay_log":                true,
+		"relay_log_recovery":       true,
+		"innodb_buffer_pool_size":  true,
+		"max_connections":          true,
+		"slow_query_log":           true,
+		"long_query_time":          true,
+	}
+)
+
+// memoryLimit returns the memory limit specified in the component, or nil.
+func (d *db) memoryLimit() *resource.Quantity {
+	limit, ok := d.component.Spec.Resources.Limits[corev1.ResourceMemory]
+	if !ok || limit.IsZero() {
+		return nil
+	}
+	return &limit
+}
+
+// validateMySQLConfig checks the configuration of the bundled mysql before it is rendered into my.cnf.
+func (d *db) validateMySQLConfig() error {
+	config := d.component.Spec.MySQLConfig
+	// the buffer pool sized from the memory limit is checked as well.
+	if size := d.innodbBufferPoolSize(); size > 0 {
+		quantity := resource.NewQuantity(size, resource.BinarySI)
+		if size < minInnodbBufferPoolSize {
+			return fmt.Errorf("innodbBufferPoolSize %s is less than 5Mi", quantity.String())
+		}
+		if limit := d.memoryLimit(); limit != nil && quantity.Cmp(*limit) >= 0 {
+			return fmt.Errorf("innodbBufferPoolSize %s must be less than the memory limit %s", quantity.String(), limit.String())
+		}
+	}
+	if config == nil {
+		return nil
+	}
+	if config.MaxConnections != nil && *config.MaxConnections < 1 {
+		return fmt.Errorf("maxConnections must be positive")
+	}
+	if slow := config.SlowQueryLog; slow != nil && slow.LongQueryTime != nil && slow.LongQueryTime.Duration < 0 {
+		return fmt.Errorf("longQueryTime of slowQueryLog must not be negative")
+	}
+	for name, value := range config.Options {
+		if !mysqlOptionName.MatchString(name) {
+			return fmt.Errorf("invalid mysql option %q", name)
+		}
+		if reservedMySQLOptions[strings.ReplaceAll(name, "-", "_")] {
+			return fmt.Errorf("mysql option %q is managed by the operator", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("the value of mysql option %q must be a single line", name)
+		}
+	}
+	return nil
+}
+
+// innodbBufferPoolSize returns the size of the innodb buffer pool in mysqlConfig, or half of the memory limit
+// if it is not specified. It returns 0 to keep the default of mysql.
+func (d *db) innodbBufferPoolSize() int64 {
+	if config := d.component.Spec.MySQLConfig; config != nil && config.InnodbBufferPoolSize != nil {
+		return config.InnodbBufferPoolSize.Value()
+	}
+	limit := d.memoryLimit()
+	if limit == nil {
+		return 0
+	}
+	size := limit.Value() / 2
+	if size >= innodbBufferPoolChunkSize {
+		// mysql rounds it to a multiple of the chunk size.
+		return size / innodbBufferPoolChunkSize * innodbBufferPoolChunkSize
+	}
+	// the chunk size is reduced by mysql for a smaller buffer pool, which must still leave memory for the connections.
+	size = size / (1 << 20) * (1 << 20)
+	if size < minInnodbBufferPoolSize {
+		size = minInnodbBufferPoolSize
+	}
+	return size
+}
+
+// tuningOptions returns the options in mysqlConfig, the buffer pool and connections are sized
+// from the memory limit if they are not specified.
+func (d *db) tuningOptions() map[string]string {
+	options := make(map[string]string)
+	config := d.component.Spec.MySQLConfig
+	if config == nil {
+		config = &rainbondv1alpha1.MySQLConfig{}
+	}
+	for name, value := range config.Options {
+		options[name] = value
+	}
+
+	limit := d.memoryLimit()
+	if size := d.innodbBufferPoolSize(); size > 0 {
+		options["innodb_buffer_pool_size"] = strconv.FormatInt(size, 10)
+	}
+	if config.MaxConnections != nil {
+		options["max_connections"] = strconv.Itoa(int(*config.MaxConnections))
+	} else if limit != nil {
+		connections := limit.Value() / memoryPerConnection
+		if connections < minMaxConnections {
+			connections = minMaxConnections
+		}
+		if connections > maxMaxConnections {
+			connections = maxMaxConnections
+		}
+		options["max_connections"] = strconv.FormatInt(connections, 10)
+	}
+	if slow := config.SlowQueryLog; slow != nil {
+		options["slow_query_log"] = "ON"
+		longQueryTime := 10.0
+		if slow.LongQueryTime != nil {
+			longQueryTime = slow.LongQueryTime.Seconds()
+		}
+		options["long_query_time"] = strconv.FormatFloat(longQueryTime, 'f', -1, 64)
+	}
+	return options
+}
+
+// tuningSection renders the tuning options in the order of the names, so that my.cnf is stable.
+func (d *db) tuningSection() string {
+	options := d.tuningOptions()
+	if len(options) == 0 {
+		return ""
+	}
+	var names []string
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString(`
+#
+# * Tuning
+#
+`)
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%-24s = %s\n", name, options[name])
+	}
+	return sb.String()
+}
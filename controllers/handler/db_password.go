@@ -0,0 +1,452 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	checksqllite "github.com/goodrain/rainbond-operator/util/check-sqllite"
+	"github.com/goodrain/rainbond-operator/util/k8sutil"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DBRotatePasswordAnnotation on rbd-db triggers a rotation of the passwords whenever its value changes.
+	DBRotatePasswordAnnotation = "rainbond.io/rotate-db-password"
+
+	// the annotations of the rbd-db secret, which record the progress of the rotation.
+	dbRotationTokenAnnotation = "rainbond.io/password-rotation-token"
+	dbRotatedUsersAnnotation  = "rainbond.io/password-rotated-users"
+	dbRotatingUserAnnotation  = "rainbond.io/password-rotating-user"
+
+	// dbCredentialsChangedAnnotation is set on the consumers of rbd-db to reconcile them with the new credentials.
+	dbCredentialsChangedAnnotation = "rainbond.io/db-credentials-change-time"
+
+	mysqlNextPasswordKey = "mysql-password-next"
+)
+
+// dbConsumer is a component which connects to rbd-db with its own user.
+type dbConsumer struct {
+	name     string
+	database string
+}
+
+func dbConsumerUserKey(name string) string {
+	return name + "-user"
+}
+
+func dbConsumerPasswordKey(name string) string {
+	return name + "-password"
+}
+
+func dbConsumerNextPasswordKey(name string) string {
+	return name + "-password-next"
+}
+
+// dbConsumers returns the installed components which use rbd-db, in the order their passwords are rotated.
+func (d *db) dbConsumers() ([]dbConsumer, error) {
+	if checksqllite.IsSQLLite() {
+		return nil, nil
+	}
+	var candidates []dbConsumer
+	if d.cluster.Spec.RegionDatabase == nil {
+		for _, name := range []string{APIName, WorkerName, ChaosName} {
+			candidates = append(candidates, dbConsumer{name: name, database: RegionDatabaseName})
+		}
+	}
+	if d.cluster.Spec.UIDatabase == nil {
+		candidates = append(candidates, dbConsumer{name: AppUIName, database: ConsoleDatabaseName})
+	}
+
+	var consumers []dbConsumer
+	for _, consumer := range candidates {
+		cpt := &rainbondv1alpha1.RbdComponent{}
+		if err := d.client.Get(d.ctx, types.NamespacedName{Namespace: d.component.Namespace, Name: consumer.name}, cpt); err != nil {
+			if k8sErrors.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("get rbdcomponent %s: %v", consumer.name, err)
+		}
+		consumers = append(consumers, consumer)
+	}
+	return consumers, nil
+}
+
+// reconcileUsers creates a dedicated user for every consumer, and rotates the passwords if it is requested.
+func (d *db) reconcileUsers() error {
+	d.usersPending = true
+	if d.secret == nil {
+		// the secret has just been created.
+		return nil
+	}
+	primary, err := d.primaryPod()
+	if err != nil || primary == nil {
+		return err
+	}
+	consumers, err := d.dbConsumers()
+	if err != nil {
+		return err
+	}
+
+	instance, err := d.dialPrimary(primary.Status.PodIP)
+	if err != nil {
+		return fmt.Errorf("connect to primary %s: %v", primary.Name, err)
+	}
+	defer instance.Close()
+
+	for _, consumer := range consumers {
+		if err := d.ensureConsumerUser(instance, consumer); err != nil {
+			return err
+		}
+	}
+
+	done, err := d.rotatePasswords(instance, primary.Status.PodIP, consumers)
+	if err != nil {
+		return err
+	}
+	d.usersPending = !done
+	return nil
+}
+
+// primaryPod returns the pod of the writable mysql server, nil if it is not ready.
+func (d *db) primaryPod() (*corev1.Pod, error) {
+	name := DBName + "-0"
+	if d.cluster.Spec.EnableHA {
+		if d.component.Status.Replication == nil || d.component.Status.Replication.Primary == "" {
+			return nil, nil
+		}
+		name = d.component.Status.Replication.Primary
+	}
+	pod := &corev1.Pod{}
+	if err := d.client.Get(d.ctx, types.NamespacedName{Namespace: d.component.Namespace, Name: name}, pod); err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get pod %s: %v", name, err)
+	}
+	if !k8sutil.IsPodReady(pod) || pod.Status.PodIP == "" {
+		return nil, nil
+	}
+	return pod, nil
+}
+
+// dialPrimary connects to the primary as root. The new root password is used if the password
+// has been changed, but the secret was not updated.
+func (d *db) dialPrimary(host string) (mysqlInstance, error) {
+	instance, err := dialMySQL(host, d.mysqlUser, d.mysqlPassword)
+	if err == nil {
+		return instance, nil
+	}
+	next := string(d.secret.Data[mysqlNextPasswordKey])
+	if next == "" {
+		return nil, err
+	}
+	instance, nextErr := dialMySQL(host, d.mysqlUser, next)
+	if nextErr != nil {
+		return nil, err
+	}
+	if err := d.updateSecret(func(secret *corev1.Secret) {
+		setRootPassword(secret, next)
+	}); err != nil {
+		instance.Close()
+		return nil, err
+	}
+	d.mysqlPassword = next
+	return instance, nil
+}
+
+// ensureConsumerUser creates the user of the consumer, then reconciles the consumer to use it instead of root.
+func (d *db) ensureConsumerUser(instance mysqlInstance, consumer dbConsumer) error {
+	if len(d.secret.Data[dbConsumerPasswordKey(consumer.name)]) > 0 {
+		return nil
+	}
+	password := randomSecretKey()
+	if password == "" {
+		return fmt.Errorf("generate password for %s", consumer.name)
+	}
+	if err := instance.EnsureUser(consumer.name, password, []string{consumer.database}); err != nil {
+		return fmt.Errorf("create user %s: %v", consumer.name, err)
+	}
+	if err := d.updateSecret(func(secret *corev1.Secret) {
+		secret.Data[dbConsumerUserKey(consumer.name)] = []byte(consumer.name)
+		secret.Data[dbConsumerPasswordKey(consumer.name)] = []byte(password)
+	}); err != nil {
+		return err
+	}
+	log.Info("created database user", "user", consumer.name)
+	return d.notifyConsumer(consumer.name)
+}
+
+// rotatePasswords rotates the password of root, then the passwords of the consumers one by one.
+// The old password of a consumer is kept until all its pods use the new one, so that it is rotated
+// without downtime. It returns true if there is no rotation in progress.
+func (d *db) rotatePasswords(instance mysqlInstance, host string, consumers []dbConsumer) (bool, error) {
+	token := d.component.Annotations[DBRotatePasswordAnnotation]
+	if token == "" {
+		return true, nil
+	}
+	if d.secret.Annotations[dbRotationTokenAnnotation] != token {
+		if err := d.updateSecret(func(secret *corev1.Secret) {
+			secret.Annotations[dbRotationTokenAnnotation] = token
+			delete(secret.Annotations, dbRotatedUsersAnnotation)
+			delete(secret.Annotations, dbRotatingUserAnnotation)
+		}); err != nil {
+			return false, err
+		}
+		log.Info("rotate database passwords", "token", token)
+	}
+	status := d.component.Status.PasswordRotation
+	if status == nil || status.Token != token {
+		status = &rainbondv1alpha1.PasswordRotationStatus{Token: token}
+		d.component.Status.PasswordRotation = status
+	}
+	status.Phase = rainbondv1alpha1.PasswordRotationRotating
+
+	if !d.rotated(d.mysqlUser) {
+		status.User = d.mysqlUser
+		if err := d.rotateRootPassword(instance); err != nil {
+			status.Message = err.Error()
+			return false, err
+		}
+	}
+	for _, consumer := range consumers {
+		if d.rotated(consumer.name) {
+			continue
+		}
+		status.User = consumer.name
+		done, err := d.rotateConsumerPassword(instance, host, consumer)
+		if err != nil {
+			status.Message = err.Error()
+			return false, err
+		}
+		if !done {
+			status.Message = fmt.Sprintf("waiting for the pods of %s to use the new password", consumer.name)
+			return false, nil
+		}
+	}
+
+	status.Phase = rainbondv1alpha1.PasswordRotationCompleted
+	status.User = ""
+	status.Message = ""
+	if status.CompletionTime == nil {
+		now := metav1.Now()
+		status.CompletionTime = &now
+	}
+	return true, nil
+}
+
+func (d *db) rotated(user string) bool {
+	for _, rotated := range strings.Split(d.secret.Annotations[dbRotatedUsersAnnotation], ",") {
+		if rotated == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *db) rotateRootPassword(instance mysqlInstance) error {
+	next, err := d.nextPassword(mysqlNextPasswordKey)
+	if err != nil {
+		return err
+	}
+	// root is used by the operator, the backup jobs and the replicas. The operator and the jobs read
+	// the password from the secret, and the replicas are set up again with it by reconcileReplication.
+	if err := instance.ChangePassword(d.mysqlUser, next, false); err != nil {
+		return fmt.Errorf("change password of %s: %v", d.mysqlUser, err)
+	}
+	if err := d.updateSecret(func(secret *corev1.Secret) {
+		setRootPassword(secret, next)
+		addRotatedUser(secret, d.mysqlUser)
+	}); err != nil {
+		return err
+	}
+	d.mysqlPassword = next
+	log.Info("rotated database password", "user", d.mysqlUser)
+	return nil
+}
+
+// rotateConsumerPassword changes the password of the consumer and keeps the old one, then waits for the
+// pods of the consumer to use the new password before discarding the old one.
+func (d *db) rotateConsumerPassword(instance mysqlInstance, host string, consumer dbConsumer) (bool, error) {
+	if d.secret.Annotations[dbRotatingUserAnnotation] != consumer.name {
+		next, err := d.nextPassword(dbConsumerNextPasswordKey(consumer.name))
+		if err != nil {
+			return false, err
+		}
+		// the password may have been changed, but the secret was not updated.
+		// Changing it again would discard the password which is still in use.
+		if probe, err := dialMySQL(host, consumer.name, next); err == nil {
+			probe.Close()
+		} else if err := instance.ChangePassword(consumer.name, next, true); err != nil {
+			return false, fmt.Errorf("change password of %s: %v", consumer.name, err)
+		}
+		if err := d.updateSecret(func(secret *corev1.Secret) {
+			secret.Data[dbConsumerPasswordKey(consumer.name)] = []byte(next)
+			delete(secret.Data, dbConsumerNextPasswordKey(consumer.name))
+			secret.Annotations[dbRotatingUserAnnotation] = consumer.name
+		}); err != nil {
+			return false, err
+		}
+		return false, d.notifyConsumer(consumer.name)
+	}
+
+	rolledOut, err := d.consumerRolledOut(consumer.name, string(d.secret.Data[dbConsumerPasswordKey(consumer.name)]))
+	if err != nil || !rolledOut {
+		return false, err
+	}
+	if err := instance.DiscardOldPassword(consumer.name); err != nil {
+		return false, fmt.Errorf("discard old password of %s: %v", consumer.name, err)
+	}
+	if err := d.updateSecret(func(secret *corev1.Secret) {
+		delete(secret.Annotations, dbRotatingUserAnnotation)
+		addRotatedUser(secret, consumer.name)
+	}); err != nil {
+		return false, err
+	}
+	log.Info("rotated database password", "user", consumer.name)
+	return true, nil
+}
+
+// nextPassword returns the new password saved in the secret under the key, it is generated if not exists.
+// The new password is saved before it is used, so that it is not lost if the secret failed to update.
+func (d *db) nextPassword(key string) (string, error) {
+	if next := string(d.secret.Data[key]); next != "" {
+		return next, nil
+	}
+	next := randomSecretKey()
+	if next == "" {
+		return "", fmt.Errorf("generate password for %s", key)
+	}
+	if err := d.updateSecret(func(secret *corev1.Secret) {
+		secret.Data[key] = []byte(next)
+	}); err != nil {
+		return "", err
+	}
+	return next, nil
+}
+
+// consumerRolledOut returns true if all the pods of the consumer are ready and use the password.
+func (d *db) consumerRolledOut(name, password string) (bool, error) {
+	cpt := &rainbondv1alpha1.RbdComponent{}
+	if err := d.client.Get(d.ctx, types.NamespacedName{Namespace: d.component.Namespace, Name: name}, cpt); err != nil {
+		return false, fmt.Errorf("get rbdcomponent %s: %v", name, err)
+	}
+	pods, err := listPods(d.ctx, d.client, d.component.Namespace, LabelsForRainbondComponent(cpt))
+	if err != nil {
+		return false, err
+	}
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || !k8sutil.IsPodReady(pod) || !podUsesPassword(pod, password) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// podUsesPassword returns true if the password is passed to the pod, by args or environment variables.
+func podUsesPassword(pod *corev1.Pod, password string) bool {
+	for _, container := range pod.Spec.Containers {
+		for _, arg := range container.Args {
+			if strings.Contains(arg, password) {
+				return true
+			}
+		}
+		for _, env := range container.Env {
+			if env.Value == password {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// notifyConsumer triggers the reconciliation of the consumer, which reads the credentials from the secret.
+func (d *db) notifyConsumer(name string) error {
+	cpt := &rainbondv1alpha1.RbdComponent{}
+	if err := d.client.Get(d.ctx, types.NamespacedName{Namespace: d.component.Namespace, Name: name}, cpt); err != nil {
+		return fmt.Errorf("get rbdcomponent %s: %v", name, err)
+	}
+	patch := client.MergeFrom(cpt.DeepCopy())
+	if cpt.Annotations == nil {
+		cpt.Annotations = make(map[string]string)
+	}
+	cpt.Annotations[dbCredentialsChangedAnnotation] = time.Now().Format(time.RFC3339Nano)
+	if err := d.client.Patch(d.ctx, cpt, patch); err != nil {
+		return fmt.Errorf("patch rbdcomponent %s: %v", name, err)
+	}
+	return nil
+}
+
+func (d *db) updateSecret(mutate func(secret *corev1.Secret)) error {
+	secret := d.secret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	mutate(secret)
+	if err := d.client.Update(d.ctx, secret); err != nil {
+		return fmt.Errorf("update secret %s: %v", secret.Name, err)
+	}
+	d.secret = secret
+	return nil
+}
+
+func setRootPassword(secret *corev1.Secret, password string) {
+	secret.Data["password"] = []byte(password)
+	secret.Data[mysqlPasswordKey] = []byte(password)
+	delete(secret.Data, mysqlNextPasswordKey)
+}
+
+func addRotatedUser(secret *corev1.Secret, user string) {
+	if rotated := secret.Annotations[dbRotatedUsersAnnotation]; rotated != "" {
+		user = rotated + "," + user
+	}
+	secret.Annotations[dbRotatedUsersAnnotation] = user
+}
+
+func (m *sqlMySQLInstance) EnsureUser(user, password string, databases []string) error {
+	// the users and passwords are generated by the operator, which are safe to be quoted.
+	stmts := []string{
+		fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED BY '%s'", user, password),
+		fmt.Sprintf("ALTER USER '%s'@'%%' IDENTIFIED BY '%s'", user, password),
+	}
+	for _, database := range databases {
+		stmts = append(stmts, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", database),
+			fmt.Sprintf("GRANT ALL PRIVILEGES ON `%s`.* TO '%s'@'%%'", database, user))
+	}
+	return m.execSensitive(stmts...)
+}
+
+func (m *sqlMySQLInstance) ChangePassword(user, password string, retain bool) error {
+	var suffix string
+	if retain {
+		suffix = " RETAIN CURRENT PASSWORD"
+	}
+	// root is also created for localhost by the docker entrypoint.
+	return m.execSensitive(
+		fmt.Sprintf("ALTER USER IF EXISTS '%s'@'%%' IDENTIFIED BY '%s'%s", user, password, suffix),
+		fmt.Sprintf("ALTER USER IF EXISTS '%s'@'localhost' IDENTIFIED BY '%s'%s", user, password, suffix),
+	)
+}
+
+func (m *sqlMySQLInstance) DiscardOldPassword(user string) error {
+	return m.exec(fmt.Sprintf("ALTER USER IF EXISTS '%s'@'%%' DISCARD OLD PASSWORD", user))
+}
+
+// execSensitive executes the statements which contain passwords, the statements are not included in the errors.
+func (m *sqlMySQLInstance) execSensitive(stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := m.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,497 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/k8sutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	dbRoleLabelKey = "rainbond.io/db-role"
+	dbRolePrimary  = "primary"
+	dbRoleReplica  = "replica"
+	// dbReplicationCredentialsAnnotation on a replica is the checksum of the credentials it replicates with,
+	// the replication is set up again once the password of root is rotated.
+	dbReplicationCredentialsAnnotation = "rainbond.io/replication-credentials-checksum"
+	// the primary is failed over only if it is not ready for dbFailoverTimeout.
+	dbFailoverTimeout = 30 * time.Second
+	dbResyncPeriod    = 10 * time.Second
+)
+
+// dbReadOnlyHost is the service of the read-only replicas.
+var dbReadOnlyHost = DBName + "-ro"
+
+// mysqlReplicaStatus is the result of SHOW SLAVE STATUS.
+type mysqlReplicaStatus struct {
+	sourceHost string
+	ioRunning  bool
+	sqlRunning bool
+	lagSeconds *int64
+	lastError  string
+}
+
+// mysqlInstance is a mysql server of rbd-db.
+type mysqlInstance interface {
+	// GTIDExecuted returns the gtid set executed by the instance.
+	GTIDExecuted() (string, error)
+	// GTIDSubset returns true if gtids is a subset of the gtid set executed by the instance.
+	GTIDSubset(gtids string) (bool, error)
+	// ReplicaStatus returns the replication status, nil if the instance is not a replica.
+	ReplicaStatus() (*mysqlReplicaStatus, error)
+	// HasUserTables returns true if there are tables in the given databases.
+	HasUserTables(databases []string) (bool, error)
+	// Promote stops the replication and makes the instance writable.
+	Promote() error
+	// Follow makes the instance read-only and replicate from the given source.
+	// All gtids executed by the instance are discarded if reset is true.
+	Follow(source, user, password string, reset bool) error
+	// SetReadOnly makes the instance read-only.
+	SetReadOnly() error
+	// SetWritable makes the instance writable, without changing the replication.
+	SetWritable() error
+	// EnsureUser creates the user with the password, and grants all privileges of the databases to it.
+	EnsureUser(user, password string, databases []string) error
+	// ChangePassword changes the password of the user. The current password is kept as
+	// the secondary password if retain is true, until it is discarded by DiscardOldPassword.
+	ChangePassword(user, password string, retain bool) error
+	// DiscardOldPassword discards the secondary password of the user.
+	DiscardOldPassword(user string) error
+	Close() error
+}
+
+// dialMySQL connects to the mysql server, it is a variable so that it can be replaced in tests.
+var dialMySQL = func(host, user, password string) (mysqlInstance, error) {
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:3306)/?timeout=3s&readTimeout=10s", user, password, host))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlMySQLInstance{db: db}, nil
+}
+
+type sqlMySQLInstance struct {
+	db *sql.DB
+}
+
+func (m *sqlMySQLInstance) GTIDExecuted() (string, error) {
+	var gtids string
+	err := m.db.QueryRow("SELECT @@GLOBAL.gtid_executed").Scan(&gtids)
+	return strings.ReplaceAll(gtids, "\n", ""), err
+}
+
+func (m *sqlMySQLInstance) GTIDSubset(gtids string) (bool, error) {
+	var subset bool
+	err := m.db.QueryRow("SELECT GTID_SUBSET(?, @@GLOBAL.gtid_executed)", gtids).Scan(&subset)
+	return subset, err
+}
+
+func (m *sqlMySQLInstance) ReplicaStatus() (*mysqlReplicaStatus, error) {
+	rows, err := m.db.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(columns))
+	for i, column := range columns {
+		fields[column] = values[i].String
+	}
+
+	status := &mysqlReplicaStatus{
+		sourceHost: fields["Master_Host"],
+		ioRunning:  fields["Slave_IO_Running"] == "Yes",
+		sqlRunning: fields["Slave_SQL_Running"] == "Yes",
+	}
+	if lag, err := strconv.ParseInt(fields["Seconds_Behind_Master"], 10, 64); err == nil {
+		status.lagSeconds = &lag
+	}
+	for _, key := range []string{"Last_IO_Error", "Last_SQL_Error"} {
+		if fields[key] != "" {
+			status.lastError = fields[key]
+			break
+		}
+	}
+	return status, nil
+}
+
+func (m *sqlMySQLInstance) HasUserTables(databases []string) (bool, error) {
+	if len(databases) == 0 {
+		return false, nil
+	}
+	args := make([]interface{}, len(databases))
+	for i := range databases {
+		args[i] = databases[i]
+	}
+	query := "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema IN (?" + strings.Repeat(",?", len(databases)-1) + ")"
+	var count int
+	if err := m.db.QueryRow(query, args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (m *sqlMySQLInstance) Promote() error {
+	return m.exec(
+		"STOP SLAVE",
+		"RESET SLAVE ALL",
+		"SET GLOBAL super_read_only = OFF",
+		"SET GLOBAL read_only = OFF",
+	)
+}
+
+func (m *sqlMySQLInstance) Follow(source, user, password string, reset bool) error {
+	if err := m.exec("STOP SLAVE"); err != nil {
+		return err
+	}
+	if reset {
+		if err := m.exec("RESET MASTER"); err != nil {
+			return err
+		}
+	}
+	if _, err := m.db.Exec("CHANGE MASTER TO MASTER_HOST = ?, MASTER_PORT = 3306, MASTER_USER = ?, MASTER_PASSWORD = ?, MASTER_AUTO_POSITION = 1",
+		source, user, password); err != nil {
+		return fmt.Errorf("change master to %s: %v", source, err)
+	}
+	return m.exec(
+		"SET GLOBAL read_only = ON",
+		"SET GLOBAL super_read_only = ON",
+		"START SLAVE",
+	)
+}
+
+func (m *sqlMySQLInstance) SetReadOnly() error {
+	return m.exec(
+		"SET GLOBAL read_only = ON",
+		"SET GLOBAL super_read_only = ON",
+	)
+}
+
+func (m *sqlMySQLInstance) SetWritable() error {
+	return m.exec(
+		"SET GLOBAL super_read_only = OFF",
+		"SET GLOBAL read_only = OFF",
+	)
+}
+
+func (m *sqlMySQLInstance) Close() error {
+	return m.db.Close()
+}
+
+func (m *sqlMySQLInstance) exec(stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := m.db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %v", stmt, err)
+		}
+	}
+	return nil
+}
+
+// dbMember is a pod of rbd-db, with the connection to its mysql server if it is ready.
+type dbMember struct {
+	pod      *corev1.Pod
+	instance mysqlInstance
+	err      error
+}
+
+func (m *dbMember) healthy() bool {
+	return m.instance != nil
+}
+
+// reconcileReplication makes sure there is exactly one writable primary, the other pods replicate from it,
+// and the primary will be failed over to the most up-to-date replica if it is not ready for dbFailoverTimeout.
+func (d *db) reconcileReplication() error {
+	pods, err := listPods(d.ctx, d.client, d.component.Namespace, d.labels)
+	if err != nil {
+		return err
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Name < pods[j].Name
+	})
+
+	members := make(map[string]*dbMember, len(pods))
+	var names []string
+	for i := range pods {
+		pod := &pods[i]
+		member := &dbMember{pod: pod}
+		if k8sutil.IsPodReady(pod) && pod.Status.PodIP != "" {
+			member.instance, member.err = dialMySQL(pod.Status.PodIP, d.mysqlUser, d.mysqlPassword)
+		}
+		members[pod.Name] = member
+		names = append(names, pod.Name)
+	}
+	defer func() {
+		for _, member := range members {
+			if member.instance != nil {
+				member.instance.Close()
+			}
+		}
+	}()
+
+	base := d.component.DeepCopy()
+	status := d.component.Status.Replication
+	if status == nil {
+		status = &rainbondv1alpha1.ReplicationStatus{}
+		d.component.Status.Replication = status
+	}
+
+	primary := members[status.Primary]
+	switch {
+	case primary == nil && status.Primary == "":
+		// bootstrap, the first pod becomes the primary, which is the only pod before the HA mode is enabled.
+		primary = members[DBName+"-0"]
+		if primary == nil || !primary.healthy() {
+			return nil
+		}
+	case primary == nil || !primary.healthy():
+		// do not fail over a ready primary, which may be unreachable from the operator only.
+		if primary != nil && (k8sutil.IsPodReady(primary.pod) || !dbFailoverDue(primary.pod)) {
+			d.updateReplicaStatus(status, members, names)
+			if primary.err != nil {
+				return fmt.Errorf("connect to primary %s: %v", primary.pod.Name, primary.err)
+			}
+			return nil
+		}
+		candidate, err := d.failoverCandidate(members, names, status.Primary)
+		if err != nil {
+			d.updateReplicaStatus(status, members, names)
+			return fmt.Errorf("failover primary %s: %v", status.Primary, err)
+		}
+		log.Info("failover rbd-db primary", "from", status.Primary, "to", candidate.pod.Name)
+		primary = candidate
+		now := metav1.Now()
+		status.LastFailoverTime = &now
+	}
+
+	if status.Primary != primary.pod.Name {
+		// record the new primary before promoting it, so that the old primary is never promoted again,
+		// even if the status is not updated after the reconciliation.
+		status.Primary = primary.pod.Name
+		if err := d.client.Status().Patch(d.ctx, d.component, client.MergeFrom(base)); err != nil {
+			return fmt.Errorf("record primary %s: %v", primary.pod.Name, err)
+		}
+		status = d.component.Status.Replication
+	}
+	// only a new primary is promoted, the primary stays read-only while the data is migrated.
+	if primary.pod.Labels[dbRoleLabelKey] != dbRolePrimary {
+		if err := primary.instance.Promote(); err != nil {
+			return fmt.Errorf("promote %s: %v", primary.pod.Name, err)
+		}
+		if d.migrating() {
+			if err := primary.instance.SetReadOnly(); err != nil {
+				return fmt.Errorf("set %s read-only: %v", primary.pod.Name, err)
+			}
+		}
+	}
+	if err := d.setDBRole(primary.pod, dbRolePrimary); err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, name := range names {
+		member := members[name]
+		if member == primary {
+			continue
+		}
+		if err := d.setDBRole(member.pod, dbRoleReplica); err != nil {
+			return err
+		}
+		if !member.healthy() {
+			continue
+		}
+		if err := d.follow(member, primary); err != nil {
+			member.err = err
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	d.updateReplicaStatus(status, members, names)
+	if len(errs) > 0 {
+		return fmt.Errorf("setup replication: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// failoverCandidate returns the healthy replica which has executed all the transactions of the other replicas.
+func (d *db) failoverCandidate(members map[string]*dbMember, names []string, oldPrimary string) (*dbMember, error) {
+	var healthy []*dbMember
+	gtids := make(map[*dbMember]string)
+	for _, name := range names {
+		member := members[name]
+		if name == oldPrimary || !member.healthy() {
+			continue
+		}
+		executed, err := member.instance.GTIDExecuted()
+		if err != nil {
+			member.err = err
+			continue
+		}
+		healthy = append(healthy, member)
+		gtids[member] = executed
+	}
+	if len(healthy) == 0 {
+		return nil, fmt.Errorf("no healthy replica")
+	}
+
+	for _, candidate := range healthy {
+		upToDate := true
+		for _, other := range healthy {
+			if other == candidate {
+				continue
+			}
+			subset, err := candidate.instance.GTIDSubset(gtids[other])
+			if err != nil || !subset {
+				upToDate = false
+				break
+			}
+		}
+		if upToDate {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("the replicas have diverged, none of them has all the transactions")
+}
+
+// follow makes the member replicate from the primary. A member which has not replicated from the primary yet,
+// such as a new replica or the recovered old primary, can only join if all its transactions exist on the primary,
+// or if it does not have any data yet.
+func (d *db) follow(member, primary *dbMember) error {
+	replicaStatus, err := member.instance.ReplicaStatus()
+	if err != nil {
+		return err
+	}
+	credentials := checksum(d.mysqlUser, d.mysqlPassword)
+	if replicaStatus != nil && replicaStatus.sourceHost == dbhost {
+		// replicating from the rw service, which always points to the primary.
+		if member.pod.Annotations[dbReplicationCredentialsAnnotation] == credentials {
+			return member.instance.SetReadOnly()
+		}
+		// the password of root has been rotated since the replication was set up.
+		if err := member.instance.Follow(dbhost, d.mysqlUser, d.mysqlPassword, false); err != nil {
+			return err
+		}
+		return d.setReplicationCredentials(member.pod, credentials)
+	}
+
+	executed, err := member.instance.GTIDExecuted()
+	if err != nil {
+		return err
+	}
+	subset, err := primary.instance.GTIDSubset(executed)
+	if err != nil {
+		return err
+	}
+	reset := false
+	if !subset {
+		hasData, err := member.instance.HasUserTables(d.databases)
+		if err != nil {
+			return err
+		}
+		if hasData {
+			return fmt.Errorf("errant transactions which do not exist on primary %s: %s", primary.pod.Name, executed)
+		}
+		// a newly initialized replica, the transactions are created by the initialization.
+		reset = true
+	}
+	if err := member.instance.Follow(dbhost, d.mysqlUser, d.mysqlPassword, reset); err != nil {
+		return err
+	}
+	return d.setReplicationCredentials(member.pod, credentials)
+}
+
+func (d *db) setReplicationCredentials(pod *corev1.Pod, checksum string) error {
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[dbReplicationCredentialsAnnotation] = checksum
+	if err := d.client.Patch(d.ctx, pod, patch); err != nil {
+		return fmt.Errorf("record replication credentials of %s: %v", pod.Name, err)
+	}
+	return nil
+}
+
+func (d *db) setDBRole(pod *corev1.Pod, role string) error {
+	if pod.Labels[dbRoleLabelKey] == role {
+		return nil
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Labels == nil {
+		pod.Labels = make(map[string]string)
+	}
+	pod.Labels[dbRoleLabelKey] = role
+	if err := d.client.Patch(d.ctx, pod, patch); err != nil {
+		return fmt.Errorf("set role of %s to %s: %v", pod.Name, role, err)
+	}
+	return nil
+}
+
+func (d *db) updateReplicaStatus(status *rainbondv1alpha1.ReplicationStatus, members map[string]*dbMember, names []string) {
+	var replicas []rainbondv1alpha1.ReplicaStatus
+	for _, name := range names {
+		if name == status.Primary {
+			continue
+		}
+		member := members[name]
+		replica := rainbondv1alpha1.ReplicaStatus{Name: name}
+		switch {
+		case member.err != nil:
+			replica.Message = member.err.Error()
+		case !member.healthy():
+			replica.Message = "pod not ready"
+		default:
+			replicaStatus, err := member.instance.ReplicaStatus()
+			if err != nil {
+				replica.Message = err.Error()
+				break
+			}
+			if replicaStatus == nil {
+				replica.Message = "not replicating"
+				break
+			}
+			replica.Running = replicaStatus.ioRunning && replicaStatus.sqlRunning
+			replica.LagSeconds = replicaStatus.lagSeconds
+			replica.Message = replicaStatus.lastError
+		}
+		replicas = append(replicas, replica)
+	}
+	status.Replicas = replicas
+}
+
+// dbFailoverDue returns true if the pod has not been ready for dbFailoverTimeout.
+func dbFailoverDue(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil {
+		return true
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return time.Since(condition.LastTransitionTime.Time) > dbFailoverTimeout
+		}
+	}
+	return time.Since(pod.CreationTimestamp.Time) > dbFailoverTimeout
+}
@@ -0,0 +1,857 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type fakeMySQLInstance struct {
+	gtids     string
+	subsets   map[string]bool
+	replica   *mysqlReplicaStatus
+	hasTables bool
+	promoted  bool
+	followed  string
+	reset     bool
+	readOnly  bool
+	// users are the passwords of the users, the current one first. Any user is accepted if it is nil.
+	users map[string][]string
+}
+
+func (f *fakeMySQLInstance) GTIDExecuted() (string, error) { return f.gtids, nil }
+func (f *fakeMySQLInstance) GTIDSubset(gtids string) (bool, error) {
+	return gtids == f.gtids || f.subsets[gtids], nil
+}
+func (f *fakeMySQLInstance) ReplicaStatus() (*mysqlReplicaStatus, error) { return f.replica, nil }
+func (f *fakeMySQLInstance) HasUserTables([]string) (bool, error)        { return f.hasTables, nil }
+func (f *fakeMySQLInstance) Promote() error {
+	f.promoted = true
+	f.replica = nil
+	f.readOnly = false
+	return nil
+}
+func (f *fakeMySQLInstance) Follow(source, user, password string, reset bool) error {
+	f.followed = source
+	f.reset = reset
+	f.replica = &mysqlReplicaStatus{sourceHost: source, ioRunning: true, sqlRunning: true, lagSeconds: new(int64)}
+	return nil
+}
+func (f *fakeMySQLInstance) SetReadOnly() error {
+	f.readOnly = true
+	return nil
+}
+func (f *fakeMySQLInstance) SetWritable() error {
+	f.readOnly = false
+	return nil
+}
+func (f *fakeMySQLInstance) EnsureUser(user, password string, databases []string) error {
+	f.users[user] = []string{password}
+	return nil
+}
+func (f *fakeMySQLInstance) ChangePassword(user, password string, retain bool) error {
+	passwords := []string{password}
+	if retain {
+		passwords = append(passwords, f.users[user][0])
+	}
+	f.users[user] = passwords
+	return nil
+}
+func (f *fakeMySQLInstance) DiscardOldPassword(user string) error {
+	f.users[user] = f.users[user][:1]
+	return nil
+}
+func (f *fakeMySQLInstance) Close() error { return nil }
+
+func (f *fakeMySQLInstance) accepts(user, password string) bool {
+	if f.users == nil {
+		return true
+	}
+	for _, p := range f.users[user] {
+		if p == password {
+			return true
+		}
+	}
+	return false
+}
+
+func dbPod(name, ip string, ready bool, since time.Time) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "rbd-system",
+		},
+		Status: corev1.PodStatus{
+			PodIP: ip,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: status, LastTransitionTime: metav1.NewTime(since)},
+			},
+		},
+	}
+}
+
+func newHADB(t *testing.T, pods ...*corev1.Pod) (*db, client.Client) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = appsv1.AddToScheme(scheme)
+	_ = batchv1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: DBName, Namespace: "rbd-system"},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{EnableHA: true},
+	}
+	if err := cli.Create(context.Background(), component); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDB(context.Background(), cli, component, cluster).(*db)
+	d.mysqlPassword = "secret"
+	d.SetStorageClassNameRWO(&pvcParameters{storageClassName: "local-path"})
+	for _, pod := range pods {
+		pod.Labels = make(map[string]string)
+		for k, v := range d.labels {
+			pod.Labels[k] = v
+		}
+		if err := cli.Create(context.Background(), pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d, cli
+}
+
+func withFakeMySQL(t *testing.T, instances map[string]*fakeMySQLInstance) {
+	old := dialMySQL
+	dialMySQL = func(host, user, password string) (mysqlInstance, error) {
+		instance, ok := instances[host]
+		if !ok {
+			return nil, fmt.Errorf("dial %s: connection refused", host)
+		}
+		if !instance.accepts(user, password) {
+			return nil, fmt.Errorf("access denied for user %s", user)
+		}
+		return instance, nil
+	}
+	t.Cleanup(func() { dialMySQL = old })
+}
+
+func TestDBResourcesInHAMode(t *testing.T) {
+	d, _ := newHADB(t)
+
+	sts := d.statefulsetForDB().(*appsv1.StatefulSet)
+	if *sts.Spec.Replicas != 2 {
+		t.Fatalf("expected 2 replicas in HA mode, got %d", *sts.Spec.Replicas)
+	}
+	if len(sts.Spec.Template.Spec.Containers[0].Command) == 0 {
+		t.Fatal("expected the server id to be set by the command")
+	}
+	if sts.Spec.Template.Spec.Affinity == nil || sts.Spec.Template.Spec.Affinity.PodAntiAffinity == nil {
+		t.Fatal("expected the mysql servers to be spread across nodes")
+	}
+	rw := d.serviceForDB().(*corev1.Service)
+	if rw.Spec.Selector[dbRoleLabelKey] != dbRolePrimary {
+		t.Fatalf("expected %s to select the primary, got %v", dbhost, rw.Spec.Selector)
+	}
+	ro := d.serviceForReadOnly().(*corev1.Service)
+	if ro.Spec.Selector[dbRoleLabelKey] != dbRoleReplica {
+		t.Fatalf("expected %s to select the replicas, got %v", dbReadOnlyHost, ro.Spec.Selector)
+	}
+
+	d.cluster.Spec.EnableHA = false
+	if d.serviceForReadOnly() != nil || *d.Replicas() != 1 {
+		t.Fatal("expected a single mysql server without HA")
+	}
+	if _, ok := d.serviceForDB().(*corev1.Service).Spec.Selector[dbRoleLabelKey]; ok {
+		t.Fatal("expected no role selector without HA")
+	}
+}
+
+func TestDBGeneratesStrongPassword(t *testing.T) {
+	d, _ := newHADB(t)
+	d.mysqlPassword = ""
+	d.cluster.Spec.NodesForChaos = []*rainbondv1alpha1.K8sNode{{Name: "node-a"}}
+	if err := d.Before(); err != nil {
+		t.Fatal(err)
+	}
+	secret := d.secretForDB().(*corev1.Secret)
+	if password := secret.StringData[mysqlPasswordKey]; len(password) < 32 || password != d.mysqlPassword {
+		t.Fatalf("expected a strong random password for a new install, got %q", password)
+	}
+}
+
+func TestDBMyCnfTuning(t *testing.T) {
+	d, _ := newHADB(t)
+	if options := d.tuningOptions(); len(options) != 0 {
+		t.Fatalf("expected the defaults of mysql without memory limit, got %v", options)
+	}
+	checksum := d.statefulsetForDB().(*appsv1.StatefulSet).Spec.Template.Annotations[dbMyCnfChecksumAnnotation]
+
+	d.component.Spec.Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")}
+	options := d.tuningOptions()
+	if options["innodb_buffer_pool_size"] != "2147483648" || options["max_connections"] != "256" {
+		t.Fatalf("expected the buffer pool and connections to be sized from the memory limit, got %v", options)
+	}
+	d.component.Spec.Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")}
+	if err := d.validateMySQLConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if size := d.tuningOptions()["innodb_buffer_pool_size"]; size != "67108864" {
+		t.Fatalf("expected the buffer pool to be half of a small memory limit, got %s", size)
+	}
+	d.component.Spec.Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("5Mi")}
+	if err := d.validateMySQLConfig(); err == nil {
+		t.Fatal("expected the buffer pool sized from the memory limit to be less than the limit")
+	}
+	d.component.Spec.Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")}
+
+	d.component.Spec.MySQLConfig = &rainbondv1alpha1.MySQLConfig{
+		InnodbBufferPoolSize: resource.NewQuantity(1<<30, resource.BinarySI),
+		SlowQueryLog:         &rainbondv1alpha1.SlowQueryLog{LongQueryTime: &metav1.Duration{Duration: 1500 * time.Millisecond}},
+		Options:              map[string]string{"wait_timeout": "600"},
+	}
+	if err := d.validateMySQLConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cnf := d.myCnf()
+	for _, line := range []string{
+		"innodb_buffer_pool_size  = 1073741824",
+		"long_query_time          = 1.5",
+		"slow_query_log           = ON",
+		"wait_timeout             = 600",
+	} {
+		if !strings.Contains(cnf, line) {
+			t.Fatalf("expected %q in my.cnf, got %s", line, cnf)
+		}
+	}
+	if d.statefulsetForDB().(*appsv1.StatefulSet).Spec.Template.Annotations[dbMyCnfChecksumAnnotation] == checksum {
+		t.Fatal("expected the mysql servers to be restarted when my.cnf is changed")
+	}
+
+	d.component.Spec.MySQLConfig.Options = map[string]string{"log-bin": "off"}
+	if err := d.validateMySQLConfig(); err == nil {
+		t.Fatal("expected the options managed by the operator to be refused")
+	}
+	d.component.Spec.MySQLConfig.Options = nil
+	d.component.Spec.MySQLConfig.InnodbBufferPoolSize = resource.NewQuantity(4<<30, resource.BinarySI)
+	if err := d.validateMySQLConfig(); err == nil {
+		t.Fatal("expected the buffer pool to be less than the memory limit")
+	}
+}
+
+func TestDBReplicationBootstrapAndFailover(t *testing.T) {
+	now := time.Now()
+	d, cli := newHADB(t,
+		dbPod("rbd-db-0", "10.0.0.1", true, now),
+		dbPod("rbd-db-1", "10.0.0.2", true, now),
+	)
+	primary := &fakeMySQLInstance{gtids: "a:1-10", subsets: map[string]bool{"b:1-2": false}}
+	replica := &fakeMySQLInstance{gtids: "b:1-2"}
+	withFakeMySQL(t, map[string]*fakeMySQLInstance{"10.0.0.1": primary, "10.0.0.2": replica})
+
+	if err := d.reconcileReplication(); err != nil {
+		t.Fatal(err)
+	}
+	status := d.component.Status.Replication
+	if status.Primary != "rbd-db-0" || !primary.promoted {
+		t.Fatalf("expected rbd-db-0 to be the primary, got %q", status.Primary)
+	}
+	if replica.followed != dbhost || !replica.reset {
+		t.Fatalf("expected the new replica to be reset and follow %s, got %q(reset: %v)", dbhost, replica.followed, replica.reset)
+	}
+	if len(status.Replicas) != 1 || !status.Replicas[0].Running || status.Replicas[0].LagSeconds == nil {
+		t.Fatalf("unexpected replica status %+v", status.Replicas)
+	}
+	pod := &corev1.Pod{}
+	_ = cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: "rbd-db-1"}, pod)
+	if pod.Labels[dbRoleLabelKey] != dbRoleReplica {
+		t.Fatalf("expected rbd-db-1 to be labeled as replica, got %v", pod.Labels)
+	}
+
+	// the primary is not ready for a while.
+	_ = cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: "rbd-db-0"}, pod)
+	pod.Status.Conditions[0].Status = corev1.ConditionFalse
+	pod.Status.Conditions[0].LastTransitionTime = metav1.NewTime(now.Add(-time.Minute))
+	if err := cli.Update(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	replica.gtids = "a:1-10"
+	if err := d.reconcileReplication(); err != nil {
+		t.Fatal(err)
+	}
+	if status.Primary != "rbd-db-1" || status.LastFailoverTime == nil || !replica.promoted {
+		t.Fatalf("expected rbd-db-1 to be promoted, got %q", status.Primary)
+	}
+	stored := &rainbondv1alpha1.RbdComponent{}
+	_ = cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: DBName}, stored)
+	if stored.Status.Replication == nil || stored.Status.Replication.Primary != "rbd-db-1" || stored.Status.Replication.LastFailoverTime == nil {
+		t.Fatalf("expected the failover to be recorded at once, got %+v", stored.Status.Replication)
+	}
+	_ = cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: "rbd-db-1"}, pod)
+	if pod.Labels[dbRoleLabelKey] != dbRolePrimary {
+		t.Fatalf("expected rbd-db-1 to be labeled as primary, got %v", pod.Labels)
+	}
+	if len(status.Replicas) != 1 || status.Replicas[0].Message != "pod not ready" {
+		t.Fatalf("unexpected replica status %+v", status.Replicas)
+	}
+}
+
+func TestDBReplicationWaitsBeforeFailover(t *testing.T) {
+	d, _ := newHADB(t,
+		dbPod("rbd-db-0", "10.0.0.1", false, time.Now()),
+		dbPod("rbd-db-1", "10.0.0.2", true, time.Now()),
+	)
+	replica := &fakeMySQLInstance{gtids: "a:1-10"}
+	withFakeMySQL(t, map[string]*fakeMySQLInstance{"10.0.0.2": replica})
+	d.component.Status.Replication = &rainbondv1alpha1.ReplicationStatus{Primary: "rbd-db-0"}
+
+	if err := d.reconcileReplication(); err != nil {
+		t.Fatal(err)
+	}
+	if d.component.Status.Replication.Primary != "rbd-db-0" || replica.promoted {
+		t.Fatal("expected no failover before the timeout")
+	}
+}
+
+func TestDBReplicationFollowsWithRotatedRootPassword(t *testing.T) {
+	d, _ := newHADB(t,
+		dbPod("rbd-db-0", "10.0.0.1", true, time.Now()),
+		dbPod("rbd-db-1", "10.0.0.2", true, time.Now()),
+	)
+	primary := &fakeMySQLInstance{gtids: "a:1-10"}
+	replica := &fakeMySQLInstance{gtids: "a:1-5", subsets: map[string]bool{}}
+	primary.subsets = map[string]bool{"a:1-5": true}
+	withFakeMySQL(t, map[string]*fakeMySQLInstance{"10.0.0.1": primary, "10.0.0.2": replica})
+
+	if err := d.reconcileReplication(); err != nil {
+		t.Fatal(err)
+	}
+	if replica.followed != dbhost {
+		t.Fatalf("expected rbd-db-1 to follow %s, got %q", dbhost, replica.followed)
+	}
+	replica.followed = ""
+	if err := d.reconcileReplication(); err != nil {
+		t.Fatal(err)
+	}
+	if replica.followed != "" {
+		t.Fatal("expected the replication to be kept")
+	}
+
+	// the password of root is rotated.
+	d.mysqlPassword = "rotated"
+	if err := d.reconcileReplication(); err != nil {
+		t.Fatal(err)
+	}
+	if replica.followed != dbhost || replica.reset {
+		t.Fatalf("expected rbd-db-1 to follow %s again without reset, got %q(reset: %v)", dbhost, replica.followed, replica.reset)
+	}
+}
+
+func TestDBReplicationKeepsPrimaryReadOnlyDuringMigration(t *testing.T) {
+	d, _ := newHADB(t,
+		dbPod("rbd-db-0", "10.0.0.1", false, time.Now().Add(-time.Minute)),
+		dbPod("rbd-db-1", "10.0.0.2", true, time.Now()),
+	)
+	replica := &fakeMySQLInstance{gtids: "a:1-10", replica: &mysqlReplicaStatus{sourceHost: dbhost}}
+	withFakeMySQL(t, map[string]*fakeMySQLInstance{"10.0.0.2": replica})
+	d.cluster.Spec.DatabaseMigration = &rainbondv1alpha1.DatabaseMigration{}
+	d.component.Status.Replication = &rainbondv1alpha1.ReplicationStatus{Primary: "rbd-db-0"}
+
+	// the new primary is read-only until the migration fails.
+	if err := d.reconcileReplication(); err != nil {
+		t.Fatal(err)
+	}
+	if d.component.Status.Replication.Primary != "rbd-db-1" || !replica.promoted || !replica.readOnly {
+		t.Fatalf("expected rbd-db-1 to be promoted read-only, got %q(read-only: %v)", d.component.Status.Replication.Primary, replica.readOnly)
+	}
+
+	// the primary is not promoted again, which would make it writable.
+	replica.promoted = false
+	if err := d.reconcileReplication(); err != nil {
+		t.Fatal(err)
+	}
+	if replica.promoted || !replica.readOnly {
+		t.Fatal("expected the primary to stay read-only during the migration")
+	}
+}
+
+func TestDBBackupResources(t *testing.T) {
+	d, _ := newHADB(t)
+	if objs := d.backupResources(); objs != nil {
+		t.Fatalf("expected no backup resources without backup config, got %d", len(objs))
+	}
+	if objs := d.ResourcesNeedDelete(); len(objs) != 1 || objs[0].GetName() != dbBackupName {
+		t.Fatal("expected the backup cronjob to be deleted without backup config")
+	}
+
+	d.cluster.Spec.DatabaseBackup = &rainbondv1alpha1.DatabaseBackup{BinlogArchive: true}
+	d.cluster.Spec.EnableHA = false
+	if cnf := d.myCnf(); !strings.Contains(cnf, "log_bin") || !strings.Contains(cnf, "server_id") {
+		t.Fatalf("expected a server id with the binlogs archived, got %s", cnf)
+	}
+	if objs := d.ResourcesNeedDelete(); objs != nil {
+		t.Fatal("expected nothing to be deleted with backup config")
+	}
+	objs := d.backupResources()
+	if len(objs) != 3 {
+		t.Fatalf("expected configmap, cronjob and pvc, got %d objects", len(objs))
+	}
+	cronJob := objs[1].(*unstructured.Unstructured)
+	if cronJob.GetAPIVersion() != "batch/v1" || cronJob.GetKind() != "CronJob" {
+		t.Fatalf("expected a batch/v1 CronJob, got %s %s", cronJob.GetAPIVersion(), cronJob.GetKind())
+	}
+	schedule, _, _ := unstructured.NestedString(cronJob.Object, "spec", "schedule")
+	if schedule != defaultDBBackupSchedule {
+		t.Fatalf("expected the default schedule, got %q", schedule)
+	}
+	containers, _, _ := unstructured.NestedSlice(cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "containers")
+	if len(containers) != 1 || containers[0].(map[string]interface{})["name"] != "backup" {
+		t.Fatalf("expected the backup container to dump to the pvc, got %v", containers)
+	}
+
+	d.cluster.Spec.DatabaseBackup.Storage = rainbondv1alpha1.DatabaseBackupStorageMinIO
+	d.minioImage = "minio/minio"
+	objs = d.backupResources()
+	if len(objs) != 3 {
+		t.Fatalf("expected the pvc to be kept with minio storage, got %d objects", len(objs))
+	}
+	cronJob = objs[1].(*unstructured.Unstructured)
+	containers, _, _ = unstructured.NestedSlice(cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "containers")
+	initContainers, _, _ := unstructured.NestedSlice(cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "initContainers")
+	if len(initContainers) != 1 || len(containers) != 1 || containers[0].(map[string]interface{})["image"] != "minio/minio" {
+		t.Fatalf("expected to dump in an init container and upload with minio, got %v", containers)
+	}
+	for _, e := range containers[0].(map[string]interface{})["env"].([]interface{}) {
+		e := e.(map[string]interface{})
+		if name := e["name"].(string); name == "MINIO_ACCESS_KEY" || name == "MINIO_SECRET_KEY" {
+			secret, _, _ := unstructured.NestedString(e, "valueFrom", "secretKeyRef", "name")
+			if _, inline := e["value"]; inline || secret != minioCredentialsSecret {
+				t.Fatalf("expected %s from the secret of minio, got %v", name, e)
+			}
+		}
+	}
+	volumes, _, _ := unstructured.NestedSlice(cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "volumes")
+	if claim, _, _ := unstructured.NestedString(volumes[1].(map[string]interface{}), "persistentVolumeClaim", "claimName"); claim != dbBackupName {
+		t.Fatalf("expected to dump to the pvc before uploading, got %v", volumes)
+	}
+}
+
+func TestDBUpdateBackupStatus(t *testing.T) {
+	d, cli := newHADB(t)
+	now := time.Now().Truncate(time.Second)
+	backupJob := func(name string, created time.Time, succeeded bool) *batchv1.Job {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "rbd-system",
+				Labels:            d.labelsForBackup(),
+				CreationTimestamp: metav1.NewTime(created),
+			},
+		}
+		if succeeded {
+			job.Status.Succeeded = 1
+			job.Status.CompletionTime = &metav1.Time{Time: created.Add(time.Minute)}
+		} else {
+			job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+		}
+		return job
+	}
+	for _, job := range []*batchv1.Job{
+		backupJob("failed-before", now.Add(-3*time.Hour), false),
+		backupJob("succeeded", now.Add(-2*time.Hour), true),
+		backupJob("failed-after", now.Add(-time.Hour), false),
+	} {
+		if err := cli.Create(context.Background(), job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.updateBackupStatus(); err != nil {
+		t.Fatal(err)
+	}
+	status := d.component.Status.Backup
+	if status == nil || status.LastSuccessfulTime == nil || !status.LastSuccessfulTime.Time.Equal(now.Add(-2*time.Hour+time.Minute)) {
+		t.Fatalf("unexpected last successful time: %+v", status)
+	}
+	if status.LastFailedJob != "failed-after" {
+		t.Fatalf("expected the failed job after the last success, got %q", status.LastFailedJob)
+	}
+}
+
+func TestDBPasswordRotation(t *testing.T) {
+	d, cli := newHADB(t, dbPod(DBName+"-0", "10.0.0.1", true, time.Now()))
+	d.cluster.Spec.EnableHA = false
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: DBName, Namespace: "rbd-system"},
+		Data: map[string][]byte{
+			mysqlUserKey:     []byte("root"),
+			mysqlPasswordKey: []byte("secret"),
+		},
+	}
+	if err := cli.Create(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	d.secret = secret
+	d.mysqlUser = "root"
+	consumerPods := make(map[string]*corev1.Pod)
+	for _, name := range []string{APIName, AppUIName} {
+		cpt := &rainbondv1alpha1.RbdComponent{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "rbd-system"}}
+		if err := cli.Create(context.Background(), cpt); err != nil {
+			t.Fatal(err)
+		}
+		pod := dbPod(name+"-0", "10.0.1.1", true, time.Now())
+		pod.Labels = LabelsForRainbondComponent(cpt)
+		pod.Spec.Containers = []corev1.Container{{Name: name}}
+		if err := cli.Create(context.Background(), pod); err != nil {
+			t.Fatal(err)
+		}
+		consumerPods[name] = pod
+	}
+	mysql := &fakeMySQLInstance{users: map[string][]string{"root": {"secret"}}}
+	withFakeMySQL(t, map[string]*fakeMySQLInstance{"10.0.0.1": mysql})
+
+	// the consumers get their own users.
+	if err := d.reconcileUsers(); err != nil {
+		t.Fatal(err)
+	}
+	apiPassword := string(d.secret.Data[dbConsumerPasswordKey(APIName)])
+	if apiPassword == "" || !mysql.accepts(APIName, apiPassword) || !mysql.accepts(AppUIName, string(d.secret.Data[dbConsumerPasswordKey(AppUIName)])) {
+		t.Fatal("expected the users of the consumers to be created")
+	}
+	if _, ok := d.secret.Data[dbConsumerUserKey(ChaosName)]; ok {
+		t.Fatal("expected no user for the component which is not installed")
+	}
+	if d.ResyncPeriod() != 0 {
+		t.Fatal("expected no resync without rotation")
+	}
+	info, err := getDefaultDBInfo(context.Background(), cli, nil, "rbd-system", DBName, APIName)
+	if err != nil || info.Username != APIName || info.Password != apiPassword {
+		t.Fatalf("expected rbd-api to use its own user, got %+v, %v", info, err)
+	}
+
+	usePassword := func(name, password string) {
+		pod := consumerPods[name]
+		pod.Spec.Containers[0].Args = []string{fmt.Sprintf("--mysql=%s:%s@tcp(rbd-db-rw:3306)/region", name, password)}
+		if err := cli.Update(context.Background(), pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usePassword(APIName, apiPassword)
+
+	// root is rotated at once, the old password of rbd-api is kept until its pods use the new one.
+	d.component.Annotations = map[string]string{DBRotatePasswordAnnotation: "1"}
+	if err := d.reconcileUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if mysql.accepts("root", "secret") || !mysql.accepts("root", d.mysqlPassword) || len(d.mysqlPassword) < 32 {
+		t.Fatal("expected the root password to be rotated")
+	}
+	newAPIPassword := string(d.secret.Data[dbConsumerPasswordKey(APIName)])
+	if newAPIPassword == apiPassword || !mysql.accepts(APIName, apiPassword) || !mysql.accepts(APIName, newAPIPassword) {
+		t.Fatal("expected both passwords of rbd-api to be valid during the rotation")
+	}
+	status := d.component.Status.PasswordRotation
+	if status.Phase != rainbondv1alpha1.PasswordRotationRotating || status.User != APIName || d.ResyncPeriod() == 0 {
+		t.Fatalf("expected rotating rbd-api, got %+v", status)
+	}
+	if err := d.reconcileUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if !mysql.accepts(APIName, apiPassword) {
+		t.Fatal("expected the old password to be kept until rbd-api uses the new one")
+	}
+
+	usePassword(APIName, newAPIPassword)
+	if err := d.reconcileUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if mysql.accepts(APIName, apiPassword) || status.User != AppUIName {
+		t.Fatalf("expected the old password of rbd-api to be discarded, got %+v", status)
+	}
+
+	usePassword(AppUIName, string(d.secret.Data[dbConsumerPasswordKey(AppUIName)]))
+	for i := 0; i < 2; i++ {
+		if err := d.reconcileUsers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status.Phase != rainbondv1alpha1.PasswordRotationCompleted || status.CompletionTime == nil || d.ResyncPeriod() != 0 {
+		t.Fatalf("expected the rotation to be completed, got %+v", status)
+	}
+	if len(mysql.users[AppUIName]) != 1 {
+		t.Fatal("expected the old password of rbd-app-ui to be discarded")
+	}
+}
+
+func TestDBMigration(t *testing.T) {
+	newMigratingDB := func(t *testing.T) (*db, client.Client, *fakeMySQLInstance) {
+		d, cli := newHADB(t, dbPod(DBName+"-0", "10.0.0.1", true, time.Now()))
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: DBName, Namespace: "rbd-system"},
+			Data: map[string][]byte{
+				mysqlUserKey:     []byte("root"),
+				mysqlPasswordKey: []byte("secret"),
+			},
+		}
+		cluster := &rainbondv1alpha1.RainbondCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: "rainbondcluster", Namespace: "rbd-system"},
+			Spec: rainbondv1alpha1.RainbondClusterSpec{
+				DatabaseMigration: &rainbondv1alpha1.DatabaseMigration{
+					RegionDatabase: &rainbondv1alpha1.Database{Host: "mysql.example.com", Username: "region"},
+				},
+			},
+		}
+		api := &rainbondv1alpha1.RbdComponent{ObjectMeta: metav1.ObjectMeta{Name: APIName, Namespace: "rbd-system"}}
+		for _, obj := range []client.Object{secret, cluster, api} {
+			if err := cli.Create(context.Background(), obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d.cluster = cluster
+		d.secret = secret
+		mysql := &fakeMySQLInstance{}
+		withFakeMySQL(t, map[string]*fakeMySQLInstance{"10.0.0.1": mysql})
+		return d, cli, mysql
+	}
+	createJob := func(t *testing.T, cli client.Client, status batchv1.JobStatus, message string) {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: dbMigrationName, Namespace: "rbd-system"},
+			Status:     status,
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      dbMigrationName + "-abcde",
+				Namespace: "rbd-system",
+				Labels:    map[string]string{"job-name": dbMigrationName},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "migrate", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}}},
+				},
+			},
+		}
+		for _, obj := range []client.Object{job, pod} {
+			if err := cli.Create(context.Background(), obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		d, cli, mysql := newMigratingDB(t)
+		if err := d.validateMigration(); err == nil {
+			t.Fatal("expected the target of the console database to be required")
+		}
+		d.cluster.Spec.DatabaseMigration.UIDatabase = &rainbondv1alpha1.Database{
+			Host:     "mysql.example.com",
+			Username: "console",
+			TLS:      &rainbondv1alpha1.DatabaseTLS{Mode: rainbondv1alpha1.DatabaseTLSVerifyCA},
+		}
+		if err := d.validateMigration(); err != nil {
+			t.Fatal(err)
+		}
+
+		// rbd-db is read-only before the job is created.
+		if err := d.prepareMigration(); err != nil {
+			t.Fatal(err)
+		}
+		if !mysql.readOnly {
+			t.Fatal("expected rbd-db to be read-only during the migration")
+		}
+		var job *batchv1.Job
+		for _, obj := range d.Resources() {
+			if j, ok := obj.(*batchv1.Job); ok && j.Name == dbMigrationName {
+				job = j
+			}
+		}
+		if job == nil {
+			t.Fatal("expected the migration job")
+		}
+		env := make(map[string]string)
+		for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+			env[e.Name] = e.Value
+		}
+		if env["REGION_DB"] != RegionDatabaseName || env["REGION_SOURCE_DB"] != "region" || env["REGION_PORT"] != "3306" || env["CONSOLE_DB"] != ConsoleDatabaseName {
+			t.Fatalf("unexpected databases of the migration: %v", env)
+		}
+		if env["CONSOLE_SSL_OPTS"] != "--ssl-mode=VERIFY_CA --ssl-capath=/etc/ssl/certs" {
+			t.Fatalf("unexpected ssl options of the console database: %s", env["CONSOLE_SSL_OPTS"])
+		}
+
+		createJob(t, cli, batchv1.JobStatus{}, "")
+		if err := d.After(); err != nil {
+			t.Fatal(err)
+		}
+		if d.component.Status.DatabaseMigration.Phase != rainbondv1alpha1.DatabaseMigrationMigrating || d.ResyncPeriod() == 0 {
+			t.Fatalf("expected migrating, got %+v", d.component.Status.DatabaseMigration)
+		}
+
+		job = &batchv1.Job{}
+		if err := cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: dbMigrationName}, job); err != nil {
+			t.Fatal(err)
+		}
+		job.Status.Succeeded = 1
+		if err := cli.Update(context.Background(), job); err != nil {
+			t.Fatal(err)
+		}
+		pod := &corev1.Pod{}
+		if err := cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: dbMigrationName + "-abcde"}, pod); err != nil {
+			t.Fatal(err)
+		}
+		pod.Status.ContainerStatuses[0].State.Terminated.Message = "REGION: verified 10 tables and 100 rows\nCONSOLE: verified 5 tables and 50 rows\n"
+		if err := cli.Update(context.Background(), pod); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.After(); err != nil {
+			t.Fatal(err)
+		}
+		status := d.component.Status.DatabaseMigration
+		if status.Phase != rainbondv1alpha1.DatabaseMigrationCompleted || status.CompletionTime == nil || !strings.Contains(status.Message, "CONSOLE: verified 5 tables") {
+			t.Fatalf("expected the migration to be completed, got %+v", status)
+		}
+		cluster := &rainbondv1alpha1.RainbondCluster{}
+		if err := cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: "rainbondcluster"}, cluster); err != nil {
+			t.Fatal(err)
+		}
+		if cluster.Spec.RegionDatabase == nil || cluster.Spec.RegionDatabase.Name != RegionDatabaseName || cluster.Spec.UIDatabase == nil || cluster.Spec.UIDatabase.Name != ConsoleDatabaseName {
+			t.Fatalf("expected the components to be switched to the external databases, got %+v", cluster.Spec)
+		}
+		if cluster.Spec.RegionDatabase.Port != mysqlPort || cluster.Spec.UIDatabase.Port != mysqlPort {
+			t.Fatalf("expected the default port of the external databases, got %d and %d", cluster.Spec.RegionDatabase.Port, cluster.Spec.UIDatabase.Port)
+		}
+		api := &rainbondv1alpha1.RbdComponent{}
+		if err := cli.Get(context.Background(), client.ObjectKey{Namespace: "rbd-system", Name: APIName}, api); err != nil {
+			t.Fatal(err)
+		}
+		if api.Annotations[dbCredentialsChangedAnnotation] == "" {
+			t.Fatal("expected rbd-api to be reconciled")
+		}
+
+		// rbd-db is scaled down, and deleted with its volumes once it is confirmed.
+		resources := d.Resources()
+		if len(resources) != 1 || *d.Replicas() != 0 || d.ResyncPeriod() != 0 || len(d.ResourcesNeedDelete()) != 1 {
+			t.Fatalf("expected the statefulset to be scaled down, got %d resources", len(resources))
+		}
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: DBName + "-" + DBName + "-0", Namespace: "rbd-system", Labels: d.labels},
+		}
+		if err := cli.Create(context.Background(), pvc); err != nil {
+			t.Fatal(err)
+		}
+		d.cluster.Spec.DatabaseMigration.DeleteBundledDatabase = true
+		if err := d.prepareMigration(); err != nil {
+			t.Fatal(err)
+		}
+		deleted := d.ResourcesNeedDelete()
+		if len(d.Resources()) != 0 || len(deleted) != 3 {
+			t.Fatalf("expected the statefulset, its volume and the backup cronjob to be deleted, got %d", len(deleted))
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		d, cli, mysql := newMigratingDB(t)
+		d.cluster.Spec.DatabaseMigration.UIDatabase = &rainbondv1alpha1.Database{Host: "mysql.example.com", Username: "console"}
+		if err := d.prepareMigration(); err != nil {
+			t.Fatal(err)
+		}
+		createJob(t, cli, batchv1.JobStatus{
+			Failed:     1,
+			Conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}},
+		}, "CONSOLE: database console is not empty\n")
+		if err := d.reconcileMigration(); err != nil {
+			t.Fatal(err)
+		}
+		status := d.component.Status.DatabaseMigration
+		if status.Phase != rainbondv1alpha1.DatabaseMigrationFailed || !strings.Contains(status.Message, "is not empty") {
+			t.Fatalf("expected the migration to fail, got %+v", status)
+		}
+		if mysql.readOnly {
+			t.Fatal("expected rbd-db to be writable after the migration failed")
+		}
+		if d.cluster.Spec.RegionDatabase != nil || *d.Replicas() != 1 {
+			t.Fatal("expected the components to keep using rbd-db")
+		}
+	})
+
+	t.Run("retried after a partial failure", func(t *testing.T) {
+		d, cli, mysql := newMigratingDB(t)
+		d.cluster.Spec.DatabaseMigration.RegionDatabase.Password = "region-pass"
+		d.cluster.Spec.DatabaseMigration.UIDatabase = &rainbondv1alpha1.Database{Host: "mysql.example.com", Username: "console"}
+		if err := d.prepareMigration(); err != nil {
+			t.Fatal(err)
+		}
+		createJob(t, cli, batchv1.JobStatus{
+			Failed:     1,
+			Conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}},
+		}, "REGION: verified 10 tables and 100 rows\nCONSOLE: table users has 1 rows, expected 2\n")
+		if err := d.reconcileMigration(); err != nil {
+			t.Fatal(err)
+		}
+		status := d.component.Status.DatabaseMigration
+		if status.Phase != rainbondv1alpha1.DatabaseMigrationFailed || !reflect.DeepEqual(status.MigratedDatabases, []string{"REGION"}) {
+			t.Fatalf("expected the region database to be recorded as migrated, got %+v", status)
+		}
+
+		// the job is deleted to migrate again.
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: dbMigrationName, Namespace: "rbd-system"}}
+		if err := cli.Delete(context.Background(), job); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.prepareMigration(); err != nil {
+			t.Fatal(err)
+		}
+		if !mysql.readOnly {
+			t.Fatal("expected rbd-db to be read-only during the migration")
+		}
+		if err := d.reconcileMigration(); err != nil {
+			t.Fatal(err)
+		}
+		status = d.component.Status.DatabaseMigration
+		if status.Phase != rainbondv1alpha1.DatabaseMigrationMigrating || !reflect.DeepEqual(status.MigratedDatabases, []string{"REGION"}) {
+			t.Fatalf("expected the migrated databases to be kept, got %+v", status)
+		}
+		var secret *corev1.Secret
+		for _, obj := range d.Resources() {
+			switch o := obj.(type) {
+			case *batchv1.Job:
+				job = o
+			case *corev1.Secret:
+				if o.Name == dbMigrationName {
+					secret = o
+				}
+			}
+		}
+		env := make(map[string]corev1.EnvVar)
+		for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+			env[e.Name] = e
+		}
+		if env["REGION_MIGRATED"].Value != "true" || env["CONSOLE_MIGRATED"].Value != "false" {
+			t.Fatalf("expected only the region database to be verified again, got %v", env)
+		}
+		password := env["REGION_PASSWORD"]
+		if password.Value != "" || password.ValueFrom == nil || password.ValueFrom.SecretKeyRef.Name != dbMigrationName {
+			t.Fatalf("expected the password from secret %s, got %+v", dbMigrationName, password)
+		}
+		if secret == nil || string(secret.Data[password.ValueFrom.SecretKeyRef.Key]) != "region-pass" {
+			t.Fatalf("expected the password in secret %s, got %+v", dbMigrationName, secret)
+		}
+	})
+}
@@ -1,6 +1,9 @@
 package handler
 
 import (
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -47,3 +50,27 @@ type Replicaser interface {
 	// return replicas for rbdcomponent.
 	Replicas() *int32
 }
+
+// ResyncPerioder provides the period to reconcile the rbdcomponent again even if it is ready.
+// It is used by the components which have to be maintained continuously, such as the failover of rbd-db.
+type ResyncPerioder interface {
+	// returns the resync period, zero means no resync.
+	ResyncPeriod() time.Duration
+}
+
+// Finalizer cleans up what is not garbage collected with the rbdcomponent, such as the files on the nodes.
+// The finalizer is added to the rbdcomponent, and removed once the cleanup is done.
+type Finalizer interface {
+	// returns the finalizer of the rbdcomponent.
+	Finalizer() string
+	// returns true once the cleanup is done.
+	Finalize() (bool, error)
+}
+
+// Migrator provides the job to migrate the database schemas before the component is rolled out.
+// The workloads of the component are not created or updated until the job succeeds.
+type Migrator interface {
+	// returns the version of the schemas and the job which migrates the schemas to it,
+	// or a nil job if there is nothing to migrate.
+	MigrationJob() (string, *batchv1.Job)
+}
@@ -3,13 +3,8 @@ package handler
 import (
 	"context"
 	"fmt"
-	"os"
-	"os/exec"
 	"strings"
 
-	batchv1 "k8s.io/api/batch/v1"
-	"k8s.io/utils/pointer"
-
 	v2 "github.com/goodrain/rainbond-operator/api/v2"
 	"github.com/sirupsen/logrus"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
@@ -31,12 +26,6 @@ var hubDataPvcName = "rbd-hub"
 var hubImageRepository = "hub-image-repository"
 var hubPasswordSecret = "hub-password"
 
-const (
-	hostsJobName       = "hosts-job"
-	hostsJobLabelKey   = "rainbond.io/hosts-job"
-	hostsJobLabelValue = "true"
-)
-
 type hub struct {
 	ctx       context.Context
 	client    client.Client
@@ -44,8 +33,21 @@ type hub struct {
 	cluster   *rainbondv1alpha1.RainbondCluster
 	labels    map[string]string
 
-	password string
-	htpasswd []byte
+	password   string
+	htpasswd   []byte
+	httpSecret string
+	users      []hubUser
+	// authConfig, authCert and authKey are the config of rbd-hub-auth and the key signing the tokens.
+	authConfig []byte
+	authCert   []byte
+	authKey    []byte
+	// gcJob is the garbage collection in progress, gcReadOnly is true once rbd-hub is read-only for it.
+	gcJob      string
+	gcReadOnly bool
+	// staleMirrors are the mirror instances whose upstreams have been removed.
+	staleMirrors []string
+	// dockerMirror is the mirror of Docker Hub added to the registry mirrors of docker.
+	dockerMirror string
 
 	pvcParametersRWO *pvcParameters
 	storageRequest   int64
@@ -53,6 +55,9 @@ type hub struct {
 
 var _ ComponentHandler = &hub{}
 var _ StorageClassRWOer = &hub{}
+var _ ResourcesDeleter = &hub{}
+var _ ResyncPerioder = &hub{}
+var _ Finalizer = &hub{}
 
 // NewHub nw hub
 func NewHub(ctx context.Context, client client.Client, component *rainbondv1alpha1.RbdComponent, cluster *rainbondv1alpha1.RainbondCluster) ComponentHandler {
@@ -77,11 +82,36 @@ func (h *hub) Before() error {
 		return NewIgnoreError("use custom image repository")
 	}
 
+	if err := h.setUsers(); err != nil {
+		return err
+	}
 	htpasswd, err := h.generateHtpasswd()
 	if err != nil {
 		return fmt.Errorf("generate htpasswd: %v", err)
 	}
 	h.htpasswd = htpasswd
+	if err := h.setAuthConfig(); err != nil {
+		return err
+	}
+
+	if err := h.setHTTPSecret(); err != nil {
+		return err
+	}
+	if err := h.validateStorage(); err != nil {
+		return err
+	}
+	if err := h.setGCJob(); err != nil {
+		return err
+	}
+	if err := h.validateMirrors(); err != nil {
+		return err
+	}
+	if err := h.setStaleMirrors(); err != nil {
+		return err
+	}
+	if err := h.setDockerMirror(); err != nil {
+		return err
+	}
 
 	if err := setStorageCassName(h.ctx, h.client, h.component.Namespace, h); err != nil {
 		return err
@@ -100,11 +130,18 @@ func (h *hub) Resources() []client.Object {
 		h.passwordSecret(),
 		h.deployment(),
 		h.serviceForHub(),
-		h.hostsJob(),
 		h.hubImageRepository(), // 绑定这个镜像仓库的secret
 		h.ingressForHub(),      //创建这个域名的路由
-		createPersistentVolumeClaimRWO(h.component.Namespace, hubDataPvcName, h.pvcParametersRWO, h.labels, h.storageRequest),
 	}
+	resources = append(resources, h.userSecrets()...)
+	resources = append(resources, h.authResources()...)
+	resources = append(resources, h.hostsResources()...)
+	resources = append(resources, h.gcResources()...)
+	resources = append(resources, h.mirrorResources()...)
+	if h.useS3() {
+		return resources
+	}
+	resources = append(resources, createPersistentVolumeClaimRWO(h.component.Namespace, hubDataPvcName, h.pvcParametersRWO, h.labels, h.storageRequest))
 
 	// Add PVC if using local-path storage
 	if h.pvcParametersRWO != nil {
@@ -115,6 +152,17 @@ func (h *hub) Resources() []client.Object {
 	return resources
 }
 
+// ResourcesNeedDelete deletes the garbage collection and rbd-hub-auth if they are disabled, the stale mirrors,
+// the former hosts-job and the former secret of the bundled minio.
+func (h *hub) ResourcesNeedDelete() []client.Object {
+	var objs []client.Object
+	objs = append(objs, h.gcResourcesNeedDelete()...)
+	objs = append(objs, h.authResourcesNeedDelete()...)
+	objs = append(objs, h.mirrorResourcesNeedDelete()...)
+	objs = append(objs, h.storageResourcesNeedDelete()...)
+	return append(objs, h.hostsResourcesNeedDelete()...)
+}
+
 func (h *hub) hubImageRepository() client.Object {
 	const Name = "hub-image-repository"
 	return &v2.ApisixTls{
@@ -139,7 +187,7 @@ func (h *hub) hubImageRepository() client.Object {
 }
 
 func (h *hub) ingressForHub() client.Object {
-	return &v2.ApisixRoute{
+	route := &v2.ApisixRoute{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "rbd-hub",
 			Namespace: rbdutil.GetenvDefault("RBD_NAMESPACE", constants.Namespace),
@@ -175,10 +223,16 @@ func (h *hub) ingressForHub() client.Object {
 			},
 		},
 	}
+	route.Spec.HTTP = append(route.Spec.HTTP, h.authRoutes()...)
+	route.Spec.HTTP = append(route.Spec.HTTP, h.mirrorRoutes()...)
+	return route
 }
 
 func (h *hub) After() error {
-	return nil
+	if err := h.updateHostsStatus(); err != nil {
+		return err
+	}
+	return h.updateGCStatus()
 }
 
 func (h *hub) ListPods() ([]corev1.Pod, error) {
@@ -192,28 +246,8 @@ func (h *hub) deployment() client.Object {
 			Value: h.component.Namespace,
 		},
 		{
-			Name:  "REGISTRY_AUTH",
-			Value: "htpasswd",
-		},
-		{
-			Name:  "REGISTRY_AUTH_HTPASSWD_REALM",
-			Value: "Registry Realm",
-		},
-		{
-			Name:  "REGISTRY_AUTH_HTPASSWD_PATH",
-			Value: "/auth/htpasswd",
-		},
-		{
-			Name:  "REGISTRY_HTTP_SECRET",
-			Value: "rainbond-registry-secret",
-		},
-		{
-			Name:  "REGISTRY_STORAGE",
-			Value: "filesystem",
-		},
-		{
-			Name:  "REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY",
-			Value: "/var/lib/registry",
+			Name:      "REGISTRY_HTTP_SECRET",
+			ValueFrom: secretKeyRef(hubPasswordSecret, hubHTTPSecretKey),
 		},
 		{
 			Name:  "REGISTRY_STORAGE_REDIRECT_DISABLE",
@@ -228,40 +262,32 @@ func (h *hub) deployment() client.Object {
 			Value: "true",
 		},
 	}
+	env = append(env, h.authEnvs()...)
+	env = append(env, h.storageEnvs()...)
+	env = append(env, h.readOnlyEnvs()...)
 	volumeMounts := []corev1.VolumeMount{
 		{
 			Name:      "htpasswd",
 			MountPath: "/auth",
 			ReadOnly:  true,
 		},
-		{
-			Name:      "data",
-			MountPath: "/var/lib/registry",
-		},
 	}
 	volumes := []corev1.Volume{
-		{
-			Name: "htpasswd",
-			VolumeSource: corev1.VolumeSource{
-				Secret: &corev1.SecretVolumeSource{
-					SecretName: hubPasswordSecret,
-					Items: []corev1.KeyToPath{
-						{
-							Key:  "HTPASSWD",
-							Path: "htpasswd",
-						},
-					},
-				},
-			},
-		},
-		{
+		h.authVolume(),
+	}
+	if !h.useS3() {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "data",
+			MountPath: "/var/lib/registry",
+		})
+		volumes = append(volumes, corev1.Volume{
 			Name: "data",
 			VolumeSource: corev1.VolumeSource{
 				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
 					ClaimName: hubDataPvcName,
 				},
 			},
-		},
+		})
 	}
 
 	env = mergeEnvs(env, h.component.Spec.Env)
@@ -284,6 +310,9 @@ func (h *hub) deployment() client.Object {
 				ObjectMeta: metav1.ObjectMeta{
 					Name:   HubName,
 					Labels: h.labels,
+					Annotations: map[string]string{
+						hubAuthConfigChecksumAnnotation: h.authChecksum(),
+					},
 				},
 				Spec: corev1.PodSpec{
 					ImagePullSecrets:              imagePullSecrets(h.component, h.cluster),
@@ -308,104 +337,6 @@ func (h *hub) deployment() client.Object {
 	return ds
 }
 
-func (h *hub) hostsJob() client.Object {
-	gatewayNodes := h.cluster.Spec.NodesForGateway
-	var gatewayHost string
-	if gatewayNodes != nil && len(gatewayNodes) > 0 {
-		gatewayHost = gatewayNodes[0].InternalIP
-	}
-	hostCMD := fmt.Sprintf("grep -qxF '%v goodrain.me' /etc/hosts || echo '%v goodrain.me' >> /etc/hosts;", gatewayHost, gatewayHost)
-	nodeList := &corev1.NodeList{}
-	if err := h.client.List(context.TODO(), nodeList, &client.ListOptions{}); err != nil {
-		logrus.Errorf("get node len failure: %v", err)
-		return nil
-	}
-	hostsJobLabels := copyLabels(h.labels)
-	hostsJobLabels[hostsJobLabelKey] = hostsJobLabelValue
-
-	// 创建 Job 对象
-	return &batchv1.Job{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      hostsJobName,
-			Namespace: h.component.Namespace,
-			Labels:    hostsJobLabels,
-		},
-		Spec: batchv1.JobSpec{
-			TTLSecondsAfterFinished: pointer.Int32Ptr(60),
-			Parallelism:             pointer.Int32Ptr(int32(len(nodeList.Items))), // 并行数应等于节点数
-			Completions:             pointer.Int32Ptr(int32(len(nodeList.Items))), // 确保每个节点完成一次
-			BackoffLimit:            pointer.Int32Ptr(0),                          // 设置重试次数
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: hostsJobLabels,
-				},
-				Spec: corev1.PodSpec{
-					Affinity: &corev1.Affinity{
-						NodeAffinity: &corev1.NodeAffinity{
-							RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
-								NodeSelectorTerms: []corev1.NodeSelectorTerm{
-									{
-										MatchExpressions: []corev1.NodeSelectorRequirement{
-											{
-												Key:      "kubernetes.io/hostname",
-												Operator: corev1.NodeSelectorOpExists, // 确保在所有节点上运行
-											},
-										},
-									},
-								},
-							},
-						},
-						PodAntiAffinity: &corev1.PodAntiAffinity{
-							RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
-								{
-									LabelSelector: &metav1.LabelSelector{
-										MatchLabels: map[string]string{
-											hostsJobLabelKey: hostsJobLabelValue,
-										},
-									},
-									TopologyKey: "kubernetes.io/hostname",
-								},
-							},
-						},
-					},
-					Tolerations: []corev1.Toleration{
-						{
-							Operator: corev1.TolerationOpExists,
-						},
-					},
-					Containers: []corev1.Container{
-						{
-							Name:            hostsJobName,
-							Image:           os.Getenv("RAINBOND_IMAGE_REPOSITORY") + "/alpine:3",
-							ImagePullPolicy: corev1.PullIfNotPresent,
-							Command: []string{
-								"/bin/sh", "-c", hostCMD,
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "hosts",
-									MountPath: "/etc/hosts",
-								},
-							},
-						},
-					},
-					Volumes: []corev1.Volume{
-						{
-							Name: "hosts",
-							VolumeSource: corev1.VolumeSource{
-								HostPath: &corev1.HostPathVolumeSource{
-									Path: "/etc/hosts",
-								},
-							},
-						},
-					},
-					RestartPolicy: corev1.RestartPolicyOnFailure,
-				},
-			},
-		},
-	}
-}
-
 func (h *hub) serviceForHub() client.Object {
 	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -474,8 +405,9 @@ func (h *hub) passwordSecret() client.Object {
 			Labels:    labels,
 		},
 		Data: map[string][]byte{
-			"HTPASSWD": h.htpasswd,
-			"password": []byte(h.password),
+			"HTPASSWD":       h.htpasswd,
+			"password":       []byte(h.password),
+			hubHTTPSecretKey: []byte(h.httpSecret),
 		},
 	}
 }
@@ -483,8 +415,3 @@ func (h *hub) passwordSecret() client.Object {
 func (h *hub) getSecret(name string) (*corev1.Secret, error) {
 	return getSecret(h.ctx, h.client, h.component.Namespace, name)
 }
-
-func (h *hub) generateHtpasswd() ([]byte, error) {
-	cmd := exec.Command("htpasswd", "-Bbn", h.cluster.Spec.ImageHub.Username, h.cluster.Spec.ImageHub.Password)
-	return cmd.CombinedOutput()
-}
@@ -0,0 +1,470 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	v2 "github.com/goodrain/rainbond-operator/api/v2"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/constants"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	"golang.org/x/crypto/bcrypt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var hubAuthName = HubName + "-auth"
+
+const (
+	hubUserPasswordKey = "password"
+	// hubBcryptCost is the cost of htpasswd -B, the password is verified on every request to rbd-hub.
+	hubBcryptCost = 5
+	hubAuthPort   = 5001
+	hubAuthPath   = "/auth"
+	// hubAuthConfigChecksumAnnotation restarts the pods when the users or their access are changed.
+	hubAuthConfigChecksumAnnotation = "rainbond.io/config-checksum"
+	hubAuthConfigKey                = "auth_config.yml"
+	hubAuthCertKey                  = "token.crt"
+	hubAuthKeyKey                   = "token.key"
+)
+
+// hubUser is a user of rbd-hub with the password resolved.
+type hubUser struct {
+	name     string
+	password string
+	access   []rainbondv1alpha1.ImageHubAccess
+	// generated is true if the password secret is to be created by the operator.
+	generated bool
+	secret    string
+}
+
+// setUsers resolves the password of each user, the secret of a user is generated unless it is specified.
+func (h *hub) setUsers() error {
+	imageHub := h.cluster.Spec.ImageHub
+	h.users = []hubUser{
+		{
+			name:     imageHub.Username,
+			password: imageHub.Password,
+			access: []rainbondv1alpha1.ImageHubAccess{
+				{Namespace: "*", Actions: []rainbondv1alpha1.ImageHubAction{"*"}},
+			},
+		},
+	}
+	names := map[string]bool{imageHub.Username: true}
+	for i := range imageHub.Users {
+		user := &imageHub.Users[i]
+		if names[user.Name] {
+			return fmt.Errorf("duplicate user %s of rbd-hub", user.Name)
+		}
+		names[user.Name] = true
+
+		hu := hubUser{name: user.Name, access: user.Access, secret: user.PasswordSecret()}
+		secret, err := h.getSecret(hu.secret)
+		if err != nil {
+			if !k8sErrors.IsNotFound(err) {
+				return fmt.Errorf("get secret %s: %v", hu.secret, err)
+			}
+			if user.SecretName != "" {
+				return fmt.Errorf("secret %s of user %s not found", user.SecretName, user.Name)
+			}
+			hu.generated = true
+			hu.password = randomSecretKey()
+		} else {
+			hu.password = string(secret.Data[hubUserPasswordKey])
+			if hu.password == "" {
+				return fmt.Errorf("secret %s of user %s has no %s", hu.secret, user.Name, hubUserPasswordKey)
+			}
+		}
+		if len(hu.access) == 0 {
+			hu.access = []rainbondv1alpha1.ImageHubAccess{
+				{Namespace: "*", Actions: []rainbondv1alpha1.ImageHubAction{rainbondv1alpha1.ImageHubActionPull, rainbondv1alpha1.ImageHubActionPush}},
+			}
+		}
+		h.users = append(h.users, hu)
+	}
+	if pullUser := imageHub.ImagePullUser; pullUser != "" && !names[pullUser] {
+		return fmt.Errorf("image pull user %s is not a user of rbd-hub", pullUser)
+	}
+	return nil
+}
+
+// generateHtpasswd hashes the passwords with bcrypt, the hashes in hub-password are kept if the passwords are not changed.
+func (h *hub) generateHtpasswd() ([]byte, error) {
+	hashes := make(map[string]string)
+	secret, err := h.getSecret(hubPasswordSecret)
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return nil, fmt.Errorf("get secret %s: %v", hubPasswordSecret, err)
+	}
+	if secret != nil {
+		for _, line := range strings.Split(string(secret.Data["HTPASSWD"]), "\n") {
+			if i := strings.Index(line, ":"); i > 0 {
+				hashes[line[:i]] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, user := range h.users {
+		hash := hashes[user.name]
+		if hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(user.password)) != nil {
+			b, err := bcrypt.GenerateFromPassword([]byte(user.password), hubBcryptCost)
+			if err != nil {
+				return nil, fmt.Errorf("hash the password of user %s: %v", user.name, err)
+			}
+			hash = string(b)
+		}
+		fmt.Fprintf(&buf, "%s:%s\n", user.name, hash)
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *hub) tokenAuth() bool {
+	return h.cluster.Spec.ImageHub != nil && h.cluster.Spec.ImageHub.TokenAuth
+}
+
+// authEnvs authorizes the requests to rbd-hub with htpasswd, or with the tokens issued by rbd-hub-auth.
+func (h *hub) authEnvs() []corev1.EnvVar {
+	if !h.tokenAuth() {
+		return []corev1.EnvVar{
+			{
+				Name:  "REGISTRY_AUTH",
+				Value: "htpasswd",
+			},
+			{
+				Name:  "REGISTRY_AUTH_HTPASSWD_REALM",
+				Value: "Registry Realm",
+			},
+			{
+				Name:  "REGISTRY_AUTH_HTPASSWD_PATH",
+				Value: "/auth/htpasswd",
+			},
+		}
+	}
+	domain := h.cluster.Spec.ImageHub.Domain
+	return []corev1.EnvVar{
+		{
+			Name:  "REGISTRY_AUTH",
+			Value: "token",
+		},
+		{
+			Name:  "REGISTRY_AUTH_TOKEN_REALM",
+			Value: "https://" + domain + hubAuthPath,
+		},
+		{
+			Name:  "REGISTRY_AUTH_TOKEN_SERVICE",
+			Value: domain,
+		},
+		{
+			Name:  "REGISTRY_AUTH_TOKEN_ISSUER",
+			Value: hubAuthName,
+		},
+		{
+			Name:  "REGISTRY_AUTH_TOKEN_ROOTCERTBUNDLE",
+			Value: "/auth/" + hubAuthCertKey,
+		},
+	}
+}
+
+// authVolume is mounted at /auth of rbd-hub.
+func (h *hub) authVolume() corev1.Volume {
+	if !h.tokenAuth() {
+		return corev1.Volume{
+			Name: "htpasswd",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: hubPasswordSecret,
+					Items: []corev1.KeyToPath{
+						{
+							Key:  "HTPASSWD",
+							Path: "htpasswd",
+						},
+					},
+				},
+			},
+		}
+	}
+	return corev1.Volume{
+		Name: "htpasswd",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: hubAuthName,
+				Items: []corev1.KeyToPath{
+					{
+						Key:  hubAuthCertKey,
+						Path: hubAuthCertKey,
+					},
+				},
+			},
+		},
+	}
+}
+
+// authChecksum changes when the users, their passwords or their access are changed.
+func (h *hub) authChecksum() string {
+	if h.tokenAuth() {
+		return checksum(string(h.authConfig))
+	}
+	return checksum(string(h.htpasswd))
+}
+
+func (h *hub) userSecrets() []client.Object {
+	var secrets []client.Object
+	for _, user := range h.users {
+		if !user.generated {
+			continue
+		}
+		secrets = append(secrets, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      user.secret,
+				Namespace: h.component.Namespace,
+				Labels: rbdutil.LabelsForRainbond(map[string]string{
+					"name": user.secret,
+				}),
+			},
+			Data: map[string][]byte{
+				"username":         []byte(user.name),
+				hubUserPasswordKey: []byte(user.password),
+			},
+		})
+	}
+	return secrets
+}
+
+// setAuthConfig renders the config of rbd-hub-auth, the key signing the tokens is kept once it is generated.
+func (h *hub) setAuthConfig() error {
+	if !h.tokenAuth() {
+		return nil
+	}
+	secret, err := h.getSecret(hubAuthName)
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("get secret %s: %v", hubAuthName, err)
+	}
+	if secret != nil && len(secret.Data[hubAuthCertKey]) > 0 && len(secret.Data[hubAuthKeyKey]) > 0 {
+		h.authCert, h.authKey = secret.Data[hubAuthCertKey], secret.Data[hubAuthKeyKey]
+	} else {
+		_, cert, key, err := commonutil.DomainSign(nil, hubAuthName)
+		if err != nil {
+			return fmt.Errorf("generate the key signing the tokens: %v", err)
+		}
+		h.authCert, h.authKey = cert, key
+	}
+
+	hashes := make(map[string]string)
+	for _, line := range strings.Split(string(h.htpasswd), "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			hashes[line[:i]] = line[i+1:]
+		}
+	}
+	type authUser struct {
+		Password string `json:"password"`
+	}
+	type authACL struct {
+		Match   map[string]string `json:"match"`
+		Actions []string          `json:"actions"`
+	}
+	config := struct {
+		Server map[string]interface{} `json:"server"`
+		Token  map[string]interface{} `json:"token"`
+		Users  map[string]authUser    `json:"users"`
+		ACL    []authACL              `json:"acl"`
+	}{
+		Server: map[string]interface{}{
+			"addr": fmt.Sprintf(":%d", hubAuthPort),
+		},
+		Token: map[string]interface{}{
+			"issuer":      hubAuthName,
+			"expiration":  900,
+			"certificate": "/config/" + hubAuthCertKey,
+			"key":         "/config/" + hubAuthKeyKey,
+		},
+		Users: make(map[string]authUser),
+	}
+	for _, user := range h.users {
+		config.Users[user.name] = authUser{Password: hashes[user.name]}
+		for _, access := range user.access {
+			match := map[string]string{"account": user.name}
+			if access.Namespace != "*" {
+				match["name"] = strings.TrimSuffix(access.Namespace, "/") + "/*"
+			}
+			var actions []string
+			for _, action := range access.Actions {
+				actions = append(actions, string(action))
+			}
+			config.ACL = append(config.ACL, authACL{Match: match, Actions: actions})
+		}
+	}
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("render the config of %s: %v", hubAuthName, err)
+	}
+	h.authConfig = b
+	return nil
+}
+
+func (h *hub) labelsForAuth() map[string]string {
+	return rbdutil.LabelsForRainbond(map[string]string{
+		"name": hubAuthName,
+	})
+}
+
+func (h *hub) authResources() []client.Object {
+	if !h.tokenAuth() {
+		return nil
+	}
+	return []client.Object{
+		h.secretForAuth(),
+		h.deploymentForAuth(),
+		h.serviceForAuth(),
+	}
+}
+
+// authResourcesNeedDelete deletes rbd-hub-auth if the token auth is disabled.
+func (h *hub) authResourcesNeedDelete() []client.Object {
+	if h.tokenAuth() {
+		return nil
+	}
+	meta := metav1.ObjectMeta{
+		Name:      hubAuthName,
+		Namespace: h.component.Namespace,
+	}
+	return []client.Object{
+		&appsv1.Deployment{ObjectMeta: meta},
+		&corev1.Service{ObjectMeta: meta},
+		&corev1.Secret{ObjectMeta: meta},
+	}
+}
+
+func (h *hub) secretForAuth() client.Object {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubAuthName,
+			Namespace: h.component.Namespace,
+			Labels:    h.labelsForAuth(),
+		},
+		Data: map[string][]byte{
+			hubAuthConfigKey: h.authConfig,
+			hubAuthCertKey:   h.authCert,
+			hubAuthKeyKey:    h.authKey,
+		},
+	}
+}
+
+// deploymentForAuth issues the tokens scoped to the access of the users.
+func (h *hub) deploymentForAuth() client.Object {
+	labels := h.labelsForAuth()
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubAuthName,
+			Namespace: h.component.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: h.component.Spec.Replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+					Annotations: map[string]string{
+						hubAuthConfigChecksumAnnotation: h.authChecksum(),
+					},
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:              imagePullSecrets(h.component, h.cluster),
+					TerminationGracePeriodSeconds: commonutil.Int64(0),
+					Containers: []corev1.Container{
+						{
+							Name:            hubAuthName,
+							Image:           rbdutil.GetenvDefault("RAINBOND_IMAGE_REPOSITORY", h.cluster.ImageRepository()) + "/docker_auth:1.11",
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Args:            []string{"/config/" + hubAuthConfigKey},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									ContainerPort: hubAuthPort,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "config",
+									MountPath: "/config",
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: hubAuthName,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (h *hub) serviceForAuth() client.Object {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubAuthName,
+			Namespace: h.component.Namespace,
+			Labels:    h.labelsForAuth(),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http",
+					Port:       hubAuthPort,
+					TargetPort: intstr.FromInt(hubAuthPort),
+				},
+			},
+			Selector: h.labelsForAuth(),
+		},
+	}
+}
+
+// authRoutes serves the tokens at goodrain.me/auth, ahead of the route of rbd-hub.
+func (h *hub) authRoutes() []v2.ApisixRouteHTTP {
+	if !h.tokenAuth() {
+		return nil
+	}
+	return []v2.ApisixRouteHTTP{
+		{
+			Name:     hubAuthName,
+			Priority: 1,
+			Match: v2.ApisixRouteHTTPMatch{
+				Hosts: []string{
+					constants.DefImageRepository,
+				},
+				Paths: []string{
+					hubAuthPath,
+				},
+			},
+			Backends: []v2.ApisixRouteHTTPBackend{
+				{
+					ServicePort:        intstr.FromInt(hubAuthPort),
+					ServiceName:        hubAuthName,
+					ResolveGranularity: "service",
+				},
+			},
+			Authentication: v2.ApisixRouteAuthentication{
+				Enable: false,
+				Type:   "basicAuth",
+			},
+		},
+	}
+}
@@ -0,0 +1,437 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var hubGCName = HubName + "-gc"
+
+const (
+	defaultHubGCSchedule              = "0 3 * * 0"
+	defaultHubGCKeepTags              = 10
+	defaultHubGCUntaggedRetentionDays = 7
+	// hubGCReadOnlyKey is the job which rbd-hub is read-only for, the job waits for it before deleting anything.
+	hubGCReadOnlyKey = "readonly"
+	// hubReadOnlyEnv puts the registry into the read-only mode.
+	hubReadOnlyEnv = "REGISTRY_STORAGE_MAINTENANCE_READONLY"
+	// hubGCResyncPeriod is how often the jobs created by the cronjob are checked.
+	hubGCResyncPeriod = time.Minute
+	// hubGCActiveResyncPeriod is how often the garbage collection in progress is checked.
+	hubGCActiveResyncPeriod = 10 * time.Second
+)
+
+// hubGCScript deletes the expired tags and the untagged manifests, then removes the unreferenced blobs.
+// The tags and the manifests are only deleted with the filesystem storage, which keeps the push time.
+// The result is written to the termination log in json, which is recorded in the status of rbd-hub.
+const hubGCScript = `set -eo pipefail
+until [ "$(cat /gc/readonly 2>/dev/null)" = "$JOB_NAME" ]; do
+  echo "waiting for rbd-hub to be read-only"
+  sleep 5
+done
+
+registry_dir=/var/lib/registry/docker/registry/v2
+tags=0
+manifests=0
+before=""
+if [ "$STORAGE" = "filesystem" ] && [ -d "$registry_dir/repositories" ]; then
+  before=$(du -sk /var/lib/registry | cut -f1)
+  for dir in $(find "$registry_dir/repositories" -type d -name _manifests); do
+    if [ -d "$dir/tags" ]; then
+      # the latest pushed tags are kept.
+      for tag in $(for t in "$dir"/tags/*; do [ -f "$t/current/link" ] && echo "$(stat -c %Y "$t/current/link") ${t##*/}"; done | sort -rn | tail -n +$((KEEP_TAGS + 1)) | cut -d' ' -f2); do
+        rm -rf "$dir/tags/$tag"
+        tags=$((tags + 1))
+      done
+    fi
+    [ -d "$dir/revisions/sha256" ] || continue
+    # the manifests referenced by the tags, including the manifests in the image indexes.
+    referenced=""
+    for link in "$dir"/tags/*/current/link; do
+      [ -f "$link" ] || continue
+      hex=$(cut -d: -f2 "$link")
+      referenced="$referenced $hex"
+      data="$registry_dir/blobs/sha256/$(echo "$hex" | cut -c1-2)/$hex/data"
+      if [ -f "$data" ]; then
+        referenced="$referenced $(grep -o 'sha256:[0-9a-f]\{64\}' "$data" | cut -d: -f2 | tr '\n' ' ')"
+      fi
+    done
+    for revision in $(find "$dir/revisions/sha256" -mindepth 1 -maxdepth 1 -type d -mtime +$UNTAGGED_RETENTION_DAYS); do
+      case " $referenced " in
+        *" ${revision##*/} "*) ;;
+        *) rm -rf "$revision"; manifests=$((manifests + 1)) ;;
+      esac
+    done
+  done
+fi
+
+registry garbage-collect /etc/docker/registry/config.yml > /tmp/gc.log
+blobs=$(grep -c "eligible for deletion" /tmp/gc.log || true)
+result="{\"deletedTags\":$tags,\"deletedManifests\":$manifests,\"deletedBlobs\":$blobs"
+if [ -n "$before" ]; then
+  after=$(du -sk /var/lib/registry | cut -f1)
+  result="$result,\"reclaimedBytes\":$(((before - after) * 1024))"
+fi
+echo "$result}" | tee /dev/termination-log
+`
+
+func (h *hub) gc() *rainbondv1alpha1.HubGarbageCollection {
+	if h.cluster.Spec.HubGarbageCollection == nil {
+		return nil
+	}
+	gc := h.cluster.Spec.HubGarbageCollection.DeepCopy()
+	if gc.Schedule == "" {
+		gc.Schedule = defaultHubGCSchedule
+	}
+	if gc.KeepTags <= 0 {
+		gc.KeepTags = defaultHubGCKeepTags
+	}
+	if gc.UntaggedRetentionDays <= 0 {
+		gc.UntaggedRetentionDays = defaultHubGCUntaggedRetentionDays
+	}
+	return gc
+}
+
+func (h *hub) labelsForGC() map[string]string {
+	return rbdutil.LabelsForRainbond(map[string]string{
+		"name": hubGCName,
+	})
+}
+
+// setGCJob finds the garbage collection in progress, and whether rbd-hub has been read-only for it.
+func (h *hub) setGCJob() error {
+	h.gcJob, h.gcReadOnly = "", false
+	if h.gc() == nil {
+		return nil
+	}
+	jobs, err := h.gcJobs()
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.Status.Succeeded == 0 && !isJobFailed(job) {
+			h.gcJob = job.Name
+			break
+		}
+	}
+	if h.gcJob == "" {
+		return nil
+	}
+
+	deploy := &appsv1.Deployment{}
+	if err := h.client.Get(h.ctx, types.NamespacedName{Namespace: h.component.Namespace, Name: HubName}, deploy); err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("get deployment %s: %v", HubName, err)
+	}
+	h.gcReadOnly = isReadOnly(deploy) && rolledOut(deploy)
+	return nil
+}
+
+func (h *hub) gcJobs() ([]batchv1.Job, error) {
+	jobList := &batchv1.JobList{}
+	if err := h.client.List(h.ctx, jobList, client.InNamespace(h.component.Namespace), client.MatchingLabels(h.labelsForGC())); err != nil {
+		return nil, fmt.Errorf("list garbage collection jobs: %v", err)
+	}
+	return jobList.Items, nil
+}
+
+func isReadOnly(deploy *appsv1.Deployment) bool {
+	for _, container := range deploy.Spec.Template.Spec.Containers {
+		for _, env := range container.Env {
+			if env.Name == hubReadOnlyEnv {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rolledOut returns true if all the pods of the deployment are updated and available.
+func rolledOut(deploy *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deploy.Spec.Replicas != nil {
+		replicas = *deploy.Spec.Replicas
+	}
+	status := deploy.Status
+	return status.ObservedGeneration >= deploy.Generation && status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas && status.AvailableReplicas == replicas
+}
+
+// readOnlyEnvs puts rbd-hub into the read-only mode during the garbage collection.
+func (h *hub) readOnlyEnvs() []corev1.EnvVar {
+	if h.gcJob == "" {
+		return nil
+	}
+	return []corev1.EnvVar{
+		{
+			Name:  hubReadOnlyEnv,
+			Value: `{"enabled":true}`,
+		},
+	}
+}
+
+func (h *hub) gcResources() []client.Object {
+	gc := h.gc()
+	if gc == nil {
+		return nil
+	}
+	objs := []client.Object{h.configMapForGC()}
+	if cronJob := h.cronJobForGC(gc); cronJob != nil {
+		objs = append(objs, cronJob)
+	}
+	return objs
+}
+
+// gcResourcesNeedDelete deletes the cronjob and the configmap of the garbage collection if it is disabled.
+func (h *hub) gcResourcesNeedDelete() []client.Object {
+	if h.gc() != nil {
+		return nil
+	}
+	cronJob := &unstructured.Unstructured{}
+	cronJob.SetGroupVersionKind(cronJobGVK)
+	cronJob.SetName(hubGCName)
+	cronJob.SetNamespace(h.component.Namespace)
+	return []client.Object{cronJob, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubGCName,
+			Namespace: h.component.Namespace,
+		},
+	}}
+}
+
+// ResyncPeriod checks the jobs created by the cronjob, so that rbd-hub is read-only in time.
+func (h *hub) ResyncPeriod() time.Duration {
+	if h.gc() == nil {
+		return 0
+	}
+	if h.gcJob != "" {
+		return hubGCActiveResyncPeriod
+	}
+	return hubGCResyncPeriod
+}
+
+func (h *hub) configMapForGC() client.Object {
+	readOnly := ""
+	if h.gcReadOnly {
+		readOnly = h.gcJob
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubGCName,
+			Namespace: h.component.Namespace,
+			Labels:    h.labelsForGC(),
+		},
+		Data: map[string]string{
+			"gc.sh":          hubGCScript,
+			hubGCReadOnlyKey: readOnly,
+		},
+	}
+}
+
+func (h *hub) cronJobForGC(gc *rainbondv1alpha1.HubGarbageCollection) client.Object {
+	labels := h.labelsForGC()
+	storage := rainbondv1alpha1.HubStorageFilesystem
+	if h.useS3() {
+		storage = rainbondv1alpha1.HubStorageS3
+	}
+	env := append([]corev1.EnvVar{
+		{
+			Name: "JOB_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['job-name']"},
+			},
+		},
+		{
+			Name:  "STORAGE",
+			Value: string(storage),
+		},
+		{
+			Name:  "KEEP_TAGS",
+			Value: strconv.Itoa(int(gc.KeepTags)),
+		},
+		{
+			Name:  "UNTAGGED_RETENTION_DAYS",
+			Value: strconv.Itoa(int(gc.UntaggedRetentionDays)),
+		},
+	}, h.storageEnvs()...)
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "gc",
+			MountPath: "/gc",
+		},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "gc",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: hubGCName},
+				},
+			},
+		},
+	}
+	var affinity *corev1.Affinity
+	if !h.useS3() {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "data",
+			MountPath: "/var/lib/registry",
+		})
+		volumes = append(volumes, corev1.Volume{
+			Name: "data",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: hubDataPvcName,
+				},
+			},
+		})
+		// the volume may only be mounted on the node of rbd-hub.
+		affinity = &corev1.Affinity{
+			PodAffinity: &corev1.PodAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+					{
+						LabelSelector: &metav1.LabelSelector{MatchLabels: h.labels},
+						TopologyKey:   "kubernetes.io/hostname",
+					},
+				},
+			},
+		}
+	}
+
+	cronJob := &batchv1beta1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubGCName,
+			Namespace: h.component.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1beta1.CronJobSpec{
+			Schedule:                   gc.Schedule,
+			ConcurrencyPolicy:          batchv1beta1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: commonutil.Int32(3),
+			FailedJobsHistoryLimit:     commonutil.Int32(3),
+			JobTemplate: batchv1beta1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: batchv1.JobSpec{
+					// rbd-hub is writable again once the job is failed.
+					BackoffLimit:          commonutil.Int32(0),
+					ActiveDeadlineSeconds: commonutil.Int64(int64((2 * time.Hour).Seconds())),
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: labels,
+						},
+						Spec: corev1.PodSpec{
+							ImagePullSecrets: imagePullSecrets(h.component, h.cluster),
+							RestartPolicy:    corev1.RestartPolicyNever,
+							Affinity:         affinity,
+							Containers: []corev1.Container{
+								{
+									Name:                     "gc",
+									Image:                    h.component.Spec.Image,
+									ImagePullPolicy:          h.component.ImagePullPolicy(),
+									Command:                  []string{"/bin/sh", "/gc/gc.sh"},
+									Env:                      env,
+									VolumeMounts:             volumeMounts,
+									TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+								},
+							},
+							Volumes: volumes,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(cronJob)
+	if err != nil {
+		log.Error(err, "convert cronjob to unstructured")
+		return nil
+	}
+	obj := &unstructured.Unstructured{Object: content}
+	obj.SetGroupVersionKind(cronJobGVK)
+	unstructured.RemoveNestedField(obj.Object, "status")
+	return obj
+}
+
+// hubGCResult is the result of a garbage collection written by hubGCScript.
+type hubGCResult struct {
+	DeletedTags      int64 `json:"deletedTags"`
+	DeletedManifests int64 `json:"deletedManifests"`
+	DeletedBlobs     int64 `json:"deletedBlobs"`
+	ReclaimedBytes   int64 `json:"reclaimedBytes"`
+}
+
+// updateGCStatus records the garbage collection in progress, and the result of the last one.
+func (h *hub) updateGCStatus() error {
+	if h.gc() == nil {
+		h.component.Status.GarbageCollection = nil
+		return nil
+	}
+	jobs, err := h.gcJobs()
+	if err != nil {
+		return err
+	}
+	status := h.component.Status.GarbageCollection
+	if status == nil {
+		status = &rainbondv1alpha1.GarbageCollectionStatus{}
+	}
+	status.Job = h.gcJob
+
+	var last *batchv1.Job
+	for i := range jobs {
+		job := &jobs[i]
+		if job.Status.Succeeded == 0 && !isJobFailed(job) {
+			continue
+		}
+		if last == nil || last.CreationTimestamp.Before(&job.CreationTimestamp) {
+			last = job
+		}
+	}
+	if last != nil && last.Name != status.LastJob {
+		message, err := jobTerminationMessage(h.ctx, h.client, last)
+		if err != nil {
+			return err
+		}
+		result := hubGCResult{}
+		status.Message = ""
+		if last.Status.Succeeded > 0 {
+			if err := json.Unmarshal([]byte(message), &result); err != nil {
+				status.Message = fmt.Sprintf("parse the result of job %s: %v", last.Name, err)
+			}
+		} else {
+			status.Message = message
+		}
+		status.LastJob = last.Name
+		status.LastCompletionTime = last.Status.CompletionTime
+		if status.LastCompletionTime == nil {
+			now := metav1.Now()
+			status.LastCompletionTime = &now
+		}
+		status.DeletedTags = result.DeletedTags
+		status.DeletedManifests = result.DeletedManifests
+		status.DeletedBlobs = result.DeletedBlobs
+		status.ReclaimedBytes = result.ReclaimedBytes
+	}
+	h.component.Status.GarbageCollection = status
+	return nil
+}
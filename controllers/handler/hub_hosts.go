@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/k8sutil"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// HubHostsName is the name of the agent which resolves goodrain.me on every node.
+var HubHostsName = HubName + "-hosts"
+
+// hubHostsCleanupName is the name of the agent which removes goodrain.me from every node before rbd-hub is deleted.
+var hubHostsCleanupName = HubHostsName + "-cleanup"
+
+const (
+	hubHostsBegin = "# BEGIN goodrain.me, managed by rainbond-operator"
+	hubHostsEnd   = "# END goodrain.me, managed by rainbond-operator"
+	// hostsJobName is the job which appended goodrain.me to /etc/hosts before the agent.
+	hostsJobName = "hosts-job"
+	// hubHostsFinalizer removes goodrain.me from /etc/hosts before rbd-hub is deleted.
+	hubHostsFinalizer = "rainbond.io/hub-hosts"
+	// hostsCleanupTimeout is how long to wait for the nodes which are not ready before rbd-hub is deleted anyway.
+	hostsCleanupTimeout = 5 * time.Minute
+)
+
+// hubHostsScript keeps the managed block of /etc/hosts in sync with /config/ip, or removes it with "remove".
+// The block is kept when the agent is stopped, so that the images are still pulled from goodrain.me while the
+// agents are restarted. The line appended by the former hosts-job is replaced by the block.
+const hubHostsScript = `mode=${1:-add}
+render() {
+  sed -e '/^` + hubHostsBegin + `$/,/^` + hubHostsEnd + `$/d' -e '/^[0-9a-fA-F.:]* goodrain\.me$/d' /etc/hosts
+  ip=$(cat /config/ip 2>/dev/null)
+  if [ "$1" = "add" ] && [ -n "$ip" ]; then
+    printf '%s\n%s goodrain.me\n%s\n' "` + hubHostsBegin + `" "$ip" "` + hubHostsEnd + `"
+  fi
+}
+update() {
+  render "$1" > /tmp/hosts || return
+  # /etc/hosts is a mounted file, it must be rewritten in place.
+  cmp -s /tmp/hosts /etc/hosts || cat /tmp/hosts > /etc/hosts
+}
+trap 'exit 0' TERM INT
+while true; do
+  update "$mode"
+  sleep 10 &
+  wait $!
+done
+`
+
+// hubHostsCheckScript succeeds if the managed block of /etc/hosts matches /config/ip, or is removed with "remove".
+const hubHostsCheckScript = `ip=$(cat /config/ip 2>/dev/null)
+[ "$1" = "remove" ] && ip=
+block=$(sed -n '/^` + hubHostsBegin + `$/,/^` + hubHostsEnd + `$/p' /etc/hosts | grep -v '^#')
+[ "$block" = "${ip:+$ip goodrain.me}" ]
+`
+
+func (h *hub) labelsForHosts() map[string]string {
+	return rbdutil.LabelsForRainbond(map[string]string{
+		"name": HubHostsName,
+	})
+}
+
+func (h *hub) hostsResources() []client.Object {
+	return []client.Object{
+		h.configMapForHosts(),
+		h.daemonSetForHosts(HubHostsName, "add"),
+	}
+}
+
+// Finalizer -
+func (h *hub) Finalizer() string {
+	return hubHostsFinalizer
+}
+
+// Finalize removes goodrain.me from /etc/hosts of every node with rbd-hub-hosts-cleanup, after the agents are
+// deleted. It is given up after hostsCleanupTimeout if the cleanup is not ready on some nodes.
+func (h *hub) Finalize() (bool, error) {
+	agent := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: HubHostsName, Namespace: h.component.Namespace}}
+	if err := h.client.Delete(h.ctx, agent); err != nil && !k8sErrors.IsNotFound(err) {
+		return false, fmt.Errorf("delete daemonset %s: %v", HubHostsName, err)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := h.client.Get(h.ctx, types.NamespacedName{Namespace: h.component.Namespace, Name: HubHostsName}, cm); err != nil {
+		if k8sErrors.IsNotFound(err) {
+			// goodrain.me has never been added.
+			return true, nil
+		}
+		return false, fmt.Errorf("get configmap %s: %v", HubHostsName, err)
+	}
+
+	cleanup := &appsv1.DaemonSet{}
+	if err := h.client.Get(h.ctx, types.NamespacedName{Namespace: h.component.Namespace, Name: hubHostsCleanupName}, cleanup); err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return false, fmt.Errorf("get daemonset %s: %v", hubHostsCleanupName, err)
+		}
+		cleanup = h.daemonSetForHosts(hubHostsCleanupName, "remove").(*appsv1.DaemonSet)
+		cleanup.OwnerReferences = []metav1.OwnerReference{
+			*metav1.NewControllerRef(h.component, rainbondv1alpha1.GroupVersion.WithKind("RbdComponent")),
+		}
+		if err := h.client.Create(h.ctx, cleanup); err != nil {
+			return false, fmt.Errorf("create daemonset %s: %v", hubHostsCleanupName, err)
+		}
+		return false, nil
+	}
+	status := cleanup.Status
+	done := status.ObservedGeneration > 0 && status.NumberReady == status.DesiredNumberScheduled
+	if !done {
+		if h.component.DeletionTimestamp != nil && time.Since(h.component.DeletionTimestamp.Time) < hostsCleanupTimeout {
+			return false, nil
+		}
+		log.Info("give up removing goodrain.me from /etc/hosts", "ready", status.NumberReady, "desired", status.DesiredNumberScheduled)
+	}
+	if err := h.client.Delete(h.ctx, cleanup); err != nil && !k8sErrors.IsNotFound(err) {
+		return false, fmt.Errorf("delete daemonset %s: %v", hubHostsCleanupName, err)
+	}
+	return true, nil
+}
+
+// hostsResourcesNeedDelete deletes the former hosts-job.
+func (h *hub) hostsResourcesNeedDelete() []client.Object {
+	return []client.Object{
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      hostsJobName,
+				Namespace: h.component.Namespace,
+			},
+		},
+	}
+}
+
+func (h *hub) configMapForHosts() client.Object {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      HubHostsName,
+			Namespace: h.component.Namespace,
+			Labels:    h.labelsForHosts(),
+		},
+		Data: map[string]string{
+			// the ip is mounted rather than set as an env, so the agents are not restarted when it changes.
+			"ip":       h.cluster.InnerGatewayIngressIP(),
+			"sync.sh":  hubHostsScript,
+			"check.sh": hubHostsCheckScript,
+		},
+	}
+}
+
+// daemonSetForHosts maintains goodrain.me in /etc/hosts on every node with the mode of hubHostsScript,
+// it is ready once /etc/hosts is up to date.
+func (h *hub) daemonSetForHosts(name, mode string) client.Object {
+	labels := rbdutil.LabelsForRainbond(map[string]string{
+		"name": name,
+	})
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: h.component.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:              imagePullSecrets(h.component, h.cluster),
+					TerminationGracePeriodSeconds: commonutil.Int64(10),
+					Tolerations: []corev1.Toleration{
+						{
+							Operator: corev1.TolerationOpExists,
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:            "sync",
+							Image:           os.Getenv("RAINBOND_IMAGE_REPOSITORY") + "/alpine:3",
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Command:         []string{"/bin/sh", "/config/sync.sh", mode},
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									Exec: &corev1.ExecAction{
+										Command: []string{"/bin/sh", "/config/check.sh", mode},
+									},
+								},
+								PeriodSeconds: 10,
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "config",
+									MountPath: "/config",
+								},
+								{
+									Name:      "hosts",
+									MountPath: "/etc/hosts",
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: HubHostsName},
+								},
+							},
+						},
+						{
+							Name: "hosts",
+							VolumeSource: corev1.VolumeSource{
+								HostPath: &corev1.HostPathVolumeSource{
+									Path: "/etc/hosts",
+									Type: k8sutil.HostPath(corev1.HostPathFile),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// updateHostsStatus records whether /etc/hosts of each node is up to date, according to the readiness of the agents.
+func (h *hub) updateHostsStatus() error {
+	nodes := &corev1.NodeList{}
+	if err := h.client.List(h.ctx, nodes); err != nil {
+		return fmt.Errorf("list nodes: %v", err)
+	}
+	pods, err := listPods(h.ctx, h.client, h.component.Namespace, h.labelsForHosts())
+	if err != nil {
+		return fmt.Errorf("list pods of %s: %v", HubHostsName, err)
+	}
+	agents := make(map[string]*corev1.Pod)
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Spec.NodeName == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		agents[pod.Spec.NodeName] = pod
+	}
+
+	status := &rainbondv1alpha1.HostsSyncStatus{
+		IP: h.cluster.InnerGatewayIngressIP(),
+	}
+	for _, node := range nodes.Items {
+		nodeStatus := rainbondv1alpha1.NodeHostsSyncStatus{Node: node.Name}
+		pod, ok := agents[node.Name]
+		switch {
+		case !ok:
+			nodeStatus.Message = "the agent is not running on the node"
+		case k8sutil.IsPodReady(pod):
+			nodeStatus.Synced = true
+			status.SyncedNodes++
+		default:
+			nodeStatus.Message = agentNotReadyMessage(pod)
+		}
+		status.Nodes = append(status.Nodes, nodeStatus)
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].Node < status.Nodes[j].Node
+	})
+	h.component.Status.HostsSync = status
+	return nil
+}
+
+func agentNotReadyMessage(pod *corev1.Pod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Waiting != nil && cs.State.Waiting.Reason != "" {
+			return fmt.Sprintf("the agent %s is waiting: %s", pod.Name, cs.State.Waiting.Reason)
+		}
+	}
+	return fmt.Sprintf("waiting for the agent %s to update /etc/hosts", pod.Name)
+}
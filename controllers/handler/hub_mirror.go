@@ -0,0 +1,532 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	v2 "github.com/goodrain/rainbond-operator/api/v2"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"github.com/goodrain/rainbond-operator/util/constants"
+	"github.com/goodrain/rainbond-operator/util/k8sutil"
+	"github.com/goodrain/rainbond-operator/util/rbdutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var hubMirrorConfigName = HubName + "-mirror-config"
+
+const (
+	// hubMirrorLabelKey is the name of the upstream cached by a mirror instance.
+	hubMirrorLabelKey = "rainbond.io/hub-mirror"
+	// hubMirrorPathPrefix is where the mirrors are served on goodrain.me.
+	hubMirrorPathPrefix = "/mirrors/"
+	// hubMirrorManagedMark marks the hosts.toml written by the operator, which is removed with the mirror.
+	hubMirrorManagedMark = "# managed by rainbond-operator"
+	containerdConfigDir  = "/etc/containerd"
+	dockerConfigDir      = "/etc/docker"
+)
+
+// hubMirrorConfigScript keeps the registry hosts of containerd in sync with the mirrors, and adds the mirror of
+// Docker Hub to the registry-mirrors of docker, which is reloaded by SIGHUP. The hosts.toml and the
+// registry-mirrors configured by the administrators are never overwritten.
+const hubMirrorConfigScript = `while true; do
+  for f in /config/*.toml; do
+    [ -f "$f" ] || continue
+    host=$(basename "$f" .toml)
+    target="/containerd/certs.d/$host/hosts.toml"
+    if [ -f "$target" ] && ! grep -q "` + hubMirrorManagedMark + `" "$target"; then
+      continue
+    fi
+    mkdir -p "/containerd/certs.d/$host"
+    cmp -s "$f" "$target" || cp "$f" "$target"
+  done
+  for f in /containerd/certs.d/*/hosts.toml; do
+    [ -f "$f" ] || continue
+    host=$(basename "$(dirname "$f")")
+    if [ ! -f "/config/$host.toml" ] && grep -q "` + hubMirrorManagedMark + `" "$f"; then
+      rm -f "$f"
+    fi
+  done
+  # containerd 2.x reads /etc/containerd/certs.d by default, containerd 1.x only if config_path is set.
+  config=/containerd/config.toml
+  if [ -f "$config" ] && ! grep -q "^version *= *3" "$config" && ! grep -Eq "config_path *= *[\"'][^\"']*/etc/containerd/certs.d" "$config"; then
+    [ -n "$warned" ] || echo "config_path of /etc/containerd/config.toml does not include /etc/containerd/certs.d, containerd does not use the mirrors"
+    warned=true
+  else
+    warned=
+  fi
+
+  mirror=$(cat /config/docker-mirror 2>/dev/null || true)
+  pid=$(pidof dockerd || true)
+  config=/docker/daemon.json
+  if [ -n "$mirror" ] && [ -n "$pid" ] && ! grep -q "\"$mirror\"" "$config" 2>/dev/null; then
+    if [ ! -s "$config" ] || [ "$(tr -d ' \t\n' < "$config")" = "{}" ]; then
+      printf '{\n  "registry-mirrors": ["%s"]\n}\n' "$mirror" > "$config"
+      kill -HUP $pid
+    elif ! grep -q '"registry-mirrors"' "$config"; then
+      awk -v mirror="$mirror" '!done && sub(/[{]/, "{\n  \"registry-mirrors\": [\"" mirror "\"],") { done = 1 } { print }' "$config" > /tmp/daemon.json
+      cat /tmp/daemon.json > "$config"
+      kill -HUP $pid
+    fi
+  fi
+  sleep 60
+done
+`
+
+// mirrors returns the upstreams cached by rbd-hub, Docker Hub and the Rainbond image repository by default.
+func (h *hub) mirrors() []rainbondv1alpha1.HubMirrorUpstream {
+	mirror := h.cluster.Spec.HubMirror
+	if mirror == nil {
+		return nil
+	}
+	upstreams := mirror.Upstreams
+	if len(upstreams) == 0 {
+		upstreams = []rainbondv1alpha1.HubMirrorUpstream{
+			{Name: "dockerhub", URL: "https://registry-1.docker.io", Host: "docker.io"},
+		}
+		if repo := h.cluster.Spec.RainbondImageRepository; repo != "" {
+			host := strings.SplitN(repo, "/", 2)[0]
+			if host != "docker.io" && strings.Contains(host, ".") {
+				upstreams = append(upstreams, rainbondv1alpha1.HubMirrorUpstream{Name: "rainbond", URL: "https://" + host})
+			}
+		}
+	}
+	result := make([]rainbondv1alpha1.HubMirrorUpstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if upstream.Host == "" {
+			if u, err := url.Parse(upstream.URL); err == nil {
+				upstream.Host = u.Host
+			}
+		}
+		result = append(result, upstream)
+	}
+	return result
+}
+
+// setDockerMirror finds the endpoint of the mirror of Docker Hub for docker. docker does not accept a mirror
+// with a path such as goodrain.me/mirrors/dockerhub, so the nodes pull through the cluster ip of the mirror.
+func (h *hub) setDockerMirror() error {
+	h.dockerMirror = ""
+	if h.cluster.Spec.HubMirror == nil || !h.cluster.Spec.HubMirror.ConfigureNodes {
+		return nil
+	}
+	for _, upstream := range h.mirrors() {
+		// docker can not authorize to the mirrors of the upstreams with credentials.
+		if upstream.Host != "docker.io" || upstream.SecretName != "" {
+			continue
+		}
+		svc := &corev1.Service{}
+		if err := h.client.Get(h.ctx, types.NamespacedName{Namespace: h.component.Namespace, Name: hubMirrorName(upstream)}, svc); err != nil {
+			if k8sErrors.IsNotFound(err) {
+				// configured once the service is created.
+				return nil
+			}
+			return fmt.Errorf("get service %s: %v", hubMirrorName(upstream), err)
+		}
+		if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != corev1.ClusterIPNone {
+			h.dockerMirror = fmt.Sprintf("http://%s:5000", svc.Spec.ClusterIP)
+		}
+	}
+	return nil
+}
+
+func hubMirrorName(upstream rainbondv1alpha1.HubMirrorUpstream) string {
+	return HubName + "-mirror-" + upstream.Name
+}
+
+func (h *hub) labelsForMirror(upstream rainbondv1alpha1.HubMirrorUpstream) map[string]string {
+	return rbdutil.LabelsForRainbond(map[string]string{
+		"name":            hubMirrorName(upstream),
+		hubMirrorLabelKey: upstream.Name,
+	})
+}
+
+func (h *hub) validateMirrors() error {
+	names := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for _, upstream := range h.mirrors() {
+		if names[upstream.Name] {
+			return fmt.Errorf("duplicate mirror %s", upstream.Name)
+		}
+		names[upstream.Name] = true
+		u, err := url.Parse(upstream.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q of mirror %s", upstream.URL, upstream.Name)
+		}
+		if hosts[upstream.Host] {
+			return fmt.Errorf("host %s is mirrored more than once", upstream.Host)
+		}
+		hosts[upstream.Host] = true
+		if upstream.SecretName == "" {
+			continue
+		}
+		secret, err := h.getSecret(upstream.SecretName)
+		if err != nil {
+			return fmt.Errorf("get secret %s of mirror %s: %v", upstream.SecretName, upstream.Name, err)
+		}
+		for _, key := range []string{"username", "password"} {
+			if len(secret.Data[key]) == 0 {
+				return fmt.Errorf("%s is required in secret %s", key, upstream.SecretName)
+			}
+		}
+	}
+	return nil
+}
+
+// setStaleMirrors finds the mirror instances whose upstreams have been removed.
+func (h *hub) setStaleMirrors() error {
+	deploys := &appsv1.DeploymentList{}
+	if err := h.client.List(h.ctx, deploys, client.InNamespace(h.component.Namespace), client.HasLabels{hubMirrorLabelKey}); err != nil {
+		return fmt.Errorf("list mirrors of %s: %v", HubName, err)
+	}
+	current := make(map[string]bool)
+	for _, upstream := range h.mirrors() {
+		current[hubMirrorName(upstream)] = true
+	}
+	h.staleMirrors = nil
+	for _, deploy := range deploys.Items {
+		if !current[deploy.Name] {
+			h.staleMirrors = append(h.staleMirrors, deploy.Name)
+		}
+	}
+	return nil
+}
+
+// mirrorResourcesNeedDelete deletes the stale mirror instances, and the node configuration if it is disabled.
+// The caches are kept.
+func (h *hub) mirrorResourcesNeedDelete() []client.Object {
+	var objs []client.Object
+	for _, name := range h.staleMirrors {
+		meta := metav1.ObjectMeta{Name: name, Namespace: h.component.Namespace}
+		objs = append(objs, &appsv1.Deployment{ObjectMeta: meta}, &corev1.Service{ObjectMeta: meta})
+	}
+	if h.cluster.Spec.HubMirror == nil || !h.cluster.Spec.HubMirror.ConfigureNodes {
+		meta := metav1.ObjectMeta{Name: hubMirrorConfigName, Namespace: h.component.Namespace}
+		objs = append(objs, &appsv1.DaemonSet{ObjectMeta: meta}, &corev1.ConfigMap{ObjectMeta: meta})
+	}
+	return objs
+}
+
+func (h *hub) mirrorResources() []client.Object {
+	var objs []client.Object
+	for _, upstream := range h.mirrors() {
+		if !h.useS3() {
+			objs = append(objs, createPersistentVolumeClaimRWO(h.component.Namespace, hubMirrorName(upstream), h.pvcParametersRWO,
+				h.labelsForMirror(upstream), getStorageRequest("HUB_MIRROR_STORAGE_REQUEST", 50)))
+		}
+		objs = append(objs, h.deploymentForMirror(upstream), h.serviceForMirror(upstream))
+	}
+	if mirror := h.cluster.Spec.HubMirror; mirror != nil && mirror.ConfigureNodes {
+		objs = append(objs, h.configMapForMirrorConfig(), h.daemonSetForMirrorConfig())
+	}
+	return objs
+}
+
+func (h *hub) deploymentForMirror(upstream rainbondv1alpha1.HubMirrorUpstream) client.Object {
+	name := hubMirrorName(upstream)
+	labels := h.labelsForMirror(upstream)
+	env := []corev1.EnvVar{
+		{
+			Name:  "REGISTRY_PROXY_REMOTEURL",
+			Value: upstream.URL,
+		},
+		{
+			Name:      "REGISTRY_HTTP_SECRET",
+			ValueFrom: secretKeyRef(hubPasswordSecret, hubHTTPSecretKey),
+		},
+		{
+			Name:  "REGISTRY_STORAGE_REDIRECT_DISABLE",
+			Value: "true",
+		},
+		{
+			Name:  "REGISTRY_STORAGE_DELETE_ENABLED",
+			Value: "true",
+		},
+		{
+			Name:  "REGISTRY_HTTP_RELATIVEURLS",
+			Value: "true",
+		},
+	}
+	if upstream.SecretName != "" {
+		env = append(env, corev1.EnvVar{
+			Name:      "REGISTRY_PROXY_USERNAME",
+			ValueFrom: secretKeyRef(upstream.SecretName, "username"),
+		}, corev1.EnvVar{
+			Name:      "REGISTRY_PROXY_PASSWORD",
+			ValueFrom: secretKeyRef(upstream.SecretName, "password"),
+		})
+	}
+	var volumeMounts []corev1.VolumeMount
+	var volumes []corev1.Volume
+	var annotations map[string]string
+	if upstream.SecretName != "" {
+		// the images pulled with the credentials are only served to the users of rbd-hub.
+		env = append(env, h.authEnvs()...)
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "htpasswd",
+			MountPath: "/auth",
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, h.authVolume())
+		annotations = map[string]string{
+			hubAuthConfigChecksumAnnotation: h.authChecksum(),
+		}
+	}
+	if h.useS3() {
+		// the caches are kept in the same bucket as rbd-hub, under the directory of the mirror.
+		rootDirectory := strings.TrimSuffix(h.s3().RootDirectory, "/") + hubMirrorPathPrefix + upstream.Name
+		for _, e := range h.storageEnvs() {
+			if e.Name != "REGISTRY_STORAGE_S3_ROOTDIRECTORY" {
+				env = append(env, e)
+			}
+		}
+		env = append(env, corev1.EnvVar{
+			Name:  "REGISTRY_STORAGE_S3_ROOTDIRECTORY",
+			Value: rootDirectory,
+		})
+	} else {
+		env = append(env, h.storageEnvs()...)
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "data",
+			MountPath: "/var/lib/registry",
+		})
+		volumes = append(volumes, corev1.Volume{
+			Name: "data",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: name,
+				},
+			},
+		})
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: h.component.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: commonutil.Int32(1),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:              imagePullSecrets(h.component, h.cluster),
+					TerminationGracePeriodSeconds: commonutil.Int64(0),
+					Affinity:                      h.component.Spec.Affinity,
+					Containers: []corev1.Container{
+						{
+							Name:            "mirror",
+							Image:           h.component.Spec.Image,
+							ImagePullPolicy: h.component.ImagePullPolicy(),
+							Env:             env,
+							VolumeMounts:    volumeMounts,
+							Resources:       setDefaultResources(h.component.Spec.Resources),
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+func (h *hub) serviceForMirror(upstream rainbondv1alpha1.HubMirrorUpstream) client.Object {
+	labels := h.labelsForMirror(upstream)
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubMirrorName(upstream),
+			Namespace: h.component.Namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "main",
+					Port:       5000,
+					TargetPort: intstr.FromInt(5000),
+				},
+			},
+			Selector: labels,
+		},
+	}
+}
+
+// mirrorRoutes serves the mirrors at goodrain.me/mirrors/<name>/v2. Like rbd-hub, the mirrors of the upstreams
+// with credentials authorize the requests themselves.
+func (h *hub) mirrorRoutes() []v2.ApisixRouteHTTP {
+	var routes []v2.ApisixRouteHTTP
+	for _, upstream := range h.mirrors() {
+		prefix := hubMirrorPathPrefix + upstream.Name + "/"
+		routes = append(routes, v2.ApisixRouteHTTP{
+			Name: hubMirrorName(upstream),
+			Match: v2.ApisixRouteHTTPMatch{
+				Hosts: []string{
+					constants.DefImageRepository,
+				},
+				Paths: []string{
+					prefix + "*",
+				},
+			},
+			Backends: []v2.ApisixRouteHTTPBackend{
+				{
+					ServicePort:        intstr.FromInt(5000),
+					ServiceName:        hubMirrorName(upstream),
+					ResolveGranularity: "service",
+				},
+			},
+			Plugins: []v2.ApisixRoutePlugin{
+				{
+					Name:   "proxy-rewrite",
+					Enable: true,
+					Config: v2.ApisixRoutePluginConfig{
+						"regex_uri": []string{"^" + prefix + "(.*)", "/$1"},
+					},
+				},
+			},
+			Authentication: v2.ApisixRouteAuthentication{
+				Enable: false,
+				Type:   "basicAuth",
+			},
+		})
+	}
+	return routes
+}
+
+// containerdHostsConfig returns the hosts.toml of containerd which pulls the images of the upstream through goodrain.me.
+func containerdHostsConfig(upstream rainbondv1alpha1.HubMirrorUpstream) string {
+	return fmt.Sprintf(`%s
+server = %q
+
+[host."https://%s%s%s/v2"]
+  capabilities = ["pull", "resolve"]
+  override_path = true
+  skip_verify = true
+`, hubMirrorManagedMark, upstream.URL, constants.DefImageRepository, hubMirrorPathPrefix, upstream.Name)
+}
+
+func (h *hub) configMapForMirrorConfig() client.Object {
+	data := map[string]string{
+		"sync.sh": hubMirrorConfigScript,
+	}
+	if h.dockerMirror != "" {
+		data["docker-mirror"] = h.dockerMirror
+	}
+	for _, upstream := range h.mirrors() {
+		// containerd can not authorize to the mirrors of the upstreams with credentials.
+		if upstream.SecretName == "" {
+			data[upstream.Host+".toml"] = containerdHostsConfig(upstream)
+		}
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubMirrorConfigName,
+			Namespace: h.component.Namespace,
+			Labels:    h.labelsForMirrorConfig(),
+		},
+		Data: data,
+	}
+}
+
+func (h *hub) labelsForMirrorConfig() map[string]string {
+	return rbdutil.LabelsForRainbond(map[string]string{
+		"name": hubMirrorConfigName,
+	})
+}
+
+// daemonSetForMirrorConfig writes the registry hosts of containerd and the registry mirrors of docker on every node,
+// it shares the pid namespace of the node to reload docker.
+func (h *hub) daemonSetForMirrorConfig() client.Object {
+	labels := h.labelsForMirrorConfig()
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubMirrorConfigName,
+			Namespace: h.component.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:              imagePullSecrets(h.component, h.cluster),
+					TerminationGracePeriodSeconds: commonutil.Int64(0),
+					HostPID:                       true,
+					Tolerations: []corev1.Toleration{
+						{
+							Operator: corev1.TolerationOpExists,
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:            "sync",
+							Image:           os.Getenv("RAINBOND_IMAGE_REPOSITORY") + "/alpine:3",
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Command:         []string{"/bin/sh", "/config/sync.sh"},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "config",
+									MountPath: "/config",
+								},
+								{
+									Name:      "containerd",
+									MountPath: "/containerd",
+								},
+								{
+									Name:      "docker",
+									MountPath: "/docker",
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: hubMirrorConfigName},
+								},
+							},
+						},
+						{
+							Name: "containerd",
+							VolumeSource: corev1.VolumeSource{
+								HostPath: &corev1.HostPathVolumeSource{
+									Path: containerdConfigDir,
+									Type: k8sutil.HostPath(corev1.HostPathDirectoryOrCreate),
+								},
+							},
+						},
+						{
+							Name: "docker",
+							VolumeSource: corev1.VolumeSource{
+								HostPath: &corev1.HostPathVolumeSource{
+									Path: dockerConfigDir,
+									Type: k8sutil.HostPath(corev1.HostPathDirectoryOrCreate),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
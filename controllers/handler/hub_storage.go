@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// hubStorageSecret held the credentials of the bundled minio for rbd-hub, they are in minioCredentialsSecret now.
+	hubStorageSecret = "rbd-hub-storage"
+	hubHTTPSecretKey = "HTTP_SECRET"
+	hubS3AccessKey   = "accessKey"
+	hubS3SecretKey   = "secretKey"
+	hubS3Region      = "us-east-1"
+	// hubMinIOBucket is created by the bundled minio.
+	hubMinIOBucket = "rbd-hub"
+)
+
+func (h *hub) storage() *rainbondv1alpha1.HubStorage {
+	if h.cluster.Spec.HubStorage == nil {
+		return &rainbondv1alpha1.HubStorage{Type: rainbondv1alpha1.HubStorageFilesystem}
+	}
+	return h.cluster.Spec.HubStorage
+}
+
+func (h *hub) useS3() bool {
+	return h.storage().Type == rainbondv1alpha1.HubStorageS3
+}
+
+// s3 returns the object storage of rbd-hub, the bucket rbd-hub of the bundled minio by default.
+func (h *hub) s3() *rainbondv1alpha1.HubS3Storage {
+	if s3 := h.storage().S3; s3 != nil {
+		return s3
+	}
+	return &rainbondv1alpha1.HubS3Storage{
+		Endpoint:   minioEndpoint,
+		Bucket:     hubMinIOBucket,
+		SecretName: minioCredentialsSecret,
+	}
+}
+
+func (h *hub) validateStorage() error {
+	if !h.useS3() {
+		if h.component.Spec.Replicas != nil && *h.component.Spec.Replicas > 1 {
+			return fmt.Errorf("%s can not run more than one replica with the filesystem storage, use s3 instead", HubName)
+		}
+		return nil
+	}
+	if h.storage().S3 == nil {
+		minio := &rainbondv1alpha1.RbdComponent{}
+		if err := h.client.Get(h.ctx, types.NamespacedName{Namespace: h.component.Namespace, Name: MinIOName}, minio); err != nil {
+			if k8sErrors.IsNotFound(err) {
+				return fmt.Errorf("the bundled minio is required if s3 of hubStorage is not specified")
+			}
+			return fmt.Errorf("get rbdcomponent %s: %v", MinIOName, err)
+		}
+		return nil
+	}
+	s3 := h.storage().S3
+	secret, err := h.getSecret(s3.SecretName)
+	if err != nil {
+		return fmt.Errorf("get secret %s of hubStorage: %v", s3.SecretName, err)
+	}
+	for _, key := range []string{hubS3AccessKey, hubS3SecretKey} {
+		if len(secret.Data[key]) == 0 {
+			return fmt.Errorf("%s is required in secret %s", key, s3.SecretName)
+		}
+	}
+	return nil
+}
+
+// setHTTPSecret keeps the secret signing the upload state, which is shared by the replicas of rbd-hub.
+func (h *hub) setHTTPSecret() error {
+	secret, err := h.getSecret(hubPasswordSecret)
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("get secret %s: %v", hubPasswordSecret, err)
+	}
+	if secret != nil && len(secret.Data[hubHTTPSecretKey]) > 0 {
+		h.httpSecret = string(secret.Data[hubHTTPSecretKey])
+		return nil
+	}
+	h.httpSecret = randomSecretKey()
+	if h.httpSecret == "" {
+		return fmt.Errorf("generate http secret of %s", HubName)
+	}
+	return nil
+}
+
+// storageResourcesNeedDelete deletes the former secret of the bundled minio, unless it is the secret of the s3 storage.
+func (h *hub) storageResourcesNeedDelete() []client.Object {
+	if s3 := h.storage().S3; s3 != nil && s3.SecretName == hubStorageSecret {
+		return nil
+	}
+	return []client.Object{&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hubStorageSecret,
+			Namespace: h.component.Namespace,
+		},
+	}}
+}
+
+// storageEnvs returns the storage configuration of the registry.
+func (h *hub) storageEnvs() []corev1.EnvVar {
+	if !h.useS3() {
+		return []corev1.EnvVar{
+			{
+				Name:  "REGISTRY_STORAGE",
+				Value: "filesystem",
+			},
+			{
+				Name:  "REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY",
+				Value: "/var/lib/registry",
+			},
+		}
+	}
+	s3 := h.s3()
+	region := s3.Region
+	if region == "" {
+		region = hubS3Region
+	}
+	env := []corev1.EnvVar{
+		{
+			Name:  "REGISTRY_STORAGE",
+			Value: "s3",
+		},
+		{
+			Name:      "REGISTRY_STORAGE_S3_ACCESSKEY",
+			ValueFrom: secretKeyRef(s3.SecretName, hubS3AccessKey),
+		},
+		{
+			Name:      "REGISTRY_STORAGE_S3_SECRETKEY",
+			ValueFrom: secretKeyRef(s3.SecretName, hubS3SecretKey),
+		},
+		{
+			Name:  "REGISTRY_STORAGE_S3_REGION",
+			Value: region,
+		},
+		{
+			Name:  "REGISTRY_STORAGE_S3_BUCKET",
+			Value: s3.Bucket,
+		},
+		{
+			Name:  "REGISTRY_STORAGE_S3_V4AUTH",
+			Value: "true",
+		},
+	}
+	if s3.Endpoint != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "REGISTRY_STORAGE_S3_REGIONENDPOINT",
+			Value: s3.Endpoint,
+		}, corev1.EnvVar{
+			Name:  "REGISTRY_STORAGE_S3_SECURE",
+			Value: fmt.Sprint(!strings.HasPrefix(s3.Endpoint, "http://")),
+		})
+	}
+	if s3.RootDirectory != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "REGISTRY_STORAGE_S3_ROOTDIRECTORY",
+			Value: s3.RootDirectory,
+		})
+	}
+	return env
+}
+
+func secretKeyRef(name, key string) *corev1.EnvVarSource {
+	return &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		},
+	}
+}
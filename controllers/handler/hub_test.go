@@ -2,132 +2,544 @@ package handler
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	"golang.org/x/crypto/bcrypt"
+	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
-func TestHostsJobToleratesTaintedNodesAndSpreadsOnlyAcrossHostsJobPods(t *testing.T) {
-	t.Parallel()
+func TestHubHostsAgent(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	namespace := "rbd-system"
+	ready := corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}}
+	waiting := corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+	}}}
+	agent := func(name, node string, status corev1.PodStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: (&hub{}).labelsForHosts()},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     status,
+		}
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "master-1"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-2"}},
+		agent("agent-1", "worker-1", waiting),
+		agent("agent-2", "master-1", ready),
+	).Build()
+	component := &rainbondv1alpha1.RbdComponent{ObjectMeta: metav1.ObjectMeta{Name: HubName, Namespace: namespace}}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			NodesForGateway: []*rainbondv1alpha1.K8sNode{{Name: "gateway-1", InternalIP: "10.0.0.10"}},
+		},
+	}
+	h := NewHub(context.Background(), cli, component, cluster).(*hub)
+
+	objs := h.hostsResources()
+	cm := objs[0].(*corev1.ConfigMap)
+	if cm.Data["ip"] != "10.0.0.10" {
+		t.Fatalf("expected goodrain.me to resolve to the gateway, got %q", cm.Data["ip"])
+	}
+	ds := objs[1].(*appsv1.DaemonSet)
+	tolerations := ds.Spec.Template.Spec.Tolerations
+	if len(tolerations) != 1 || tolerations[0].Operator != corev1.TolerationOpExists {
+		t.Fatalf("expected the agent to tolerate all taints, got %v", tolerations)
+	}
+	if ds.Spec.Template.Labels["name"] == HubName {
+		t.Fatal("expected the agents not to be counted as the pods of rbd-hub")
+	}
+	if ds.Spec.Template.Spec.Containers[0].ReadinessProbe == nil {
+		t.Fatal("expected the agent to be ready once /etc/hosts is up to date")
+	}
+	if command := ds.Spec.Template.Spec.Containers[0].Command; command[len(command)-1] != "add" {
+		t.Fatalf("expected the agent to add goodrain.me, got %v", command)
+	}
+	deleted := h.hostsResourcesNeedDelete()
+	if _, ok := deleted[0].(*batchv1.Job); !ok || deleted[0].GetName() != hostsJobName {
+		t.Fatalf("expected the former hosts-job to be deleted, got %v", deleted)
+	}
+
+	if err := h.updateHostsStatus(); err != nil {
+		t.Fatal(err)
+	}
+	status := h.component.Status.HostsSync
+	if status.IP != "10.0.0.10" || status.SyncedNodes != 1 || len(status.Nodes) != 3 {
+		t.Fatalf("unexpected hosts sync status %+v", status)
+	}
+	if node := status.Nodes[0]; node.Node != "master-1" || !node.Synced {
+		t.Fatalf("expected master-1 to be synced, got %+v", node)
+	}
+	if node := status.Nodes[1]; node.Synced || !strings.Contains(node.Message, "ImagePullBackOff") {
+		t.Fatalf("expected worker-1 to wait for the agent, got %+v", node)
+	}
+	if node := status.Nodes[2]; node.Synced || !strings.Contains(node.Message, "not running") {
+		t.Fatalf("expected no agent on worker-2, got %+v", node)
+	}
+}
+
+func TestHubHostsCleanup(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = appsv1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	namespace := "rbd-system"
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	now := metav1.Now()
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: HubName, Namespace: namespace, UID: "uid", DeletionTimestamp: &now},
+	}
+	h := NewHub(context.Background(), cli, component, &rainbondv1alpha1.RainbondCluster{}).(*hub)
+	if done, err := h.Finalize(); err != nil || !done {
+		t.Fatalf("expected nothing to clean up without the agents, got %v, %v", done, err)
+	}
+
+	for _, obj := range h.hostsResources() {
+		if err := cli.Create(context.Background(), obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if done, err := h.Finalize(); err != nil || done {
+		t.Fatalf("expected to wait for the cleanup, got %v, %v", done, err)
+	}
+	if err := cli.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: HubHostsName}, &appsv1.DaemonSet{}); !k8sErrors.IsNotFound(err) {
+		t.Fatalf("expected the agents to be deleted, got %v", err)
+	}
+	cleanup := &appsv1.DaemonSet{}
+	if err := cli.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: hubHostsCleanupName}, cleanup); err != nil {
+		t.Fatal(err)
+	}
+	if command := cleanup.Spec.Template.Spec.Containers[0].Command; command[len(command)-1] != "remove" {
+		t.Fatalf("expected the cleanup to remove goodrain.me, got %v", command)
+	}
+	if done, err := h.Finalize(); err != nil || done {
+		t.Fatalf("expected to wait until the cleanup is ready, got %v, %v", done, err)
+	}
+
+	cleanup.Status = appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: 3, NumberReady: 3}
+	if err := cli.Update(context.Background(), cleanup); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := h.Finalize(); err != nil || !done {
+		t.Fatalf("expected the cleanup to be done, got %v, %v", done, err)
+	}
+	if err := cli.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: hubHostsCleanupName}, &appsv1.DaemonSet{}); !k8sErrors.IsNotFound(err) {
+		t.Fatalf("expected the cleanup to be deleted, got %v", err)
+	}
+
+	// the nodes which are not ready do not block the deletion forever.
+	if done, err := h.Finalize(); err != nil || done {
+		t.Fatalf("expected to wait for the cleanup, got %v, %v", done, err)
+	}
+	component.DeletionTimestamp = &metav1.Time{Time: now.Add(-hostsCleanupTimeout)}
+	if done, err := h.Finalize(); err != nil || !done {
+		t.Fatalf("expected the cleanup to be given up, got %v, %v", done, err)
+	}
+}
 
+func TestHubS3Storage(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
 	component := &rainbondv1alpha1.RbdComponent{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      HubName,
-			Namespace: "rbd-system",
+		ObjectMeta: metav1.ObjectMeta{Name: HubName, Namespace: "rbd-system"},
+		Spec:       rainbondv1alpha1.RbdComponentSpec{Replicas: commonutil.Int32(2)},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			HubStorage: &rainbondv1alpha1.HubStorage{Type: rainbondv1alpha1.HubStorageS3},
 		},
 	}
+	h := NewHub(context.Background(), cli, component, cluster).(*hub)
+	if err := h.validateStorage(); err == nil {
+		t.Fatal("expected the bundled minio to be required")
+	}
+	minio := &rainbondv1alpha1.RbdComponent{ObjectMeta: metav1.ObjectMeta{Name: MinIOName, Namespace: "rbd-system"}}
+	if err := cli.Create(context.Background(), minio); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.validateStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.setHTTPSecret(); err != nil || len(h.httpSecret) != 64 {
+		t.Fatalf("expected a random http secret, got %q, %v", h.httpSecret, err)
+	}
+	if err := cli.Create(context.Background(), h.passwordSecret()); err != nil {
+		t.Fatal(err)
+	}
+	httpSecret := h.httpSecret
+	if err := h.setHTTPSecret(); err != nil || h.httpSecret != httpSecret {
+		t.Fatal("expected the http secret to be kept")
+	}
+
+	// the bundled minio is used by default.
+	deploy := h.deployment().(*appsv1.Deployment)
+	env := make(map[string]corev1.EnvVar)
+	for _, e := range deploy.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e
+	}
+	if env["REGISTRY_STORAGE"].Value != "s3" || env["REGISTRY_STORAGE_S3_BUCKET"].Value != hubMinIOBucket ||
+		env["REGISTRY_STORAGE_S3_REGIONENDPOINT"].Value != "http://minio-service:9000" || env["REGISTRY_STORAGE_S3_SECURE"].Value != "false" {
+		t.Fatalf("unexpected storage of the registry: %v", env)
+	}
+	if _, ok := env["REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY"]; ok {
+		t.Fatal("expected no filesystem storage")
+	}
+	if ref := env["REGISTRY_STORAGE_S3_SECRETKEY"].ValueFrom; ref == nil || ref.SecretKeyRef.Name != minioCredentialsSecret {
+		t.Fatal("expected the credentials of the bundled minio")
+	}
+	if ref := env["REGISTRY_HTTP_SECRET"].ValueFrom; ref == nil || ref.SecretKeyRef.Name != hubPasswordSecret {
+		t.Fatal("expected the shared http secret")
+	}
+	if *deploy.Spec.Replicas != 2 || len(deploy.Spec.Template.Spec.Volumes) != 1 {
+		t.Fatal("expected the replicas without the data volume")
+	}
+	if len(h.storageResourcesNeedDelete()) != 1 {
+		t.Fatal("expected the former secret of the bundled minio to be deleted")
+	}
+
+	// the other s3 compatible storages.
+	cluster.Spec.HubStorage.S3 = &rainbondv1alpha1.HubS3Storage{
+		Endpoint:   "https://oss.example.com",
+		Bucket:     "images",
+		SecretName: "oss",
+	}
+	if err := h.validateStorage(); err == nil {
+		t.Fatal("expected the secret of the storage to be required")
+	}
+	for _, e := range h.storageEnvs() {
+		if e.Name == "REGISTRY_STORAGE_S3_SECURE" && e.Value != "true" {
+			t.Fatal("expected https to the storage")
+		}
+	}
+
+	cluster.Spec.HubStorage = nil
+	if err := h.validateStorage(); err == nil {
+		t.Fatal("expected more than one replica to be refused with the filesystem storage")
+	}
+}
+
+func TestHubGarbageCollection(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = appsv1.AddToScheme(scheme)
+	_ = batchv1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: HubName, Namespace: "rbd-system"},
+	}
 	cluster := &rainbondv1alpha1.RainbondCluster{
 		Spec: rainbondv1alpha1.RainbondClusterSpec{
-			NodesForGateway: []*rainbondv1alpha1.K8sNode{
-				{
-					Name:       "gateway-1",
-					InternalIP: "10.0.0.10",
-				},
-			},
+			HubGarbageCollection: &rainbondv1alpha1.HubGarbageCollection{KeepTags: 5},
 		},
 	}
+	h := NewHub(context.Background(), cli, component, cluster).(*hub)
+	if err := h.setGCJob(); err != nil {
+		t.Fatal(err)
+	}
+	objs := h.gcResources()
+	if len(objs) != 2 || h.ResyncPeriod() != hubGCResyncPeriod || len(h.ResourcesNeedDelete()) != 7 {
+		t.Fatalf("expected the scheduled garbage collection, got %d resources", len(objs))
+	}
+	cronJob := objs[1].(*unstructured.Unstructured)
+	schedule, _, _ := unstructured.NestedString(cronJob.Object, "spec", "schedule")
+	containers, _, _ := unstructured.NestedSlice(cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "containers")
+	env := make(map[string]string)
+	for _, e := range containers[0].(map[string]interface{})["env"].([]interface{}) {
+		e := e.(map[string]interface{})
+		value, _ := e["value"].(string)
+		env[e["name"].(string)] = value
+	}
+	if schedule != defaultHubGCSchedule || env["KEEP_TAGS"] != "5" || env["UNTAGGED_RETENTION_DAYS"] != "7" || env["STORAGE"] != "filesystem" {
+		t.Fatalf("unexpected garbage collection %s: %v", schedule, env)
+	}
 
-	k8sClient := &nodeListClient{
-		staticClient: &staticClient{
-			scheme:  runtime.NewScheme(),
-			objects: map[client.ObjectKey]client.Object{},
+	// rbd-hub is read-only once a job is created, the job waits until it is rolled out.
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: hubGCName + "-1", Namespace: "rbd-system", Labels: h.labelsForGC()},
+	}
+	if err := cli.Create(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.setGCJob(); err != nil {
+		t.Fatal(err)
+	}
+	deploy := h.deployment().(*appsv1.Deployment)
+	if h.gcJob != job.Name || h.gcReadOnly || !isReadOnly(deploy) || h.ResyncPeriod() != hubGCActiveResyncPeriod {
+		t.Fatal("expected rbd-hub to be read-only during the garbage collection")
+	}
+	if cm := h.configMapForGC().(*corev1.ConfigMap); cm.Data[hubGCReadOnlyKey] != "" {
+		t.Fatal("expected the job to wait for the rollout")
+	}
+	deploy.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	if err := cli.Create(context.Background(), deploy); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.setGCJob(); err != nil {
+		t.Fatal(err)
+	}
+	if cm := h.configMapForGC().(*corev1.ConfigMap); cm.Data[hubGCReadOnlyKey] != job.Name {
+		t.Fatal("expected the job to start once rbd-hub is read-only")
+	}
+
+	// the result is recorded, and rbd-hub is writable again.
+	job.Status.Succeeded = 1
+	if err := cli.Update(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: job.Name + "-abcde", Namespace: "rbd-system", Labels: map[string]string{"job-name": job.Name}},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+				Message: `{"deletedTags":3,"deletedManifests":2,"deletedBlobs":10,"reclaimedBytes":1048576}`,
+			}}}},
 		},
-		nodes: []corev1.Node{
-			{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "worker-1",
-					Labels: map[string]string{
-						"kubernetes.io/hostname": "worker-1",
-					},
-				},
-			},
-			{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "master-1",
-					Labels: map[string]string{
-						"kubernetes.io/hostname": "master-1",
-					},
-				},
-				Spec: corev1.NodeSpec{
-					Taints: []corev1.Taint{
-						{
-							Key:    "CriticalAddonsOnly",
-							Value:  "true",
-							Effect: corev1.TaintEffectNoExecute,
-						},
-					},
-				},
-			},
+	}
+	if err := cli.Create(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.setGCJob(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.After(); err != nil {
+		t.Fatal(err)
+	}
+	status := h.component.Status.GarbageCollection
+	if status.Job != "" || status.LastJob != job.Name || status.DeletedTags != 3 || status.DeletedBlobs != 10 || status.ReclaimedBytes != 1048576 || status.LastCompletionTime == nil {
+		t.Fatalf("unexpected status of the garbage collection: %+v", status)
+	}
+	if isReadOnly(h.deployment().(*appsv1.Deployment)) {
+		t.Fatal("expected rbd-hub to be writable after the garbage collection")
+	}
+
+	cluster.Spec.HubGarbageCollection = nil
+	if len(h.ResourcesNeedDelete()) != 9 || h.ResyncPeriod() != 0 {
+		t.Fatal("expected the garbage collection to be deleted")
+	}
+}
+
+func TestHubMirror(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = appsv1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: HubName, Namespace: "rbd-system"},
+	}
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			RainbondImageRepository: "registry.cn-hangzhou.aliyuncs.com/goodrain",
+			HubMirror:               &rainbondv1alpha1.HubMirror{ConfigureNodes: true},
 		},
 	}
+	h := NewHub(context.Background(), cli, component, cluster).(*hub)
+	h.SetStorageClassNameRWO(&pvcParameters{storageClassName: "local-path"})
 
-	handler := &hub{
-		ctx:       context.Background(),
-		client:    k8sClient,
-		component: component,
-		cluster:   cluster,
-		labels:    LabelsForRainbondComponent(component),
+	// Docker Hub and the Rainbond image repository are cached by default.
+	mirrors := h.mirrors()
+	if len(mirrors) != 2 || mirrors[0].Host != "docker.io" || mirrors[1].Host != "registry.cn-hangzhou.aliyuncs.com" {
+		t.Fatalf("unexpected default mirrors: %+v", mirrors)
+	}
+	if err := h.validateMirrors(); err != nil {
+		t.Fatal(err)
+	}
+	var deploys []*appsv1.Deployment
+	var configMap *corev1.ConfigMap
+	for _, obj := range h.mirrorResources() {
+		switch o := obj.(type) {
+		case *appsv1.Deployment:
+			deploys = append(deploys, o)
+		case *corev1.ConfigMap:
+			configMap = o
+		}
+	}
+	if len(deploys) != 2 || deploys[0].Name != "rbd-hub-mirror-dockerhub" || configMap == nil {
+		t.Fatal("expected a mirror instance for each upstream, and the configuration of the nodes")
+	}
+	env := make(map[string]string)
+	for _, e := range deploys[0].Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if env["REGISTRY_PROXY_REMOTEURL"] != "https://registry-1.docker.io" || env["REGISTRY_STORAGE"] != "filesystem" {
+		t.Fatalf("unexpected mirror: %v", env)
+	}
+	hosts := configMap.Data["docker.io.toml"]
+	if !strings.Contains(hosts, `[host."https://goodrain.me/mirrors/dockerhub/v2"]`) || !strings.Contains(hosts, "override_path = true") {
+		t.Fatalf("unexpected hosts.toml of containerd: %s", hosts)
+	}
+	// docker pulls through the cluster ip of the mirror of Docker Hub once the service is created.
+	if _, ok := configMap.Data["docker-mirror"]; ok {
+		t.Fatal("expected no mirror of docker before the service is created")
+	}
+	svc := h.serviceForMirror(mirrors[0]).(*corev1.Service)
+	svc.Spec.ClusterIP = "10.43.0.10"
+	if err := cli.Create(context.Background(), svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.setDockerMirror(); err != nil {
+		t.Fatal(err)
+	}
+	if mirror := h.configMapForMirrorConfig().(*corev1.ConfigMap).Data["docker-mirror"]; mirror != "http://10.43.0.10:5000" {
+		t.Fatalf("unexpected mirror of docker: %q", mirror)
+	}
+	if ds := h.daemonSetForMirrorConfig().(*appsv1.DaemonSet); !ds.Spec.Template.Spec.HostPID {
+		t.Fatal("expected the pid namespace of the node to reload docker")
+	}
+	routes := h.mirrorRoutes()
+	if len(routes) != 2 || routes[0].Match.Paths[0] != "/mirrors/dockerhub/*" || routes[0].Backends[0].ServiceName != "rbd-hub-mirror-dockerhub" {
+		t.Fatalf("unexpected routes of the mirrors: %+v", routes)
 	}
 
-	job, ok := handler.hostsJob().(*batchv1.Job)
-	if !ok {
-		t.Fatalf("expected *batchv1.Job, got %T", handler.hostsJob())
+	// the upstreams with credentials.
+	cluster.Spec.HubMirror = &rainbondv1alpha1.HubMirror{
+		Upstreams: []rainbondv1alpha1.HubMirrorUpstream{
+			{Name: "quay", URL: "https://quay.io", SecretName: "quay"},
+		},
 	}
-	if job.Spec.Parallelism == nil || *job.Spec.Parallelism != 2 {
-		t.Fatalf("expected parallelism 2, got %v", job.Spec.Parallelism)
+	if err := h.validateMirrors(); err == nil {
+		t.Fatal("expected the secret of the upstream to be required")
 	}
-	if job.Spec.Completions == nil || *job.Spec.Completions != 2 {
-		t.Fatalf("expected completions 2, got %v", job.Spec.Completions)
+	var quay *appsv1.Deployment
+	for _, obj := range h.mirrorResources() {
+		if deploy, ok := obj.(*appsv1.Deployment); ok {
+			quay = deploy
+		}
 	}
+	authorized := false
+	for _, e := range quay.Spec.Template.Spec.Containers[0].Env {
+		authorized = authorized || (e.Name == "REGISTRY_AUTH" && e.Value == "htpasswd")
+	}
+	if !authorized {
+		t.Fatal("expected the mirror of the upstream with credentials to authorize the requests")
+	}
+	if _, ok := h.configMapForMirrorConfig().(*corev1.ConfigMap).Data["quay.io.toml"]; ok {
+		t.Fatal("expected the upstream with credentials not to be mirrored on the nodes")
+	}
+	if err := cli.Create(context.Background(), deploys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.setStaleMirrors(); err != nil {
+		t.Fatal(err)
+	}
+	deleted := h.mirrorResourcesNeedDelete()
+	if len(h.staleMirrors) != 1 || h.staleMirrors[0] != "rbd-hub-mirror-dockerhub" || len(deleted) != 4 {
+		t.Fatalf("expected the stale mirror and the node configuration to be deleted, got %v", h.staleMirrors)
+	}
+}
 
-	if len(job.Spec.Template.Spec.Tolerations) != 1 {
-		t.Fatalf("expected one toleration for tainted nodes, got %d", len(job.Spec.Template.Spec.Tolerations))
+func TestHubUsers(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = rainbondv1alpha1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	component := &rainbondv1alpha1.RbdComponent{
+		ObjectMeta: metav1.ObjectMeta{Name: HubName, Namespace: "rbd-system"},
 	}
-	if got := job.Spec.Template.Spec.Tolerations[0].Operator; got != corev1.TolerationOpExists {
-		t.Fatalf("expected toleration operator %q, got %q", corev1.TolerationOpExists, got)
+	cluster := &rainbondv1alpha1.RainbondCluster{
+		Spec: rainbondv1alpha1.RainbondClusterSpec{
+			ImageHub: &rainbondv1alpha1.ImageHub{
+				Domain:   "goodrain.me",
+				Username: "admin",
+				Password: "admin-password",
+				Users: []rainbondv1alpha1.ImageHubUser{
+					{
+						Name: "ci",
+						Access: []rainbondv1alpha1.ImageHubAccess{
+							{Namespace: "team1", Actions: []rainbondv1alpha1.ImageHubAction{rainbondv1alpha1.ImageHubActionPull, rainbondv1alpha1.ImageHubActionPush}},
+						},
+					},
+					{Name: "viewer", SecretName: "viewer-password"},
+				},
+				TokenAuth: true,
+			},
+		},
+	}
+	h := NewHub(context.Background(), cli, component, cluster).(*hub)
+	if err := h.setUsers(); err == nil {
+		t.Fatal("expected the secret of viewer to be required")
+	}
+	viewer := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "viewer-password", Namespace: "rbd-system"},
+		Data:       map[string][]byte{"password": []byte("viewer-password")},
+	}
+	if err := cli.Create(context.Background(), viewer); err != nil {
+		t.Fatal(err)
 	}
-	if got := job.Spec.Template.Labels["rainbond.io/hosts-job"]; got != "true" {
-		t.Fatalf("expected hosts-job template label rainbond.io/hosts-job=true, got %q", got)
+	if err := h.setUsers(); err != nil {
+		t.Fatal(err)
 	}
+	secrets := h.userSecrets()
+	if len(secrets) != 1 || secrets[0].GetName() != "rbd-hub-user-ci" {
+		t.Fatalf("expected the password of ci to be generated, got %v", secrets)
+	}
+	ciPassword := string(secrets[0].(*corev1.Secret).Data["password"])
 
-	affinity := job.Spec.Template.Spec.Affinity
-	if affinity == nil || affinity.PodAntiAffinity == nil {
-		t.Fatalf("expected pod anti-affinity to keep one job pod per hostname")
+	htpasswd, err := h.generateHtpasswd()
+	if err != nil {
+		t.Fatal(err)
 	}
-	terms := affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution
-	if len(terms) != 1 {
-		t.Fatalf("expected one required pod anti-affinity term, got %d", len(terms))
+	h.htpasswd = htpasswd
+	passwords := map[string]string{"admin": "admin-password", "ci": ciPassword, "viewer": "viewer-password"}
+	lines := strings.Split(strings.TrimSpace(string(htpasswd)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 users in htpasswd, got %q", htpasswd)
 	}
-	if got := terms[0].TopologyKey; got != "kubernetes.io/hostname" {
-		t.Fatalf("expected pod anti-affinity topology key kubernetes.io/hostname, got %q", got)
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if err := bcrypt.CompareHashAndPassword([]byte(parts[1]), []byte(passwords[parts[0]])); err != nil {
+			t.Fatalf("unexpected hash of user %s: %v", parts[0], err)
+		}
 	}
-	if terms[0].LabelSelector == nil {
-		t.Fatalf("expected pod anti-affinity label selector to be configured")
+	// the hashes are kept, so that rbd-hub is not restarted on every reconcile.
+	if err := cli.Create(context.Background(), h.passwordSecret()); err != nil {
+		t.Fatal(err)
 	}
-	if got := terms[0].LabelSelector.MatchLabels["rainbond.io/hosts-job"]; got != "true" {
-		t.Fatalf("expected pod anti-affinity selector rainbond.io/hosts-job=true, got %q", got)
+	again, err := h.generateHtpasswd()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, ok := terms[0].LabelSelector.MatchLabels["name"]; ok {
-		t.Fatalf("expected pod anti-affinity selector not to match shared component labels, got %v", terms[0].LabelSelector.MatchLabels)
+	if string(again) != string(htpasswd) {
+		t.Fatal("expected the hashes of the unchanged passwords to be kept")
 	}
-}
 
-type nodeListClient struct {
-	*staticClient
-	nodes []corev1.Node
-}
+	if err := h.setAuthConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config := string(h.authConfig)
+	if !strings.Contains(config, "name: team1/*") || !strings.Contains(config, "account: viewer") || len(h.authCert) == 0 {
+		t.Fatalf("unexpected config of rbd-hub-auth:\n%s", config)
+	}
+	deploy := h.deployment().(*appsv1.Deployment)
+	envs := make(map[string]string)
+	for _, env := range deploy.Spec.Template.Spec.Containers[0].Env {
+		envs[env.Name] = env.Value
+	}
+	if envs["REGISTRY_AUTH"] != "token" || envs["REGISTRY_AUTH_TOKEN_REALM"] != "https://goodrain.me/auth" {
+		t.Fatalf("expected rbd-hub to accept the tokens of rbd-hub-auth, got %v", envs)
+	}
+	if len(h.authResources()) != 3 || len(h.authRoutes()) != 1 || h.authResourcesNeedDelete() != nil {
+		t.Fatal("expected rbd-hub-auth to be deployed")
+	}
 
-func (n *nodeListClient) List(_ context.Context, obj client.ObjectList, _ ...client.ListOption) error {
-	switch out := obj.(type) {
-	case *corev1.NodeList:
-		out.Items = append(out.Items, n.nodes...)
-		return nil
-	default:
-		panic("unexpected List call in test")
+	cluster.Spec.ImageHub.ImagePullUser = "unknown"
+	if err := h.setUsers(); err == nil {
+		t.Fatal("expected the image pull user to be one of the users")
 	}
 }
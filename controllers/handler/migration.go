@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/goodrain/rainbond-operator/util/commonutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MigrationLabelKey is the label of the migration jobs, the value is the name of the component.
+const MigrationLabelKey = "rainbond.io/migration"
+
+// schemaVersion returns the version of the schemas in the image, which is the digest or the tag of the image.
+func schemaVersion(image string) string {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		return image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return "latest"
+}
+
+// migrationJob returns the job which runs the first container of the pod template with the given command and args,
+// so that the schemas are migrated with the same image, database and volumes as the component.
+func migrationJob(name, namespace, version string, template corev1.PodTemplateSpec, command, args []string) *batchv1.Job {
+	spec := template.Spec.DeepCopy()
+	spec.RestartPolicy = corev1.RestartPolicyNever
+	container := spec.Containers[0]
+	container.Name = "migrate"
+	container.Command = command
+	container.Args = args
+	container.Ports = nil
+	container.ReadinessProbe = nil
+	container.LivenessProbe = nil
+	container.StartupProbe = nil
+	spec.Containers = []corev1.Container{container}
+
+	// the pods of the job must not be selected by the component.
+	labels := map[string]string{
+		MigrationLabelKey: name,
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      migrationJobName(name, version),
+			Namespace: namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				"rainbond.io/schema-version": version,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: commonutil.Int32(2),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: *spec,
+			},
+		},
+	}
+}
+
+// migrationJobName returns an unique name for every version, the version may be too long or not a valid name.
+func migrationJobName(name, version string) string {
+	return fmt.Sprintf("%s-migrate-%x", name, sha256.Sum256([]byte(version)))[:len(name)+len("-migrate-")+10]
+}
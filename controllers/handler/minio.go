@@ -16,6 +16,20 @@ import (
 // MinIOName name for minIO
 var MinIOName = "minio"
 
+const (
+	// minioEndpoint is the endpoint of the bundled minio in the namespace of rainbond.
+	minioEndpoint = "http://minio-service:9000"
+	// minioRootUser is the root user of the bundled minio, which is shared by rbd-hub and the backups of rbd-db.
+	minioRootUser = "admin"
+	// minioCredentialsSecret holds the credentials of minioRootUser, in the format of the s3 secret of hubStorage.
+	minioCredentialsSecret = "rbd-minio"
+)
+
+// minioRootPassword returns the password of minioRootUser.
+func minioRootPassword() string {
+	return rbdutil.GetenvDefault("RBD_MINIO_ROOT_PASSWORD", "admin1234")
+}
+
 type minIO struct {
 	ctx              context.Context
 	client           client.Client
@@ -46,6 +60,7 @@ func (m *minIO) Before() error {
 
 func (m *minIO) Resources() []client.Object {
 	return []client.Object{
+		m.credentialsSecret(),
 		m.statefulSet(),
 		m.service(),
 	}
@@ -63,6 +78,21 @@ func (m *minIO) SetStorageClassNameRWO(pvcParameters *pvcParameters) {
 	m.pvcParametersRWO = pvcParameters
 }
 
+// credentialsSecret returns the credentials of the bundled minio, which are referenced by rbd-hub and the backups of rbd-db.
+func (m *minIO) credentialsSecret() client.Object {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      minioCredentialsSecret,
+			Namespace: m.component.Namespace,
+			Labels:    copyLabels(m.labels),
+		},
+		Data: map[string][]byte{
+			hubS3AccessKey: []byte(minioRootUser),
+			hubS3SecretKey: []byte(minioRootPassword()),
+		},
+	}
+}
+
 func (m *minIO) statefulSet() client.Object {
 	claimName := "minio-data" // PersistentVolumeClaim 名称
 	minioPVC := createPersistentVolumeClaimRWO(m.component.Namespace, claimName, m.pvcParametersRWO, m.labels, m.storageRequest)
@@ -110,11 +140,11 @@ func (m *minIO) statefulSet() client.Object {
 									Name:  "MINIO_BUCKETS",
 									Value: "rbd-hub",
 								}, {
-									Name:  "MINIO_ROOT_USER",
-									Value: "admin",
+									Name:      "MINIO_ROOT_USER",
+									ValueFrom: secretKeyRef(minioCredentialsSecret, hubS3AccessKey),
 								}, {
-									Name:  "MINIO_ROOT_PASSWORD",
-									Value: rbdutil.GetenvDefault("RBD_MINIO_ROOT_PASSWORD", "admin1234"),
+									Name:      "MINIO_ROOT_PASSWORD",
+									ValueFrom: secretKeyRef(minioCredentialsSecret, hubS3SecretKey),
 								},
 							},
 							LivenessProbe: &corev1.Probe{
@@ -67,6 +67,7 @@ func (m *mq) deployment() client.Object {
 	}
 	var volumeMounts []corev1.VolumeMount
 	var volumes []corev1.Volume
+	args = append(args, etcdArgs(m.cluster)...)
 	if m.etcdSecret != nil {
 		volume, mount := volumeByEtcd(m.etcdSecret)
 		volumeMounts = append(volumeMounts, mount)
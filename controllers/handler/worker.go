@@ -49,7 +49,7 @@ func NewWorker(ctx context.Context, client client.Client, component *rainbondv1a
 
 func (w *worker) Before() error {
 	if !checksqllite.IsSQLLite() {
-		db, err := getDefaultDBInfo(w.ctx, w.client, w.cluster.Spec.RegionDatabase, w.component.Namespace, DBName)
+		db, err := getDefaultDBInfo(w.ctx, w.client, w.cluster.Spec.RegionDatabase, w.component.Namespace, DBName, WorkerName)
 		if err != nil {
 			return fmt.Errorf("get db info: %v", err)
 		}
@@ -97,6 +97,7 @@ func (w *worker) deployment() client.Object {
 	if !checksqllite.IsSQLLite() {
 		args = append(args, w.db.RegionDataSource())
 	}
+	args = append(args, etcdArgs(w.cluster)...)
 	if w.etcdSecret != nil {
 		volume, mount := volumeByEtcd(w.etcdSecret)
 		volumeMounts = append(volumeMounts, mount)
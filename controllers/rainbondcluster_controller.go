@@ -14,6 +14,7 @@ import (
 	"github.com/goodrain/rainbond-operator/util/rbdutil"
 	"github.com/goodrain/rainbond-operator/util/uuidutil"
 	"github.com/juju/errors"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -35,6 +36,8 @@ type RainbondClusterReconciler struct {
 // +kubebuilder:rbac:groups=rainbond.io,resources=rainbondclusters,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=rainbond.io,resources=rainbondclusters/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=rainbond.io,resources=rainbondclusters/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;update
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -64,6 +67,14 @@ func (r *RainbondClusterReconciler) Reconcile(ctx context.Context, request ctrl.
 
 	mgr := clustermgr.NewClusterMgr(ctx, r.Client, reqLogger, rainbondcluster, r.Scheme)
 
+	if !rainbondcluster.DeletionTimestamp.IsZero() {
+		if err := mgr.RemoveInternalDNS(); err != nil {
+			reqLogger.Error(err, "remove internal dns")
+			return reconcile.Result{RequeueAfter: time.Second * 2}, err
+		}
+		return reconcile.Result{}, nil
+	}
+
 	// generate status for rainbond cluster
 	reqLogger.V(6).Info("start generate status")
 	status, err := mgr.GenerateRainbondClusterStatus()
@@ -115,7 +126,11 @@ func (r *RainbondClusterReconciler) Reconcile(ctx context.Context, request ctrl.
 	}
 
 	// setup nodesForGateway nodesForChaos gatewayIngressIP if empty
-	if rainbondcluster.Spec.NodesForGateway == nil || rainbondcluster.Spec.NodesForChaos == nil || rainbondcluster.Spec.GatewayIngressIPs == nil {
+	// the gateway ingress ips are populated from the load balancer in LoadBalancer mode, and they are required
+	// if rbd-gateway does not listen on nodesForGateway.
+	loadBalancerMode := rainbondcluster.GatewayMode() == rainbondv1alpha1.GatewayModeLoadBalancer
+	onGatewayNodes := rainbondcluster.GatewayOnNodesForGateway()
+	if rainbondcluster.Spec.NodesForGateway == nil || rainbondcluster.Spec.NodesForChaos == nil || (rainbondcluster.Spec.GatewayIngressIPs == nil && onGatewayNodes) {
 		gatewayNodes, chaosNodes := r.GetRainbondGatewayNodeAndChaosNodes()
 		if gatewayNodes == nil || chaosNodes == nil {
 			return reconcile.Result{RequeueAfter: time.Second * 3}, err
@@ -126,7 +141,7 @@ func (r *RainbondClusterReconciler) Reconcile(ctx context.Context, request ctrl.
 		if rainbondcluster.Spec.NodesForChaos == nil {
 			rainbondcluster.Spec.NodesForChaos = chaosNodes
 		}
-		if rainbondcluster.Spec.GatewayIngressIPs == nil {
+		if rainbondcluster.Spec.GatewayIngressIPs == nil && onGatewayNodes {
 			rainbondcluster.Spec.GatewayIngressIPs = func() (re []string) {
 				for _, n := range rainbondcluster.Spec.NodesForGateway {
 					if n.ExternalIP != "" {
@@ -183,7 +198,8 @@ func (r *RainbondClusterReconciler) Reconcile(ctx context.Context, request ctrl.
 		return reconcile.Result{Requeue: true}, err
 	}
 
-	if rainbondcluster.Spec.SuffixHTTPHost == "" {
+	// wait for the load balancer, or the suffix would resolve to a node.
+	if rainbondcluster.Spec.SuffixHTTPHost == "" && (onGatewayNodes || len(rainbondcluster.Spec.GatewayIngressIPs) > 0) {
 		var ip string
 		if len(rainbondcluster.Spec.NodesForGateway) > 0 {
 			ip = rainbondcluster.Spec.NodesForGateway[0].InternalIP
@@ -219,13 +235,37 @@ func (r *RainbondClusterReconciler) Reconcile(ctx context.Context, request ctrl.
 		}
 	}
 
-	return ctrl.Result{}, nil
+	changed, err := mgr.SyncGatewayIngressIPs()
+	if err != nil {
+		reqLogger.Error(err, "sync gateway ingress ips")
+		return reconcile.Result{RequeueAfter: time.Second * 2}, err
+	}
+	if changed {
+		return reconcile.Result{Requeue: true}, nil
+	}
+	if !onGatewayNodes && len(rainbondcluster.Spec.GatewayIngressIPs) == 0 {
+		if loadBalancerMode {
+			reqLogger.Info("waiting for the load balancer of rbd-gateway")
+		} else {
+			reqLogger.Info("gatewayIngressIPs is required to reach rbd-gateway", "mode", rainbondcluster.GatewayMode())
+		}
+		return reconcile.Result{RequeueAfter: time.Second * 5}, nil
+	}
+
+	if err := mgr.SyncInternalDNS(); err != nil {
+		reqLogger.Error(err, "sync internal dns")
+		return reconcile.Result{RequeueAfter: time.Second * 2}, err
+	}
+
+	// re-evaluate the prechecks periodically, so that failures after installation are reflected in the conditions.
+	return ctrl.Result{RequeueAfter: rainbondcluster.PrecheckInterval()}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *RainbondClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&rainbondv1alpha1.RainbondCluster{}).
+		Owns(&batchv1.Job{}).
 		Complete(r)
 }
 
@@ -52,6 +52,16 @@ func TestRainbondClusterReconcileRequeuesAfterCreatingImagePullSecret(t *testing
 				Password: "admin1234",
 			},
 		},
+		Status: rainbondv1alpha1.RainbondClusterStatus{
+			Conditions: []rainbondv1alpha1.RainbondClusterCondition{
+				{
+					// the credential has been verified by the image repository precheck.
+					Type:              rainbondv1alpha1.RainbondClusterConditionTypeImageRepository,
+					Status:            corev1.ConditionTrue,
+					LastHeartbeatTime: metav1.Now(),
+				},
+			},
+		},
 	}
 
 	k8sClient := &rainbondClusterReconcileTestClient{
@@ -29,9 +29,14 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	rainbondv1alpha1 "github.com/goodrain/rainbond-operator/api/v1alpha1"
 	componentmgr "github.com/goodrain/rainbond-operator/controllers/component-mgr"
@@ -53,6 +58,10 @@ type RbdComponentReconciler struct {
 // +kubebuilder:rbac:groups=rainbond.io,resources=rbdcomponents,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=rainbond.io,resources=rbdcomponents/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=rainbond.io,resources=rbdcomponents/finalizers,verbs=update
+// +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups="",resources=pods/log,verbs=get
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -100,6 +109,10 @@ func (r *RbdComponentReconciler) Reconcile(ctx context.Context, request ctrl.Req
 
 	cluster := &rainbondv1alpha1.RainbondCluster{}
 	if err := r.Get(ctx, types.NamespacedName{Namespace: cpt.Namespace, Name: constants.RainbondClusterName}, cluster); err != nil {
+		// the rainbondcluster may be deleted before the rbdcomponents while uninstalling.
+		if k8sErrors.IsNotFound(err) && !cpt.DeletionTimestamp.IsZero() {
+			return r.finalize(ctx, cpt, fn(ctx, r.Client, cpt, cluster))
+		}
 		condition := clusterCondition(err)
 		changed := cpt.Status.UpdateCondition(condition)
 		if changed {
@@ -111,7 +124,23 @@ func (r *RbdComponentReconciler) Reconcile(ctx context.Context, request ctrl.Req
 
 	mgr.SetConfigCompletedCondition()
 
+	// the image is taken from the selected image repository, which is not persisted.
+	cpt.Spec.Image = cluster.ComponentImage(cpt.Spec.Image)
+
 	hdl := fn(ctx, r.Client, cpt, cluster)
+	if finalizer, ok := hdl.(chandler.Finalizer); ok {
+		if !cpt.DeletionTimestamp.IsZero() {
+			return r.finalize(ctx, cpt, hdl)
+		}
+		if !controllerutil.ContainsFinalizer(cpt, finalizer.Finalizer()) {
+			patch := client.MergeFrom(cpt.DeepCopy())
+			controllerutil.AddFinalizer(cpt, finalizer.Finalizer())
+			if err := r.Patch(ctx, cpt, patch); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	}
+
 	if err := hdl.Before(); err != nil {
 		// TODO: merge with mgr.checkPrerequisites
 		if chandler.IsIgnoreError(err) {
@@ -146,37 +175,48 @@ func (r *RbdComponentReconciler) Reconcile(ctx context.Context, request ctrl.Req
 	}
 
 	// Create or update Resources first to ensure Services exist before ApisixRoutes
+	migrator, _ := hdl.(chandler.Migrator)
+	var workloads []client.Object
 	resources := hdl.Resources()
 	for _, res := range resources {
 		if res == nil {
 			continue
 		}
-		applySystemCriticalDefaults(res)
-		if res.GetNamespace() != "" {
-			// Set RbdComponent cpt as the owner and controller
-			if err := controllerutil.SetControllerReference(cpt, res.(metav1.Object), r.Scheme); err != nil {
-				log.Error(err, "set controller reference")
-				condition := rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentReady, corev1.ConditionFalse,
-					"SetControllerReferenceFailed", err.Error())
-				changed := cpt.Status.UpdateCondition(condition)
-				if changed {
-					r.Recorder.Event(cpt, corev1.EventTypeWarning, condition.Reason, condition.Message)
-					return reconcile.Result{Requeue: true}, mgr.UpdateStatus()
-				}
+		if migrator != nil && isWorkload(res) {
+			// rolled out after the schemas are migrated.
+			workloads = append(workloads, res)
+			continue
+		}
+		if result, err := r.applyResource(mgr, cpt, res); result != nil {
+			return *result, err
+		}
+	}
+
+	if migrator != nil {
+		version, job := migrator.MigrationJob()
+		if job != nil {
+			applySystemCriticalDefaults(job)
+			if err := controllerutil.SetControllerReference(cpt, job, r.Scheme); err != nil {
 				return reconcile.Result{}, err
 			}
 		}
-		// Check if the resource already exists, if not create a new one
-		reconcileResult, err := mgr.UpdateOrCreateResource(res)
+		result, err := mgr.Migrate(version, job)
 		if err != nil {
-			log.Error(err, "update or create resource")
-			condition := rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentReady, corev1.ConditionFalse, "ErrCreateResources", err.Error())
-			changed := cpt.Status.UpdateCondition(condition)
-			if changed {
+			log.Error(err, "migrate the schemas")
+			condition := rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentReady, corev1.ConditionFalse, "ErrMigration", err.Error())
+			if cpt.Status.UpdateCondition(condition) {
 				r.Recorder.Event(cpt, corev1.EventTypeWarning, condition.Reason, condition.Message)
 				return reconcile.Result{Requeue: true}, mgr.UpdateStatus()
 			}
-			return reconcileResult, err
+			return reconcile.Result{}, err
+		}
+		if result != nil {
+			return *result, nil
+		}
+		for _, res := range workloads {
+			if result, err := r.applyResource(mgr, cpt, res); result != nil {
+				return *result, err
+			}
 		}
 	}
 
@@ -274,9 +314,56 @@ func (r *RbdComponentReconciler) Reconcile(ctx context.Context, request ctrl.Req
 		return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
 	}
 
+	if resyncPerioder, ok := hdl.(chandler.ResyncPerioder); ok {
+		if period := resyncPerioder.ResyncPeriod(); period > 0 {
+			return ctrl.Result{RequeueAfter: period}, nil
+		}
+	}
+
 	return ctrl.Result{}, nil
 }
 
+// applyResource creates or updates the resource owned by the rbdcomponent, it returns a result if the reconciliation should stop.
+func (r *RbdComponentReconciler) applyResource(mgr *componentmgr.RbdcomponentMgr, cpt *rainbondv1alpha1.RbdComponent, res client.Object) (*reconcile.Result, error) {
+	log := r.Log.WithValues("rbdcomponent", types.NamespacedName{Namespace: cpt.Namespace, Name: cpt.Name})
+	applySystemCriticalDefaults(res)
+	if res.GetNamespace() != "" {
+		// Set RbdComponent cpt as the owner and controller
+		if err := controllerutil.SetControllerReference(cpt, res.(metav1.Object), r.Scheme); err != nil {
+			log.Error(err, "set controller reference")
+			condition := rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentReady, corev1.ConditionFalse,
+				"SetControllerReferenceFailed", err.Error())
+			changed := cpt.Status.UpdateCondition(condition)
+			if changed {
+				r.Recorder.Event(cpt, corev1.EventTypeWarning, condition.Reason, condition.Message)
+				return &reconcile.Result{Requeue: true}, mgr.UpdateStatus()
+			}
+			return &reconcile.Result{}, err
+		}
+	}
+	// Check if the resource already exists, if not create a new one
+	reconcileResult, err := mgr.UpdateOrCreateResource(res)
+	if err != nil {
+		log.Error(err, "update or create resource")
+		condition := rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.RbdComponentReady, corev1.ConditionFalse, "ErrCreateResources", err.Error())
+		changed := cpt.Status.UpdateCondition(condition)
+		if changed {
+			r.Recorder.Event(cpt, corev1.EventTypeWarning, condition.Reason, condition.Message)
+			return &reconcile.Result{Requeue: true}, mgr.UpdateStatus()
+		}
+		return &reconcileResult, err
+	}
+	return nil, nil
+}
+
+func isWorkload(obj client.Object) bool {
+	switch obj.(type) {
+	case *appsv1.Deployment, *appsv1.StatefulSet, *appsv1.DaemonSet:
+		return true
+	}
+	return false
+}
+
 func applySystemCriticalDefaults(obj client.Object) {
 	var podSpec *corev1.PodSpec
 	switch workload := obj.(type) {
@@ -313,6 +400,48 @@ func setDefaultEphemeralStorageRequest(containers []corev1.Container) {
 func (r *RbdComponentReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&rainbondv1alpha1.RbdComponent{}).
+		// the agents of rbd-hub report whether goodrain.me is resolved on each node.
+		Watches(&source.Kind{Type: &appsv1.DaemonSet{}}, &handler.EnqueueRequestForOwner{
+			OwnerType:    &rainbondv1alpha1.RbdComponent{},
+			IsController: true,
+		}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return obj.GetName() == chandler.HubHostsName
+		}))).
+		// goodrain.me resolves to the gateway.
+		Watches(&source.Kind{Type: &rainbondv1alpha1.RainbondCluster{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: chandler.HubName}}}
+		}), builder.WithPredicates(predicate.Funcs{
+			CreateFunc:  func(event.CreateEvent) bool { return false },
+			DeleteFunc:  func(event.DeleteEvent) bool { return false },
+			GenericFunc: func(event.GenericEvent) bool { return false },
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				oldCluster, oldOK := e.ObjectOld.(*rainbondv1alpha1.RainbondCluster)
+				newCluster, newOK := e.ObjectNew.(*rainbondv1alpha1.RainbondCluster)
+				return oldOK && newOK && oldCluster.InnerGatewayIngressIP() != newCluster.InnerGatewayIngressIP()
+			},
+		})).
+		// the components fail over to the selected image repository.
+		Watches(&source.Kind{Type: &rainbondv1alpha1.RainbondCluster{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			cptList := &rainbondv1alpha1.RbdComponentList{}
+			if err := r.List(context.Background(), cptList, client.InNamespace(obj.GetNamespace())); err != nil {
+				r.Log.Error(err, "list rbdcomponents")
+				return nil
+			}
+			var requests []reconcile.Request
+			for _, cpt := range cptList.Items {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: cpt.Namespace, Name: cpt.Name}})
+			}
+			return requests
+		}), builder.WithPredicates(predicate.Funcs{
+			CreateFunc:  func(event.CreateEvent) bool { return false },
+			DeleteFunc:  func(event.DeleteEvent) bool { return false },
+			GenericFunc: func(event.GenericEvent) bool { return false },
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				oldCluster, oldOK := e.ObjectOld.(*rainbondv1alpha1.RainbondCluster)
+				newCluster, newOK := e.ObjectNew.(*rainbondv1alpha1.RainbondCluster)
+				return oldOK && newOK && oldCluster.ImageRepository() != newCluster.ImageRepository()
+			},
+		})).
 		Complete(r)
 }
 
@@ -326,3 +455,21 @@ func clusterCondition(err error) *rainbondv1alpha1.RbdComponentCondition {
 
 	return rainbondv1alpha1.NewRbdComponentCondition(rainbondv1alpha1.ClusterConfigCompeleted, corev1.ConditionFalse, reason, msg)
 }
+
+// finalize cleans up before the rbdcomponent is deleted, then removes its finalizer.
+func (r *RbdComponentReconciler) finalize(ctx context.Context, cpt *rainbondv1alpha1.RbdComponent, hdl chandler.ComponentHandler) (reconcile.Result, error) {
+	finalizer, ok := hdl.(chandler.Finalizer)
+	if !ok || !controllerutil.ContainsFinalizer(cpt, finalizer.Finalizer()) {
+		return reconcile.Result{}, nil
+	}
+	done, err := finalizer.Finalize()
+	if err != nil {
+		return reconcile.Result{RequeueAfter: 3 * time.Second}, err
+	}
+	if !done {
+		return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+	patch := client.MergeFrom(cpt.DeepCopy())
+	controllerutil.RemoveFinalizer(cpt, finalizer.Finalizer())
+	return reconcile.Result{}, r.Patch(ctx, cpt, patch)
+}
@@ -103,15 +103,6 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "RbdComponent")
 		os.Exit(1)
 	}
-	if err = (&controllers.NodeReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Node"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Node")
-		os.Exit(1)
-	}
-	setupLog.Info("successfully registered NodeReconciler controller")
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("health", healthz.Ping); err != nil {
@@ -1,9 +1,13 @@
 package commonutil
 
 import (
-	"github.com/sirupsen/logrus"
+	"context"
 	"net"
+	"sort"
 	"time"
+
+	"github.com/goodrain/rainbond-operator/util/repositoryutil"
+	"github.com/sirupsen/logrus"
 )
 
 // GetLatency Get URL latency
@@ -22,6 +26,8 @@ type Result struct {
 	URL     string
 	Success bool
 	Latency time.Duration
+	// Message is the reason why the url is not available.
+	Message string
 }
 
 // CompareLatency Compare the latency of multiple urls and return the address with the least latency
@@ -31,7 +37,7 @@ func CompareLatency(urls ...string) string {
 	for _, url := range urls {
 		go func(u string) {
 			success, latency := GetLatency(u)
-			ch <- Result{u, success, latency}
+			ch <- Result{URL: u, Success: success, Latency: latency}
 		}(url)
 	}
 
@@ -66,3 +72,46 @@ func CompareLatency(urls ...string) string {
 	logrus.Infof("optimal address: %s (latency: %v)", best.URL, best.Latency)
 	return best.URL
 }
+
+// Registry is an image registry to be compared, with the optional credential.
+type Registry struct {
+	// URL is the registry host, such as registry.cn-hangzhou.aliyuncs.com or docker.io.
+	URL      string
+	Username string
+	Password string
+}
+
+// CompareRegistryLatency logs in to the registries concurrently with the shared v2 client of repositoryutil,
+// and returns the results sorted by the latency of the ping, the unavailable registries come last in the order given.
+func CompareRegistryLatency(timeout time.Duration, registries ...Registry) []Result {
+	results := make([]Result, len(registries))
+	done := make(chan struct{}, len(registries))
+	for i := range registries {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			results[i].URL = registries[i].URL
+			latency, err := repositoryutil.Login(context.Background(), registries[i].URL, repositoryutil.LoginOptions{
+				Username: registries[i].Username,
+				Password: registries[i].Password,
+				Timeout:  timeout,
+			})
+			if err != nil {
+				logrus.Debugf("ping registry %s: %v", registries[i].URL, err)
+				results[i].Message = err.Error()
+				return
+			}
+			results[i].Success, results[i].Latency = true, latency
+		}(i)
+	}
+	for range registries {
+		<-done
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Success != results[j].Success {
+			return results[i].Success
+		}
+		return results[i].Success && results[i].Latency < results[j].Latency
+	})
+	return results
+}
@@ -51,4 +51,11 @@ const (
 
 	// AliyunCSINasProvisioner name for aliyun csi nas provisioner
 	AliyunCSINasProvisioner = "aliyun-csi-nas-provisioner"
+
+	// EtcdCAFileKey is the key of the ca certificate in the etcd secret.
+	EtcdCAFileKey = "ca-file"
+	// EtcdCertFileKey is the key of the client certificate in the etcd secret.
+	EtcdCertFileKey = "cert-file"
+	// EtcdKeyFileKey is the key of the client private key in the etcd secret.
+	EtcdKeyFileKey = "key-file"
 )
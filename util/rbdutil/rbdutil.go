@@ -50,6 +50,12 @@ func LabelsForAccessModeRWO() map[string]string {
 	}
 }
 
+// LocalPathStorageClassName returns the name of the storage class used for rwo volumes,
+// STORAGE_CLASS_NAME takes precedence over the bundled local-path provisioner.
+func LocalPathStorageClassName() string {
+	return GetenvDefault("STORAGE_CLASS_NAME", "local-path")
+}
+
 // FilterNodesWithPortConflicts -
 func FilterNodesWithPortConflicts(nodes []*rainbondv1alpha1.K8sNode) []*rainbondv1alpha1.K8sNode {
 	var result []*rainbondv1alpha1.K8sNode
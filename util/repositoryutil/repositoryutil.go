@@ -2,124 +2,350 @@ package repositoryutil
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
-	dockercliconfigtypes "github.com/docker/cli/cli/config/types"
-	"github.com/docker/docker/api/types"
-	registrytypes "github.com/docker/docker/api/types/registry"
-	"github.com/docker/docker/registry"
-	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
 	"net/url"
-	"runtime"
 	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
-// Code from https://github.com/containerd/nerdctl/blob/v0.15.0/cmd/nerdctl/login.go
-func loginClientSide(ctx context.Context, insecure bool, auth types.AuthConfig) (registrytypes.AuthenticateOKBody, error) {
-	var insecureRegistries []string
-	if insecure {
-		insecureRegistries = append(insecureRegistries, auth.ServerAddress)
+// ErrUnauthorized means the registry rejects the credential.
+var ErrUnauthorized = errors.New("unauthorized")
+
+const defaultTimeout = 10 * time.Second
+
+// manifestMediaTypes are accepted when requesting a manifest, so that the registry does not convert it.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// LoginOptions are the options to verify the credential of a registry.
+type LoginOptions struct {
+	Username string
+	Password string
+	// Insecure skips the verification of the registry certificate, and falls back to plain http
+	// if the registry does not serve https.
+	Insecure bool
+	// CACert is the pem encoded certificate to verify the registry certificate, in addition to the system roots.
+	CACert []byte
+	// DialAddress is the address to connect to instead of resolving the host of the registry,
+	// such as the gateway serving goodrain.me.
+	DialAddress string
+	// Timeout of each request, defaults to 10s.
+	Timeout time.Duration
+}
+
+// Login verifies the credential against the registry v2 api, answering the bearer token or basic auth challenge.
+// It returns the latency of the first ping to the v2 api.
+// Without a credential, it verifies that the registry is available to anonymous users.
+func Login(ctx context.Context, serverAddress string, opts LoginOptions) (time.Duration, error) {
+	host, err := convertToHostname(serverAddress)
+	if err != nil {
+		return 0, err
+	}
+	if host == "docker.io" || host == "index.docker.io" {
+		host = "registry-1.docker.io"
+	}
+	cli, err := newHTTPClient(opts)
+	if err != nil {
+		return 0, err
 	}
-	svc, err := registry.NewService(registry.ServiceOptions{
-		InsecureRegistries: insecureRegistries,
-	})
 
+	endpoint := "https://" + host + "/v2/"
+	start := time.Now()
+	resp, err := get(ctx, cli, endpoint, "")
+	if err != nil && opts.Insecure {
+		logrus.Debugf("ping %s: %v, fall back to plain http", endpoint, err)
+		endpoint = "http://" + host + "/v2/"
+		start = time.Now()
+		resp, err = get(ctx, cli, endpoint, "")
+	}
 	if err != nil {
-		return registrytypes.AuthenticateOKBody{}, err
+		return 0, err
 	}
+	latency := time.Since(start)
 
-	userAgent := fmt.Sprintf("Docker-Client/nerdctl-%s", runtime.GOOS)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return latency, nil
+	case http.StatusUnauthorized:
+	default:
+		return 0, fmt.Errorf("unexpected status %d of %s", resp.StatusCode, endpoint)
+	}
 
-	status, token, err := svc.Auth(ctx, &auth, userAgent)
+	authorization, err := authorize(ctx, cli, host, endpoint, resp, opts)
+	if err != nil {
+		return 0, err
+	}
+	resp, err = get(ctx, cli, endpoint, authorization)
+	if err != nil {
+		return 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return latency, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return 0, errors.Wrapf(ErrUnauthorized, "login %s as %q", host, opts.Username)
+	default:
+		return 0, fmt.Errorf("login %s: unexpected status %d", host, resp.StatusCode)
+	}
+}
 
-	return registrytypes.AuthenticateOKBody{
-		Status:        status,
-		IdentityToken: token,
-	}, err
+// LoginRepository logs in to a image repository, the certificate of the registry is not verified
+// if it is not trusted.
+func LoginRepository(serverAddress, username, password string) error {
+	if username == "" {
+		return fmt.Errorf("error: Username is Required")
+	}
+	if password == "" {
+		return fmt.Errorf("error: Password is Required")
+	}
+	ctx := context.Background()
+	opts := LoginOptions{Username: username, Password: password}
+	_, err := Login(ctx, serverAddress, opts)
+	if err == nil || errors.Is(err, ErrUnauthorized) {
+		return err
+	}
+	logrus.Infof("First login failed [%+v], login insecure repository %s with username %s", err, serverAddress, username)
+	opts.Insecure = true
+	if _, err := Login(ctx, serverAddress, opts); err != nil {
+		return errors.Wrap(err, "login insecure repository")
+	}
+	return nil
 }
 
-func convertToHostname(serverAddress string) (string, error) {
-	// Ensure that URL contains scheme for a good parsing process
-	if strings.Contains(serverAddress, "://") {
-		u, err := url.Parse(serverAddress)
+// ManifestExists returns true if the image, such as rainbond/rbd-api:v6.0.0, is present in the registry,
+// by requesting the head of its manifest. The registry is accessed with the same options as Login.
+func ManifestExists(ctx context.Context, serverAddress, image string, opts LoginOptions) (bool, error) {
+	host, err := convertToHostname(serverAddress)
+	if err != nil {
+		return false, err
+	}
+	repository, reference := image, "latest"
+	if i := strings.LastIndex(image, "@"); i > 0 {
+		repository, reference = image[:i], image[i+1:]
+	} else if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repository, reference = image[:i], image[i+1:]
+	}
+	cli, err := newHTTPClient(opts)
+	if err != nil {
+		return false, err
+	}
+
+	endpoint := "https://" + host + "/v2/" + repository + "/manifests/" + reference
+	resp, err := headManifest(ctx, cli, endpoint, "")
+	if err != nil && opts.Insecure {
+		logrus.Debugf("head %s: %v, fall back to plain http", endpoint, err)
+		endpoint = "http://" + host + "/v2/" + repository + "/manifests/" + reference
+		resp, err = headManifest(ctx, cli, endpoint, "")
+	}
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err := authorize(ctx, cli, host, endpoint, resp, opts)
 		if err != nil {
-			return "", err
+			return false, err
 		}
-		serverAddress = u.Host
-	} else {
-		u, err := url.Parse("https://" + serverAddress)
-		if err != nil {
-			return "", err
+		if resp, err = headManifest(ctx, cli, endpoint, authorization); err != nil {
+			return false, err
 		}
-		serverAddress = u.Host
 	}
-
-	return serverAddress, nil
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, errors.Wrapf(ErrUnauthorized, "pull %s from %s as %q", image, host, opts.Username)
+	default:
+		return false, fmt.Errorf("head manifest %s: unexpected status %d", endpoint, resp.StatusCode)
+	}
 }
 
-// GetDefaultAuthConfig gets default auth config
-func GetDefaultAuthConfig(serverAddress, username, password string, isDefaultRegistry bool) (*types.AuthConfig, error) {
-	if !isDefaultRegistry {
-		var err error
-		serverAddress, err = convertToHostname(serverAddress)
-		if err != nil {
-			return nil, err
+func newHTTPClient(opts LoginOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if len(opts.CACert) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
 		}
+		if !pool.AppendCertsFromPEM(opts.CACert) {
+			return nil, fmt.Errorf("invalid ca certificate of the registry")
+		}
+		tlsConfig.RootCAs = pool
 	}
-	res := types.AuthConfig(dockercliconfigtypes.AuthConfig{
-		ServerAddress: serverAddress,
-	})
-	if username != "" {
-		res.Username = username
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if opts.DialAddress != "" {
+				_, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				addr = net.JoinHostPort(opts.DialAddress, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
 	}
-	if password != "" {
-		res.Password = password
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
 	}
-	return &res, nil
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
 }
 
-// ConfigureAuthentication configures authentication for a registry
-func ConfigureAuthentication(authConfig *types.AuthConfig, username, password string) error {
-	authConfig.Username = strings.TrimSpace(authConfig.Username)
-	if username = strings.TrimSpace(username); username == "" {
-		username = authConfig.Username
+func get(ctx context.Context, cli *http.Client, endpoint, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
 	}
-	if username == "" {
-		return fmt.Errorf("error: Username is Required")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
 	}
-	if password == "" {
-		return fmt.Errorf("error: Password is Required")
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, err
 	}
-	authConfig.Username = username
-	authConfig.Password = password
-	return nil
+	resp.Body.Close()
+	return resp, nil
 }
 
-// LoginRepository logs in to a image repository
-func LoginRepository(serverAddress, username, password string) error {
-	ctx := context.Background()
-	isDefaultRegistry := serverAddress == "goodrain.me"
+func headManifest(ctx context.Context, cli *http.Client, endpoint, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// authorize answers the bearer token or basic auth challenge of the response, and returns the authorization header.
+func authorize(ctx context.Context, cli *http.Client, host, endpoint string, resp *http.Response, opts LoginOptions) (string, error) {
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch scheme {
+	case "bearer":
+		token, err := requestToken(ctx, cli, params, opts)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	case "basic":
+		if opts.Username == "" {
+			return "", errors.Wrapf(ErrUnauthorized, "%s requires a credential", host)
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(opts.Username, opts.Password)
+		return req.Header.Get("Authorization"), nil
+	default:
+		return "", fmt.Errorf("unsupported challenge %q of %s", resp.Header.Get("WWW-Authenticate"), endpoint)
+	}
+}
+
+// parseChallenge parses the WWW-Authenticate header, eg. Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseChallenge(header string) (string, map[string]string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	params := make(map[string]string)
+	if len(parts) == 2 {
+		for _, param := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 {
+				params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+	return strings.ToLower(parts[0]), params
+}
 
-	authConfig, err := GetDefaultAuthConfig(serverAddress, username, password, isDefaultRegistry)
-	if authConfig == nil {
-		authConfig = &types.AuthConfig{ServerAddress: serverAddress}
+// requestToken requests a bearer token from the realm, authenticated by the credential if there is one.
+func requestToken(ctx context.Context, cli *http.Client, params map[string]string, opts LoginOptions) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid realm %q of the bearer challenge", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	}
+	if opts.Username != "" {
+		query.Set("account", opts.Username)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if opts.Username != "" {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", errors.Wrapf(ErrUnauthorized, "request token from %s as %q", realm.Host, opts.Username)
+	default:
+		return "", fmt.Errorf("request token from %s: unexpected status %d", realm.Host, resp.StatusCode)
 	}
 
-	if err == nil && authConfig.Username != "" && authConfig.Password != "" {
-		//login With StoreCreds
-		_, err = loginClientSide(ctx, false, *authConfig)
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode token from %s: %v", realm.Host, err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
 	}
+	return "", fmt.Errorf("no token from %s", realm.Host)
+}
 
-	if err != nil || authConfig.Username == "" || authConfig.Password == "" {
-		logrus.Infof("First login failed [%+v], login insecure repository %s with username %s and password %s", err, serverAddress, authConfig.Username, authConfig.Password)
-		err = ConfigureAuthentication(authConfig, username, password)
+func convertToHostname(serverAddress string) (string, error) {
+	// Ensure that URL contains scheme for a good parsing process
+	if strings.Contains(serverAddress, "://") {
+		u, err := url.Parse(serverAddress)
 		if err != nil {
-			return errors.Wrap(err, "ConfigureAuthentication")
+			return "", err
 		}
-		_, err = loginClientSide(ctx, true, *authConfig)
+		serverAddress = u.Host
+	} else {
+		u, err := url.Parse("https://" + serverAddress)
 		if err != nil {
-			return errors.Wrap(err, "loginClientSide")
+			return "", err
 		}
+		serverAddress = u.Host
 	}
-	return nil
+
+	return serverAddress, nil
 }
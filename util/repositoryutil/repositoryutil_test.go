@@ -1,37 +1,124 @@
 package repositoryutil
 
-import "testing"
-
-func TestLoginRepository(t *testing.T) {
-	testcase := []struct {
-		serverAddress string
-		username      string
-		password      string
-		wantErr       bool
-	}{
-		{
-			serverAddress: "registry.cn-hangzhou.aliyuncs.com",
-			username:      "testuser",
-			password:      "123456",
-			wantErr:       true,
-		},
-		{
-			serverAddress: "goodrain.me",
-			username:      "admin",
-			password:      "123456",
-			wantErr:       true,
-		},
-		{
-			serverAddress: "docker.io",
-			username:      "testuser",
-			password:      "123456",
-			wantErr:       true,
-		},
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func newRegistry(t *testing.T, scheme string) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); ok && (username != "admin" || password != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("service") != "registry" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token": "t0ken"}`))
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		// only the api and rainbond/rbd-api:v6.0.0 are found.
+		serve := func() {
+			if r.URL.Path != "/v2/" && r.URL.Path != "/v2/rainbond/rbd-api/manifests/v6.0.0" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+		authorization := r.Header.Get("Authorization")
+		switch scheme {
+		case "bearer":
+			if authorization == "Bearer t0ken" {
+				serve()
+				return
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, server.URL))
+		case "basic":
+			if username, password, ok := r.BasicAuth(); ok && username == "admin" && password == "secret" {
+				serve()
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		default:
+			serve()
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	server = httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	for _, scheme := range []string{"bearer", "basic", "anonymous"} {
+		server := newRegistry(t, scheme)
+		host := strings.TrimPrefix(server.URL, "https://")
+
+		if _, err := Login(ctx, host, LoginOptions{Username: "admin", Password: "secret"}); err == nil {
+			t.Fatalf("%s: expected the untrusted certificate to be rejected", scheme)
+		}
+		if _, err := Login(ctx, host, LoginOptions{Username: "admin", Password: "secret", Insecure: true}); err != nil {
+			t.Fatalf("%s: login: %v", scheme, err)
+		}
+		_, err := Login(ctx, host, LoginOptions{Username: "admin", Password: "wrong", Insecure: true})
+		if scheme == "anonymous" {
+			if err != nil {
+				t.Fatalf("%s: login: %v", scheme, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("%s: expected unauthorized, got %v", scheme, err)
+		}
+		if err := LoginRepository(host, "admin", "wrong"); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("%s: expected unauthorized, got %v", scheme, err)
+		}
+		if err := LoginRepository(host, "admin", "secret"); err != nil {
+			t.Fatalf("%s: login repository: %v", scheme, err)
+		}
+	}
+}
+
+func TestLoginDialAddress(t *testing.T) {
+	server := newRegistry(t, "basic")
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+
+	_, err := Login(context.Background(), "goodrain.me:"+port, LoginOptions{
+		Username:    "admin",
+		Password:    "secret",
+		Insecure:    true,
+		DialAddress: "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatalf("login through the dial address: %v", err)
 	}
-	for _, tc := range testcase {
-		err := LoginRepository(tc.serverAddress, tc.username, tc.password)
-		if err != nil && !tc.wantErr {
-			t.Fatalf("LoginRepository() error = %v, wantErr %v", err, tc.wantErr)
+}
+
+func TestManifestExists(t *testing.T) {
+	ctx := context.Background()
+	for _, scheme := range []string{"bearer", "basic", "anonymous"} {
+		server := newRegistry(t, scheme)
+		host := strings.TrimPrefix(server.URL, "https://")
+		opts := LoginOptions{Username: "admin", Password: "secret", Insecure: true}
+
+		if exists, err := ManifestExists(ctx, host, "rainbond/rbd-api:v6.0.0", opts); err != nil || !exists {
+			t.Fatalf("%s: expected rbd-api to exist, got %v, %v", scheme, exists, err)
+		}
+		if exists, err := ManifestExists(ctx, host, "rainbond/rbd-worker:v6.0.0", opts); err != nil || exists {
+			t.Fatalf("%s: expected rbd-worker not to exist, got %v, %v", scheme, exists, err)
+		}
+		opts.Password = "wrong"
+		if _, err := ManifestExists(ctx, host, "rainbond/rbd-api:v6.0.0", opts); scheme != "anonymous" && !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("%s: expected unauthorized, got %v", scheme, err)
 		}
 	}
 }